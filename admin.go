@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+// isAdmin reports whether user may run admin commands.
+func (s *SlackListener) isAdmin(user string) bool {
+	for _, a := range s.admins {
+		if a == user {
+			return true
+		}
+	}
+	return false
+}
+
+// replyEphemeral answers msg with text only visible to its author.
+func (s *SlackListener) replyEphemeral(channel string, msg slack.Msg, text string) error {
+	if _, err := s.postEphemeral(channel, msg.User, msg.ThreadTimestamp, text, slack.PostMessageParameters{}); err != nil {
+		return fmt.Errorf("failed to post message: %s", err)
+	}
+	return nil
+}
+
+// handleAPIKeyCommand manages REST API keys:
+//
+//	apikey create <name> [reader|writer|approver|admin]
+//	apikey list
+//	apikey revoke <id>
+func (s *SlackListener) handleAPIKeyCommand(channel string, msg slack.Msg, args []string) error {
+	loc := s.locale(msg.User)
+	if !s.isAdmin(msg.User) {
+		return s.replyEphemeral(channel, msg, tr(loc, "apikey.admins_only"))
+	}
+
+	usage := tr(loc, "apikey.usage")
+	if len(args) == 0 {
+		return s.replyEphemeral(channel, msg, usage)
+	}
+
+	store := s.orders.store
+	switch strings.ToLower(args[0]) {
+	case "create":
+		if len(args) < 2 || len(args) > 3 {
+			return s.replyEphemeral(channel, msg, usage)
+		}
+		role := roleReader
+		if len(args) == 3 {
+			role = apiRole(strings.ToLower(args[2]))
+		}
+		key, secret, err := store.CreateAPIKey(args[1], role, s.team(), msg.User)
+		if err != nil {
+			return s.replyEphemeral(channel, msg, fmt.Sprintf(":warning: %s", err))
+		}
+		return s.replyEphemeral(channel, msg, tr(loc, "apikey.created", key.ID, key.Name, key.Role, secret))
+
+	case "list":
+		keys := store.APIKeys(s.team())
+		if len(keys) == 0 {
+			return s.replyEphemeral(channel, msg, tr(loc, "apikey.none"))
+		}
+		lines := make([]string, 0, len(keys))
+		for _, k := range keys {
+			line := tr(loc, "apikey.line", k.ID, k.Name, k.Role, k.CreatedBy, k.CreatedAt.Format("2006-01-02"))
+			if k.Revoked {
+				line += tr(loc, "apikey.revoked_tag")
+			}
+			lines = append(lines, line)
+		}
+		return s.replyEphemeral(channel, msg, strings.Join(lines, "\n"))
+
+	case "revoke":
+		if len(args) != 2 {
+			return s.replyEphemeral(channel, msg, usage)
+		}
+		if err := store.RevokeAPIKey(s.team(), args[1]); err != nil {
+			return s.replyEphemeral(channel, msg, fmt.Sprintf(":warning: %s", err))
+		}
+		return s.replyEphemeral(channel, msg, tr(loc, "apikey.revoked", args[1]))
+	}
+	return s.replyEphemeral(channel, msg, usage)
+}
+
+// handleJobsCommand shows admins how the interaction queue is doing.
+func (s *SlackListener) handleJobsCommand(channel string, msg slack.Msg, args []string) error {
+	loc := s.locale(msg.User)
+	if !s.isAdmin(msg.User) {
+		return s.replyEphemeral(channel, msg, tr(loc, "jobs.admins_only"))
+	}
+	if s.jobs == nil {
+		return s.replyEphemeral(channel, msg, tr(loc, "jobs.none"))
+	}
+	stats := s.jobs.Stats()
+	lines := []string{tr(loc, "jobs.queue", stats.String())}
+	for i, n := range stats.WaitCount {
+		if n == 0 {
+			continue
+		}
+		bound := tr(loc, "jobs.wait.longer")
+		if i < len(jobWaitBuckets) {
+			bound = tr(loc, "jobs.wait", jobWaitBuckets[i].String())
+		}
+		lines = append(lines, fmt.Sprintf("• %s: %d", bound, n))
+	}
+	return s.replyEphemeral(channel, msg, strings.Join(lines, "\n"))
+}
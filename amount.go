@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// amount is a money amount in hundredths of the currency unit.
+// Fixed point keeps totals and budgets exact.
+type amount int64
+
+// parseAmount parses a decimal such as "12", "12.3" or "1,234.56".
+func parseAmount(s string) (amount, error) {
+	s = strings.Replace(strings.TrimSpace(s), ",", "", -1)
+	if s == "" {
+		return 0, fmt.Errorf("empty amount")
+	}
+
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	intPart, fracPart := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	if intPart == "" || len(fracPart) > 2 || strings.Trim(intPart+fracPart, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	units, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil || units > 1<<53 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	cents := int64(0)
+	if fracPart != "" {
+		cents, _ = strconv.ParseInt((fracPart + "0")[:2], 10, 64)
+	}
+
+	a := amount(units*100 + cents)
+	if neg {
+		a = -a
+	}
+	return a, nil
+}
+
+// mul returns a multiplied by n.
+func (a amount) mul(n int) amount {
+	return a * amount(n)
+}
+
+// String formats a with two decimals, e.g. "1234.50".
+func (a amount) String() string {
+	sign := ""
+	if a < 0 {
+		sign = "-"
+		a = -a
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, a/100, a%100)
+}
+
+// MarshalJSON encodes a as a decimal string so clients never see cents.
+func (a amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON accepts a decimal string or number.
+func (a *amount) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n json.Number
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("invalid amount %s", b)
+		}
+		s = n.String()
+	}
+	v, err := parseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
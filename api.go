@@ -0,0 +1,533 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiPrefix       = "/api/v1/"
+	apiDefaultLimit = 50
+	apiMaxLimit     = 200
+	apiMaxBody      = 1 << 20
+)
+
+// apiHandler serves the versioned REST API under /api/v1/ for tools
+// which integrate with orders without slack.
+type apiHandler struct {
+	store      *orderStore
+	orders     *orderService
+	workspaces *workspaceRegistry
+}
+
+// apiError is written as {"error": "..."} with status.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e apiError) Error() string { return e.message }
+
+func errorf(status int, format string, a ...interface{}) error {
+	return apiError{status: status, message: fmt.Sprintf(format, a...)}
+}
+
+// apiContext carries the authenticated key of a request.
+type apiContext struct {
+	key apiKey
+}
+
+func (c apiContext) require(role apiRole) error {
+	if !c.key.Role.allows(role) {
+		return errorf(http.StatusForbidden, "this API key needs the %s role", role)
+	}
+	return nil
+}
+
+// order returns the order with idStr, not found if it belongs to another
+// workspace than the key.
+func (h apiHandler) order(c apiContext, idStr string) (order, error) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return order{}, errorf(http.StatusNotFound, "order %s not found", idStr)
+	}
+	o, ok := h.store.Order(id)
+	if !ok || o.TeamID != c.key.TeamID {
+		return order{}, errorf(http.StatusNotFound, "order %s not found", idStr)
+	}
+	return o, nil
+}
+
+func (h apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	if path == "openapi.json" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, openAPIDocument)
+		return
+	}
+
+	secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	key, ok := h.store.AuthenticateAPIKey(secret)
+	if !ok {
+		writeAPIError(w, errorf(http.StatusUnauthorized, "missing or invalid API key"))
+		return
+	}
+	c := apiContext{key: key}
+
+	r.Body = http.MaxBytesReader(w, r.Body, apiMaxBody)
+	res, err := h.route(c, r, strings.Split(path, "/"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	switch res := res.(type) {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case created:
+		writeJSON(w, http.StatusCreated, res.v)
+	case apiFile:
+		w.Header().Set("Content-Type", res.contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", res.name))
+		w.Write(res.body)
+	default:
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// created is returned by handlers which created a resource.
+type created struct {
+	v interface{}
+}
+
+// apiFile is returned by handlers which download a file instead of JSON.
+type apiFile struct {
+	name        string
+	contentType string
+	body        []byte
+}
+
+func (h apiHandler) route(c apiContext, r *http.Request, parts []string) (interface{}, error) {
+	switch {
+	case len(parts) == 1 && parts[0] == "orders":
+		switch r.Method {
+		case http.MethodGet:
+			return h.listOrders(c, r)
+		case http.MethodPost:
+			return h.createOrder(c, r)
+		}
+	case len(parts) == 2 && parts[0] == "orders":
+		if r.Method == http.MethodGet {
+			return h.getOrder(c, parts[1])
+		}
+	case len(parts) == 3 && parts[0] == "orders" && parts[2] == "transitions":
+		if r.Method == http.MethodPost {
+			return h.transitionOrder(c, r, parts[1])
+		}
+	case len(parts) == 3 && parts[0] == "orders" && parts[2] == "purchase-order":
+		if r.Method == http.MethodGet {
+			return h.getPurchaseOrder(c, parts[1])
+		}
+	case len(parts) == 1 && parts[0] == "catalog":
+		switch r.Method {
+		case http.MethodGet:
+			return h.listCatalog(c)
+		case http.MethodPost:
+			return h.saveCatalogItem(c, r, "")
+		}
+	case len(parts) == 2 && parts[0] == "catalog":
+		switch r.Method {
+		case http.MethodGet:
+			return h.getCatalogItem(c, parts[1])
+		case http.MethodPut:
+			return h.saveCatalogItem(c, r, parts[1])
+		case http.MethodDelete:
+			return h.deleteCatalogItem(c, parts[1])
+		}
+	case len(parts) == 1 && parts[0] == "assets":
+		if r.Method == http.MethodGet {
+			return h.listAssets(c, r)
+		}
+	default:
+		return nil, errorf(http.StatusNotFound, "not found")
+	}
+	return nil, errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+}
+
+// orderList is a page of orders. NextAfter is set when more orders exist.
+type orderList struct {
+	Orders    []order `json:"orders"`
+	NextAfter int64   `json:"next_after,omitempty"`
+}
+
+// listOrders returns the orders of the workspace of the key filtered by
+// status, requester, creation time and missing receipts, paginated with
+// limit and after (an order ID).
+func (h apiHandler) listOrders(c apiContext, r *http.Request) (interface{}, error) {
+	if err := c.require(roleReader); err != nil {
+		return nil, err
+	}
+
+	q := r.URL.Query()
+	limit := apiDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > apiMaxLimit {
+			return nil, errorf(http.StatusBadRequest, "limit must be between 1 and %d", apiMaxLimit)
+		}
+		limit = n
+	}
+	var after int64
+	if v := q.Get("after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "invalid after %q", v)
+		}
+		after = n
+	}
+	statuses := map[orderStatus]bool{}
+	for _, v := range splitList(q.Get("status")) {
+		statuses[orderStatus(v)] = true
+	}
+	var since, until time.Time
+	for name, dst := range map[string]*time.Time{"created_since": &since, "created_until": &until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errorf(http.StatusBadRequest, "%s must be RFC 3339", name)
+			}
+			*dst = t
+		}
+	}
+	requester := q.Get("requester")
+	if team := q.Get("team_id"); team != "" && team != c.key.TeamID {
+		return nil, errorf(http.StatusForbidden, "this API key cannot read orders of team %s", team)
+	}
+	missingReceipt := q.Get("missing_receipt") == "true"
+
+	orders := h.store.Orders(func(o *order) bool {
+		switch {
+		case o.ID <= after:
+		case len(statuses) > 0 && !statuses[o.Status]:
+		case requester != "" && o.Requester != requester:
+		case o.TeamID != c.key.TeamID:
+		case !since.IsZero() && o.CreatedAt.Before(since):
+		case !until.IsZero() && !o.CreatedAt.Before(until):
+		case missingReceipt && !o.missingReceipt():
+		default:
+			return true
+		}
+		return false
+	})
+
+	list := orderList{Orders: orders}
+	if len(orders) > limit {
+		list.Orders = orders[:limit]
+		list.NextAfter = orders[limit-1].ID
+	}
+	if list.Orders == nil {
+		list.Orders = []order{}
+	}
+	return list, nil
+}
+
+func (h apiHandler) getOrder(c apiContext, idStr string) (interface{}, error) {
+	if err := c.require(roleReader); err != nil {
+		return nil, err
+	}
+	return h.order(c, idStr)
+}
+
+// createOrderRequest is the body of POST /orders.
+type createOrderRequest struct {
+	TeamID    string `json:"team_id"`
+	ChannelID string `json:"channel_id"`
+	Requester string `json:"requester"`
+	SKU       string `json:"sku"`
+	ItemName  string `json:"item_name"`
+	ItemURL   string `json:"item_url"`
+	Reason    string `json:"reason"`
+	Count     int    `json:"count"`
+	UnitPrice amount `json:"unit_price"`
+	// Currency defaults to the base currency.
+	Currency string `json:"currency"`
+}
+
+// createOrder creates a draft in the workspace of the key. Submitting it for
+// approval is a transition.
+func (h apiHandler) createOrder(c apiContext, r *http.Request) (interface{}, error) {
+	if err := c.require(roleWriter); err != nil {
+		return nil, err
+	}
+	var req createOrderRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.TeamID == "" {
+		req.TeamID = c.key.TeamID
+	} else if req.TeamID != c.key.TeamID {
+		return nil, errorf(http.StatusForbidden, "this API key cannot create orders in team %s", req.TeamID)
+	}
+
+	if req.SKU != "" {
+		it, ok := h.store.CatalogItem(req.SKU)
+		if !ok || !it.Active {
+			return nil, errorf(http.StatusUnprocessableEntity, "unknown catalog item %q", req.SKU)
+		}
+		if req.ItemName == "" {
+			req.ItemName = it.Name
+		}
+		if req.ItemURL == "" {
+			req.ItemURL = it.URL
+		}
+		if req.UnitPrice == 0 {
+			req.UnitPrice = it.UnitPrice
+		}
+	}
+
+	var problems []string
+	if !slackIDPattern.MatchString(req.Requester) {
+		problems = append(problems, "requester must be a slack user ID")
+	}
+	if req.ItemName == "" {
+		problems = append(problems, "item_name is required")
+	}
+	if req.Count < 1 {
+		problems = append(problems, "count must be greater than 0")
+	}
+	if req.UnitPrice < 0 {
+		problems = append(problems, "unit_price must not be negative")
+	}
+	if req.Currency == "" {
+		req.Currency = h.orders.currencies.Base()
+	} else if !h.orders.currencies.Allowed(req.Currency) {
+		problems = append(problems, fmt.Sprintf("currency %s is not accepted", req.Currency))
+	}
+	if len(problems) > 0 {
+		return nil, errorf(http.StatusUnprocessableEntity, "%s", strings.Join(problems, "; "))
+	}
+
+	channelID := req.ChannelID
+	if channelID == "" {
+		channelID = h.workspaces.OrdersChannel(req.TeamID)
+	}
+	draft := order{
+		TeamID:    req.TeamID,
+		ChannelID: channelID,
+		Requester: req.Requester,
+		SKU:       req.SKU,
+		ItemName:  req.ItemName,
+		ItemURL:   req.ItemURL,
+		Reason:    req.Reason,
+		Count:     req.Count,
+		UnitPrice: req.UnitPrice,
+		Currency:  req.Currency,
+	}
+
+	// Blocking policy rules refuse the order like the order dialog does
+	if h.orders.policies != nil {
+		results := h.orders.policies.Evaluate(draft, time.Now())
+		for _, r := range results {
+			if r.Action == policyBlock {
+				problems = append(problems, r.Rule+": "+r.Message)
+			}
+		}
+		if len(problems) > 0 {
+			return nil, errorf(http.StatusUnprocessableEntity, "%s", strings.Join(problems, "; "))
+		}
+		draft.Policies = results
+	}
+
+	o, err := h.orders.CreateDraft(draft)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] Order %s created by API key %s", o.Ref(), c.key.Name)
+	return created{o}, nil
+}
+
+// transitionRequest is the body of POST /orders/{id}/transitions.
+type transitionRequest struct {
+	Status orderStatus `json:"status"`
+	Note   string      `json:"note"`
+}
+
+// transitionRoles is the role needed to move an order to each status.
+var transitionRoles = map[orderStatus]apiRole{
+	statusPending:   roleWriter,
+	statusCancelled: roleWriter,
+	statusPurchased: roleWriter,
+	statusDelivered: roleWriter,
+	statusIssue:     roleWriter,
+	statusApproved:  roleApprover,
+	statusRejected:  roleApprover,
+}
+
+func (h apiHandler) transitionOrder(c apiContext, r *http.Request, idStr string) (interface{}, error) {
+	var req transitionRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	role, ok := transitionRoles[req.Status]
+	if !ok {
+		return nil, errorf(http.StatusUnprocessableEntity, "cannot transition to %q", req.Status)
+	}
+	if err := c.require(role); err != nil {
+		return nil, err
+	}
+
+	current, err := h.order(c, idStr)
+	if err != nil {
+		return nil, err
+	}
+	if !canTransition(current.Status, req.Status) {
+		return nil, errorf(http.StatusConflict, "order %s is %s and cannot be %s", current.Ref(), current.Status, req.Status)
+	}
+
+	o, err := h.orders.TransitionByAPI(current.ID, req.Status, c.key, req.Note)
+	if err != nil {
+		return nil, errorf(http.StatusConflict, "%s", err)
+	}
+	return o, nil
+}
+
+// getPurchaseOrder downloads the PO PDF issued when the order was approved.
+func (h apiHandler) getPurchaseOrder(c apiContext, idStr string) (interface{}, error) {
+	if err := c.require(roleReader); err != nil {
+		return nil, err
+	}
+	o, err := h.order(c, idStr)
+	if err != nil {
+		return nil, err
+	}
+	po, ok := h.store.PurchaseOrder(o.ID)
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "order %s has no purchase order", idStr)
+	}
+	return apiFile{name: po.Filename(), contentType: "application/pdf", body: po.PDF}, nil
+}
+
+// listAssets returns the assets of the workspace of the key filtered by owner and category, as JSON or
+// as CSV with format=csv.
+func (h apiHandler) listAssets(c apiContext, r *http.Request) (interface{}, error) {
+	if err := c.require(roleReader); err != nil {
+		return nil, err
+	}
+	q := r.URL.Query()
+	owner, category := q.Get("owner"), q.Get("category")
+	assets := h.store.Assets(func(a *asset) bool {
+		return a.TeamID == c.key.TeamID && (owner == "" || a.Owner == owner) && (category == "" || strings.EqualFold(a.Category, category))
+	})
+
+	switch q.Get("format") {
+	case "", "json":
+		if assets == nil {
+			assets = []asset{}
+		}
+		return map[string][]asset{"assets": assets}, nil
+	case "csv":
+		body, err := assetsCSV(assets, h.workspaces)
+		if err != nil {
+			return nil, err
+		}
+		return apiFile{name: "assets.csv", contentType: "text/csv; charset=utf-8", body: body}, nil
+	}
+	return nil, errorf(http.StatusBadRequest, "format must be json or csv")
+}
+
+func (h apiHandler) listCatalog(c apiContext) (interface{}, error) {
+	if err := c.require(roleReader); err != nil {
+		return nil, err
+	}
+	return map[string][]catalogItem{"items": h.store.CatalogItems()}, nil
+}
+
+func (h apiHandler) getCatalogItem(c apiContext, sku string) (interface{}, error) {
+	if err := c.require(roleReader); err != nil {
+		return nil, err
+	}
+	it, ok := h.store.CatalogItem(sku)
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "catalog item %s not found", sku)
+	}
+	return it, nil
+}
+
+// saveCatalogItem creates an item (POST) or replaces the item of sku (PUT).
+func (h apiHandler) saveCatalogItem(c apiContext, r *http.Request, sku string) (interface{}, error) {
+	if err := c.require(roleAdmin); err != nil {
+		return nil, err
+	}
+	it := catalogItem{Active: true}
+	if err := decodeJSON(r, &it); err != nil {
+		return nil, err
+	}
+
+	if sku == "" {
+		if _, ok := h.store.CatalogItem(it.SKU); ok {
+			return nil, errorf(http.StatusConflict, "catalog item %s already exists", it.SKU)
+		}
+	} else if it.SKU == "" {
+		it.SKU = sku
+	} else if it.SKU != sku {
+		return nil, errorf(http.StatusUnprocessableEntity, "sku in body does not match the URL")
+	}
+
+	if err := h.store.SaveCatalogItem(it); err != nil {
+		return nil, errorf(http.StatusUnprocessableEntity, "%s", err)
+	}
+	saved, _ := h.store.CatalogItem(it.SKU)
+	if sku == "" {
+		return created{saved}, nil
+	}
+	return saved, nil
+}
+
+func (h apiHandler) deleteCatalogItem(c apiContext, sku string) (interface{}, error) {
+	if err := c.require(roleAdmin); err != nil {
+		return nil, err
+	}
+	ok, err := h.store.DeleteCatalogItem(sku)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "catalog item %s not found", sku)
+	}
+	return nil, nil
+}
+
+func decodeJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errorf(http.StatusBadRequest, "invalid JSON body: %s", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(apiError); ok {
+		status = e.status
+	} else {
+		log.Printf("[ERROR] API: %s", err)
+	}
+	msg := err.Error()
+	if status == http.StatusInternalServerError {
+		msg = "internal error"
+	}
+	writeJSON(w, status, map[string]string{"error": msg})
+}
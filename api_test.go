@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+	newFakeSlack(t)
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaces := newWorkspaceRegistry(store, "xoxb-test", "C1")
+	orders := &orderService{
+		store:     store,
+		threads:   &orderThreads{workspaces: workspaces, store: store},
+		callbacks: newCallbackSigner([]byte("0123456789abcdef")),
+		policies:  newPolicyEngine(store, nil, []policyConfig{{Name: "pens", Keywords: []string{"pen"}, MinReasonLength: 3, Action: "block"}}),
+	}
+	h := apiHandler{store: store, orders: orders, workspaces: workspaces}
+	keys := map[apiRole]string{}
+	for _, role := range []apiRole{roleReader, roleWriter, roleApprover, roleAdmin} {
+		_, secret, err := store.CreateAPIKey(string(role), role, "T1", "UADMIN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[role] = secret
+	}
+	_, otherTeam, err := store.CreateAPIKey("other", roleAdmin, "T2", "UADMIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path, key, body string
+		code                    int
+		want                    string
+	}{
+		{"GET", "/api/v1/openapi.json", "", "", http.StatusOK, `"openapi"`},
+		{"GET", "/api/v1/orders", "", "", http.StatusUnauthorized, "missing or invalid API key"},
+		{"GET", "/api/v1/orders", "wrong", "", http.StatusUnauthorized, "missing or invalid API key"},
+
+		// Catalog items are managed by admins
+		{"POST", "/api/v1/catalog", keys[roleWriter], `{"sku":"KB-1","name":"Keyboard","unit_price":"99.50"}`, http.StatusForbidden, "needs the admin role"},
+		{"POST", "/api/v1/catalog", keys[roleAdmin], `{"sku":"KB-1","name":"Keyboard","unit_price":"99.50"}`, http.StatusCreated, `"sku":"KB-1"`},
+
+		// Writers create drafts, from the catalog or not
+		{"POST", "/api/v1/orders", keys[roleReader], `{"requester":"U1","sku":"KB-1","count":2}`, http.StatusForbidden, "needs the writer role"},
+		{"POST", "/api/v1/orders", keys[roleWriter], `{"requester":"U1","sku":"KB-1","count":2}`, http.StatusCreated, `"item_name":"Keyboard"`},
+		{"POST", "/api/v1/orders", keys[roleWriter], `{"requester":"U1","item_name":"Mouse","count":1,"unit_price":"20"}`, http.StatusCreated, `"id":2`},
+		{"POST", "/api/v1/orders", keys[roleWriter], `{"requester":"U1","sku":"NOPE","count":1}`, http.StatusUnprocessableEntity, `unknown catalog item \"NOPE\"`},
+		{"POST", "/api/v1/orders", keys[roleWriter], `{"requester":"bob","count":0}`, http.StatusUnprocessableEntity, "requester must be a slack user ID; item_name is required; count must be greater than 0"},
+		{"POST", "/api/v1/orders", keys[roleWriter], `{"requester":"U1","item_name":"Pen","count":1}`, http.StatusUnprocessableEntity, "pens: "},
+		{"POST", "/api/v1/orders", keys[roleWriter], `{"requester":"U1","item_name":"Cup","count":1,"extra":true}`, http.StatusBadRequest, ""},
+
+		// Approvers approve what writers submitted
+		{"POST", "/api/v1/orders/1/transitions", keys[roleWriter], `{"status":"pending"}`, http.StatusOK, `"status":"pending"`},
+		{"POST", "/api/v1/orders/1/transitions", keys[roleWriter], `{"status":"approved"}`, http.StatusForbidden, "needs the approver role"},
+		{"POST", "/api/v1/orders/1/transitions", keys[roleApprover], `{"status":"approved","note":"ok"}`, http.StatusOK, `"status":"approved"`},
+		{"POST", "/api/v1/orders/1/transitions", keys[roleApprover], `{"status":"approved"}`, http.StatusConflict, "is approved and cannot be approved"},
+		{"POST", "/api/v1/orders/2/transitions", keys[roleApprover], `{"status":"shipped"}`, http.StatusUnprocessableEntity, `cannot transition to \"shipped\"`},
+
+		// Listing filters and pages
+		{"GET", "/api/v1/orders?limit=1", keys[roleReader], "", http.StatusOK, `"next_after":1`},
+		{"GET", "/api/v1/orders?limit=1&after=1", keys[roleReader], "", http.StatusOK, `"id":2`},
+		{"GET", "/api/v1/orders?status=approved", keys[roleReader], "", http.StatusOK, `"id":1`},
+		{"GET", "/api/v1/orders?limit=0", keys[roleReader], "", http.StatusBadRequest, "limit must be between 1 and 200"},
+		{"GET", "/api/v1/orders?created_since=yesterday", keys[roleReader], "", http.StatusBadRequest, "created_since must be RFC 3339"},
+		{"GET", "/api/v1/orders/1", keys[roleReader], "", http.StatusOK, `"approved_by":"api:approver"`},
+		{"GET", "/api/v1/orders/9", keys[roleReader], "", http.StatusNotFound, "order 9 not found"},
+		{"DELETE", "/api/v1/orders/1", keys[roleAdmin], "", http.StatusMethodNotAllowed, "method DELETE not allowed"},
+		{"GET", "/api/v1/nope", keys[roleAdmin], "", http.StatusNotFound, "not found"},
+
+		// Keys only see their own workspace
+		{"GET", "/api/v1/orders", otherTeam, "", http.StatusOK, `"orders":[]`},
+		{"GET", "/api/v1/orders/1", otherTeam, "", http.StatusNotFound, "order 1 not found"},
+		{"GET", "/api/v1/orders?team_id=T1", otherTeam, "", http.StatusForbidden, "cannot read orders of team T1"},
+		{"POST", "/api/v1/orders/2/transitions", otherTeam, `{"status":"cancelled"}`, http.StatusNotFound, "order 2 not found"},
+		{"POST", "/api/v1/orders", otherTeam, `{"team_id":"T1","requester":"U1","item_name":"Cup","count":1}`, http.StatusForbidden, "cannot create orders in team T1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.key != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s %s = %d %s, want %d with %q", tt.method, tt.path, rec.Code, rec.Body, tt.code, tt.want)
+		}
+		if tt.code >= 400 && !json.Valid(rec.Body.Bytes()) {
+			t.Errorf("%s %s: error is not JSON: %s", tt.method, tt.path, rec.Body)
+		}
+	}
+
+	// Orders made through the API are recorded with the key as actor
+	o, _ := store.Order(1)
+	if o.TeamID != "T1" || o.ChannelID != "C1" || o.UnitPrice != 9950 || o.Count != 2 {
+		t.Errorf("order 1 = %+v", o)
+	}
+	if last := o.History[len(o.History)-1]; last.User != "api:approver" || last.Text != "ok" {
+		t.Errorf("last event = %+v", last)
+	}
+}
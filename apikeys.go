@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiRole is what an API key is allowed to do. Each role includes the
+// permissions of the roles before it.
+type apiRole string
+
+const (
+	roleReader   apiRole = "reader"
+	roleWriter   apiRole = "writer"
+	roleApprover apiRole = "approver"
+	roleAdmin    apiRole = "admin"
+)
+
+var roleRanks = map[apiRole]int{
+	roleReader:   1,
+	roleWriter:   2,
+	roleApprover: 3,
+	roleAdmin:    4,
+}
+
+// allows reports whether r includes the permissions of required.
+func (r apiRole) allows(required apiRole) bool {
+	return roleRanks[r] >= roleRanks[required]
+}
+
+const apiKeyPrefix = "obk_"
+
+// apiKey is a credential of the REST API. Only the hash of the secret is stored.
+type apiKey struct {
+	ID   string  `json:"id"`
+	Name string  `json:"name"`
+	Role apiRole `json:"role"`
+	// TeamID is the workspace the key was issued in, the key only sees
+	// its orders and assets.
+	TeamID    string    `json:"team_id,omitempty"`
+	Hash      string    `json:"hash"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used,omitempty"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey issues a key of teamID and returns it with its secret.
+// The secret cannot be recovered afterwards.
+func (s *orderStore) CreateAPIKey(name string, role apiRole, teamID, createdBy string) (apiKey, string, error) {
+	if _, ok := roleRanks[role]; !ok {
+		return apiKey{}, "", fmt.Errorf("unknown role %q", role)
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return apiKey{}, "", err
+	}
+	id := hex.EncodeToString(buf[:4])
+	secret := apiKeyPrefix + id + "_" + hex.EncodeToString(buf[4:])
+
+	key := apiKey{
+		ID:        id,
+		Name:      name,
+		Role:      role,
+		TeamID:    teamID,
+		Hash:      hashAPIKey(secret),
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.APIKeys[id] = key
+	if err := s.flush(); err != nil {
+		delete(s.data.APIKeys, id)
+		return apiKey{}, "", err
+	}
+	return key, secret, nil
+}
+
+// AuthenticateAPIKey returns the active key of secret.
+func (s *orderStore) AuthenticateAPIKey(secret string) (apiKey, bool) {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return apiKey{}, false
+	}
+	id := strings.SplitN(strings.TrimPrefix(secret, apiKeyPrefix), "_", 2)[0]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.data.APIKeys[id]
+	if !ok || key.Revoked {
+		return apiKey{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKey(secret))) != 1 {
+		return apiKey{}, false
+	}
+
+	// Last use is informational, it is persisted with the next write
+	key.LastUsed = time.Now()
+	s.data.APIKeys[id] = key
+	return key, true
+}
+
+// RevokeAPIKey disables the key of teamID with id.
+func (s *orderStore) RevokeAPIKey(teamID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.data.APIKeys[id]
+	if !ok || key.TeamID != teamID {
+		return fmt.Errorf("API key %s not found", id)
+	}
+	key.Revoked = true
+	s.data.APIKeys[id] = key
+	return s.flush()
+}
+
+// APIKeys returns the keys of teamID, newest first.
+func (s *orderStore) APIKeys(teamID string) []apiKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []apiKey
+	for _, k := range s.data.APIKeys {
+		if k.TeamID == teamID {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	actionRegisterAssets = "order_register_assets"
+
+	// assetDialogPrefix starts the callback ID of the serial number dialog,
+	// followed by the callback token of the order.
+	assetDialogPrefix = "asset_dialog:"
+)
+
+// asset is a delivered item tracked by IT, one per serial number.
+type asset struct {
+	Tag         string    `json:"tag"`
+	Serial      string    `json:"serial"`
+	Category    string    `json:"category"`
+	ItemName    string    `json:"item_name"`
+	Owner       string    `json:"owner"`
+	TeamID      string    `json:"team_id"`
+	OrderID     int64     `json:"order_id"`
+	PurchasedAt time.Time `json:"purchased_at"`
+	Price       amount    `json:"price"`
+	// WarrantyEnd is zero when the category has no warranty configured.
+	WarrantyEnd time.Time `json:"warranty_end"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// RegisterAssets tags and stores the assets of the order with id. It fails
+// if the order has assets already.
+func (s *orderStore) RegisterAssets(id int64, assets []asset) ([]asset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.data.Assets {
+		if a.OrderID == id {
+			return nil, trErrorf("order.error.assets_twice", id)
+		}
+	}
+
+	last := s.data.LastAssetNumber
+	tagged := make([]asset, len(assets))
+	for i, a := range assets {
+		last++
+		a.Tag = fmt.Sprintf("A-%05d", last)
+		s.data.Assets[a.Tag] = a
+		tagged[i] = a
+	}
+	prev := s.data.LastAssetNumber
+	s.data.LastAssetNumber = last
+	if err := s.flush(); err != nil {
+		for _, a := range tagged {
+			delete(s.data.Assets, a.Tag)
+		}
+		s.data.LastAssetNumber = prev
+		return nil, err
+	}
+	return tagged, nil
+}
+
+// Assets returns the assets for which match returns true, ordered by tag.
+// A nil match returns every asset.
+func (s *orderStore) Assets(match func(a *asset) bool) []asset {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var assets []asset
+	for _, a := range s.data.Assets {
+		if match == nil || match(&a) {
+			assets = append(assets, a)
+		}
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i].Tag < assets[j].Tag })
+	return assets
+}
+
+// assetRegistry asks requesters of delivered hardware for serial numbers
+// and turns them into assets.
+type assetRegistry struct {
+	orders     *orderService
+	categories []assetCategoryConfig
+}
+
+// categoryOf returns the asset category of o. Catalog orders use the
+// category of their item, other orders match by keywords in the item name.
+func (r *assetRegistry) categoryOf(o order) (assetCategoryConfig, bool) {
+	if o.SKU != "" {
+		if it, ok := r.orders.store.CatalogItem(o.SKU); ok && it.Category != "" {
+			for _, c := range r.categories {
+				if strings.EqualFold(c.Name, it.Category) {
+					return c, true
+				}
+			}
+			return assetCategoryConfig{}, false
+		}
+	}
+	name := strings.ToLower(o.ItemName)
+	for _, c := range r.categories {
+		for _, k := range c.Keywords {
+			if strings.Contains(name, strings.ToLower(k)) {
+				return c, true
+			}
+		}
+	}
+	return assetCategoryConfig{}, false
+}
+
+// OrderChanged asks for the serial numbers of delivered hardware.
+func (r *assetRegistry) OrderChanged(c orderChange) {
+	if c.To != statusDelivered {
+		return
+	}
+	if _, ok := r.categoryOf(c.Order); !ok {
+		return
+	}
+	go func() {
+		if err := r.askSerials(c.Order); err != nil {
+			log.Printf("[ERROR] Failed to ask serial numbers of %s: %s", c.Order.Ref(), err)
+		}
+	}()
+}
+
+// askSerials DMs the requester of o a button opening the serial number dialog.
+func (r *assetRegistry) askSerials(o order) error {
+	client, err := r.orders.threads.workspaces.Client(o.TeamID)
+	if err != nil {
+		return err
+	}
+	_, _, channel, err := client.OpenIMChannel(o.Requester)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = client.SendMessage(
+		channel,
+		slack.MsgOptionText(fmt.Sprintf("Your order %s (%s) becomes a company asset. IT needs its serial numbers.", o.Ref(), o.ItemName), false),
+		slack.MsgOptionAttachments(slack.Attachment{
+			CallbackID: "order_assets",
+			Color:      statusColors[statusDelivered],
+			Actions: []slack.AttachmentAction{
+				{Name: actionRegisterAssets, Text: "Enter serial numbers", Type: "button", Style: "primary", Value: r.orders.callbacks.Sign(o)},
+			},
+		}),
+	)
+	return err
+}
+
+// serialDialog asks for one serial number per item of o.
+func serialDialog(o order, token, loc string) slack.Dialog {
+	hint := tr(loc, "serials.hint")
+	if o.Count > 1 {
+		hint = tr(loc, "serials.hint.many", o.Count)
+	}
+	return slack.Dialog{
+		CallbackId:  assetDialogPrefix + token,
+		Title:       tr(loc, "serials.title", o.Ref()),
+		SubmitLabel: tr(loc, "serials.register"),
+		Elements: []slack.DialogElement{
+			slack.DialogTextElement{
+				Label: tr(loc, "serials.label"),
+				Name:  "serials",
+				Type:  "textarea",
+				Hint:  hint,
+			},
+		},
+	}
+}
+
+// parseSerials splits text into serial numbers, one per line. Errors are
+// in loc for the dialog.
+func parseSerials(text string, count int, loc string) ([]string, error) {
+	var serials []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(text, "\n") {
+		s := strings.TrimSpace(line)
+		if s == "" {
+			continue
+		}
+		if seen[s] {
+			return nil, errors.New(tr(loc, "serials.error.twice", s))
+		}
+		seen[s] = true
+		serials = append(serials, s)
+	}
+	if len(serials) != count {
+		return nil, errors.New(tr(loc, "serials.error.count", count, len(serials)))
+	}
+	return serials, nil
+}
+
+// Register creates the assets of o with serials and tells the thread.
+func (r *assetRegistry) Register(o order, serials []string, user string) ([]asset, error) {
+	cat, ok := r.categoryOf(o)
+	if !ok {
+		return nil, trErrorf("order.error.assets_category", o.Ref())
+	}
+	now := time.Now()
+	purchased := o.CreatedAt
+	for _, ev := range o.History {
+		if ev.Kind == eventStatus && ev.Status == statusPurchased {
+			purchased = ev.At
+		}
+	}
+	var warrantyEnd time.Time
+	if cat.WarrantyMonths > 0 {
+		warrantyEnd = purchased.AddDate(0, cat.WarrantyMonths, 0)
+	}
+
+	assets := make([]asset, len(serials))
+	for i, serial := range serials {
+		assets[i] = asset{
+			Serial:      serial,
+			Category:    cat.Name,
+			ItemName:    o.ItemName,
+			Owner:       o.Requester,
+			TeamID:      o.TeamID,
+			OrderID:     o.ID,
+			PurchasedAt: purchased,
+			Price:       o.UnitPrice,
+			WarrantyEnd: warrantyEnd,
+			CreatedAt:   now,
+		}
+	}
+	assets, err := r.orders.store.RegisterAssets(o.ID, assets)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] Registered %d asset(s) of %s", len(assets), o.Ref())
+
+	tags := make([]string, len(assets))
+	for i, a := range assets {
+		tags[i] = fmt.Sprintf("`%s` (%s)", a.Tag, a.Serial)
+	}
+	text := fmt.Sprintf(":label: <@%s> registered %s", user, strings.Join(tags, ", "))
+	if err := r.orders.threads.Reply(o, text); err != nil {
+		log.Printf("[ERROR] %s", err)
+	}
+	return assets, nil
+}
+
+// assetsCSV exports assets for IT. Owner names are resolved with workspaces.
+func assetsCSV(assets []asset, workspaces *workspaceRegistry) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"tag", "serial", "category", "item", "owner_id", "owner", "order", "purchase_date", "price", "warranty_end"})
+	names := map[string]string{}
+	for _, a := range assets {
+		name, ok := names[a.TeamID+"/"+a.Owner]
+		if !ok {
+			name = workspaces.UserName(a.TeamID, a.Owner)
+			names[a.TeamID+"/"+a.Owner] = name
+		}
+		warranty := ""
+		if !a.WarrantyEnd.IsZero() {
+			warranty = a.WarrantyEnd.Format("2006-01-02")
+		}
+		w.Write([]string{
+			a.Tag,
+			a.Serial,
+			a.Category,
+			a.ItemName,
+			a.Owner,
+			name,
+			fmt.Sprintf("#%d", a.OrderID),
+			a.PurchasedAt.Format("2006-01-02"),
+			a.Price.String(),
+			warranty,
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// handleAssetsCommand lists and exports assets:
+//
+//	assets           your assets
+//	assets @user     the assets of user
+//	assets export    every asset as CSV, sent in a DM (admins only)
+func (s *SlackListener) handleAssetsCommand(channel string, msg slack.Msg, args []string) error {
+	store := s.orders.store
+	owner := msg.User
+	loc := s.locale(msg.User)
+	var user string
+	var mentioned bool
+	if len(args) == 1 {
+		user, mentioned = mentionedUser(args[0])
+	}
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && strings.EqualFold(args[0], "export"):
+		if !s.isAdmin(msg.User) {
+			return s.replyEphemeral(channel, msg, tr(loc, "assets.admins_only"))
+		}
+		body, err := assetsCSV(store.Assets(nil), s.orders.threads.workspaces)
+		if err != nil {
+			return err
+		}
+		_, _, im, err := s.client.OpenIMChannel(msg.User)
+		if err != nil {
+			return fmt.Errorf("failed to open DM: %s", err)
+		}
+		token, err := s.orders.threads.workspaces.Token(s.teamID)
+		if err != nil {
+			return err
+		}
+		return uploadSlackFile(token, slackFile{
+			Channel:  im,
+			Filename: "assets-" + time.Now().Format("20060102") + ".csv",
+			Title:    "Assets",
+			Content:  body,
+		})
+	case mentioned:
+		owner = user
+	default:
+		return s.replyEphemeral(channel, msg, tr(loc, "assets.usage"))
+	}
+
+	assets := store.Assets(func(a *asset) bool { return a.Owner == owner })
+	if len(assets) == 0 {
+		return s.replyEphemeral(channel, msg, tr(loc, "assets.none", owner))
+	}
+	lines := []string{tr(loc, "assets.list", owner)}
+	for _, a := range assets {
+		line := tr(loc, "assets.line", a.Tag, a.ItemName, a.Category, a.Serial, a.OrderID, a.PurchasedAt.Format("2006-01-02"))
+		if !a.WarrantyEnd.IsZero() {
+			line += tr(loc, "assets.warranty", a.WarrantyEnd.Format("2006-01-02"))
+		}
+		lines = append(lines, line)
+	}
+	return s.replyEphemeral(channel, msg, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+func TestAssetsCommand(t *testing.T) {
+	fake := newFakeSlack(t)
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	purchased := time.Date(2024, 4, 2, 0, 0, 0, 0, time.UTC)
+	_, err = store.RegisterAssets(7, []asset{
+		{Serial: "SN1", Category: "laptop", ItemName: "Laptop", Owner: "UALICE", OrderID: 7, PurchasedAt: purchased},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SlackListener{
+		client:    slack.New("xoxb-test"),
+		channelID: "C1",
+		botID:     "UBOT",
+		orders:    &orderService{store: store, threads: &orderThreads{workspaces: newWorkspaceRegistry(store, "xoxb-test", "C1"), store: store}},
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"<@UBOT> assets <@UALICE>", "Assets of <@UALICE>:\n• `A-00001` Laptop (laptop), S/N SN1, order #7, bought 2024-04-02"},
+		{"<@UBOT> assets <@UALICE|alice>", "Assets of <@UALICE>:\n• `A-00001` Laptop (laptop), S/N SN1, order #7, bought 2024-04-02"},
+		{"<@UBOT> assets", "<@UBOB> has no assets."},
+		{"<@UBOT> assets <@UCAROL>", "<@UCAROL> has no assets."},
+		{"<@UBOT> assets x<@UALICE>", "Usage: `assets`, `assets @user` or `assets export`"},
+		{"<@UBOT> assets <@UALICE> <@UCAROL>", "Usage: `assets`, `assets @user` or `assets export`"},
+	}
+	for i, tt := range tests {
+		fake.reset()
+		ev := &slack.MessageEvent{Msg: slack.Msg{Channel: "C1", User: "UBOB", Text: tt.text, Timestamp: fmt.Sprintf("1500000000.%06d", i)}}
+		if err := s.handleMessageEvent(ev); err != nil {
+			t.Errorf("%q: %s", tt.text, err)
+			continue
+		}
+		// The first reply also looks up the locale of UBOB
+		var replies []slackCall
+		for _, c := range fake.recorded() {
+			if c.Method != "users.info" {
+				replies = append(replies, c)
+			}
+		}
+		if len(replies) != 1 || replies[0].Method != "chat.postEphemeral" || replies[0].Args.Get("user") != "UBOB" {
+			t.Errorf("%q: calls = %v", tt.text, replies)
+			continue
+		}
+		if got := replies[0].Args.Get("text"); got != tt.want {
+			t.Errorf("%q: replied %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
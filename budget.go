@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+)
+
+// spendingStatuses are the statuses whose totals are debited from a budget.
+var spendingStatuses = map[orderStatus]bool{
+	statusApproved:  true,
+	statusPurchased: true,
+	statusDelivered: true,
+	statusIssue:     true,
+}
+
+// budget is the monthly amount a team can spend.
+type budget struct {
+	Team    string
+	Members []string
+	Monthly amount
+}
+
+// budgetBook tracks team budgets against the stored orders. Budgets are in
+// the base currency of currencies.
+type budgetBook struct {
+	store      *orderStore
+	currencies *currencyBook
+	budgets    []budget
+}
+
+// newBudgetBook builds the budgets of a validated config.
+func newBudgetBook(store *orderStore, currencies *currencyBook, configs []budgetConfig) *budgetBook {
+	b := &budgetBook{store: store, currencies: currencies}
+	for _, c := range configs {
+		monthly, _ := parseAmount(c.Monthly)
+		b.budgets = append(b.budgets, budget{Team: c.Team, Members: c.Members, Monthly: monthly})
+	}
+	return b
+}
+
+// For returns the budget of the team user belongs to.
+func (b *budgetBook) For(user string) (budget, bool) {
+	for _, bg := range b.budgets {
+		for _, m := range bg.Members {
+			if m == user {
+				return bg, true
+			}
+		}
+	}
+	return budget{}, false
+}
+
+// Spent returns the total of the orders of bg members created in the month of now.
+func (b *budgetBook) Spent(bg budget, now time.Time) amount {
+	members := map[string]bool{}
+	for _, m := range bg.Members {
+		members[m] = true
+	}
+	year, month, _ := now.Date()
+
+	var spent amount
+	for _, o := range b.store.Orders(func(o *order) bool {
+		y, m, _ := o.CreatedAt.In(now.Location()).Date()
+		return members[o.Requester] && spendingStatuses[o.Status] && y == year && m == month
+	}) {
+		spent += b.currencies.BaseTotal(o)
+	}
+	return spent
+}
+
+// Remaining returns how much bg can still spend in the month of now.
+func (b *budgetBook) Remaining(bg budget, now time.Time) amount {
+	return bg.Monthly - b.Spent(bg, now)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// callbackVersion starts every callback token so that the format can
+	// change without misreading buttons posted before.
+	callbackVersion = "v2"
+
+	// callbackTTL is how long buttons and dialogs about an order work.
+	// Orders can wait for approval or delivery for weeks.
+	callbackTTL = 30 * 24 * time.Hour
+)
+
+// onceActions change an order, so each of their buttons can be clicked
+// once per user. Other order buttons only open a dialog.
+var onceActions = map[string]bool{
+	dialogConfirm:     true,
+	dialogCancel:      true,
+	actionJoinOrder:   true,
+	actionApprove:     true,
+	actionReject:      true,
+	actionPurchase:    true,
+	actionDeliver:     true,
+	actionReship:      true,
+	actionReceived:    true,
+	actionNotReceived: true,
+	actionDamaged:     true,
+}
+
+// viewActions are the other buttons about an order, they open a dialog
+// or only answer the click.
+var viewActions = map[string]bool{
+	dialogMore:           true,
+	actionEditDraft:      true,
+	actionEditOrder:      true,
+	actionEditCharges:    true,
+	actionTrack:          true,
+	actionRegisterAssets: true,
+}
+
+// callbackDialogPrefixes are the dialogs whose callback ID is a prefix
+// followed by a callback token.
+var callbackDialogPrefixes = []string{
+	trackingDialogPrefix,
+	assetDialogPrefix,
+	chargesDialogPrefix,
+	editDialogPrefix,
+	orderDialogCallback + ":",
+}
+
+// isOrderAction reports whether the value of action is a callback token.
+func isOrderAction(action string) bool {
+	return onceActions[action] || viewActions[action]
+}
+
+// callbackPayload is what a button or dialog about an order carries. Stage
+// and Version are the status and version of the order when it was posted,
+// a button of another status or version is stale.
+type callbackPayload struct {
+	OrderID int64
+	// TargetID is the order to join for join buttons.
+	TargetID int64
+	Stage    orderStatus
+	Version  int64
+	Nonce    string
+	Expires  time.Time
+}
+
+// callbackSigner signs callback tokens so that clicks cannot be forged by
+// crafting a payload with another order ID.
+type callbackSigner struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func newCallbackSigner(secret []byte) *callbackSigner {
+	return &callbackSigner{secret: secret, now: time.Now}
+}
+
+// Sign returns the token of a button or dialog about o.
+func (c *callbackSigner) Sign(o order) string {
+	return c.sign(callbackPayload{OrderID: o.ID, Stage: o.Status, Version: o.Version})
+}
+
+// SignJoin returns the token of the button joining draft to target.
+func (c *callbackSigner) SignJoin(draft, target order) string {
+	return c.sign(callbackPayload{OrderID: draft.ID, TargetID: target.ID, Stage: draft.Status, Version: draft.Version})
+}
+
+// sign encodes p with a new nonce and expiry as
+// "v2.<payload>.<signature>", both base64url.
+func (c *callbackSigner) sign(p callbackPayload) string {
+	nonce, err := randomHex(8)
+	if err != nil {
+		// A nonce only tells clicks apart, the signature still holds
+		nonce = strconv.FormatInt(c.now().UnixNano(), 36)
+	}
+	p.Nonce = nonce
+	p.Expires = c.now().Add(callbackTTL)
+	payload := fmt.Sprintf("%d|%d|%s|%d|%d|%s", p.OrderID, p.TargetID, p.Stage, p.Version, p.Expires.Unix(), p.Nonce)
+	return callbackVersion + "." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(c.mac(payload))
+}
+
+func (c *callbackSigner) mac(payload string) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(callbackVersion + "." + payload))
+	return mac.Sum(nil)
+}
+
+// Verify checks the signature and expiry of token and returns its payload.
+func (c *callbackSigner) Verify(token string) (callbackPayload, error) {
+	var p callbackPayload
+	invalid := trErrorf("button.error.invalid")
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != callbackVersion {
+		return p, invalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return p, invalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, c.mac(string(payload))) {
+		return p, invalid
+	}
+
+	f := strings.Split(string(payload), "|")
+	if len(f) != 6 {
+		return p, invalid
+	}
+	var exp int64
+	if p.OrderID, err = strconv.ParseInt(f[0], 10, 64); err != nil {
+		return p, invalid
+	}
+	if p.TargetID, err = strconv.ParseInt(f[1], 10, 64); err != nil {
+		return p, invalid
+	}
+	if p.Version, err = strconv.ParseInt(f[3], 10, 64); err != nil {
+		return p, invalid
+	}
+	if exp, err = strconv.ParseInt(f[4], 10, 64); err != nil {
+		return p, invalid
+	}
+	p.Stage, p.Expires, p.Nonce = orderStatus(f[2]), time.Unix(exp, 0), f[5]
+	if c.now().After(p.Expires) {
+		return p, trErrorf("button.error.expired")
+	}
+	return p, nil
+}
+
+// CallbackSecret returns the secret callback tokens are signed with,
+// generated on first use and kept so buttons work across restarts.
+func (s *orderStore) CallbackSecret() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.CallbackSecret == "" {
+		secret, err := randomHex(32)
+		if err != nil {
+			return nil, err
+		}
+		s.data.CallbackSecret = secret
+		if err := s.flush(); err != nil {
+			s.data.CallbackSecret = ""
+			return nil, err
+		}
+	}
+	return []byte(s.data.CallbackSecret), nil
+}
+
+// checkAction checks the verified payload p of a button about an order.
+// The order must not have changed since the button was posted. It returns
+// the value the button had before tokens: the order ID, or
+// "<draft>:<target>" to join. Buttons changing the order are used up by
+// useButton once their job is accepted.
+func (h interactionHandler) checkAction(action string, p callbackPayload) (string, error) {
+	o, ok := h.orders.store.Order(p.OrderID)
+	if !ok {
+		return "", trErrorf("order.error.not_found", p.OrderID)
+	}
+	if o.Status != p.Stage {
+		return "", trErrorf("button.error.stale", o.Ref(), statusName(o.Status))
+	}
+	if o.Version != p.Version {
+		return "", trErrorf("button.error.changed", o.Ref())
+	}
+	if action == actionJoinOrder {
+		return fmt.Sprintf("%d:%d", p.OrderID, p.TargetID), nil
+	}
+	return strconv.FormatInt(p.OrderID, 10), nil
+}
+
+// useButton uses up the button p for user. A button works once per user,
+// not once: the buttons of an order are posted once for everyone, e.g.
+// every approver of a policy stage clicks the same Approve. The buttons of
+// one message share their token, so a user cannot click Approve twice nor
+// Approve and then Reject.
+func (h interactionHandler) useButton(p callbackPayload, user string) error {
+	if err := h.orders.store.UseLink(p.Nonce+":"+user, p.Expires, h.orders.callbacks.now()); err != nil {
+		return trErrorf("button.error.used")
+	}
+	return nil
+}
+
+// firstField returns a field of a dialog submission to show an error on
+// which is about the whole dialog.
+func firstField(submission map[string]string) string {
+	var names []string
+	for name := range submission {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// verifyDialog checks the token in the callback ID of a dialog about an
+// order and returns the callback ID with the order ID in its place, and the
+// order ID. Orders can change while a dialog is open, the services check
+// their status.
+func (h interactionHandler) verifyDialog(callbackID string) (string, int64, error) {
+	for _, prefix := range callbackDialogPrefixes {
+		if !strings.HasPrefix(callbackID, prefix) {
+			continue
+		}
+		p, err := h.orders.callbacks.Verify(strings.TrimPrefix(callbackID, prefix))
+		if err != nil {
+			return "", 0, err
+		}
+		return prefix + strconv.FormatInt(p.OrderID, 10), p.OrderID, nil
+	}
+	return callbackID, 0, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	c := newCallbackSigner([]byte("0123456789abcdef"))
+	c.now = func() time.Time { return now }
+	o := order{ID: 7, Status: statusPending, Version: 3}
+	token := c.Sign(o)
+
+	p, err := c.Verify(token)
+	if err != nil || p.OrderID != 7 || p.Stage != statusPending || p.Version != 3 || !p.Expires.Equal(now.Add(callbackTTL)) {
+		t.Fatalf("Verify = %+v, %v", p, err)
+	}
+	if p, err := c.Verify(c.SignJoin(o, order{ID: 9})); err != nil || p.OrderID != 7 || p.TargetID != 9 {
+		t.Errorf("Verify of a join = %+v, %v", p, err)
+	}
+
+	parts := strings.Split(token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	other := newCallbackSigner([]byte("fedcba9876543210"))
+	other.now = c.now
+	expired := newCallbackSigner(c.secret)
+	expired.now = func() time.Time { return now.Add(-callbackTTL - time.Second) }
+
+	tests := []struct {
+		name, token, err string
+	}{
+		{"other secret", other.Sign(o), "not valid"},
+		{"other order", parts[0] + "." + encode(strings.Replace(string(payload), "7|", "8|", 1)) + "." + parts[2], "not valid"},
+		{"other version", parts[0] + "." + encode(strings.Replace(string(payload), "|3|", "|4|", 1)) + "." + parts[2], "not valid"},
+		{"no signature", parts[0] + "." + parts[1] + ".", "not valid"},
+		{"old format", "v1." + parts[1] + "." + parts[2], "not valid"},
+		{"order ID", "7", "not valid"},
+		{"expired", expired.Sign(o), "has expired"},
+	}
+	for _, tt := range tests {
+		if _, err := c.Verify(tt.token); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: Verify = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestCheckAction(t *testing.T) {
+	h, o := newTestHandler(t, nil)
+	token := h.orders.callbacks.Sign(o)
+	check := func() error {
+		p, err := h.orders.callbacks.Verify(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = h.checkAction(actionApprove, p)
+		return err
+	}
+	if err := check(); err != nil {
+		t.Fatalf("fresh button: %v", err)
+	}
+
+	// Comments in the thread leave the order as it is
+	if err := h.orders.Comment(o.ID, "U2", "any update?"); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(); err != nil {
+		t.Errorf("button after a comment: %v", err)
+	}
+
+	// The approval of an edited order is asked for again
+	if _, err := h.orders.store.UpdateOrder(o.ID, func(o *order) error {
+		o.Count = 20
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(); err == nil || !strings.Contains(err.Error(), "was changed since") {
+		t.Errorf("button of another version: %v", err)
+	}
+
+	if _, err := h.orders.store.UpdateOrder(o.ID, func(o *order) error {
+		return o.transition(statusCancelled, "U1", "", time.Now())
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(); err == nil || !strings.Contains(err.Error(), "is cancelled now") {
+		t.Errorf("button of another status: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var skuPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// catalogItem is a pre-approved item people can order.
+type catalogItem struct {
+	SKU       string    `json:"sku"`
+	Name      string    `json:"name"`
+	URL       string    `json:"url,omitempty"`
+	Category  string    `json:"category,omitempty"`
+	UnitPrice amount    `json:"unit_price"`
+	Active    bool      `json:"active"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (it catalogItem) validate() error {
+	if !skuPattern.MatchString(it.SKU) {
+		return fmt.Errorf("invalid sku %q", it.SKU)
+	}
+	if it.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if it.UnitPrice < 0 {
+		return fmt.Errorf("unit_price must not be negative")
+	}
+	return nil
+}
+
+// SaveCatalogItem adds or replaces a catalog item.
+func (s *orderStore) SaveCatalogItem(it catalogItem) error {
+	if err := it.validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it.UpdatedAt = time.Now()
+	s.data.Catalog[it.SKU] = it
+	return s.flush()
+}
+
+// DeleteCatalogItem removes a catalog item.
+func (s *orderStore) DeleteCatalogItem(sku string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Catalog[sku]; !ok {
+		return false, nil
+	}
+	delete(s.data.Catalog, sku)
+	return true, s.flush()
+}
+
+// CatalogItem returns the item of sku.
+func (s *orderStore) CatalogItem(sku string) (catalogItem, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	it, ok := s.data.Catalog[sku]
+	return it, ok
+}
+
+// CatalogItems returns every catalog item ordered by SKU.
+func (s *orderStore) CatalogItems() []catalogItem {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := make([]catalogItem, 0, len(s.data.Catalog))
+	for _, it := range s.data.Catalog {
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].SKU < items[j].SKU })
+	return items
+}
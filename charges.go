@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	actionEditCharges = "order_edit_charges"
+
+	// chargesDialogPrefix starts the callback ID of the charges dialog,
+	// followed by the callback token of the order.
+	chargesDialogPrefix = "charges_dialog:"
+)
+
+// chargeStatuses are the statuses in which the charges of an order can
+// still change. Once purchased, the order is what was paid.
+var chargeStatuses = map[orderStatus]bool{
+	statusDraft:    true,
+	statusPending:  true,
+	statusApproved: true,
+}
+
+// discount is a discount or coupon taken off an order.
+type discount struct {
+	Label  string `json:"label"`
+	Amount amount `json:"amount"`
+}
+
+// Subtotal returns the price of the items alone.
+func (o *order) Subtotal() amount {
+	return o.UnitPrice.mul(o.Count)
+}
+
+// DiscountTotal returns the sum of the discounts of o.
+func (o *order) DiscountTotal() amount {
+	var total amount
+	for _, d := range o.Discounts {
+		total += d.Amount
+	}
+	return total
+}
+
+// Tax returns the tax of o: TaxAmount if set, otherwise TaxRate percent of
+// the discounted subtotal rounded half up to the cent. Shipping is not taxed.
+func (o *order) Tax() amount {
+	if o.TaxAmount != nil {
+		return *o.TaxAmount
+	}
+	base := o.Subtotal() - o.DiscountTotal()
+	if base <= 0 {
+		return 0
+	}
+	// The rate is in hundredths of a percent
+	return (base*o.TaxRate + 5000) / 10000
+}
+
+// hasTax reports whether a tax was set on o.
+func (o *order) hasTax() bool {
+	return o.TaxAmount != nil || o.TaxRate != 0
+}
+
+// taxRateText formats the tax rate of o without trailing zeros, e.g. "8.25".
+func (o *order) taxRateText() string {
+	return strings.TrimRight(strings.TrimRight(o.TaxRate.String(), "0"), ".")
+}
+
+// chargesText lists the charges of o on one line, empty if there are none.
+func (o *order) chargesText() string {
+	var parts []string
+	if o.Shipping != 0 {
+		parts = append(parts, "shipping "+o.money(o.Shipping))
+	}
+	if o.hasTax() {
+		tax := "tax " + o.money(o.Tax())
+		if o.TaxAmount == nil {
+			tax += fmt.Sprintf(" (%s%%)", o.taxRateText())
+		}
+		if o.TaxRegion != "" {
+			tax += " for " + o.TaxRegion
+		}
+		parts = append(parts, tax)
+	}
+	for _, d := range o.Discounts {
+		parts = append(parts, fmt.Sprintf("%s -%s", d.Label, o.money(d.Amount)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// taxRegion is a region whose tax rate orders default to.
+type taxRegion struct {
+	Name string
+	Rate amount
+}
+
+// taxTable holds the tax regions of the config. A nil table has none.
+type taxTable struct {
+	regions       []taxRegion
+	defaultRegion string
+}
+
+// newTaxTable builds the regions of a validated config.
+func newTaxTable(cfg taxesConfig) *taxTable {
+	t := &taxTable{defaultRegion: cfg.DefaultRegion}
+	for _, r := range cfg.Regions {
+		rate, _ := parseAmount(r.Rate)
+		t.regions = append(t.regions, taxRegion{Name: r.Name, Rate: rate})
+	}
+	return t
+}
+
+// Region returns the region called name.
+func (t *taxTable) Region(name string) (taxRegion, bool) {
+	if t == nil {
+		return taxRegion{}, false
+	}
+	for _, r := range t.regions {
+		if strings.EqualFold(r.Name, name) {
+			return r, true
+		}
+	}
+	return taxRegion{}, false
+}
+
+// Names returns the names of the regions.
+func (t *taxTable) Names() []string {
+	if t == nil {
+		return nil
+	}
+	names := make([]string, len(t.regions))
+	for i, r := range t.regions {
+		names[i] = r.Name
+	}
+	return names
+}
+
+// applyDefault taxes o at the default region unless it has a tax already.
+func (t *taxTable) applyDefault(o *order) {
+	if t == nil || o.hasTax() || o.TaxRegion != "" {
+		return
+	}
+	if r, ok := t.Region(t.defaultRegion); ok {
+		o.TaxRegion = r.Name
+		o.TaxRate = r.Rate
+	}
+}
+
+// orderCharges are the charges entered in the charges dialog.
+type orderCharges struct {
+	Shipping  amount
+	TaxRegion string
+	TaxRate   amount
+	TaxAmount *amount
+	Discounts []discount
+}
+
+// apply sets the charges of o to c.
+func (c orderCharges) apply(o *order) {
+	o.Shipping = c.Shipping
+	o.TaxRegion = c.TaxRegion
+	o.TaxRate = c.TaxRate
+	o.TaxAmount = c.TaxAmount
+	o.Discounts = c.Discounts
+}
+
+// SetCharges replaces the shipping, tax and discounts of the order with id
+// on behalf of a purchaser or approver. Policies are checked again, and the
+// order goes back to approval like an edit if its total rises.
+func (s *orderService) SetCharges(id int64, user string, c orderCharges) (order, error) {
+	now := time.Now()
+	before, ok := s.store.Order(id)
+	if !ok {
+		return order{}, trErrorf("order.error.not_found", id)
+	}
+	changed := before.clone()
+	c.apply(&changed)
+
+	// Evaluated outside the store lock like approvals, see checkPolicies
+	var results []policyResult
+	if s.policies != nil {
+		results = s.policies.Evaluate(changed, now)
+		if r, blocked := blocking(results); blocked {
+			return before, trErrorf("policy.rule", r.Rule, r.reason())
+		}
+	}
+	rises, raised := s.raisesTotal(before, changed)
+
+	var (
+		reapproved bool
+		from       orderStatus
+	)
+	o, err := s.store.UpdateOrderVersion(id, before.Version, func(o *order) error {
+		if !s.isPurchaser(user) {
+			return trErrorf("order.error.charges_role", o.Ref())
+		}
+		if !chargeStatuses[o.Status] {
+			return trErrorf("order.error.charges_state", o.Ref(), statusName(o.Status))
+		}
+		from = o.Status
+		c.apply(o)
+		if o.Total() < 0 {
+			return trErrorf("order.error.discounts")
+		}
+		o.record(orderEvent{At: now, User: user, Kind: eventCharges, Text: o.chargesText()})
+		o.recordPolicies(results)
+
+		// Drafts are approved with their charges once submitted. An approved
+		// order also goes back if a rule triggered by the new total needs
+		// its approver.
+		switch {
+		case from == statusDraft:
+		case raised, from == statusApproved && (rises || len(o.openStages()) > 0):
+			reapproved = true
+			reopenApproval(o, user, "charges raised after approval", now)
+		}
+		return nil
+	})
+	if err != nil {
+		return o, err
+	}
+	log.Printf("[INFO] Charges of %s changed by %s", o.Ref(), user)
+
+	if published, err := s.threads.Publish(o); err != nil {
+		log.Printf("[ERROR] %s", err)
+	} else {
+		o = published
+	}
+	text := fmt.Sprintf(":receipt: <@%s> updated the charges, %s in total", user, o.money(o.Total()))
+	if charges := o.chargesText(); charges != "" {
+		text += ": " + charges
+	}
+	if reapproved {
+		text += "\n" + s.reapprovalText(o)
+	}
+	if err := s.threads.Reply(o, text); err != nil {
+		log.Printf("[ERROR] %s", err)
+	}
+	if reapproved {
+		s.announceReapproval(o, from, user, "charges raised after approval", now)
+	}
+	return o, nil
+}
+
+// parseDiscounts reads one discount per line, the amount last:
+//
+//	Coupon SPRING24 10.00
+//	15
+func parseDiscounts(text, loc string) ([]discount, error) {
+	var discounts []discount
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		a, err := parseAmount(fields[len(fields)-1])
+		if err != nil || a <= 0 {
+			return nil, errors.New(tr(loc, "charges.error.discount", strings.TrimSpace(line)))
+		}
+		label := strings.Join(fields[:len(fields)-1], " ")
+		if label == "" {
+			label = "Discount"
+		}
+		discounts = append(discounts, discount{Label: label, Amount: a})
+	}
+	return discounts, nil
+}
+
+// chargesDialog edits the charges of o, filled with the current ones.
+func chargesDialog(o order, regions []string, token, loc string) slack.Dialog {
+	optional := func(a amount) string {
+		if a == 0 {
+			return ""
+		}
+		return a.String()
+	}
+	// The rate of a region is not repeated so that picking another region works
+	taxRate := ""
+	if o.TaxRegion == "" {
+		taxRate = optional(o.TaxRate)
+	}
+	taxAmount := ""
+	if o.TaxAmount != nil {
+		taxAmount = o.TaxAmount.String()
+	}
+	discounts := make([]string, len(o.Discounts))
+	for i, d := range o.Discounts {
+		discounts[i] = d.Label + " " + d.Amount.String()
+	}
+
+	elements := []slack.DialogElement{
+		slack.DialogTextElement{
+			Label:       tr(loc, "charges.shipping"),
+			Name:        "shipping",
+			Type:        "text",
+			Placeholder: tr(loc, "charges.shipping.example"),
+			Value:       optional(o.Shipping),
+			Optional:    true,
+		},
+	}
+	if len(regions) > 0 {
+		options := make([]slack.DialogElementOption, len(regions))
+		for i, r := range regions {
+			options[i] = slack.DialogElementOption{Label: r, Value: r}
+		}
+		elements = append(elements, slack.DialogSelectElement{
+			Label:    tr(loc, "charges.tax_region"),
+			Name:     "tax_region",
+			Type:     "select",
+			Value:    o.TaxRegion,
+			Options:  options,
+			Optional: true,
+		})
+	}
+	elements = append(elements,
+		slack.DialogTextElement{
+			Label:       tr(loc, "charges.tax_rate"),
+			Name:        "tax_rate",
+			Type:        "text",
+			Placeholder: tr(loc, "charges.tax_rate.example"),
+			Hint:        tr(loc, "charges.tax_rate.hint"),
+			Value:       taxRate,
+			Optional:    true,
+		},
+		slack.DialogTextElement{
+			Label:       tr(loc, "charges.tax_amount"),
+			Name:        "tax_amount",
+			Type:        "text",
+			Placeholder: tr(loc, "charges.tax_amount.example"),
+			Hint:        tr(loc, "charges.tax_amount.hint"),
+			Value:       taxAmount,
+			Optional:    true,
+		},
+		slack.DialogTextElement{
+			Label:       tr(loc, "charges.discounts"),
+			Name:        "discounts",
+			Type:        "textarea",
+			Placeholder: tr(loc, "charges.discounts.example"),
+			Hint:        tr(loc, "charges.discounts.hint"),
+			Value:       strings.Join(discounts, "\n"),
+			Optional:    true,
+		},
+	)
+	return slack.Dialog{
+		CallbackId:  chargesDialogPrefix + token,
+		Title:       tr(loc, "charges.title", o.Ref()),
+		SubmitLabel: tr(loc, "dialog.save"),
+		Elements:    elements,
+	}
+}
+
+// parseChargesDialog reads the charges dialog, taking the rate of the
+// selected region when no rate is typed. Errors are in loc.
+func parseChargesDialog(submission map[string]string, taxes *taxTable, loc string) (orderCharges, []dialogError) {
+	var (
+		c    orderCharges
+		errs []dialogError
+		err  error
+	)
+	optional := func(name string) (amount, bool) {
+		v := strings.TrimSpace(submission[name])
+		if v == "" {
+			return 0, false
+		}
+		a, err := parseAmount(v)
+		if err != nil || a < 0 {
+			errs = append(errs, dialogError{Name: name, Error: tr(loc, "charges.error.amount")})
+			return 0, false
+		}
+		return a, true
+	}
+
+	c.Shipping, _ = optional("shipping")
+	if name := submission["tax_region"]; name != "" {
+		r, ok := taxes.Region(name)
+		if !ok {
+			errs = append(errs, dialogError{Name: "tax_region", Error: tr(loc, "charges.error.region", name)})
+		}
+		c.TaxRegion, c.TaxRate = r.Name, r.Rate
+	}
+	if rate, ok := optional("tax_rate"); ok {
+		if rate > 10000 {
+			errs = append(errs, dialogError{Name: "tax_rate", Error: tr(loc, "charges.error.rate")})
+		}
+		c.TaxRate = rate
+	}
+	if tax, ok := optional("tax_amount"); ok {
+		c.TaxAmount = &tax
+	}
+	if c.Discounts, err = parseDiscounts(submission["discounts"], loc); err != nil {
+		errs = append(errs, dialogError{Name: "discounts", Error: err.Error()})
+	}
+	return c, errs
+}
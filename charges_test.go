@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetCharges(t *testing.T) {
+	fake := newFakeSlack(t)
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := &orderService{
+		store:          store,
+		threads:        &orderThreads{workspaces: newWorkspaceRegistry(store, "xoxb-test", "C1"), store: store},
+		approvers:      []string{"UBOSS"},
+		purchasers:     []string{"UBUY"},
+		reapproveAbove: 20000,
+		callbacks:      newCallbackSigner([]byte("0123456789abcdef")),
+	}
+	orders.policies = newPolicyEngine(store, nil, []policyConfig{
+		{Name: "cap", MonthlyCap: "1000", Action: "block", Message: "too much"},
+		{Name: "it", MonthlyCap: "300", Action: "approval", Approvers: []string{"UIT"}},
+	})
+	var changes []orderChange
+	orders.OnChange(func(c orderChange) { changes = append(changes, c) })
+
+	o, err := orders.CreateDraft(order{Requester: "U1", ItemName: "Desk", Count: 2, UnitPrice: 5000, ChannelID: "C1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = orders.Transition(o.ID, statusPending, "U1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = orders.Transition(o.ID, statusApproved, "UBOSS", ""); err != nil {
+		t.Fatal(err)
+	}
+	changes = nil
+
+	// lastReply returns the last reply in the thread of the order.
+	lastReply := func() string {
+		messages := fake.messages("C1")
+		for i := len(messages) - 1; i >= 0; i-- {
+			if text := messages[i].Get("text"); text != "" {
+				return text
+			}
+		}
+		return ""
+	}
+	tests := []struct {
+		name    string
+		user    string
+		charges orderCharges
+		err     string
+		status  orderStatus
+		total   amount
+		reply   string
+	}{
+		{"requester", "U1", orderCharges{Shipping: 1000}, "only purchasers and approvers can change the charges", statusApproved, 10000, ""},
+		{"lower", "UBUY", orderCharges{Discounts: []discount{{Label: "Coupon", Amount: 500}}}, "", statusApproved, 9500, "95.00 in total: Coupon -5.00"},
+		{"raised after approval", "UBUY", orderCharges{Shipping: 1000}, "", statusPending, 11000, "110.00 in total: shipping 10.00\nIt needs approval again from <@UBOSS>"},
+		{"raised below the limit", "UBOSS", orderCharges{Shipping: 5000}, "", statusPending, 15000, "150.00 in total: shipping 50.00"},
+		{"over the cap", "UBOSS", orderCharges{Shipping: 100000}, "cap: too much", statusPending, 15000, ""},
+		{"raised above the limit", "UBUY", orderCharges{Shipping: 25000}, "", statusPending, 35000, "350.00 in total: shipping 250.00\nIt needs approval again from <@UIT>"},
+	}
+	for _, tt := range tests {
+		fake.reset()
+		_, err := orders.SetCharges(o.ID, tt.user, tt.charges)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: SetCharges = %v, want %q", tt.name, err, tt.err)
+		}
+		got, _ := store.Order(o.ID)
+		if got.Status != tt.status || got.Total() != tt.total {
+			t.Errorf("%s: order is %s with %s in total, want %s with %s", tt.name, got.Status, got.Total(), tt.status, tt.total)
+		}
+		if reply := lastReply(); tt.reply == "" && reply != "" || !strings.HasSuffix(reply, tt.reply) {
+			t.Errorf("%s: replied %q, want %q", tt.name, reply, tt.reply)
+		}
+	}
+
+	o, _ = store.Order(o.ID)
+	if o.ApprovedBy != "" || o.Rate != nil {
+		t.Errorf("approval kept: %q, %+v", o.ApprovedBy, o.Rate)
+	}
+	if open := o.openStages(); len(open) != 1 || open[0].Rule != "it" {
+		t.Errorf("open stages = %+v", open)
+	}
+	// Only going back from approved to pending is a status change
+	if len(changes) != 1 || changes[0].From != statusApproved || changes[0].To != statusPending || changes[0].Note != "charges raised after approval" {
+		t.Errorf("changes = %+v", changes)
+	}
+}
@@ -0,0 +1,779 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultConfigPath = "orderbot.config.json"
+	defaultListenAddr = ":3000"
+	defaultStorageDSN = "file:orderbot.json"
+
+	transportRTM = "rtm"
+)
+
+// config is the whole bot configuration. Values are read from the config
+// file first, then overridden by environment variables and finally flags.
+type config struct {
+	Transport  string           `json:"transport"`
+	ListenAddr string           `json:"listen_addr"`
+	StorageDSN string           `json:"storage_dsn"`
+	Slack      slackConfig      `json:"slack"`
+	Channels   channelsConfig   `json:"channels"`
+	Approval   approvalConfig   `json:"approval"`
+	Currencies currenciesConfig `json:"currencies"`
+	Taxes      taxesConfig      `json:"taxes"`
+	Schedules  schedulesConfig  `json:"schedules"`
+	Budgets    []budgetConfig   `json:"budgets"`
+	Email      emailConfig      `json:"email"`
+	// PurchaseOrders issues a PO when an order is approved if Company is set.
+	PurchaseOrders purchaseOrderConfig `json:"purchase_orders"`
+	Receipts       receiptsConfig      `json:"receipts"`
+	Tracking       trackingConfig      `json:"tracking"`
+	Assets         assetsConfig        `json:"assets"`
+	Policies       []policyConfig      `json:"policies"`
+	// Interactions tunes the queue running clicks and dialogs.
+	Interactions interactionsConfig `json:"interactions"`
+	// Admins are slack user IDs allowed to run admin commands.
+	Admins []string `json:"admins"`
+	// Locale is the language for users whose slack locale is not supported.
+	Locale string `json:"locale"`
+
+	// envErrors are the environment variables which could not be parsed,
+	// reported by validate with the other problems.
+	envErrors []string
+}
+
+type slackConfig struct {
+	BotToken          string `json:"bot_token"`
+	VerificationToken string `json:"verification_token"`
+	ClientID          string `json:"client_id"`
+	ClientSecret      string `json:"client_secret"`
+	RedirectURL       string `json:"redirect_url"`
+	// CallbackSecret signs the values of buttons. One is generated and kept
+	// in the storage if empty.
+	CallbackSecret string `json:"callback_secret"`
+}
+
+type interactionsConfig struct {
+	// Workers is the number of interactions processed at once.
+	Workers int `json:"workers"`
+	// QueueSize is the number of interactions waiting at most. Clicks are
+	// refused with a "try again" message once it is full.
+	QueueSize int `json:"queue_size"`
+}
+
+type channelsConfig struct {
+	// Orders is the channel where people mention the bot to order.
+	Orders string `json:"orders"`
+	// Approvals is where approval requests are posted. Defaults to Orders.
+	Approvals string `json:"approvals"`
+}
+
+type approvalConfig struct {
+	// Approvers are slack user IDs allowed to approve orders.
+	Approvers []string `json:"approvers"`
+	// Purchasers are slack user IDs who buy approved orders, change their
+	// charges and mark them purchased. Approvers can too.
+	Purchasers []string `json:"purchasers"`
+	// AutoApproveBelow is the total, in the base currency, under which
+	// orders are approved without asking. Empty disables auto approval.
+	AutoApproveBelow string `json:"auto_approve_below"`
+	// ReapproveAbove is the total, in the base currency, above which an
+	// edit raising the total of a pending order needs approval again.
+	// Edits of approved orders always do. Empty disables it.
+	ReapproveAbove string `json:"reapprove_above"`
+	// RequireReason rejects orders submitted without a reason.
+	RequireReason bool `json:"require_reason"`
+}
+
+type currenciesConfig struct {
+	// Base is the currency of budgets, policy caps and reports.
+	Base string `json:"base"`
+	// Allowed are the other currencies orders can be made in.
+	Allowed []string `json:"allowed"`
+	// Provider is where exchange rates come from: "static" reads RatesFile,
+	// "http" fetches RatesURL and "fake" uses fixed rates.
+	Provider  string `json:"provider"`
+	RatesFile string `json:"rates_file"`
+	RatesURL  string `json:"rates_url"`
+}
+
+// taxesConfig are the tax rates orders default to.
+type taxesConfig struct {
+	// DefaultRegion is the region new orders are taxed at, none if empty.
+	DefaultRegion string            `json:"default_region"`
+	Regions       []taxRegionConfig `json:"regions"`
+}
+
+type taxRegionConfig struct {
+	Name string `json:"name"`
+	// Rate is a percentage with up to two decimals such as "10" or "8.25".
+	Rate string `json:"rate"`
+}
+
+type schedulesConfig struct {
+	// Reminder is how often approvers are reminded of pending orders.
+	Reminder string `json:"reminder"`
+	// Digest is the weekly digest time, e.g. "Mon 09:00".
+	Digest string `json:"digest"`
+}
+
+// budgetConfig is the monthly budget of a team, in the base currency.
+type budgetConfig struct {
+	Team    string   `json:"team"`
+	Members []string `json:"members"`
+	Monthly string   `json:"monthly"`
+}
+
+// emailConfig enables email notifications when SMTP.Addr is set.
+type emailConfig struct {
+	SMTP smtpConfig `json:"smtp"`
+	// PublicURL is the base URL of this server, used in approval links.
+	PublicURL string `json:"public_url"`
+	// LinkSecret signs the one-time approval links.
+	LinkSecret string `json:"link_secret"`
+	// Recipients are notified besides the users who set their own
+	// preference with "@orderbot email".
+	Recipients []emailRecipient `json:"recipients"`
+}
+
+type smtpConfig struct {
+	// Addr is "host:port" of the SMTP server.
+	Addr     string `json:"addr"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+	StartTLS bool   `json:"starttls"`
+}
+
+type purchaseOrderConfig struct {
+	Company string   `json:"company"`
+	Address []string `json:"address"`
+	// Vendor is used when it cannot be told from the item URL.
+	Vendor string `json:"vendor"`
+	// TaxRate is a percentage such as "10" or "8.25".
+	TaxRate string `json:"tax_rate"`
+	// NumberFormat formats the PO sequence number, e.g. "PO-%05d".
+	NumberFormat string `json:"number_format"`
+	// Template is the path of a text/template replacing the default layout.
+	Template string `json:"template"`
+}
+
+type receiptsConfig struct {
+	// Storage keeps copies of receipts: "file:<dir>" or
+	// "s3://<bucket>/<prefix>". Empty keeps them in slack only.
+	Storage string   `json:"storage"`
+	S3      s3Config `json:"s3"`
+}
+
+type trackingConfig struct {
+	// PollInterval is how often carriers are asked about shipments.
+	PollInterval string `json:"poll_interval"`
+	// Fake adds the "fake" carrier which tells the status by the tracking
+	// number prefix, for trying the bot out.
+	Fake     bool            `json:"fake"`
+	Carriers []carrierConfig `json:"carriers"`
+}
+
+// carrierConfig is a tracking service answering
+// GET <url>?number=<number> with {"status": "..."}.
+type carrierConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type assetsConfig struct {
+	// Categories of delivered orders registered as assets.
+	Categories []assetCategoryConfig `json:"categories"`
+}
+
+// assetCategoryConfig matches the category of catalog items, or orders
+// outside the catalog whose item name contains one of Keywords.
+type assetCategoryConfig struct {
+	Name           string   `json:"name"`
+	Keywords       []string `json:"keywords"`
+	WarrantyMonths int      `json:"warranty_months"`
+}
+
+// policyConfig is a policy rule. It applies to orders of Categories
+// (catalog categories) or whose item name contains one of Keywords, or to
+// every order if both are empty. It is triggered when one of its checks
+// fails, or always if it has none, e.g. to require IT approval.
+type policyConfig struct {
+	Name       string   `json:"name"`
+	Categories []string `json:"categories"`
+	Keywords   []string `json:"keywords"`
+
+	MaxQuantity     int      `json:"max_quantity"`
+	BannedDomains   []string `json:"banned_domains"`
+	MinReasonLength int      `json:"min_reason_length"`
+	// MonthlyCap is the most a user may order per month, in the base currency.
+	MonthlyCap string `json:"monthly_cap"`
+
+	// Action is "block", "warn" or "approval".
+	Action string `json:"action"`
+	// Approvers approve orders triggering an "approval" rule.
+	Approvers []string `json:"approvers"`
+	// Message replaces the description of the failed check.
+	Message string `json:"message"`
+}
+
+// s3Config is an S3 compatible service such as AWS S3 or MinIO.
+type s3Config struct {
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// defaultConfig returns the configuration used when nothing is set.
+func defaultConfig() config {
+	return config{
+		Transport:  transportRTM,
+		ListenAddr: defaultListenAddr,
+		StorageDSN: defaultStorageDSN,
+		Currencies: currenciesConfig{Base: "USD", Provider: "static"},
+		Locale:     localeEN,
+		Schedules: schedulesConfig{
+			Reminder: "24h",
+			Digest:   "Mon 09:00",
+		},
+		PurchaseOrders: purchaseOrderConfig{NumberFormat: "PO-%05d"},
+		Tracking:       trackingConfig{PollInterval: "30m"},
+		Interactions:   interactionsConfig{Workers: defaultJobWorkers, QueueSize: defaultJobQueueSize},
+	}
+}
+
+// loadConfigFile overrides cfg with the values in path.
+// A missing file is ignored unless required is true.
+func loadConfigFile(cfg *config, path string, required bool) error {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(buf)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("failed to decode config %s: %s", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides cfg with environment variables.
+// The names used before the config file existed are kept.
+func applyEnv(cfg *config, getenv func(string) string) {
+	strs := []struct {
+		name string
+		dst  *string
+	}{
+		{"TRANSPORT", &cfg.Transport},
+		{"LISTEN_ADDR", &cfg.ListenAddr},
+		{"STORAGE_DSN", &cfg.StorageDSN},
+		{"BOT_TOKEN", &cfg.Slack.BotToken},
+		{"VERIFICATION_TOKEN", &cfg.Slack.VerificationToken},
+		{"SLACK_CLIENT_ID", &cfg.Slack.ClientID},
+		{"SLACK_CLIENT_SECRET", &cfg.Slack.ClientSecret},
+		{"SLACK_REDIRECT_URL", &cfg.Slack.RedirectURL},
+		{"CALLBACK_SECRET", &cfg.Slack.CallbackSecret},
+		{"CHANNEL_ID", &cfg.Channels.Orders},
+		{"APPROVAL_CHANNEL_ID", &cfg.Channels.Approvals},
+		{"AUTO_APPROVE_BELOW", &cfg.Approval.AutoApproveBelow},
+		{"REAPPROVE_ABOVE", &cfg.Approval.ReapproveAbove},
+		{"BASE_CURRENCY", &cfg.Currencies.Base},
+		{"RATES_PROVIDER", &cfg.Currencies.Provider},
+		{"RATES_FILE", &cfg.Currencies.RatesFile},
+		{"RATES_URL", &cfg.Currencies.RatesURL},
+		{"TAX_REGION", &cfg.Taxes.DefaultRegion},
+		{"LOCALE", &cfg.Locale},
+		{"REMINDER_INTERVAL", &cfg.Schedules.Reminder},
+		{"DIGEST_AT", &cfg.Schedules.Digest},
+		{"SMTP_ADDR", &cfg.Email.SMTP.Addr},
+		{"SMTP_USERNAME", &cfg.Email.SMTP.Username},
+		{"SMTP_PASSWORD", &cfg.Email.SMTP.Password},
+		{"SMTP_FROM", &cfg.Email.SMTP.From},
+		{"PUBLIC_URL", &cfg.Email.PublicURL},
+		{"EMAIL_LINK_SECRET", &cfg.Email.LinkSecret},
+		{"RECEIPT_STORAGE", &cfg.Receipts.Storage},
+		{"S3_ENDPOINT", &cfg.Receipts.S3.Endpoint},
+		{"S3_REGION", &cfg.Receipts.S3.Region},
+		{"S3_ACCESS_KEY_ID", &cfg.Receipts.S3.AccessKeyID},
+		{"S3_SECRET_ACCESS_KEY", &cfg.Receipts.S3.SecretAccessKey},
+		{"TRACKING_POLL_INTERVAL", &cfg.Tracking.PollInterval},
+	}
+	for _, s := range strs {
+		if v := getenv(s.name); v != "" {
+			*s.dst = v
+		}
+	}
+
+	if v := getenv("ADMINS"); v != "" {
+		cfg.Admins = splitList(v)
+	}
+	if v := getenv("APPROVERS"); v != "" {
+		cfg.Approval.Approvers = splitList(v)
+	}
+	if v := getenv("PURCHASERS"); v != "" {
+		cfg.Approval.Purchasers = splitList(v)
+	}
+	if v := getenv("CURRENCIES"); v != "" {
+		cfg.Currencies.Allowed = splitList(v)
+	}
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"INTERACTION_WORKERS", &cfg.Interactions.Workers},
+		{"INTERACTION_QUEUE_SIZE", &cfg.Interactions.QueueSize},
+	}
+	for _, i := range ints {
+		v := getenv(i.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			cfg.envErrors = append(cfg.envErrors, fmt.Sprintf("%s: invalid number %q", i.name, v))
+			continue
+		}
+		*i.dst = n
+	}
+	bools := []struct {
+		name string
+		dst  *bool
+	}{
+		{"REQUIRE_REASON", &cfg.Approval.RequireReason},
+		{"SMTP_STARTTLS", &cfg.Email.SMTP.StartTLS},
+	}
+	for _, b := range bools {
+		v := getenv(b.name)
+		if v == "" {
+			continue
+		}
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			cfg.envErrors = append(cfg.envErrors, fmt.Sprintf("%s: invalid boolean %q", b.name, v))
+			continue
+		}
+		*b.dst = on
+	}
+}
+
+// splitList splits a comma separated list and drops empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// configFlags registers flags which override cfg once parsed.
+func configFlags(fs *flag.FlagSet, cfg *config) {
+	fs.StringVar(&cfg.Transport, "transport", cfg.Transport, "slack transport (rtm)")
+	fs.StringVar(&cfg.ListenAddr, "listen", cfg.ListenAddr, "HTTP listen address")
+	fs.StringVar(&cfg.StorageDSN, "storage", cfg.StorageDSN, "storage DSN (file:<path> or memory:)")
+}
+
+// configErrors holds every problem found in a config.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+var (
+	slackIDPattern  = regexp.MustCompile(`^[A-Z0-9]+$`)
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+	amountPattern   = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	weekdays        = map[string]time.Weekday{
+		"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+		"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+		"sat": time.Saturday,
+	}
+)
+
+// validate reports all problems of cfg at once.
+func (cfg config) validate() error {
+	errs := append(configErrors(nil), cfg.envErrors...)
+	addf := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+
+	if cfg.Transport != transportRTM {
+		addf("transport: unsupported transport %q (supported: %s)", cfg.Transport, transportRTM)
+	}
+
+	if _, port, err := net.SplitHostPort(cfg.ListenAddr); err != nil {
+		addf("listen_addr: %s", err)
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		addf("listen_addr: invalid port %q", port)
+	}
+
+	if _, _, err := parseStorageDSN(cfg.StorageDSN); err != nil {
+		addf("storage_dsn: %s", err)
+	}
+
+	if cfg.Slack.BotToken == "" && cfg.Slack.ClientID == "" {
+		addf("slack: either bot_token or client_id is required")
+	}
+	if cfg.Slack.BotToken != "" && !strings.HasPrefix(cfg.Slack.BotToken, "xox") {
+		addf("slack.bot_token: does not look like a slack token")
+	}
+	if cfg.Slack.VerificationToken == "" {
+		addf("slack.verification_token: required")
+	}
+	if cfg.Slack.ClientID != "" && cfg.Slack.ClientSecret == "" {
+		addf("slack.client_secret: required when client_id is set")
+	}
+	if v := cfg.Slack.CallbackSecret; v != "" && len(v) < 16 {
+		addf("slack.callback_secret: at least 16 characters are required")
+	}
+
+	if cfg.Interactions.Workers < 1 {
+		addf("interactions.workers: must be at least 1")
+	}
+	if cfg.Interactions.QueueSize < 1 {
+		addf("interactions.queue_size: must be at least 1")
+	}
+
+	if cfg.Slack.BotToken != "" && cfg.Channels.Orders == "" {
+		addf("channels.orders: required")
+	}
+	if id := cfg.Channels.Orders; id != "" && !slackIDPattern.MatchString(id) {
+		addf("channels.orders: invalid channel ID %q", id)
+	}
+	if id := cfg.Channels.Approvals; id != "" && !slackIDPattern.MatchString(id) {
+		addf("channels.approvals: invalid channel ID %q", id)
+	}
+
+	for _, id := range cfg.Admins {
+		if !slackIDPattern.MatchString(id) {
+			addf("admins: invalid user ID %q", id)
+		}
+	}
+	for _, id := range cfg.Approval.Approvers {
+		if !slackIDPattern.MatchString(id) {
+			addf("approval.approvers: invalid user ID %q", id)
+		}
+	}
+	for _, id := range cfg.Approval.Purchasers {
+		if !slackIDPattern.MatchString(id) {
+			addf("approval.purchasers: invalid user ID %q", id)
+		}
+	}
+	if v := cfg.Approval.AutoApproveBelow; v != "" && !amountPattern.MatchString(v) {
+		addf("approval.auto_approve_below: invalid amount %q", v)
+	}
+	if v := cfg.Approval.ReapproveAbove; v != "" && !amountPattern.MatchString(v) {
+		addf("approval.reapprove_above: invalid amount %q", v)
+	}
+
+	if _, ok := locales[cfg.Locale]; !ok {
+		addf("locale: must be %s or %s, not %q", localeEN, localeJA, cfg.Locale)
+	}
+
+	if !currencyPattern.MatchString(cfg.Currencies.Base) {
+		addf("currencies.base: invalid currency code %q", cfg.Currencies.Base)
+	}
+	for _, c := range cfg.Currencies.Allowed {
+		if !currencyPattern.MatchString(c) {
+			addf("currencies.allowed: invalid currency code %q", c)
+		}
+	}
+	switch cfg.Currencies.Provider {
+	case "static", "fake":
+	case "http":
+		if u, err := url.Parse(cfg.Currencies.RatesURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			addf("currencies.rates_url: invalid URL %q", cfg.Currencies.RatesURL)
+		}
+	default:
+		addf("currencies.provider: must be static, http or fake, not %q", cfg.Currencies.Provider)
+	}
+
+	regions := map[string]bool{}
+	for i, r := range cfg.Taxes.Regions {
+		if r.Name == "" {
+			addf("taxes.regions[%d].name: required", i)
+		} else if regions[strings.ToLower(r.Name)] {
+			addf("taxes.regions[%d].name: duplicate region %q", i, r.Name)
+		}
+		regions[strings.ToLower(r.Name)] = true
+		if rate, err := parseAmount(r.Rate); !amountPattern.MatchString(r.Rate) || err != nil || rate > 10000 {
+			addf("taxes.regions[%d].rate: invalid percentage %q", i, r.Rate)
+		}
+	}
+	if v := cfg.Taxes.DefaultRegion; v != "" && !regions[strings.ToLower(v)] {
+		addf("taxes.default_region: unknown region %q", v)
+	}
+
+	if d, err := time.ParseDuration(cfg.Schedules.Reminder); err != nil {
+		addf("schedules.reminder: %s", err)
+	} else if d < time.Minute {
+		addf("schedules.reminder: must be at least 1m")
+	}
+	if _, _, err := parseWeeklyTime(cfg.Schedules.Digest); err != nil {
+		addf("schedules.digest: %s", err)
+	}
+
+	teams := map[string]bool{}
+	members := map[string]string{}
+	for i, b := range cfg.Budgets {
+		if b.Team == "" {
+			addf("budgets[%d].team: required", i)
+		} else if teams[b.Team] {
+			addf("budgets[%d].team: duplicate team %q", i, b.Team)
+		}
+		teams[b.Team] = true
+		if a, err := parseAmount(b.Monthly); err != nil || a <= 0 {
+			addf("budgets[%d].monthly: invalid amount %q", i, b.Monthly)
+		}
+		for _, id := range b.Members {
+			if !slackIDPattern.MatchString(id) {
+				addf("budgets[%d].members: invalid user ID %q", i, id)
+			} else if other, ok := members[id]; ok {
+				addf("budgets[%d].members: %s is already a member of %q", i, id, other)
+			}
+			members[id] = b.Team
+		}
+	}
+
+	if e := cfg.Email; e.SMTP.Addr != "" {
+		if _, _, err := net.SplitHostPort(e.SMTP.Addr); err != nil {
+			addf("email.smtp.addr: %s", err)
+		}
+		if _, err := mail.ParseAddress(e.SMTP.From); err != nil {
+			addf("email.smtp.from: invalid address %q", e.SMTP.From)
+		}
+		if e.PublicURL != "" {
+			if u, err := url.Parse(e.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				addf("email.public_url: %q is not an http(s) URL", e.PublicURL)
+			}
+			if len(e.LinkSecret) < 16 {
+				addf("email.link_secret: at least 16 characters are required with public_url")
+			}
+		}
+		for i, r := range e.Recipients {
+			if _, err := mail.ParseAddress(r.Address); err != nil {
+				addf("email.recipients[%d].address: invalid address %q", i, r.Address)
+			}
+			if r.User != "" && !slackIDPattern.MatchString(r.User) {
+				addf("email.recipients[%d].user: invalid user ID %q", i, r.User)
+			}
+			if r.TeamID != "" && !slackIDPattern.MatchString(r.TeamID) {
+				addf("email.recipients[%d].team_id: invalid team ID %q", i, r.TeamID)
+			}
+			for _, ev := range r.Events {
+				if !emailEventNames[ev] {
+					addf("email.recipients[%d].events: unknown event %q", i, ev)
+				}
+			}
+		}
+	}
+
+	if po := cfg.PurchaseOrders; po.Company != "" {
+		if v := po.TaxRate; v != "" && !amountPattern.MatchString(v) {
+			addf("purchase_orders.tax_rate: invalid percentage %q", v)
+		}
+		if n := fmt.Sprintf(po.NumberFormat, 1); strings.Contains(n, "%!") || n == po.NumberFormat {
+			addf("purchase_orders.number_format: %q must format one integer", po.NumberFormat)
+		}
+		if _, err := parsePurchaseOrderTemplate(po.Template); err != nil {
+			addf("purchase_orders.template: %s", err)
+		}
+	}
+
+	if _, err := openFileStorage(cfg.Receipts.Storage, cfg.Receipts.S3); err != nil {
+		addf("receipts.storage: %s", err)
+	}
+
+	if d, err := time.ParseDuration(cfg.Tracking.PollInterval); err != nil {
+		addf("tracking.poll_interval: %s", err)
+	} else if d < time.Minute {
+		addf("tracking.poll_interval: must be at least 1m")
+	}
+	carriers := map[string]bool{"fake": cfg.Tracking.Fake}
+	for i, c := range cfg.Tracking.Carriers {
+		if c.Name == "" {
+			addf("tracking.carriers[%d].name: required", i)
+		} else if carriers[c.Name] {
+			addf("tracking.carriers[%d].name: duplicate carrier %q", i, c.Name)
+		}
+		carriers[c.Name] = true
+		if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			addf("tracking.carriers[%d].url: %q is not an http(s) URL", i, c.URL)
+		}
+	}
+
+	categories := map[string]bool{}
+	for i, c := range cfg.Assets.Categories {
+		name := strings.ToLower(c.Name)
+		if name == "" {
+			addf("assets.categories[%d].name: required", i)
+		} else if categories[name] {
+			addf("assets.categories[%d].name: duplicate category %q", i, c.Name)
+		}
+		categories[name] = true
+		for _, k := range c.Keywords {
+			if strings.TrimSpace(k) == "" {
+				addf("assets.categories[%d].keywords: empty keyword", i)
+			}
+		}
+		if c.WarrantyMonths < 0 {
+			addf("assets.categories[%d].warranty_months: must not be negative", i)
+		}
+	}
+
+	policies := map[string]bool{}
+	for i, p := range cfg.Policies {
+		if p.Name == "" {
+			addf("policies[%d].name: required", i)
+		} else if policies[p.Name] {
+			addf("policies[%d].name: duplicate policy %q", i, p.Name)
+		}
+		policies[p.Name] = true
+		if !policyActions[policyAction(p.Action)] {
+			addf("policies[%d].action: unsupported action %q (supported: block, warn, approval)", i, p.Action)
+		}
+		if p.Action == string(policyApproval) && len(p.Approvers) == 0 {
+			addf("policies[%d].approvers: required for the approval action", i)
+		}
+		for _, id := range p.Approvers {
+			if !slackIDPattern.MatchString(id) {
+				addf("policies[%d].approvers: invalid user ID %q", i, id)
+			}
+		}
+		if p.MaxQuantity < 0 {
+			addf("policies[%d].max_quantity: must not be negative", i)
+		}
+		if p.MinReasonLength < 0 {
+			addf("policies[%d].min_reason_length: must not be negative", i)
+		}
+		if v := p.MonthlyCap; v != "" && !amountPattern.MatchString(v) {
+			addf("policies[%d].monthly_cap: invalid amount %q", i, v)
+		}
+		for _, d := range p.BannedDomains {
+			if d == "" || strings.ContainsAny(d, "/: ") {
+				addf("policies[%d].banned_domains: invalid domain %q", i, d)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// approvalChannel returns the channel approval requests are posted to.
+func (cfg config) approvalChannel() string {
+	if cfg.Channels.Approvals != "" {
+		return cfg.Channels.Approvals
+	}
+	return cfg.Channels.Orders
+}
+
+// parseStorageDSN splits dsn into its scheme and path.
+func parseStorageDSN(dsn string) (scheme, path string, err error) {
+	i := strings.Index(dsn, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("missing scheme in %q", dsn)
+	}
+	scheme, path = dsn[:i], dsn[i+1:]
+	switch scheme {
+	case "memory":
+		return scheme, "", nil
+	case "file":
+		if path == "" {
+			return "", "", fmt.Errorf("missing path in %q", dsn)
+		}
+		return scheme, path, nil
+	}
+	return "", "", fmt.Errorf("unsupported scheme %q (supported: file, memory)", scheme)
+}
+
+// parseWeeklyTime parses "<weekday> HH:MM".
+func parseWeeklyTime(s string) (time.Weekday, time.Duration, error) {
+	f := strings.Fields(s)
+	if len(f) != 2 {
+		return 0, 0, fmt.Errorf("expected \"<weekday> HH:MM\", got %q", s)
+	}
+	name := strings.ToLower(f[0])
+	if len(name) > 3 {
+		name = name[:3]
+	}
+	day, ok := weekdays[name]
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid weekday %q", f[0])
+	}
+	t, err := time.Parse("15:04", f[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time %q", f[1])
+	}
+	return day, time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// loadConfig builds the config from the file, environment and args.
+// .env must be loaded already.
+func loadConfig(name string, args []string) (config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", defaultConfigPath, "path to the config file")
+	// Parse once to find the config file, then again so flags win over it.
+	first := cfg
+	configFlags(fs, &first)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	explicit := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicit = true
+		}
+	})
+	if err := loadConfigFile(&cfg, *path, explicit); err != nil {
+		return cfg, err
+	}
+	applyEnv(&cfg, os.Getenv)
+
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.String("config", *path, "path to the config file")
+	configFlags(fs, &cfg)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// configCheck implements "orderbot config check".
+func configCheck(args []string) int {
+	cfg, err := loadConfig("config check", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("config is valid")
+	return 0
+}
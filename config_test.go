@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// validConfig returns the smallest config which passes validate.
+func validConfig() config {
+	cfg := defaultConfig()
+	cfg.Slack.BotToken = "xoxb-test"
+	cfg.Slack.VerificationToken = "vt"
+	cfg.Channels.Orders = "C1"
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().validate(); err != nil {
+		t.Fatalf("valid config: %s", err)
+	}
+
+	cfg := validConfig()
+	cfg.ListenAddr = "localhost"
+	cfg.Channels.Approvals = "approvals"
+	cfg.Approval.AutoApproveBelow = "50 USD"
+	cfg.Interactions.Workers = 0
+	cfg.Schedules.Digest = "Someday 09:00"
+	cfg.envErrors = []string{`INTERACTION_QUEUE_SIZE: invalid number "many"`}
+	err := cfg.validate()
+	errs, ok := err.(configErrors)
+	if !ok {
+		t.Fatalf("validate = %v, want configErrors", err)
+	}
+	// Every problem is reported at once, environment ones first
+	want := []string{
+		"INTERACTION_QUEUE_SIZE: invalid number",
+		"listen_addr:",
+		"interactions.workers:",
+		"channels.approvals: invalid channel ID",
+		"approval.auto_approve_below: invalid amount",
+		"schedules.digest: invalid weekday",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("validate reported %d problems, want %d:\n%s", len(errs), len(want), err)
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(errs[i], w) {
+			t.Errorf("problem %d = %q, want %q...", i, errs[i], w)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orderbot.config.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"listen_addr": ":4000",
+		"slack": {"bot_token": "xoxb-file", "verification_token": "vt"},
+		"channels": {"orders": "C1"},
+		"approval": {"approvers": ["UFILE"], "require_reason": true}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BOT_TOKEN", "xoxb-env")
+	t.Setenv("APPROVERS", "UENV1, UENV2")
+	t.Setenv("REQUIRE_REASON", "false")
+	t.Setenv("LISTEN_ADDR", ":5000")
+
+	// The environment wins over the file, and flags over both
+	cfg, err := loadConfig("test", []string{"-config", path, "-listen", ":6000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Slack.BotToken != "xoxb-env" || cfg.Slack.VerificationToken != "vt" {
+		t.Errorf("slack = %+v", cfg.Slack)
+	}
+	if len(cfg.Approval.Approvers) != 2 || cfg.Approval.Approvers[1] != "UENV2" || cfg.Approval.RequireReason {
+		t.Errorf("approval = %+v", cfg.Approval)
+	}
+	if cfg.ListenAddr != ":6000" {
+		t.Errorf("listen_addr = %q", cfg.ListenAddr)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("validate: %s", err)
+	}
+
+	// Values which cannot be parsed are reported by validate, not dropped
+	t.Setenv("INTERACTION_WORKERS", "four")
+	t.Setenv("SMTP_STARTTLS", "maybe")
+	if cfg, err = loadConfig("test", []string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Interactions.Workers != defaultJobWorkers {
+		t.Errorf("workers = %d", cfg.Interactions.Workers)
+	}
+	err = cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), `INTERACTION_WORKERS: invalid number "four"`) || !strings.Contains(err.Error(), `SMTP_STARTTLS: invalid boolean "maybe"`) {
+		t.Errorf("validate = %v", err)
+	}
+
+	// A config file given explicitly must exist, the default one need not
+	if _, err := loadConfig("test", []string{"-config", path + ".missing"}); err == nil {
+		t.Error("missing explicit config file was ignored")
+	}
+	if _, err := loadConfig("test", []string{"-unknown"}); err == nil {
+		t.Error("unknown flag was ignored")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	actionJoinOrder = "order_join"
+
+	// duplicateWindow is how far back orders are compared with a new one.
+	duplicateWindow = 30 * 24 * time.Hour
+	// duplicateMaxShown is the most duplicates warned about.
+	duplicateMaxShown = 3
+	// duplicateNameSimilarity is the share of common words above which two
+	// item names are taken as the same item.
+	duplicateNameSimilarity = 0.75
+)
+
+// duplicateStatuses are the statuses of orders a new order can duplicate.
+var duplicateStatuses = map[orderStatus]bool{
+	statusPending:   true,
+	statusApproved:  true,
+	statusPurchased: true,
+	statusDelivered: true,
+	statusIssue:     true,
+}
+
+// orderJoin is someone who joined an order instead of ordering the same
+// item again.
+type orderJoin struct {
+	User  string    `json:"user"`
+	Count int       `json:"count"`
+	At    time.Time `json:"at"`
+}
+
+// normalizeItemURL strips what differs between links to the same product:
+// the scheme, "www.", the query, the fragment and trailing slashes.
+func normalizeItemURL(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	path := strings.TrimRight(u.EscapedPath(), "/")
+	if path == "" {
+		// A shop's front page says nothing about the item
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.") + path
+}
+
+// nameWords returns the lower cased words of an item name.
+func nameWords(name string) map[string]bool {
+	words := map[string]bool{}
+	for _, w := range strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		words[w] = true
+	}
+	return words
+}
+
+// similarNames reports whether a and b share most of their words, so that
+// "Dell U2720Q monitor" matches "Monitor Dell U2720Q".
+func similarNames(a, b string) bool {
+	wa, wb := nameWords(a), nameWords(b)
+	if len(wa) == 0 || len(wb) == 0 {
+		return false
+	}
+	common := 0
+	for w := range wa {
+		if wb[w] {
+			common++
+		}
+	}
+	union := len(wa) + len(wb) - common
+	return float64(common)/float64(union) >= duplicateNameSimilarity
+}
+
+// isDuplicate reports whether o orders the same item as other.
+func isDuplicate(o, other order) bool {
+	if o.SKU != "" && o.SKU == other.SKU {
+		return true
+	}
+	if u := normalizeItemURL(o.ItemURL); u != "" && u == normalizeItemURL(other.ItemURL) {
+		return true
+	}
+	return similarNames(o.ItemName, other.ItemName)
+}
+
+// Duplicates returns the recent orders of the workspace of o which order
+// the same item, newest first.
+func (s *orderService) Duplicates(o order, now time.Time) []order {
+	matches := s.store.Orders(func(other *order) bool {
+		return other.ID != o.ID &&
+			other.TeamID == o.TeamID &&
+			duplicateStatuses[other.Status] &&
+			now.Sub(other.CreatedAt) <= duplicateWindow &&
+			isDuplicate(o, *other)
+	})
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	if len(matches) > duplicateMaxShown {
+		matches = matches[:duplicateMaxShown]
+	}
+	return matches
+}
+
+// daysAgo formats how long ago t was in days.
+func daysAgo(loc string, t, now time.Time) string {
+	switch days := int(now.Sub(t).Hours() / 24); days {
+	case 0:
+		return tr(loc, "duplicate.today")
+	case 1:
+		return tr(loc, "duplicate.yesterday")
+	default:
+		return tr(loc, "duplicate.days_ago", days)
+	}
+}
+
+// duplicateAttachment warns in loc that draft may duplicate other. Pending
+// orders can be joined instead with the button of value.
+func duplicateAttachment(draft, other order, loc, value string, now time.Time) slack.Attachment {
+	who := fmt.Sprintf("<@%s>", other.Requester)
+	if other.Requester == draft.Requester {
+		who = tr(loc, "duplicate.you")
+	}
+	a := slack.Attachment{
+		Text: tr(loc, "duplicate.text", who, daysAgo(loc, other.CreatedAt, now),
+			tr(loc, "duplicate.status."+string(other.Status)), other.Ref(), other.ItemName),
+		Color:      "warning",
+		CallbackID: "order_duplicate",
+	}
+	if other.Status == statusPending && other.Requester != draft.Requester {
+		a.Actions = []slack.AttachmentAction{{
+			Name:  actionJoinOrder,
+			Text:  tr(loc, "duplicate.join", other.Ref()),
+			Type:  "button",
+			Value: value,
+		}}
+	}
+	return a
+}
+
+// parseJoinValue splits the value of the join button.
+func parseJoinValue(v string) (draftID, targetID int64, err error) {
+	parts := strings.SplitN(v, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid join value %q", v)
+	}
+	if draftID, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if targetID, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	return draftID, targetID, nil
+}
+
+// Join adds the items of the draft to the pending order target and drops
+// the draft, so one order is approved and bought for both requesters.
+func (s *orderService) Join(draftID, targetID int64, user string) (order, error) {
+	draft, ok := s.store.Order(draftID)
+	if !ok {
+		return order{}, trErrorf("order.error.not_found", draftID)
+	}
+	if draft.Requester != user || draft.Status != statusDraft {
+		return order{}, trErrorf("order.error.join_draft", draft.Ref())
+	}
+
+	now := time.Now()
+	o, err := s.store.UpdateOrder(targetID, func(o *order) error {
+		if o.Status != statusPending {
+			return trErrorf("order.error.join_status", o.Ref(), statusName(o.Status))
+		}
+		if o.Requester == user {
+			return trErrorf("order.error.join_own", o.Ref())
+		}
+		o.Count += draft.Count
+		o.Joined = append(o.Joined, orderJoin{User: user, Count: draft.Count, At: now})
+		o.record(orderEvent{At: now, User: user, Kind: eventJoined, Text: strconv.Itoa(draft.Count)})
+		return nil
+	})
+	if err != nil {
+		return o, err
+	}
+
+	// The draft was never posted, so it is dropped without a thread
+	if _, err := s.store.UpdateOrder(draftID, func(d *order) error {
+		return d.transition(statusCancelled, user, "joined "+o.Ref(), now)
+	}); err != nil {
+		log.Printf("[ERROR] Failed to cancel %s: %s", draft.Ref(), err)
+	}
+
+	if published, err := s.threads.Publish(o); err != nil {
+		log.Printf("[ERROR] %s", err)
+	} else {
+		o = published
+	}
+	text := fmt.Sprintf(":handshake: <@%s> joined the order with %d more, %d in total (cc <@%s>)", user, draft.Count, o.Count, o.Requester)
+	if err := s.threads.Reply(o, text); err != nil {
+		log.Printf("[ERROR] %s", err)
+	}
+	return o, nil
+}
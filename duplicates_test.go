@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeItemURL(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"https://www.amazon.com/dp/B07/?tag=x#reviews", "amazon.com/dp/B07"},
+		{"http://Amazon.com/dp/B07", "amazon.com/dp/B07"},
+		{" https://shop.example.com/item/1// ", "shop.example.com/item/1"},
+		{"https://www.amazon.com/", ""},
+		{"https://amazon.com", ""},
+		{"amazon.com/dp/B07", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeItemURL(tt.in); got != tt.want {
+			t.Errorf("normalizeItemURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSimilarNames(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"Dell U2720Q monitor", "Monitor, Dell U2720Q", true},
+		// 3 of 4 words in common is just similar enough
+		{"Logitech MX Keys keyboard", "Logitech MX Keys", true},
+		{"Logitech MX Keys", "Logitech MX Master", false},
+		{"Logitech MX Keys Mini", "Logitech MX Keys Plus", false},
+		{"USB-C cable 2m", "usb c cable 2m", true},
+		{"Pen", "Red pen", false},
+		{"", "", false},
+		{"!!!", "!!!", false},
+	}
+	for _, tt := range tests {
+		if got := similarNames(tt.a, tt.b); got != tt.want {
+			t.Errorf("similarNames(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &orderService{store: store}
+	now := time.Now()
+	day := 24 * time.Hour
+	create := func(o order) order {
+		o.Requester, o.Count = "U1", 1
+		o, err := store.CreateOrder(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	monitor := create(order{ItemName: "Dell U2720Q monitor", Status: statusPending, CreatedAt: now.Add(-3 * day)})
+	byURL := create(order{ItemName: "Screen", ItemURL: "https://www.amazon.com/dp/B07?tag=x", Status: statusDelivered, CreatedAt: now.Add(-2 * day)})
+	bySKU := create(order{ItemName: "Display", SKU: "U2720Q", Status: statusApproved, CreatedAt: now.Add(-day)})
+	// Neither of these is a duplicate
+	create(order{ItemName: "Monitor Dell U2720Q", Status: statusRejected, CreatedAt: now})
+	create(order{ItemName: "Monitor Dell U2720Q", Status: statusPending, CreatedAt: now.Add(-31 * day)})
+	create(order{ItemName: "Monitor Dell U2720Q", Status: statusPending, CreatedAt: now, TeamID: "T2"})
+	create(order{ItemName: "Shop", ItemURL: "https://amazon.com/", Status: statusPending, CreatedAt: now})
+
+	draft := create(order{ItemName: "monitor, Dell U2720Q", ItemURL: "http://amazon.com/dp/B07/", SKU: "U2720Q", Status: statusDraft})
+	var got []int64
+	for _, o := range s.Duplicates(draft, now) {
+		got = append(got, o.ID)
+	}
+	// Newest first
+	if want := []int64{bySKU.ID, byURL.ID, monitor.ID}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("duplicates = %v, want %v", got, want)
+	}
+}
+
+func TestDuplicateAttachment(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	draft := order{ID: 3, Requester: "U2", ItemName: "Keyboard"}
+	other := order{ID: 1, Requester: "U1", ItemName: "Keyboard", Status: statusPending, CreatedAt: now.Add(-3 * 24 * time.Hour)}
+
+	a := duplicateAttachment(draft, other, localeEN, "3:1", now)
+	if want := ":warning: <@U1> ordered this 3 days ago, still pending: #1 Keyboard"; a.Text != want {
+		t.Errorf("text = %q, want %q", a.Text, want)
+	}
+	if len(a.Actions) != 1 || a.Actions[0].Text != "Join #1 instead" || a.Actions[0].Value != "3:1" {
+		t.Errorf("actions = %+v", a.Actions)
+	}
+
+	a = duplicateAttachment(draft, other, localeJA, "3:1", now)
+	if !strings.Contains(a.Text, "3 日前に") || !strings.Contains(a.Text, "承認待ち") || a.Actions[0].Text != "代わりに #1 に参加" {
+		t.Errorf("ja attachment = %q, %+v", a.Text, a.Actions)
+	}
+
+	// Own orders cannot be joined
+	other.Requester = "U2"
+	a = duplicateAttachment(draft, other, localeEN, "3:1", now.Add(-2*24*time.Hour))
+	if want := ":warning: You ordered this yesterday, still pending: #1 Keyboard"; a.Text != want || len(a.Actions) != 0 {
+		t.Errorf("own order = %q, %+v", a.Text, a.Actions)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	actionEditOrder = "order_edit"
+
+	// editDialogPrefix starts the callback ID of the dialog editing a
+	// submitted order, followed by the callback token of the order.
+	editDialogPrefix = "edit_dialog:"
+)
+
+// editStatuses are the statuses in which the requester can still edit an
+// order. Approved orders go back to approval when edited.
+var editStatuses = map[orderStatus]bool{
+	statusPending:  true,
+	statusApproved: true,
+}
+
+// orderFields are the fields of the order dialog.
+type orderFields struct {
+	ItemName  string
+	ItemURL   string
+	Reason    string
+	Count     int
+	UnitPrice amount
+	Currency  string
+}
+
+// apply sets the fields of o to f.
+func (f orderFields) apply(o *order) {
+	o.ItemName = f.ItemName
+	o.ItemURL = f.ItemURL
+	o.Reason = f.Reason
+	o.Count = f.Count
+	o.UnitPrice = f.UnitPrice
+	o.Currency = f.Currency
+}
+
+// diff lists what f changes in o, e.g. `count 2 → 3`, none if nothing.
+func (f orderFields) diff(o order) []string {
+	var changes []string
+	text := func(name, from, to string) {
+		if from != to {
+			changes = append(changes, fmt.Sprintf("%s %q → %q", name, from, to))
+		}
+	}
+	text("item name", o.ItemName, f.ItemName)
+	text("URL", o.ItemURL, f.ItemURL)
+	text("reason", o.Reason, f.Reason)
+	if o.Count != f.Count {
+		changes = append(changes, fmt.Sprintf("count %d → %d", o.Count, f.Count))
+	}
+	if o.UnitPrice != f.UnitPrice {
+		changes = append(changes, fmt.Sprintf("price per item %s → %s", o.UnitPrice, f.UnitPrice))
+	}
+	// Orders made before currencies were kept are in the base currency
+	if o.Currency != "" && o.Currency != f.Currency {
+		changes = append(changes, fmt.Sprintf("currency %s → %s", o.Currency, f.Currency))
+	}
+	return changes
+}
+
+// Edit changes the fields of the order with id on behalf of its requester
+// and records what changed. The order goes back to approval if it was
+// approved, or if the edit raises its total above reapproveAbove, in which
+// case the approvals of policy stages are reset too.
+func (s *orderService) Edit(id int64, user string, f orderFields) (order, error) {
+	now := time.Now()
+	before, ok := s.store.Order(id)
+	if !ok {
+		return order{}, trErrorf("order.error.not_found", id)
+	}
+	edited := before.clone()
+	f.apply(&edited)
+	edited.Rate = nil
+
+	// Evaluated outside the store lock like approvals, see checkPolicies
+	var results []policyResult
+	if s.policies != nil {
+		results = s.policies.Evaluate(edited, now)
+		if r, blocked := blocking(results); blocked {
+			return before, trErrorf("policy.rule", r.Rule, r.reason())
+		}
+	}
+	_, raised := s.raisesTotal(before, edited)
+
+	var (
+		changes    []string
+		reapproved bool
+		from       orderStatus
+	)
+	o, err := s.store.UpdateOrderVersion(id, before.Version, func(o *order) error {
+		if o.Requester != user {
+			return trErrorf("order.error.edit_owner", o.Requester, o.Ref())
+		}
+		if !editStatuses[o.Status] {
+			return trErrorf("order.error.edit_status", o.Ref(), statusName(o.Status))
+		}
+		if changes = f.diff(*o); len(changes) == 0 {
+			return nil
+		}
+		from = o.Status
+		f.apply(o)
+		o.record(orderEvent{At: now, User: user, Kind: eventEdited, Text: strings.Join(changes, ", ")})
+		o.recordPolicies(results)
+
+		if reapproved = from == statusApproved || raised; reapproved {
+			reopenApproval(o, user, "edited after approval", now)
+		}
+		return nil
+	})
+	if err != nil || len(changes) == 0 {
+		return o, err
+	}
+	log.Printf("[INFO] Order %s edited by %s", o.Ref(), user)
+
+	if published, err := s.threads.Publish(o); err != nil {
+		log.Printf("[ERROR] %s", err)
+	} else {
+		o = published
+	}
+	text := fmt.Sprintf(":pencil2: <@%s> edited the order: %s", user, strings.Join(changes, ", "))
+	if reapproved {
+		text += "\n" + s.reapprovalText(o)
+	}
+	if err := s.threads.Reply(o, text); err != nil {
+		log.Printf("[ERROR] %s", err)
+	}
+	if reapproved {
+		s.announceReapproval(o, from, user, "edited after approval", now)
+	}
+	return o, nil
+}
+
+// raisesTotal compares the totals of before and after in the base currency.
+// It reports whether the total rises, and whether it rises above
+// reapproveAbove, which needs approval again.
+func (s *orderService) raisesTotal(before, after order) (rises, aboveLimit bool) {
+	oldTotal, newTotal := s.currencies.BaseTotal(before), s.currencies.BaseTotal(after)
+	rises = newTotal > oldTotal
+	return rises, rises && s.reapproveAbove > 0 && newTotal > s.reapproveAbove
+}
+
+// reopenApproval resets the approvals of the policy stages of o, and sends
+// it back to pending with reason if it was approved.
+func reopenApproval(o *order, user, reason string, now time.Time) {
+	for i := range o.Policies {
+		o.Policies[i].ApprovedBy = ""
+	}
+	if o.Status == statusApproved {
+		o.Status = statusPending
+		o.ApprovedBy = ""
+		o.Rate = nil
+		o.record(orderEvent{At: now, User: user, Kind: eventStatus, Status: statusPending, Text: reason})
+	}
+}
+
+// reapprovalText tells who approves o again after reopenApproval.
+func (s *orderService) reapprovalText(o order) string {
+	approvers := s.approvers
+	if open := o.openStages(); len(open) > 0 {
+		approvers = open[0].Approvers
+	}
+	text := "It needs approval again"
+	if len(approvers) > 0 {
+		text += " from " + mentions(approvers)
+	}
+	return text
+}
+
+// announceReapproval posts the approval buttons of o again. Going back from
+// approved to pending is a status change for email and webhooks.
+func (s *orderService) announceReapproval(o order, from orderStatus, user, reason string, now time.Time) {
+	s.postNextStep(o)
+	if from != statusApproved {
+		return
+	}
+	change := orderChange{Order: o, From: from, To: statusPending, Actor: user, Note: reason, At: now}
+	for _, fn := range s.observers {
+		fn(change)
+	}
+}
+
+// respondToEditDialog edits the order in the callback ID with the dialog.
+func (h interactionHandler) respondToEditDialog(w http.ResponseWriter, dialog slack.DialogCallback, responseURL string) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(dialog.CallbackID, editDialogPrefix), 10, 64)
+	if err != nil {
+		log.Printf("[ERROR] Invalid edit dialog: %q", dialog.CallbackID)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fields, errs := h.parseOrderDialog(dialog.Submission, h.workspaces.knownLocale(dialog.Team.ID, dialog.User.ID))
+	if len(errs) > 0 {
+		respondDialogErrors(w, errs)
+		return
+	}
+	h.saveDialog(w, dialog, responseURL, id, "item_name", func() error {
+		_, err := h.orders.Edit(id, dialog.User.ID, fields)
+		return err
+	})
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Email events a recipient can subscribe to.
+const (
+	emailApprovalRequest = "approval_request"
+	emailApproved        = "approved"
+	emailDigest          = "digest"
+)
+
+var emailEventNames = map[string]bool{
+	emailApprovalRequest: true,
+	emailApproved:        true,
+	emailDigest:          true,
+}
+
+const (
+	smtpTimeout = 30 * time.Second
+	// approvalLinkTTL is how long the links in an approval request work.
+	approvalLinkTTL = 72 * time.Hour
+)
+
+// emailRecipient is someone notified by email. User is the slack user the
+// recipient acts as when approving through a link, if any.
+type emailRecipient struct {
+	Address string   `json:"address"`
+	User    string   `json:"user,omitempty"`
+	Events  []string `json:"events,omitempty"`
+	// TeamID is the workspace whose orders are notified. Configured
+	// recipients without one get every workspace; preferences set before
+	// they were kept per workspace belong to the workspace of the bot token.
+	TeamID string `json:"team_id,omitempty"`
+}
+
+// wants reports whether r subscribed to event. No events means all of them.
+func (r emailRecipient) wants(event string) bool {
+	if len(r.Events) == 0 {
+		return true
+	}
+	for _, e := range r.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// SetEmailPref stores the email preference of a slack user.
+func (s *orderStore) SetEmailPref(r emailRecipient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.EmailPrefs[r.User] = r
+	return s.flush()
+}
+
+// DeleteEmailPref turns email notifications of user off.
+func (s *orderStore) DeleteEmailPref(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data.EmailPrefs, user)
+	return s.flush()
+}
+
+// EmailPref returns the email preference of user.
+func (s *orderStore) EmailPref(user string) (emailRecipient, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.data.EmailPrefs[user]
+	return r, ok
+}
+
+// EmailPrefs returns every email preference ordered by user.
+func (s *orderStore) EmailPrefs() []emailRecipient {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rs := make([]emailRecipient, 0, len(s.data.EmailPrefs))
+	for _, r := range s.data.EmailPrefs {
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].User < rs[j].User })
+	return rs
+}
+
+// UseLink marks the one-time link nonce as used until it expires.
+// It fails if the link was used already.
+func (s *orderStore) UseLink(nonce string, expires, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.UsedLinks[nonce]; ok {
+		return fmt.Errorf("this link was used already")
+	}
+	for n, exp := range s.data.UsedLinks {
+		if exp.Before(now) {
+			delete(s.data.UsedLinks, n)
+		}
+	}
+	s.data.UsedLinks[nonce] = expires
+	return s.flush()
+}
+
+// approvalLink is the content of a signed one-time link to approve or
+// reject an order from an email.
+type approvalLink struct {
+	OrderID int64
+	Status  orderStatus
+	User    string
+	Expires time.Time
+	Nonce   string
+}
+
+// signApprovalLink encodes l as "<payload>.<signature>", both base64url.
+func signApprovalLink(secret []byte, l approvalLink) string {
+	payload := fmt.Sprintf("%d|%s|%s|%d|%s", l.OrderID, l.Status, l.User, l.Expires.Unix(), l.Nonce)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseApprovalLink verifies token and returns its content.
+func parseApprovalLink(secret []byte, token string, now time.Time) (approvalLink, error) {
+	var l approvalLink
+	invalid := fmt.Errorf("this link is invalid")
+
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return l, invalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return l, invalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return l, invalid
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return l, invalid
+	}
+
+	var exp int64
+	f := strings.Split(string(payload), "|")
+	if len(f) != 5 {
+		return l, invalid
+	}
+	if _, err := fmt.Sscan(f[0], &l.OrderID); err != nil {
+		return l, invalid
+	}
+	if _, err := fmt.Sscan(f[3], &exp); err != nil {
+		return l, invalid
+	}
+	l.Status, l.User, l.Expires, l.Nonce = orderStatus(f[1]), f[2], time.Unix(exp, 0), f[4]
+	if now.After(l.Expires) {
+		return l, fmt.Errorf("this link has expired")
+	}
+	return l, nil
+}
+
+// emailOrder is an order as shown in emails.
+type emailOrder struct {
+	Ref       string
+	ItemName  string
+	ItemURL   string
+	Count     int
+	UnitPrice amount
+	Total     amount
+	Currency  string
+	Charges   string
+	Requester string
+	Reason    string
+	Status    orderStatus
+	Created   string
+}
+
+type emailLinks struct {
+	Approve string
+	Reject  string
+}
+
+var emailTemplates = template.Must(template.New("").Parse(`
+{{define "order"}}Order {{.Ref}}: {{.Count}} x {{.ItemName}}
+  Requested by: {{.Requester}}
+{{- if .UnitPrice}}
+  Price:        {{.UnitPrice}} each, {{.Total}}{{with .Currency}} {{.}}{{end}} in total
+{{- end}}
+{{- if .Charges}}
+  Including:    {{.Charges}}
+{{- end}}
+{{- if .ItemURL}}
+  URL:          {{.ItemURL}}
+{{- end}}
+{{- if .Reason}}
+  Reason:       {{.Reason}}
+{{- end}}
+  Created:      {{.Created}}
+{{end}}
+
+{{define "approval_request.subject"}}Approval requested: order {{.Order.Ref}} {{.Order.ItemName}}{{end}}
+{{define "approval_request"}}{{.Order.Requester}} requested an order which is waiting for approval.
+
+{{template "order" .Order}}
+{{- with .Links}}
+Approve: {{.Approve}}
+Reject:  {{.Reject}}
+
+Each link works once and expires in 72 hours.
+{{- else}}
+Approve or reject it in slack.
+{{- end}}
+{{end}}
+
+{{define "approved.subject"}}Order {{.Order.Ref}} approved: {{.Order.ItemName}}{{end}}
+{{define "approved"}}{{.Actor}} approved this order{{if .Note}}: {{.Note}}{{end}}.
+
+{{template "order" .Order}}
+{{end}}
+
+{{define "digest.subject"}}Weekly order digest {{.From}} - {{.To}}{{with .Team}} ({{.}}){{end}}{{end}}
+{{define "digest"}}Orders from {{.From}} to {{.To}}
+
+Created:  {{.Created}}
+Approved: {{len .Approved}} ({{.ApprovedTotal}}{{with .BaseCurrency}} {{.}}{{end}} in total)
+{{- if .Approved}}
+
+Approved this week:
+{{range .Approved}}
+{{template "order" .}}
+{{- end}}
+{{- end}}
+{{- if .Pending}}
+
+Waiting for approval:
+{{range .Pending}}
+{{template "order" .}}
+{{- end}}
+{{- end}}
+{{end}}
+`))
+
+// emailNotifier sends order notifications and weekly digests by email.
+type emailNotifier struct {
+	store      *orderStore
+	orders     *orderService
+	smtp       smtpConfig
+	publicURL  string
+	secret     []byte
+	recipients []emailRecipient
+	now        func() time.Time
+}
+
+func newEmailNotifier(store *orderStore, orders *orderService, cfg emailConfig) *emailNotifier {
+	return &emailNotifier{
+		store:      store,
+		orders:     orders,
+		smtp:       cfg.SMTP,
+		publicURL:  strings.TrimRight(cfg.PublicURL, "/"),
+		secret:     []byte(cfg.LinkSecret),
+		recipients: cfg.Recipients,
+		now:        time.Now,
+	}
+}
+
+// recipientsOf returns the configured recipients and the slack users who
+// subscribed to event about the orders of teamID, once per address.
+func (n *emailNotifier) recipientsOf(teamID, event string) []emailRecipient {
+	seen := map[string]bool{}
+	var rs []emailRecipient
+	add := func(r emailRecipient) {
+		key := strings.ToLower(r.Address)
+		if !r.wants(event) || seen[key] {
+			return
+		}
+		seen[key] = true
+		rs = append(rs, r)
+	}
+	for _, r := range n.recipients {
+		if r.TeamID == "" || r.TeamID == teamID {
+			add(r)
+		}
+	}
+	for _, r := range n.store.EmailPrefs() {
+		if r.TeamID == teamID || (r.TeamID == "" && n.orders.threads.workspaces.IsFallbackTeam(teamID)) {
+			add(r)
+		}
+	}
+	return rs
+}
+
+// OrderChanged emails approval requests and approved orders.
+// Sending happens in the background so slack is not kept waiting.
+func (n *emailNotifier) OrderChanged(c orderChange) {
+	var event string
+	switch c.To {
+	case statusPending:
+		event = emailApprovalRequest
+	case statusApproved:
+		event = emailApproved
+	default:
+		return
+	}
+	rs := n.recipientsOf(c.Order.TeamID, event)
+	if len(rs) == 0 {
+		return
+	}
+
+	go func() {
+		o := n.emailOrder(c.Order)
+		for _, r := range rs {
+			data := map[string]interface{}{
+				"Order": o,
+				"Actor": n.orders.threads.workspaces.ActorName(c.Order.TeamID, c.Actor),
+				"Note":  c.Note,
+			}
+			if event == emailApprovalRequest {
+				if links, ok := n.approvalLinks(c.Order, r); ok {
+					data["Links"] = links
+				}
+			}
+			if err := n.sendTemplate(r.Address, event, data); err != nil {
+				log.Printf("[ERROR] Failed to email %s of %s to %s: %s", event, c.Order.Ref(), r.Address, err)
+			}
+		}
+	}()
+}
+
+// approvalLinks returns one-time links for r to approve or reject o.
+// Only recipients who are approvers get links.
+func (n *emailNotifier) approvalLinks(o order, r emailRecipient) (emailLinks, bool) {
+	if n.publicURL == "" || r.User == "" || !n.orders.isApprover(r.User) {
+		return emailLinks{}, false
+	}
+	link := func(status orderStatus) (string, error) {
+		nonce, err := randomHex(12)
+		if err != nil {
+			return "", err
+		}
+		token := signApprovalLink(n.secret, approvalLink{
+			OrderID: o.ID,
+			Status:  status,
+			User:    r.User,
+			Expires: n.now().Add(approvalLinkTTL),
+			Nonce:   nonce,
+		})
+		return n.publicURL + emailApprovePath + "?token=" + url.QueryEscape(token), nil
+	}
+
+	var links emailLinks
+	var err error
+	if links.Approve, err = link(statusApproved); err != nil {
+		log.Printf("[ERROR] %s", err)
+		return links, false
+	}
+	if links.Reject, err = link(statusRejected); err != nil {
+		log.Printf("[ERROR] %s", err)
+		return links, false
+	}
+	return links, true
+}
+
+// Digest emails a summary of the week before now to the digest recipients
+// of every workspace.
+func (n *emailNotifier) Digest(now time.Time) {
+	teams := map[string]bool{}
+	for _, o := range n.store.Orders(nil) {
+		teams[o.TeamID] = true
+	}
+	for _, r := range append(append([]emailRecipient{}, n.recipients...), n.store.EmailPrefs()...) {
+		if r.TeamID != "" {
+			teams[r.TeamID] = true
+		}
+	}
+	if len(teams) == 0 {
+		teams[""] = true
+	}
+	ids := make([]string, 0, len(teams))
+	for id := range teams {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		n.digest(id, now)
+	}
+}
+
+// digest emails a summary of the orders of teamID in the week before now.
+func (n *emailNotifier) digest(teamID string, now time.Time) {
+	rs := n.recipientsOf(teamID, emailDigest)
+	if len(rs) == 0 {
+		return
+	}
+	from := now.AddDate(0, 0, -7)
+
+	created := 0
+	var approved, pending []emailOrder
+	var approvedTotal amount
+	for _, o := range n.store.Orders(func(o *order) bool { return o.TeamID == teamID }) {
+		if o.Status == statusDraft {
+			continue
+		}
+		if !o.CreatedAt.Before(from) && o.CreatedAt.Before(now) {
+			created++
+		}
+		switch {
+		case o.Status == statusPending:
+			pending = append(pending, n.emailOrder(o))
+		case spendingStatuses[o.Status] && approvedBetween(o, from, now):
+			approved = append(approved, n.emailOrder(o))
+			approvedTotal += n.orders.currencies.BaseTotal(o)
+		}
+	}
+
+	// Workspaces installed through OAuth are named in the subject
+	var team string
+	if inst, ok := n.store.Installation(teamID); ok {
+		team = inst.TeamName
+	}
+	data := map[string]interface{}{
+		"Team":          team,
+		"From":          from.Format("2006-01-02"),
+		"To":            now.Format("2006-01-02"),
+		"Created":       created,
+		"Approved":      approved,
+		"ApprovedTotal": approvedTotal,
+		"BaseCurrency":  n.orders.currencies.Base(),
+		"Pending":       pending,
+	}
+	for _, r := range rs {
+		if err := n.sendTemplate(r.Address, emailDigest, data); err != nil {
+			log.Printf("[ERROR] Failed to email digest to %s: %s", r.Address, err)
+		}
+	}
+}
+
+// RunDigest calls Digest every week at day and at until ctx is done.
+func (n *emailNotifier) RunDigest(ctx context.Context, day time.Weekday, at time.Duration, beat *heartbeat) {
+	for {
+		next := nextWeekly(n.now(), day, at)
+		beat.Beat(next)
+		select {
+		case <-time.After(next.Sub(n.now())):
+		case <-ctx.Done():
+			return
+		}
+		n.Digest(next)
+	}
+}
+
+// nextWeekly returns the first time after now on day at the time of day at.
+func nextWeekly(now time.Time, day time.Weekday, at time.Duration) time.Time {
+	y, m, d := now.Date()
+	t := time.Date(y, m, d, 0, 0, 0, 0, now.Location()).Add(at)
+	t = t.AddDate(0, 0, (int(day)-int(t.Weekday())+7)%7)
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 7)
+	}
+	return t
+}
+
+// approvedBetween reports whether o was approved between from and to.
+func approvedBetween(o order, from, to time.Time) bool {
+	for _, ev := range o.History {
+		if ev.Kind == eventStatus && ev.Status == statusApproved {
+			return !ev.At.Before(from) && ev.At.Before(to)
+		}
+	}
+	return false
+}
+
+func (n *emailNotifier) emailOrder(o order) emailOrder {
+	return emailOrder{
+		Ref:       o.Ref(),
+		ItemName:  o.ItemName,
+		ItemURL:   o.ItemURL,
+		Count:     o.Count,
+		UnitPrice: o.UnitPrice,
+		Total:     o.Total(),
+		Currency:  o.Currency,
+		Charges:   o.chargesText(),
+		Requester: n.orders.threads.workspaces.UserName(o.TeamID, o.Requester),
+		Reason:    o.Reason,
+		Status:    o.Status,
+		Created:   o.CreatedAt.Format("2006-01-02 15:04"),
+	}
+}
+
+// sendTemplate renders the templates of event with data and sends them to addr.
+func (n *emailNotifier) sendTemplate(addr, event string, data interface{}) error {
+	var subject, body bytes.Buffer
+	if err := emailTemplates.ExecuteTemplate(&subject, event+".subject", data); err != nil {
+		return err
+	}
+	if err := emailTemplates.ExecuteTemplate(&body, event, data); err != nil {
+		return err
+	}
+	return n.send(addr, subject.String(), body.String())
+}
+
+// send delivers a plain text email to addr through the SMTP server.
+func (n *emailNotifier) send(addr, subject, body string) error {
+	from, err := mail.ParseAddress(n.smtp.From)
+	if err != nil {
+		return err
+	}
+	msg, err := buildEmail(n.smtp.From, addr, subject, body, n.now())
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(n.smtp.Addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", n.smtp.Addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if n.smtp.StartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("STARTTLS failed: %s", err)
+		}
+	}
+	if n.smtp.Username != "" {
+		// PlainAuth refuses to send the password unless TLS is used or
+		// the server is on localhost
+		if err := c.Auth(smtp.PlainAuth("", n.smtp.Username, n.smtp.Password, host)); err != nil {
+			return fmt.Errorf("SMTP auth failed: %s", err)
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(addr); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildEmail returns a quoted-printable UTF-8 plain text message.
+func buildEmail(from, to, subject, body string, now time.Time) ([]byte, error) {
+	var b bytes.Buffer
+	headers := []struct{ name, value string }{
+		{"From", from},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", h.name, h.value)
+	}
+	b.WriteString("\r\n")
+
+	w := quotedprintable.NewWriter(&b)
+	if _, err := w.Write([]byte(strings.Replace(body, "\n", "\r\n", -1))); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// handleEmailCommand sets the email preference of the author:
+//
+//	email                                show the preference
+//	email <address> [event,event,...]    notify address, all events by default
+//	email off
+func (s *SlackListener) handleEmailCommand(channel string, msg slack.Msg, args []string) error {
+	store := s.orders.store
+	events := make([]string, 0, len(emailEventNames))
+	for e := range emailEventNames {
+		events = append(events, e)
+	}
+	sort.Strings(events)
+	loc := s.locale(msg.User)
+	usage := tr(loc, "email.usage", strings.Join(events, ", "))
+
+	switch {
+	case len(args) == 0:
+		r, ok := store.EmailPref(msg.User)
+		if !ok {
+			return s.replyEphemeral(channel, msg, tr(loc, "email.off")+" "+usage)
+		}
+		subscribed := tr(loc, "email.all_events")
+		if len(r.Events) > 0 {
+			subscribed = strings.Join(r.Events, ", ")
+		}
+		return s.replyEphemeral(channel, msg, tr(loc, "email.current", r.Address, subscribed))
+
+	case len(args) == 1 && strings.ToLower(args[0]) == "off":
+		if err := store.DeleteEmailPref(msg.User); err != nil {
+			return s.replyEphemeral(channel, msg, fmt.Sprintf(":warning: %s", err))
+		}
+		return s.replyEphemeral(channel, msg, tr(loc, "email.off"))
+
+	case len(args) <= 2:
+		// Slack formats addresses as <mailto:a@example.com|a@example.com>
+		raw := strings.TrimPrefix(strings.Trim(args[0], "<>"), "mailto:")
+		if i := strings.Index(raw, "|"); i >= 0 {
+			raw = raw[:i]
+		}
+		addr, err := mail.ParseAddress(raw)
+		if err != nil {
+			return s.replyEphemeral(channel, msg, tr(loc, "email.invalid", raw))
+		}
+		r := emailRecipient{Address: addr.Address, User: msg.User, TeamID: s.team()}
+		if len(args) == 2 {
+			for _, e := range splitList(args[1]) {
+				if !emailEventNames[e] {
+					return s.replyEphemeral(channel, msg, tr(loc, "email.unknown", e, usage))
+				}
+				r.Events = append(r.Events, e)
+			}
+		}
+		if err := store.SetEmailPref(r); err != nil {
+			return s.replyEphemeral(channel, msg, fmt.Sprintf(":warning: %s", err))
+		}
+		return s.replyEphemeral(channel, msg, tr(loc, "email.set", r.Address))
+	}
+	return s.replyEphemeral(channel, msg, usage)
+}
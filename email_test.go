@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpMessage is an email received by smtpSink.
+type smtpMessage struct {
+	From    string
+	To      []string
+	Subject string
+	Body    string
+}
+
+// smtpSink is an SMTP server keeping the emails it receives, enough for
+// net/smtp without extensions.
+type smtpSink struct {
+	ln       net.Listener
+	messages chan smtpMessage
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &smtpSink{ln: ln, messages: make(chan smtpMessage, 16)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(t, conn)
+		}
+	}()
+	return sink
+}
+
+func (sink *smtpSink) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 sink")
+	var m smtpMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			m.From = strings.Trim(strings.TrimSpace(line)[len("MAIL FROM:"):], "<>")
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			m.To = append(m.To, strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>"))
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 end with .")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			msg, err := mail.ReadMessage(strings.NewReader(data.String()))
+			if err != nil {
+				t.Errorf("invalid email: %s", err)
+				return
+			}
+			body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+			if err != nil {
+				t.Errorf("invalid email body: %s", err)
+				return
+			}
+			m.Subject, _ = new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+			m.Body = strings.Replace(string(body), "\r\n", "\n", -1)
+			sink.messages <- m
+			m = smtpMessage{}
+			reply("250 ok")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// next returns the next email, failing if none comes.
+func (sink *smtpSink) next(t *testing.T) smtpMessage {
+	t.Helper()
+	select {
+	case m := <-sink.messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email received")
+		return smtpMessage{}
+	}
+}
+
+// newTestNotifier returns a notifier sending to sink, with UBOSS as the only
+// approver. Slack is not configured, so threads are not updated.
+func newTestNotifier(t *testing.T, sink *smtpSink, recipients ...emailRecipient) *emailNotifier {
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := &orderService{
+		store:     store,
+		threads:   &orderThreads{workspaces: newWorkspaceRegistry(store, "", ""), store: store},
+		approvers: []string{"UBOSS"},
+		callbacks: newCallbackSigner([]byte("0123456789abcdef")),
+	}
+	return newEmailNotifier(store, orders, emailConfig{
+		SMTP:       smtpConfig{Addr: sink.ln.Addr().String(), From: "Orderbot <orderbot@example.com>"},
+		PublicURL:  "https://orderbot.example.com/",
+		LinkSecret: "0123456789abcdef0123456789abcdef",
+		Recipients: recipients,
+	})
+}
+
+// submitOrder stores a pending order of U1.
+func submitOrder(t *testing.T, orders *orderService, name string) order {
+	o, err := orders.CreateDraft(order{Requester: "U1", ItemName: name, Count: 2, UnitPrice: 1250, Reason: "new hire"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, err = orders.Transition(o.ID, statusPending, "U1", ""); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestEmailNotifications(t *testing.T) {
+	sink := newSMTPSink(t)
+	n := newTestNotifier(t, sink,
+		emailRecipient{Address: "boss@example.com", User: "UBOSS", Events: []string{emailApprovalRequest}},
+		emailRecipient{Address: "finance@example.com", Events: []string{emailApproved}},
+	)
+	o := submitOrder(t, n.orders, "Kéyboard")
+
+	n.OrderChanged(orderChange{Order: o, From: statusDraft, To: statusPending, Actor: "U1"})
+	m := sink.next(t)
+	if m.From != "orderbot@example.com" || len(m.To) != 1 || m.To[0] != "boss@example.com" {
+		t.Errorf("sent from %s to %v", m.From, m.To)
+	}
+	if want := "Approval requested: order " + o.Ref() + " Kéyboard"; m.Subject != want {
+		t.Errorf("subject = %q, want %q", m.Subject, want)
+	}
+	for _, want := range []string{"2 x Kéyboard", "12.50 each, 25.00 in total", "Reason:       new hire", "Each link works once"} {
+		if !strings.Contains(m.Body, want) {
+			t.Errorf("body does not contain %q:\n%s", want, m.Body)
+		}
+	}
+	for _, action := range []string{"Approve", "Reject"} {
+		link := regexp.MustCompile(action + `: +(\S+)`).FindStringSubmatch(m.Body)
+		if link == nil || !strings.HasPrefix(link[1], "https://orderbot.example.com/email/approve?token=") {
+			t.Errorf("no %s link in:\n%s", action, m.Body)
+		}
+	}
+
+	// Only finance subscribed to approved orders, and gets no links
+	n.OrderChanged(orderChange{Order: o, From: statusPending, To: statusApproved, Actor: "UBOSS", Note: "ok"})
+	m = sink.next(t)
+	if m.To[0] != "finance@example.com" || m.Subject != "Order "+o.Ref()+" approved: Kéyboard" {
+		t.Errorf("sent %q to %v", m.Subject, m.To)
+	}
+	if !strings.HasPrefix(m.Body, "UBOSS approved this order: ok.") || strings.Contains(m.Body, "token=") {
+		t.Errorf("body:\n%s", m.Body)
+	}
+
+	// Nobody subscribed to other changes
+	n.OrderChanged(orderChange{Order: o, From: statusApproved, To: statusPurchased, Actor: "UBOSS"})
+	select {
+	case m := <-sink.messages:
+		t.Errorf("unexpected email %q", m.Subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEmailDigest(t *testing.T) {
+	sink := newSMTPSink(t)
+	n := newTestNotifier(t, sink, emailRecipient{Address: "finance@example.com", Events: []string{emailDigest}})
+	approved := submitOrder(t, n.orders, "Monitor")
+	if _, err := n.orders.Transition(approved.ID, statusApproved, "UBOSS", ""); err != nil {
+		t.Fatal(err)
+	}
+	pending := submitOrder(t, n.orders, "Headset")
+
+	n.Digest(time.Now().Add(time.Hour))
+	m := sink.next(t)
+	if !strings.HasPrefix(m.Subject, "Weekly order digest ") {
+		t.Errorf("subject = %q", m.Subject)
+	}
+	for _, want := range []string{
+		"Created:  2",
+		"Approved: 1 (25.00 in total)",
+		"Approved this week:\n\nOrder " + approved.Ref() + ": 2 x Monitor",
+		"Waiting for approval:\n\nOrder " + pending.Ref() + ": 2 x Headset",
+	} {
+		if !strings.Contains(m.Body, want) {
+			t.Errorf("digest does not contain %q:\n%s", want, m.Body)
+		}
+	}
+}
+
+func TestEmailApprovalLink(t *testing.T) {
+	sink := newSMTPSink(t)
+	n := newTestNotifier(t, sink)
+	now := time.Now()
+	n.now = func() time.Time { return now }
+	h := emailApprovalHandler{notifier: n}
+
+	serve := func(method, token string) *httptest.ResponseRecorder {
+		var req *http.Request
+		if method == http.MethodGet {
+			req = httptest.NewRequest(method, emailApprovePath+"?token="+url.QueryEscape(token), nil)
+		} else {
+			req = httptest.NewRequest(method, emailApprovePath, strings.NewReader("token="+url.QueryEscape(token)))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	sign := func(o order, status orderStatus, user, nonce string, expires time.Time) string {
+		return signApprovalLink(n.secret, approvalLink{OrderID: o.ID, Status: status, User: user, Expires: expires, Nonce: nonce})
+	}
+
+	o := submitOrder(t, n.orders, "Keyboard")
+	token := sign(o, statusApproved, "UBOSS", "n1", now.Add(time.Hour))
+
+	// GET only shows the order, so that mail scanners do not use the link up
+	rec := serve(http.MethodGet, token)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Approve this order") {
+		t.Errorf("GET = %d:\n%s", rec.Code, rec.Body)
+	}
+	if got, _ := n.store.Order(o.ID); got.Status != statusPending {
+		t.Fatalf("GET changed the order to %s", got.Status)
+	}
+
+	rec = serve(http.MethodPost, token)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "The order is approved.") {
+		t.Errorf("POST = %d:\n%s", rec.Code, rec.Body)
+	}
+	if got, _ := n.store.Order(o.ID); got.Status != statusApproved || got.ApprovedBy != "UBOSS" {
+		t.Errorf("order is %s by %q after POST", got.Status, got.ApprovedBy)
+	}
+
+	rec = serve(http.MethodPost, token)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "used already") {
+		t.Errorf("second POST = %d:\n%s", rec.Code, rec.Body)
+	}
+
+	other := submitOrder(t, n.orders, "Mouse")
+	valid := sign(other, statusRejected, "UBOSS", "n2", now.Add(time.Hour))
+	payload := valid[:strings.LastIndex(valid, ".")]
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"tampered", strings.Replace(valid, payload, sign(o, statusRejected, "UBOSS", "n2", now.Add(time.Hour))[:len(payload)], 1), "this link is invalid"},
+		{"other secret", signApprovalLink([]byte("another secret"), approvalLink{OrderID: other.ID, Status: statusRejected, User: "UBOSS", Expires: now.Add(time.Hour), Nonce: "n3"}), "this link is invalid"},
+		{"expired", sign(other, statusRejected, "UBOSS", "n4", now.Add(-time.Minute)), "this link has expired"},
+		{"garbage", "nope", "this link is invalid"},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			rec := serve(method, tt.token)
+			if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("%s %s = %d:\n%s", tt.name, method, rec.Code, rec.Body)
+			}
+		}
+	}
+	if got, _ := n.store.Order(other.ID); got.Status != statusPending {
+		t.Errorf("refused links changed the order to %s", got.Status)
+	}
+
+	// A link of someone who cannot approve shows the order it is about
+	rec = serve(http.MethodPost, sign(other, statusApproved, "U1", "n5", now.Add(time.Hour)))
+	body := rec.Body.String()
+	if rec.Code != http.StatusConflict || !strings.Contains(body, "Order "+other.Ref()+": 2 x Mouse") || strings.Contains(body, "#0") {
+		t.Errorf("refused transition = %d:\n%s", rec.Code, body)
+	}
+}
+
+func TestEmailWorkspaces(t *testing.T) {
+	sink := newSMTPSink(t)
+	n := newTestNotifier(t, sink,
+		emailRecipient{Address: "all@example.com", Events: []string{emailDigest}},
+		emailRecipient{Address: "t2@example.com", TeamID: "T2", Events: []string{emailDigest}},
+	)
+	// U1 set a preference before they were kept per workspace
+	for _, r := range []emailRecipient{
+		{Address: "u1@example.com", User: "U1"},
+		{Address: "u2@example.com", User: "U2", TeamID: "T2"},
+	} {
+		if err := n.store.SetEmailPref(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addresses := func(rs []emailRecipient) string {
+		var a []string
+		for _, r := range rs {
+			a = append(a, r.Address)
+		}
+		return strings.Join(a, ",")
+	}
+	for _, tt := range []struct{ team, want string }{
+		{"", "all@example.com,u1@example.com"},
+		{"T2", "all@example.com,t2@example.com,u2@example.com"},
+		{"T3", "all@example.com"},
+	} {
+		if got := addresses(n.recipientsOf(tt.team, emailDigest)); got != tt.want {
+			t.Errorf("recipients of %q = %s, want %s", tt.team, got, tt.want)
+		}
+	}
+
+	// Each workspace gets a digest of its own orders
+	submitOrder(t, n.orders, "Monitor")
+	o, err := n.orders.CreateDraft(order{TeamID: "T2", Requester: "U2", ItemName: "Desk", Count: 1, UnitPrice: 30000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.orders.Transition(o.ID, statusPending, "U2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.store.SaveInstallation(installation{TeamID: "T2", TeamName: "Acme", BotToken: "xoxb-t2"}); err != nil {
+		t.Fatal(err)
+	}
+	n.Digest(time.Now().Add(time.Hour))
+	digests := map[string][]string{}
+	for i := 0; i < 5; i++ {
+		m := sink.next(t)
+		team := "bot token"
+		if strings.HasSuffix(m.Subject, " (Acme)") {
+			team = "Acme"
+		}
+		if strings.Contains(m.Body, "Monitor") != (team == "bot token") || strings.Contains(m.Body, "Desk") != (team == "Acme") {
+			t.Errorf("digest of %s to %s:\n%s", team, m.To[0], m.Body)
+		}
+		digests[team] = append(digests[team], m.To[0])
+	}
+	for team, want := range map[string]string{
+		"bot token": "all@example.com,u1@example.com",
+		"Acme":      "all@example.com,t2@example.com,u2@example.com",
+	} {
+		sort.Strings(digests[team])
+		if got := strings.Join(digests[team], ","); got != want {
+			t.Errorf("digests of %s went to %s, want %s", team, got, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// emailApprovePath serves the approval links sent by email.
+const emailApprovePath = "/email/approve"
+
+var approvalPage = template.Must(template.New("approval").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>orderbot</title></head>
+<body>
+{{if .Order}}<h1>Order {{.Order.Ref}}: {{.Order.Count}} x {{.Order.ItemName}}</h1>
+<p>Requested by {{.Order.Requester}}{{if .Order.UnitPrice}}, {{.Order.Total}} in total{{end}}.</p>
+{{if .Order.Reason}}<p>Reason: {{.Order.Reason}}</p>{{end}}{{end}}
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Token}}<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">{{.Action}} this order</button>
+</form>{{end}}
+</body>
+</html>
+`))
+
+// emailApprovalHandler approves or rejects orders from one-time links.
+// GET only shows a confirmation so that mail scanners which follow links
+// do not use them up, the change is made by the POST of the form.
+type emailApprovalHandler struct {
+	notifier *emailNotifier
+}
+
+func (h emailApprovalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	n := h.notifier
+	token := r.FormValue("token")
+	now := n.now()
+
+	link, err := parseApprovalLink(n.secret, token, now)
+	if err != nil {
+		h.render(w, http.StatusForbidden, map[string]interface{}{"Message": "Sorry, " + err.Error() + "."})
+		return
+	}
+	o, ok := n.store.Order(link.OrderID)
+	if !ok {
+		h.render(w, http.StatusNotFound, map[string]interface{}{"Message": "The order does not exist anymore."})
+		return
+	}
+	action := "Approve"
+	if link.Status == statusRejected {
+		action = "Reject"
+	}
+
+	if r.Method == http.MethodGet {
+		data := map[string]interface{}{"Order": n.emailOrder(o), "Action": action}
+		if o.Status == statusPending {
+			data["Token"] = token
+		} else {
+			data["Message"] = "This order is " + string(o.Status) + " already."
+		}
+		h.render(w, http.StatusOK, data)
+		return
+	}
+
+	if err := n.store.UseLink(link.Nonce, link.Expires, now); err != nil {
+		h.render(w, http.StatusConflict, map[string]interface{}{"Order": n.emailOrder(o), "Message": "Sorry, " + err.Error() + "."})
+		return
+	}
+	// The order fetched above is shown if the transition fails
+	changed, err := n.orders.Transition(link.OrderID, link.Status, link.User, "via email")
+	if err != nil {
+		h.render(w, http.StatusConflict, map[string]interface{}{"Order": n.emailOrder(o), "Message": err.Error()})
+		return
+	}
+	o = changed
+	log.Printf("[INFO] %s %s order %s by email", link.User, link.Status, o.Ref())
+	h.render(w, http.StatusOK, map[string]interface{}{"Order": n.emailOrder(o), "Message": "The order is " + string(o.Status) + "."})
+}
+
+func (h emailApprovalHandler) render(w http.ResponseWriter, status int, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Keep the token out of referrers
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	if err := approvalPage.Execute(w, data); err != nil {
+		log.Printf("[ERROR] Failed to render approval page: %s", err)
+	}
+}
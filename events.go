@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// eventsHandler receives Events API callbacks. Events which RTM does not
+// deliver, such as app_home_opened, are handled here.
+type eventsHandler struct {
+	verificationToken string
+	home              *homeTab
+}
+
+// eventCallback is the envelope of an Events API request.
+type eventCallback struct {
+	Token     string          `json:"token"`
+	Type      string          `json:"type"`
+	Challenge string          `json:"challenge"`
+	TeamID    string          `json:"team_id"`
+	Event     json.RawMessage `json:"event"`
+}
+
+type appHomeOpenedEvent struct {
+	Type string `json:"type"`
+	User string `json:"user"`
+	Tab  string `json:"tab"`
+}
+
+func (h eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		log.Printf("[ERROR] Invalid method: %s", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("[ERROR] Failed to read request body: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var cb eventCallback
+	if err := json.Unmarshal(buf, &cb); err != nil {
+		log.Printf("[ERROR] Failed to decode event from slack: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Only accept events from slack with valid token
+	if cb.Token != h.verificationToken {
+		log.Printf("[ERROR] Invalid token: %s", cb.Token)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch cb.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, cb.Challenge)
+		return
+	case "event_callback":
+	default:
+		log.Printf("[ERROR] Unknown event callback type: %s", cb.Type)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var ev struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(cb.Event, &ev); err != nil {
+		log.Printf("[ERROR] Failed to decode event: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	metricEvents.Inc("events_api", ev.Type)
+
+	// Slack retries unless it gets a response within 3 seconds,
+	// so slack API calls are made after responding.
+	w.WriteHeader(http.StatusOK)
+
+	switch ev.Type {
+	case "app_home_opened":
+		var home appHomeOpenedEvent
+		if err := json.Unmarshal(cb.Event, &home); err != nil {
+			log.Printf("[ERROR] Failed to decode app_home_opened: %s", err)
+			return
+		}
+		if home.Tab != "" && home.Tab != "home" {
+			return
+		}
+		go func() {
+			if err := h.home.Publish(cb.TeamID, home.User); err != nil {
+				log.Printf("[ERROR] %s", err)
+			}
+		}()
+	}
+}
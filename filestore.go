@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileStorage keeps copies of files such as receipts outside of slack.
+type fileStorage interface {
+	// Put stores body under key and returns where it was stored.
+	Put(key, contentType string, body []byte) (string, error)
+}
+
+// openFileStorage returns the storage of dsn, "file:<dir>" or
+// "s3://<bucket>/<prefix>", or nil if dsn is empty.
+func openFileStorage(dsn string, s3 s3Config) (fileStorage, error) {
+	switch {
+	case dsn == "":
+		return nil, nil
+	case strings.HasPrefix(dsn, "file:"):
+		dir := strings.TrimPrefix(dsn, "file:")
+		if dir == "" {
+			return nil, fmt.Errorf("missing directory in %q", dsn)
+		}
+		return localStorage{dir: dir}, nil
+	case strings.HasPrefix(dsn, "s3://"):
+		parts := strings.SplitN(strings.TrimPrefix(dsn, "s3://"), "/", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("missing bucket in %q", dsn)
+		}
+		st := &s3Storage{cfg: s3, bucket: parts[0], client: &http.Client{Timeout: time.Minute}}
+		if len(parts) == 2 {
+			st.prefix = strings.Trim(parts[1], "/")
+		}
+		if s3.Endpoint == "" || s3.AccessKeyID == "" || s3.SecretAccessKey == "" {
+			return nil, fmt.Errorf("s3 storage needs an endpoint and credentials")
+		}
+		return st, nil
+	}
+	return nil, fmt.Errorf("unsupported storage %q (supported: file:<dir>, s3://<bucket>/<prefix>)", dsn)
+}
+
+// localStorage stores files in a directory.
+type localStorage struct {
+	dir string
+}
+
+func (s localStorage) Put(key, contentType string, body []byte) (string, error) {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return "file:" + path, nil
+}
+
+// s3Storage stores files in an S3 compatible bucket with path style URLs,
+// which MinIO and most other implementations support.
+type s3Storage struct {
+	cfg    s3Config
+	bucket string
+	prefix string
+	client *http.Client
+}
+
+func (s *s3Storage) Put(key, contentType string, body []byte) (string, error) {
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	endpoint, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	u := *endpoint
+	u.Path = "/" + s.bucket + "/" + key
+
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("s3 put returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return "s3://" + s.bucket + "/" + key, nil
+}
+
+// sign adds an AWS Signature Version 4 to req.
+func (s *s3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	region := s.cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	headers := map[string]string{
+		"content-type":         req.Header.Get("Content-Type"),
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(headers[h]) + "\n")
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID, scope, strings.Join(signed, ";"), signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
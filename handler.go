@@ -2,11 +2,13 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/nlopes/slack"
 )
@@ -23,8 +25,31 @@ const (
 
 // interactionHandler handles interactive message response.
 type interactionHandler struct {
-	slackClient       *slack.Client
+	workspaces        *workspaceRegistry
+	orders            *orderService
+	home              *homeTab
+	tracking          *trackingService
+	assets            *assetRegistry
 	verificationToken string
+	// guard answers retries and serializes interactions about an order.
+	guard *interactionGuard
+	// jobs runs the slow part of interactions after they are acknowledged.
+	jobs *jobQueue
+}
+
+// blockActionCallback is sent when a button of a Block Kit view, such as
+// the App Home, is clicked. Other fields are shared with
+// slack.AttachmentActionCallback.
+type blockActionCallback struct {
+	Type    string `json:"type"`
+	Actions []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+		ActionTs string `json:"action_ts"`
+	} `json:"actions"`
+	View struct {
+		Type string `json:"type"`
+	} `json:"view"`
 }
 
 func (h interactionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -41,12 +66,13 @@ func (h interactionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jsonStr, err := url.QueryUnescape(string(buf)[8:])
-	if err != nil {
-		log.Printf("[ERROR] Failed to unespace request body: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	form, err := url.ParseQuery(string(buf))
+	if err != nil || form.Get("payload") == "" {
+		log.Printf("[ERROR] Failed to parse request body: %q", buf)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	jsonStr := form.Get("payload")
 
 	var message slack.AttachmentActionCallback
 	if err := json.Unmarshal([]byte(jsonStr), &message); err != nil {
@@ -62,21 +88,157 @@ func (h interactionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var actionName string
-	if message.Actions == nil {
+	client, err := h.workspaces.Client(message.Team.ID)
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var blockAction blockActionCallback
+	if err := json.Unmarshal([]byte(jsonStr), &blockAction); err != nil {
+		log.Printf("[ERROR] Failed to decode json message from slack: %s", jsonStr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var actionName, actionValue string
+	switch {
+	case blockAction.Type == "block_actions" && len(blockAction.Actions) > 0:
+		actionName = blockAction.Actions[0].ActionID
+		actionValue = blockAction.Actions[0].Value
+	case message.Actions == nil:
 		actionName = dialogCallback
-	} else {
+	default:
 		action := message.Actions[0]
 		actionName = action.Name
+		actionValue = action.Value
+	}
+
+	// Retries of slack get the first response instead of acting twice
+	w, finish, first := h.guard.Begin(interactionKey(message, blockAction), w)
+	if !first {
+		return
+	}
+	defer finish()
+	metricInteractions.Inc(actionName)
+
+	// Buttons about an order carry a signed token, see callbacks.go.
+	// Clicks about the same order run one at a time.
+	var (
+		orderIDs []int64
+		slot     *jobSlot
+		use      func() error
+	)
+	if isOrderAction(actionName) {
+		// The job is given its place in the queue first, so that a click
+		// refused as the queue is full does not use up the button
+		var ok bool
+		if slot, ok = h.jobs.Reserve(actionName); !ok {
+			respondEphemeral(w, tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "jobs.busy"))
+			return
+		}
+		defer slot.Release()
+		p, err := h.orders.callbacks.Verify(actionValue)
+		if err == nil {
+			orderIDs = []int64{p.OrderID, p.TargetID}
+			unlock := h.guard.LockOrders(orderIDs...)
+			actionValue, err = h.checkAction(actionName, p)
+			unlock()
+		}
+		if err != nil {
+			log.Printf("[INFO] Refused %s by %s: %s", actionName, message.User.ID, err)
+			respondError(w, h.workspaces.knownLocale(message.Team.ID, message.User.ID), err)
+			return
+		}
+		if onceActions[actionName] {
+			use = func() error { return h.useButton(p, message.User.ID) }
+		}
+	}
+
+	// Buttons on the App Home refresh it instead of replacing a message
+	var refreshHome func()
+	if blockAction.View.Type == "home" {
+		refreshHome = func() {
+			if err := h.home.Publish(message.Team.ID, message.User.ID); err != nil {
+				log.Printf("[ERROR] %s", err)
+			}
+		}
+	}
+
+	// Calls to slack and order changes run after the interaction is
+	// acknowledged, slack gives up on it after three seconds
+	enqueue := func(run func(w http.ResponseWriter)) {
+		h.enqueue(w, interactionJob{
+			name:        actionName,
+			responseURL: message.ResponseURL,
+			orders:      orderIDs,
+			run:         run,
+			locale:      h.workspaces.knownLocale(message.Team.ID, message.User.ID),
+			slot:        slot,
+			use:         use,
+			then:        refreshHome,
+		})
+	}
+	// Dialogs are opened right away, their trigger ID expires after three
+	// seconds too. Only refreshing the App Home is left to the queue.
+	openDialog := func(open func(loc string) error) {
+		if err := open(h.workspaces.knownLocale(message.Team.ID, message.User.ID)); err != nil {
+			log.Printf("[ERROR] Failed to open dialog of %s: %s", actionName, err)
+		}
+		if refreshHome != nil {
+			enqueue(func(http.ResponseWriter) {})
+		}
+	}
+	openOrderDialog := func(o *order) {
+		openDialog(func(loc string) error {
+			return h.sendDialog(client, message.TriggerID, loc, o)
+		})
 	}
 
 	switch actionName {
 
 	case orderStart:
-		h.sendDialog(message.TriggerID)
+		openOrderDialog(nil)
+
+	case actionEditDraft:
+		id, err := strconv.ParseInt(actionValue, 10, 64)
+		if err != nil {
+			log.Printf("[ERROR] Invalid order ID: %q", actionValue)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		o, ok := h.orders.store.Order(id)
+		if !ok || o.Requester != message.User.ID || o.Status != statusDraft {
+			respondEphemeral(w, tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "order.edit_gone"))
+			return
+		}
+		openOrderDialog(&o)
+
+	case actionEditOrder:
+		id, err := strconv.ParseInt(actionValue, 10, 64)
+		if err != nil {
+			log.Printf("[ERROR] Invalid order ID: %q", actionValue)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		o, ok := h.orders.store.Order(id)
+		if !ok {
+			respondEphemeral(w, ":warning: "+tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "order.not_found", id))
+			return
+		}
+		if o.Requester != message.User.ID {
+			respondEphemeral(w, tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "order.requester_only", o.Ref(), o.Requester))
+			return
+		}
+		if !editStatuses[o.Status] {
+			respondEphemeral(w, tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "order.edit_gone"))
+			return
+		}
+		openOrderDialog(&o)
 
 	case actionCancel:
-		title := fmt.Sprintf(":x: @%s canceled the request", message.User.Name)
+		title := tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "order.cancelled", message.User.Name)
 		log.Printf("trigger_id: %s", message.TriggerID)
 		responseMessage(w, message.OriginalMessage, title, "")
 
@@ -88,24 +250,205 @@ func (h interactionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		var orderID int64
+		if dialogRes.CallbackID, orderID, err = h.verifyDialog(dialogRes.CallbackID); err != nil {
+			log.Printf("[INFO] Refused dialog of %s: %s", dialogRes.User.ID, err)
+			loc := h.workspaces.knownLocale(dialogRes.Team.ID, dialogRes.User.ID)
+			respondDialogErrors(w, []dialogError{{Name: firstField(dialogRes.Submission), Error: errorText(loc, err)}})
+			return
+		}
+		// Submissions are checked right away, so that slack shows errors
+		// next to the fields, and saved by the job queue
+		if strings.HasPrefix(dialogRes.CallbackID, trackingDialogPrefix) {
+			h.respondToTrackingDialog(w, dialogRes, message.ResponseURL)
+			return
+		}
+		if strings.HasPrefix(dialogRes.CallbackID, assetDialogPrefix) {
+			h.respondToAssetDialog(w, dialogRes, message.ResponseURL)
+			return
+		}
+		if strings.HasPrefix(dialogRes.CallbackID, chargesDialogPrefix) {
+			h.respondToChargesDialog(w, dialogRes, message.ResponseURL)
+			return
+		}
+		if strings.HasPrefix(dialogRes.CallbackID, editDialogPrefix) {
+			h.respondToEditDialog(w, dialogRes, message.ResponseURL)
+			return
+		}
+		defer h.guard.LockOrders(orderID)()
+
 		h.respondToDialog(
+			w,
+			client,
 			dialogRes,
 			message.TriggerID)
 
 	case dialogCancel:
-		title := fmt.Sprintf(":x: @%s canceled the request", message.User.Name)
-		log.Printf("trigger_id: %s", message.TriggerID)
-		responseMessage(w, message.OriginalMessage, title, "")
+		enqueue(func(w http.ResponseWriter) {
+			if id, err := strconv.ParseInt(actionValue, 10, 64); err == nil {
+				if _, err := h.orders.Transition(id, statusCancelled, message.User.ID, ""); err != nil {
+					log.Printf("[ERROR] Failed to cancel order: %s", err)
+				}
+			}
+			title := tr(h.workspaces.Locale(message.Team.ID, message.User.ID), "order.cancelled", message.User.Name)
+			responseMessage(w, message.OriginalMessage, title, "")
+		})
 
 	case dialogConfirm:
-		title := fmt.Sprintf(":ok: Your order has been placed!")
-		responseMessage(w, message.OriginalMessage, title, "")
-		// order.MakeApprovalParameters()
+		id, err := strconv.ParseInt(actionValue, 10, 64)
+		if err != nil {
+			log.Printf("[ERROR] Invalid order ID: %q", actionValue)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		enqueue(func(w http.ResponseWriter) {
+			loc := h.workspaces.Locale(message.Team.ID, message.User.ID)
+			o, err := h.orders.Transition(id, statusPending, message.User.ID, "")
+			if err != nil {
+				respondError(w, loc, err)
+				return
+			}
+			responseMessage(w, message.OriginalMessage, tr(loc, "order.placed"), tr(loc, "order.follow", o.Ref()))
+		})
+
+	case actionJoinOrder:
+		draftID, targetID, err := parseJoinValue(actionValue)
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		enqueue(func(w http.ResponseWriter) {
+			loc := h.workspaces.Locale(message.Team.ID, message.User.ID)
+			o, err := h.orders.Join(draftID, targetID, message.User.ID)
+			if err != nil {
+				respondError(w, loc, err)
+				return
+			}
+			responseMessage(w, message.OriginalMessage, tr(loc, "order.joined", o.Ref()), tr(loc, "order.joined_total", o.Count))
+		})
 
 	case dialogMore:
-		title := fmt.Sprintf(":ok: Let's add more!")
+		title := tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "order.more")
 		responseMessage(w, message.OriginalMessage, title, "")
 
+	case actionTrack:
+		id, err := strconv.ParseInt(actionValue, 10, 64)
+		if err != nil {
+			log.Printf("[ERROR] Invalid order ID: %q", actionValue)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		o, ok := h.orders.store.Order(id)
+		if !ok {
+			respondEphemeral(w, ":warning: "+tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "order.not_found", id))
+			return
+		}
+		if h.tracking == nil || len(h.tracking.carriers) == 0 {
+			respondEphemeral(w, tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "tracking.no_carriers"))
+			return
+		}
+		openDialog(func(loc string) error {
+			return client.OpenDialog(message.TriggerID, trackingDialog(o, h.tracking.Carriers(), h.orders.callbacks.Sign(o), loc))
+		})
+
+	case actionEditCharges:
+		id, err := strconv.ParseInt(actionValue, 10, 64)
+		if err != nil {
+			log.Printf("[ERROR] Invalid order ID: %q", actionValue)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		o, ok := h.orders.store.Order(id)
+		if !ok {
+			respondEphemeral(w, ":warning: "+tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "order.not_found", id))
+			return
+		}
+		if !h.orders.isPurchaser(message.User.ID) {
+			respondEphemeral(w, tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "charges.not_allowed"))
+			return
+		}
+		if !chargeStatuses[o.Status] {
+			respondEphemeral(w, tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "charges.closed", o.Ref(), o.Status))
+			return
+		}
+		openDialog(func(loc string) error {
+			return client.OpenDialog(message.TriggerID, chargesDialog(o, h.orders.taxes.Names(), h.orders.callbacks.Sign(o), loc))
+		})
+
+	case actionRegisterAssets:
+		id, err := strconv.ParseInt(actionValue, 10, 64)
+		if err != nil {
+			log.Printf("[ERROR] Invalid order ID: %q", actionValue)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		o, ok := h.orders.store.Order(id)
+		if !ok {
+			respondEphemeral(w, ":warning: "+tr(h.workspaces.knownLocale(message.Team.ID, message.User.ID), "order.not_found", id))
+			return
+		}
+		openDialog(func(loc string) error {
+			return client.OpenDialog(message.TriggerID, serialDialog(o, h.orders.callbacks.Sign(o), loc))
+		})
+
+	case actionReceived, actionNotReceived, actionDamaged:
+		id, err := strconv.ParseInt(actionValue, 10, 64)
+		if err != nil {
+			log.Printf("[ERROR] Invalid order ID: %q", actionValue)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		to, note := statusDelivered, ""
+		switch actionName {
+		case actionNotReceived:
+			to, note = statusIssue, "not received"
+		case actionDamaged:
+			to, note = statusIssue, "arrived damaged"
+		}
+		enqueue(func(w http.ResponseWriter) {
+			loc := h.workspaces.Locale(message.Team.ID, message.User.ID)
+			o, err := h.orders.Transition(id, to, message.User.ID, note)
+			if err != nil {
+				respondError(w, loc, err)
+				return
+			}
+			title := tr(loc, "delivery.thanks")
+			value := ""
+			if to == statusIssue {
+				title = tr(loc, "delivery.sorry")
+				value = tr(loc, "delivery.assigned", actorMention(o.AssignedTo), o.Ref())
+				if o.AssignedTo == "" {
+					value = tr(loc, "order.follow", o.Ref())
+				}
+			}
+			responseMessage(w, message.OriginalMessage, title, value)
+		})
+
+	case actionApprove, actionReject, actionPurchase, actionDeliver, actionReship:
+		id, err := strconv.ParseInt(actionValue, 10, 64)
+		if err != nil {
+			log.Printf("[ERROR] Invalid order ID: %q", actionValue)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		to := map[string]orderStatus{
+			actionApprove:  statusApproved,
+			actionReject:   statusRejected,
+			actionPurchase: statusPurchased,
+			actionDeliver:  statusDelivered,
+			actionReship:   statusPurchased,
+		}[actionName]
+		enqueue(func(w http.ResponseWriter) {
+			loc := h.workspaces.Locale(message.Team.ID, message.User.ID)
+			if _, err := h.orders.Transition(id, to, message.User.ID, ""); err != nil {
+				respondError(w, loc, err)
+				return
+			}
+			title := tr(loc, "status.by", tr(loc, "status."+string(to)), message.User.Name)
+			responseMessage(w, message.OriginalMessage, title, "")
+		})
+
 	default:
 		log.Printf("[ERROR] ]Invalid action was submitted: %s", actionName)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -114,82 +457,320 @@ func (h interactionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h interactionHandler) respondToDialog(
+	w http.ResponseWriter,
+	client *slack.Client,
 	dialog slack.DialogCallback,
 	triggerID string) {
 
-	// fmt.Printf("d: %+v", dialog)
+	loc := h.workspaces.knownLocale(dialog.Team.ID, dialog.User.ID)
+	fields, errs := h.parseOrderDialog(dialog.Submission, loc)
+	if len(errs) > 0 {
+		respondDialogErrors(w, errs)
+		return
+	}
+	slot, ok := h.reserveDialog(w, dialog, "item_name")
+	if !ok {
+		return
+	}
+	defer slot.Release()
 
-	var (
-		itemName   = dialog.Submission["item_name"]
-		itemURL    = dialog.Submission["item_url"]
-		itemReason = dialog.Submission["item_reason"]
-		itemCount  = dialog.Submission["item_count"]
-	)
+	// Dialogs opened from the App Home have no channel
+	channelID := dialog.Channel.ID
+	if channelID == "" {
+		channelID = h.workspaces.OrdersChannel(dialog.Team.ID)
+	}
 
+	draft := order{
+		TeamID:    dialog.Team.ID,
+		ChannelID: channelID,
+		Requester: dialog.User.ID,
+	}
+	fields.apply(&draft)
+
+	// Blocking policy rules keep the dialog open, others are recorded
+	now := time.Now()
+	if h.orders.policies != nil {
+		results := h.orders.policies.Evaluate(draft, now)
+		for _, r := range results {
+			if r.Action == policyBlock {
+				field := r.field
+				if field == "" {
+					field = "item_name"
+				}
+				errs = append(errs, dialogError{Name: field, Error: errorText(loc, trErrorf("policy.rule", r.Rule, r.reason()))})
+			}
+		}
+		if len(errs) > 0 {
+			respondDialogErrors(w, errs)
+			return
+		}
+		draft.Policies = results
+	}
+
+	// Keep the order as a draft until the user confirms it
+	o, err := h.orders.CreateDraft(draft)
+	if err != nil {
+		log.Printf("[ERROR] Failed to save order: %s", err)
+		respondDialogErrors(w, []dialogError{{Name: "item_name", Error: tr(loc, "dialog.error.save")}})
+		return
+	}
+	// A draft edited from its confirmation is replaced by the new one
+	if prev := strings.TrimPrefix(dialog.CallbackID, orderDialogCallback+":"); prev != dialog.CallbackID {
+		if id, err := strconv.ParseInt(prev, 10, 64); err == nil {
+			if err := h.orders.DiscardDraft(id, dialog.User.ID); err != nil {
+				log.Printf("[ERROR] Failed to discard draft: %s", err)
+			}
+		}
+	}
+
+	// The dialog closes once acknowledged, the confirmation follows
+	h.enqueue(w, interactionJob{name: dialogCallback, slot: slot, run: func(http.ResponseWriter) {
+		loc := h.workspaces.Locale(dialog.Team.ID, dialog.User.ID)
+		params := slack.PostMessageParameters{
+			Attachments: confirmationAttachments(o, loc, h.orders.Duplicates(o, now), h.orders.callbacks, now),
+		}
+		if _, err := h.postEphemeral(
+			client,
+			channelID,
+			dialog.User.ID,
+			"",
+			params); err != nil {
+			log.Printf("[ERROR] Failed to post message: %s", err)
+		}
+	}})
+}
+
+// parseOrderDialog reads the fields of the order dialog, telling slack
+// which ones are wrong so the dialog stays open.
+func (h interactionHandler) parseOrderDialog(submission map[string]string, loc string) (orderFields, []dialogError) {
+	f := orderFields{
+		ItemName: submission["item_name"],
+		ItemURL:  submission["item_url"],
+		Reason:   submission["item_reason"],
+		Currency: submission["item_currency"],
+	}
+	var errs []dialogError
+	count, err := strconv.Atoi(submission["item_count"])
+	if err != nil || count < 1 {
+		errs = append(errs, dialogError{Name: "item_count", Error: tr(loc, "dialog.error.count")})
+	}
+	f.Count = count
+	if h.orders.requireReason && strings.TrimSpace(f.Reason) == "" {
+		errs = append(errs, dialogError{Name: "item_reason", Error: tr(loc, "dialog.error.reason")})
+	}
+	if v := submission["item_price"]; v != "" {
+		if f.UnitPrice, err = parseAmount(v); err != nil || f.UnitPrice < 0 {
+			errs = append(errs, dialogError{Name: "item_price", Error: tr(loc, "dialog.error.price")})
+		}
+	}
+	if f.Currency == "" {
+		f.Currency = h.orders.currencies.Base()
+	} else if !h.orders.currencies.Allowed(f.Currency) {
+		errs = append(errs, dialogError{Name: "item_currency", Error: tr(loc, "dialog.error.currency", f.Currency)})
+	}
+	return f, errs
+}
+
+// confirmationAttachments asks the requester of the draft o to confirm it,
+// with the policy results and recent duplicates under it. A draft blocked
+// by a policy can only be edited or cancelled.
+func confirmationAttachments(o order, loc string, duplicates []order, callbacks *callbackSigner, now time.Time) []slack.Attachment {
+	orderID := callbacks.Sign(o)
 	attachment := slack.Attachment{
-		Text:       "Did I get your order right?",
+		Text:       tr(loc, "confirm.text"),
 		Color:      "36a64f",
 		CallbackID: "order_conf",
 		Fields: []slack.AttachmentField{
 			slack.AttachmentField{
-				Title: "Item name",
-				Value: itemName,
+				Title: tr(loc, "confirm.item_name"),
+				Value: o.ItemName,
 				Short: false,
 			},
 			slack.AttachmentField{
-				Title: "Reason",
-				Value: itemReason,
+				Title: tr(loc, "confirm.reason"),
+				Value: o.Reason,
 				Short: false,
 			},
 			slack.AttachmentField{
-				Title: "URL",
-				Value: itemURL,
+				Title: tr(loc, "confirm.url"),
+				Value: o.ItemURL,
 				Short: false,
 			},
 			slack.AttachmentField{
-				Title: "How many",
-				Value: itemCount,
+				Title: tr(loc, "confirm.count"),
+				Value: strconv.Itoa(o.Count),
 				Short: false,
 			},
-		},
-		Actions: []slack.AttachmentAction{
-			slack.AttachmentAction{
-				Name:  dialogConfirm,
-				Text:  "Confirm",
-				Type:  "button",
-				Style: "primary",
-			},
-			slack.AttachmentAction{
-				Name: dialogMore,
-				Text: "Add more items",
-				Type: "button",
-			},
-			slack.AttachmentAction{
-				Name:  dialogCancel,
-				Text:  "Cancel",
-				Type:  "button",
-				Style: "danger",
+			slack.AttachmentField{
+				Title: tr(loc, "confirm.total"),
+				Value: formatMoney(loc, o.Total(), o.Currency),
+				Short: false,
 			},
 		},
 	}
+	if _, blocked := blocking(o.Policies); !blocked {
+		attachment.Actions = append(attachment.Actions, slack.AttachmentAction{
+			Name:  dialogConfirm,
+			Text:  tr(loc, "confirm.confirm"),
+			Type:  "button",
+			Style: "primary",
+			Value: orderID,
+		})
+	}
+	attachment.Actions = append(attachment.Actions,
+		slack.AttachmentAction{
+			Name:  actionEditDraft,
+			Text:  tr(loc, "confirm.edit"),
+			Type:  "button",
+			Value: orderID,
+		},
+		slack.AttachmentAction{
+			Name:  dialogMore,
+			Text:  tr(loc, "confirm.more"),
+			Type:  "button",
+			Value: orderID,
+		},
+		slack.AttachmentAction{
+			Name:  dialogCancel,
+			Text:  tr(loc, "confirm.cancel"),
+			Type:  "button",
+			Style: "danger",
+			Value: orderID,
+		},
+	)
 
-	params := slack.PostMessageParameters{
-		Attachments: []slack.Attachment{
-			attachment,
+	if charges := o.chargesText(); charges != "" {
+		attachment.Fields = append(attachment.Fields, slack.AttachmentField{Title: tr(loc, "confirm.including"), Value: charges})
+	}
+	attachments := []slack.Attachment{attachment}
+	for _, r := range o.Policies {
+		attachments = append(attachments, slack.Attachment{Text: r.text(), Color: "warning", MarkdownIn: []string{"text"}})
+	}
+
+	// Warn about the same item ordered recently, it can be joined instead
+	for _, other := range duplicates {
+		attachments = append(attachments, duplicateAttachment(o, other, loc, callbacks.SignJoin(o, other), now))
+	}
+	return attachments
+}
+
+// reserveDialog takes a place in the job queue for a dialog submission.
+// When the queue is full, the dialog stays open with an error next to field.
+func (h interactionHandler) reserveDialog(w http.ResponseWriter, dialog slack.DialogCallback, field string) (*jobSlot, bool) {
+	slot, ok := h.jobs.Reserve(dialogCallback)
+	if !ok {
+		loc := h.workspaces.knownLocale(dialog.Team.ID, dialog.User.ID)
+		respondDialogErrors(w, []dialogError{{Name: field, Error: tr(loc, "jobs.busy")}})
+	}
+	return slot, ok
+}
+
+// saveDialog acknowledges the checked dialog about the order id and runs
+// save on the job queue. The dialog is closed by then, so an error of save
+// is posted to responseURL. Without a queue it stays open with the error
+// next to field.
+func (h interactionHandler) saveDialog(w http.ResponseWriter, dialog slack.DialogCallback, responseURL string, id int64, field string, save func() error) {
+	if h.jobs == nil {
+		defer h.guard.LockOrders(id)()
+		if err := save(); err != nil {
+			loc := h.workspaces.knownLocale(dialog.Team.ID, dialog.User.ID)
+			respondDialogErrors(w, []dialogError{{Name: field, Error: errorText(loc, err)}})
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	slot, ok := h.reserveDialog(w, dialog, field)
+	if !ok {
+		return
+	}
+	h.enqueue(w, interactionJob{
+		name:        dialogCallback,
+		responseURL: responseURL,
+		orders:      []int64{id},
+		slot:        slot,
+		run: func(w http.ResponseWriter) {
+			if err := save(); err != nil {
+				log.Printf("[INFO] Refused dialog of %s: %s", dialog.User.ID, err)
+				respondError(w, h.workspaces.Locale(dialog.Team.ID, dialog.User.ID), err)
+			}
 		},
+	})
+}
+
+// respondToTrackingDialog records the tracking number submitted for the
+// order in the callback ID.
+func (h interactionHandler) respondToTrackingDialog(w http.ResponseWriter, dialog slack.DialogCallback, responseURL string) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(dialog.CallbackID, trackingDialogPrefix), 10, 64)
+	if err != nil {
+		log.Printf("[ERROR] Invalid tracking dialog: %q", dialog.CallbackID)
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
+	number := strings.TrimSpace(dialog.Submission["number"])
+	if number == "" {
+		loc := h.workspaces.knownLocale(dialog.Team.ID, dialog.User.ID)
+		respondDialogErrors(w, []dialogError{{Name: "number", Error: tr(loc, "tracking.error.number")}})
+		return
+	}
+	h.saveDialog(w, dialog, responseURL, id, "number", func() error {
+		_, err := h.tracking.SetTracking(id, dialog.Submission["carrier"], number, dialog.User.ID)
+		return err
+	})
+}
 
-	if _, err := h.postEphemeral(
-		dialog.Channel.ID,
-		dialog.User.ID,
-		"",
-		params); err != nil {
-		fmt.Errorf("failed to post message: %s", err)
+// respondToChargesDialog saves the charges submitted for the order in the
+// callback ID.
+func (h interactionHandler) respondToChargesDialog(w http.ResponseWriter, dialog slack.DialogCallback, responseURL string) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(dialog.CallbackID, chargesDialogPrefix), 10, 64)
+	if err != nil {
+		log.Printf("[ERROR] Invalid charges dialog: %q", dialog.CallbackID)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	charges, errs := parseChargesDialog(dialog.Submission, h.orders.taxes, h.workspaces.knownLocale(dialog.Team.ID, dialog.User.ID))
+	if len(errs) > 0 {
+		respondDialogErrors(w, errs)
+		return
+	}
+	h.saveDialog(w, dialog, responseURL, id, "shipping", func() error {
+		_, err := h.orders.SetCharges(id, dialog.User.ID, charges)
+		return err
+	})
+}
+
+// respondToAssetDialog registers the serial numbers submitted for the
+// order in the callback ID.
+func (h interactionHandler) respondToAssetDialog(w http.ResponseWriter, dialog slack.DialogCallback, responseURL string) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(dialog.CallbackID, assetDialogPrefix), 10, 64)
+	if err != nil {
+		log.Printf("[ERROR] Invalid asset dialog: %q", dialog.CallbackID)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	loc := h.workspaces.knownLocale(dialog.Team.ID, dialog.User.ID)
+	o, ok := h.orders.store.Order(id)
+	if !ok {
+		respondDialogErrors(w, []dialogError{{Name: "serials", Error: tr(loc, "order.not_found", id)}})
+		return
+	}
+	if dialog.User.ID != o.Requester {
+		respondDialogErrors(w, []dialogError{{Name: "serials", Error: tr(loc, "serials.error.owner", o.Ref())}})
+		return
+	}
+	serials, err := parseSerials(dialog.Submission["serials"], o.Count, loc)
+	if err != nil {
+		respondDialogErrors(w, []dialogError{{Name: "serials", Error: err.Error()}})
+		return
 	}
+	h.saveDialog(w, dialog, responseURL, id, "serials", func() error {
+		_, err := h.assets.Register(o, serials, dialog.User.ID)
+		return err
+	})
 }
 
-func (h interactionHandler) postEphemeral(channel, user, text string, params slack.PostMessageParameters) (string, error) {
-	return h.slackClient.PostEphemeral(
+func (h interactionHandler) postEphemeral(client *slack.Client, channel, user, text string, params slack.PostMessageParameters) (string, error) {
+	return client.PostEphemeral(
 		channel,
 		user,
 		slack.MsgOptionText(text, params.EscapeText),
@@ -198,52 +779,102 @@ func (h interactionHandler) postEphemeral(channel, user, text string, params sla
 	)
 }
 
+// sendDialog opens the order dialog, filled with o when it is edited. A
+// draft is replaced by a new one, a submitted order is edited in place.
 func (h interactionHandler) sendDialog(
-	triggerID string) {
+	client *slack.Client,
+	triggerID string,
+	loc string,
+	o *order) error {
 
 	log.Printf("trigger_id: %s", triggerID)
+	var d order
+	callbackID := orderDialogCallback
+	if o != nil {
+		d = *o
+		if d.Status == statusDraft {
+			callbackID += ":" + h.orders.callbacks.Sign(d)
+		} else {
+			callbackID = editDialogPrefix + h.orders.callbacks.Sign(d)
+		}
+	}
+	count, price := "", ""
+	if d.Count > 0 {
+		count = strconv.Itoa(d.Count)
+	}
+	if d.UnitPrice > 0 {
+		price = d.UnitPrice.String()
+	}
 	dialog := slack.Dialog{
-		CallbackId:     "dialog_callback_id",
-		Title:          "dialog test",
+		CallbackId:     callbackID,
+		Title:          tr(loc, "dialog.title"),
 		NotifyOnCancel: true,
 		Elements: []slack.DialogElement{
 			slack.DialogTextElement{
-				Label:       "Item name",
+				Label:       tr(loc, "dialog.item_name"),
 				Name:        "item_name",
 				Type:        "text",
-				Placeholder: "e.g. Keyboard",
-				Hint:        "Type the name of item you are ordering",
+				Placeholder: tr(loc, "dialog.item_name.example"),
+				Hint:        tr(loc, "dialog.item_name.hint"),
+				Value:       d.ItemName,
 			},
 			slack.DialogTextElement{
-				Label:       "Reason of order",
+				Label:       tr(loc, "dialog.reason"),
 				Name:        "item_reason",
 				Type:        "text",
-				Placeholder: "e.g. Because I need a keyboard to work.",
-				Hint:        "This will help your boss to know why you need this",
+				Placeholder: tr(loc, "dialog.reason.example"),
+				Hint:        tr(loc, "dialog.reason.hint"),
+				Optional:    !h.orders.requireReason,
+				Value:       d.Reason,
 			},
 			slack.DialogTextElement{
-				Label:       "URL",
+				Label:       tr(loc, "dialog.url"),
 				Name:        "item_url",
 				Type:        "text",
 				Subtype:     "url",
-				Placeholder: "e.g. http://a.co/d/...",
-				Hint:        "Type URL of item you are ordering",
+				Placeholder: tr(loc, "dialog.url.example"),
+				Hint:        tr(loc, "dialog.url.hint"),
+				Value:       d.ItemURL,
 			},
 			slack.DialogTextElement{
-				Label:       "How many?",
+				Label:       tr(loc, "dialog.count"),
 				Name:        "item_count",
 				Type:        "text",
 				Subtype:     "number",
-				Placeholder: "e.g. 1",
-				Hint:        "How many do you want?",
+				Placeholder: tr(loc, "dialog.count.example"),
+				Hint:        tr(loc, "dialog.count.hint"),
+				Value:       count,
+			},
+			slack.DialogTextElement{
+				Label:       tr(loc, "dialog.price"),
+				Name:        "item_price",
+				Type:        "text",
+				Placeholder: tr(loc, "dialog.price.example"),
+				Hint:        tr(loc, "dialog.price.hint"),
+				Optional:    true,
+				Value:       price,
 			},
 		},
 	}
-
-	if err := h.slackClient.OpenDialog(triggerID, dialog); err != nil {
-		fmt.Printf("\ntest %+v", err)
-		log.Printf("\n[ERROR]: %s", err)
+	if currencies := h.orders.currencies.Currencies(); len(currencies) > 1 {
+		options := make([]slack.DialogElementOption, len(currencies))
+		for i, c := range currencies {
+			options[i] = slack.DialogElementOption{Label: c, Value: c}
+		}
+		selected := currencies[0]
+		if d.Currency != "" {
+			selected = d.Currency
+		}
+		dialog.Elements = append(dialog.Elements, slack.DialogSelectElement{
+			Label:   tr(loc, "dialog.currency"),
+			Name:    "item_currency",
+			Type:    "select",
+			Value:   selected,
+			Options: options,
+		})
 	}
+
+	return client.OpenDialog(triggerID, dialog)
 }
 
 // responseMessage response to the original slackbutton enabled message.
@@ -269,7 +900,41 @@ func responseMessage(w http.ResponseWriter, original slack.Message, title, value
 		},
 	}
 
+	// Posted to the response URL, a message replaces the original only if asked
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		slack.PostMessageParameters
+		ReplaceOriginal bool `json:"replace_original"`
+	}{params, true})
+}
+
+// respondError shows err in loc only to the user who clicked.
+func respondError(w http.ResponseWriter, loc string, err error) {
+	respondEphemeral(w, ":warning: "+errorText(loc, err))
+}
+
+// respondEphemeral shows text only to the user who clicked, leaving the
+// original message untouched.
+func respondEphemeral(w http.ResponseWriter, text string) {
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"response_type":    "ephemeral",
+		"replace_original": false,
+		"text":             text,
+	})
+}
+
+// dialogError tells slack which dialog field was invalid.
+type dialogError struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// respondDialogErrors keeps the dialog open and shows errs next to the fields.
+func respondDialogErrors(w http.ResponseWriter, errs []dialogError) {
 	w.Header().Add("Content-type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(&params)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": errs})
 }
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// postInteraction sends payload to h as slack does and returns the response.
+func postInteraction(h http.Handler, payload interface{}) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(payload)
+	req := httptest.NewRequest(http.MethodPost, "/interaction", strings.NewReader("payload="+url.QueryEscape(string(b))))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// responseURLs records the messages posted to response URLs, by path.
+type responseURLs struct {
+	*httptest.Server
+	mu    sync.Mutex
+	posts map[string][]string
+}
+
+func newResponseURLs(t *testing.T) *responseURLs {
+	r := &responseURLs{posts: map[string][]string{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		r.posts[req.URL.Path] = append(r.posts[req.URL.Path], string(body))
+		r.mu.Unlock()
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestConcurrentInteractions(t *testing.T) {
+	for _, queued := range []bool{false, true} {
+		name := "direct"
+		if queued {
+			name = "queued"
+		}
+		t.Run(name, func(t *testing.T) { testConcurrentInteractions(t, queued) })
+	}
+}
+
+// testConcurrentInteractions clicks the approve and reject buttons of one
+// order by two approvers at once, each click sent several times as slack
+// retries do. Exactly one click may change the order.
+func testConcurrentInteractions(t *testing.T, queued bool) {
+	var jobs *jobQueue
+	if queued {
+		jobs = newJobQueue(256)
+		jobs.Start(4)
+	}
+	h, o := newTestHandler(t, jobs)
+	orders, store := h.orders, h.orders.store
+	orders.approvers = []string{"UBOSS1", "UBOSS2"}
+
+	var mu sync.Mutex
+	var changes []orderChange
+	orders.OnChange(func(c orderChange) {
+		mu.Lock()
+		changes = append(changes, c)
+		mu.Unlock()
+	})
+	urls := newResponseURLs(t)
+
+	// Approve and reject share the token of the message they are posted in
+	token := orders.callbacks.Sign(o)
+	const clicks, retries = 8, 4
+	responses := make([][]*httptest.ResponseRecorder, clicks)
+	var wg sync.WaitGroup
+	for i := 0; i < clicks; i++ {
+		responses[i] = make([]*httptest.ResponseRecorder, retries)
+		user := fmt.Sprintf("UBOSS%d", i%2+1)
+		action := []string{actionApprove, actionReject}[i/2%2]
+		payload := map[string]interface{}{
+			"type":         "interactive_message",
+			"token":        "vt",
+			"callback_id":  "order",
+			"action_ts":    fmt.Sprintf("1500000000.%06d", i),
+			"response_url": fmt.Sprintf("%s/%d", urls.URL, i),
+			"team":         map[string]string{"id": ""},
+			"user":         map[string]string{"id": user, "name": user},
+			"channel":      map[string]string{"id": "C1"},
+			"actions":      []map[string]string{{"name": action, "value": token}},
+		}
+		for j := 0; j < retries; j++ {
+			wg.Add(1)
+			go func(i, j int) {
+				defer wg.Done()
+				responses[i][j] = postInteraction(h, payload)
+			}(i, j)
+		}
+	}
+	wg.Wait()
+	if queued {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := h.jobs.Drain(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(changes) != 1 {
+		t.Fatalf("observers were called %d times: %+v", len(changes), changes)
+	}
+	got, _ := store.Order(o.ID)
+	if got.Status != changes[0].To || (got.Status != statusApproved && got.Status != statusRejected) {
+		t.Errorf("order is %s, observers saw %s", got.Status, changes[0].To)
+	}
+	events := 0
+	for _, e := range got.History {
+		if e.Kind == eventStatus && e.Status != statusPending {
+			events++
+		}
+	}
+	if events != 1 {
+		t.Errorf("%d status events after submission: %+v", events, got.History)
+	}
+
+	// Retries get the response of the first request, and every click is
+	// answered once: right away when refused, else at its response URL
+	succeeded := 0
+	for i, rs := range responses {
+		first := rs[0]
+		for _, r := range rs[1:] {
+			if r.Code != first.Code || r.Body.String() != first.Body.String() {
+				t.Errorf("click %d: retry got %d %q, first request %d %q", i, r.Code, r.Body, first.Code, first.Body)
+			}
+		}
+		answers := urls.posts[fmt.Sprintf("/%d", i)]
+		if first.Body.Len() > 0 {
+			answers = append(answers, first.Body.String())
+		}
+		if len(answers) != 1 {
+			t.Errorf("click %d answered %d times: %q", i, len(answers), answers)
+			continue
+		}
+		if !strings.Contains(answers[0], ":warning:") {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d clicks succeeded, want 1", succeeded)
+	}
+}
+
+// newTestHandler returns a handler for orders with UBOSS as approver and a
+// submitted order of U1.
+func newTestHandler(t *testing.T, jobs *jobQueue) (interactionHandler, order) {
+	newFakeSlack(t)
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaces := newWorkspaceRegistry(store, "xoxb-test", "C1")
+	orders := &orderService{
+		store:     store,
+		threads:   &orderThreads{workspaces: workspaces, store: store},
+		approvers: []string{"UBOSS"},
+		callbacks: newCallbackSigner([]byte("0123456789abcdef")),
+	}
+	h := interactionHandler{
+		workspaces:        workspaces,
+		orders:            orders,
+		verificationToken: "vt",
+		guard:             newInteractionGuard(),
+		jobs:              jobs,
+	}
+	return h, submitOrder(t, orders, "Keyboard")
+}
+
+func TestBusyClickKeepsButton(t *testing.T) {
+	jobs := newJobQueue(1)
+	h, o := newTestHandler(t, jobs)
+	token := h.orders.callbacks.Sign(o)
+	click := func(ts string) *httptest.ResponseRecorder {
+		return postInteraction(h, map[string]interface{}{
+			"type":        "interactive_message",
+			"token":       "vt",
+			"callback_id": "order",
+			"action_ts":   ts,
+			"team":        map[string]string{"id": ""},
+			"user":        map[string]string{"id": "UBOSS", "name": "boss"},
+			"actions":     []map[string]string{{"name": actionApprove, "value": token}},
+		})
+	}
+
+	slot, ok := jobs.Reserve("other")
+	if !ok {
+		t.Fatal("cannot reserve the only slot")
+	}
+	if rec := click("1500000000.000001"); !strings.Contains(rec.Body.String(), "I am busy right now") {
+		t.Fatalf("click on a full queue = %q", rec.Body)
+	}
+	slot.Release()
+
+	// The refused click did not use up the button
+	if rec := click("1500000000.000002"); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatalf("click = %d %q", rec.Code, rec.Body)
+	}
+	jobs.Start(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := jobs.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := h.orders.store.Order(o.ID); got.Status != statusApproved {
+		t.Errorf("order is %s", got.Status)
+	}
+}
+
+func TestDialogSavedByJob(t *testing.T) {
+	jobs := newJobQueue(4)
+	jobs.Start(1)
+	h, o := newTestHandler(t, jobs)
+	urls := newResponseURLs(t)
+	submit := func(user, count string) *httptest.ResponseRecorder {
+		return postInteraction(h, map[string]interface{}{
+			"type":         "dialog_submission",
+			"token":        "vt",
+			"callback_id":  editDialogPrefix + h.orders.callbacks.Sign(o),
+			"response_url": urls.URL + "/" + user,
+			"team":         map[string]string{"id": ""},
+			"user":         map[string]string{"id": user},
+			"submission":   map[string]string{"item_name": "Keyboard", "item_count": count, "item_reason": "new hire"},
+		})
+	}
+
+	// Mistakes keep the dialog open
+	rec := submit("U1", "none")
+	if !strings.Contains(rec.Body.String(), `"name":"item_count"`) {
+		t.Errorf("invalid count = %q", rec.Body)
+	}
+	// Others are acknowledged and answered once saved
+	for _, user := range []string{"U1", "U2"} {
+		if rec := submit(user, "3"); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+			t.Errorf("%s: submission = %d %q", user, rec.Code, rec.Body)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := jobs.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := h.orders.store.Order(o.ID); got.Count != 3 {
+		t.Errorf("order has %d items", got.Count)
+	}
+	if posts := urls.posts["/U1"]; len(posts) != 0 {
+		t.Errorf("U1 got %q", posts)
+	}
+	if posts := urls.posts["/U2"]; len(posts) != 1 || !strings.Contains(posts[0], ":warning:") {
+		t.Errorf("U2 got %q", posts)
+	}
+}
+
+func TestInteractionBody(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	for _, body := range []string{"", "payload", "x=1", "payload=%zz"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/interaction", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("body %q = %d", body, rec.Code)
+		}
+	}
+}
+
+func TestDraftNotSaved(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+	store := h.orders.store
+	last := store.data.LastOrderID
+	// Writing the store fails from now on
+	store.path = filepath.Join(t.TempDir(), "missing", "orderbot.json")
+
+	rec := postInteraction(h, map[string]interface{}{
+		"type":        "dialog_submission",
+		"token":       "vt",
+		"callback_id": orderDialogCallback,
+		"team":        map[string]string{"id": ""},
+		"user":        map[string]string{"id": "U1"},
+		"channel":     map[string]string{"id": "C1"},
+		"submission":  map[string]string{"item_name": "Mouse", "item_count": "1", "item_reason": "broken"},
+	})
+	if !strings.Contains(rec.Body.String(), `"name":"item_name"`) || !strings.Contains(rec.Body.String(), "could not be saved") {
+		t.Errorf("submission = %d %q", rec.Code, rec.Body)
+	}
+	if store.data.LastOrderID != last || len(store.data.Orders) != int(last) {
+		t.Errorf("failed draft was kept: last ID %d, %d orders", store.data.LastOrderID, len(store.data.Orders))
+	}
+}
+
+func TestDialogOpenedRightAway(t *testing.T) {
+	// The queue is not started, jobs would never run
+	jobs := newJobQueue(4)
+	h, o := newTestHandler(t, jobs)
+	fake := newFakeSlack(t)
+	click := func(name, value string) {
+		rec := postInteraction(h, map[string]interface{}{
+			"type":        "interactive_message",
+			"token":       "vt",
+			"callback_id": "order",
+			"trigger_id":  "T" + name,
+			"team":        map[string]string{"id": ""},
+			"user":        map[string]string{"id": "U1", "name": "u1"},
+			"channel":     map[string]string{"id": "C1"},
+			"actions":     []map[string]string{{"name": name, "value": value}},
+		})
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: %d %q", name, rec.Code, rec.Body)
+		}
+	}
+	click(orderStart, "")
+	click(actionEditOrder, h.orders.callbacks.Sign(o))
+
+	opened := 0
+	for _, c := range fake.recorded() {
+		if c.Method == "dialog.open" {
+			opened++
+		}
+	}
+	if opened != 2 {
+		t.Errorf("%d dialogs opened, want 2", opened)
+	}
+	if n := jobs.Stats().Queued; n != 0 {
+		t.Errorf("%d jobs queued", n)
+	}
+}
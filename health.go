@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	// readyCheckTimeout is how long a readiness check may take, e.g. when
+	// the store is locked by a slow write.
+	readyCheckTimeout = 2 * time.Second
+
+	// heartbeatGrace is how late a scheduler may beat, as its work takes time.
+	heartbeatGrace = 2 * time.Minute
+)
+
+// readiness holds the checks telling whether the bot is working, served at
+// readyzPath. healthzPath only tells that the process is up.
+type readiness struct {
+	mu     sync.Mutex
+	checks map[string]func() error
+	now    func() time.Time
+}
+
+func newReadiness() *readiness {
+	return &readiness{checks: map[string]func() error{}, now: time.Now}
+}
+
+// Add registers check under name. It fails by returning an error.
+func (r *readiness) Add(name string, check func() error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks[name] = check
+}
+
+// Heartbeat registers a check failing once the scheduler name stops
+// beating, see heartbeat.
+func (r *readiness) Heartbeat(name string) *heartbeat {
+	b := &heartbeat{}
+	r.Add(name, func() error { return b.check(r.now()) })
+	return b
+}
+
+// readyCheckResult is the outcome of a check in the response of readyzPath.
+type readyCheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Check runs every check at once and returns their results by name.
+func (r *readiness) Check() (map[string]readyCheckResult, bool) {
+	r.mu.Lock()
+	checks := make(map[string]func() error, len(r.checks))
+	for name, check := range r.checks {
+		checks[name] = check
+	}
+	r.mu.Unlock()
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = map[string]readyCheckResult{}
+		ready   = true
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func() error) {
+			defer wg.Done()
+			done := make(chan error, 1)
+			go func() { done <- check() }()
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(readyCheckTimeout):
+				err = fmt.Errorf("no answer within %s", readyCheckTimeout)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				results[name] = readyCheckResult{Status: "fail", Error: err.Error()}
+				ready = false
+				return
+			}
+			results[name] = readyCheckResult{Status: "ok"}
+		}(name, check)
+	}
+	wg.Wait()
+	return results, ready
+}
+
+// serveReady answers 200 if every check passes and 503 otherwise, with the
+// result of each check.
+func (r *readiness) serveReady(w http.ResponseWriter, req *http.Request) {
+	results, ready := r.Check()
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": results,
+	})
+}
+
+// serveHealth answers 200 as long as the process serves HTTP.
+func serveHealth(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// heartbeat tells whether a scheduler is running: it beats before waiting,
+// with the time it expects to beat next. A nil heartbeat does nothing.
+type heartbeat struct {
+	mu  sync.Mutex
+	due time.Time
+}
+
+// Beat records that the scheduler runs and beats again at next.
+func (b *heartbeat) Beat(next time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.due = next
+}
+
+func (b *heartbeat) check(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.due.IsZero():
+		return errors.New("not started")
+	case now.After(b.due.Add(heartbeatGrace)):
+		return fmt.Errorf("late since %s", b.due.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Check reports the listeners which are not authenticated or connected.
+func (m *listenerManager) Check() error {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.listeners))
+	for key := range m.listeners {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	listeners := make([]*SlackListener, len(keys))
+	for i, key := range keys {
+		listeners[i] = m.listeners[key]
+	}
+	m.mu.Unlock()
+
+	var problems []string
+	for i, l := range listeners {
+		if err := l.check(); err != nil {
+			team := keys[i]
+			if team == "" {
+				team = "default workspace"
+			}
+			problems = append(problems, fmt.Sprintf("%s: %s", team, err))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeReady(t *testing.T) {
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	r := newReadiness()
+	r.now = func() time.Time { return now }
+	serve := func() (int, map[string]readyCheckResult) {
+		rec := httptest.NewRecorder()
+		r.serveReady(rec, httptest.NewRequest("GET", readyzPath, nil))
+		var body struct {
+			Status string                      `json:"status"`
+			Checks map[string]readyCheckResult `json:"checks"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if (rec.Code == http.StatusOK) != (body.Status == "ok") {
+			t.Errorf("status %q with code %d", body.Status, rec.Code)
+		}
+		return rec.Code, body.Checks
+	}
+
+	store, err := openOrderStore(filepath.Join(t.TempDir(), "orders.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Add("store", store.Ping)
+	reminders := r.Heartbeat("reminders")
+	reminders.Beat(now.Add(time.Hour))
+	if code, checks := serve(); code != http.StatusOK || len(checks) != 2 || checks["store"].Status != "ok" || checks["reminders"].Status != "ok" {
+		t.Fatalf("ready = %d %+v", code, checks)
+	}
+
+	// Every failing check is reported, not only the first one
+	r.Heartbeat("digest")
+	reminders.Beat(now.Add(-heartbeatGrace - time.Second))
+	r.Add("slack", func() error { return errors.New("T1: RTM is not connected") })
+	code, checks := serve()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("code = %d", code)
+	}
+	want := map[string]readyCheckResult{
+		"store":     {Status: "ok"},
+		"digest":    {Status: "fail", Error: "not started"},
+		"reminders": {Status: "fail", Error: "late since 2024-03-01T08:57:59Z"},
+		"slack":     {Status: "fail", Error: "T1: RTM is not connected"},
+	}
+	if len(checks) != len(want) {
+		t.Errorf("checks = %+v", checks)
+	}
+	for name, w := range want {
+		if checks[name] != w {
+			t.Errorf("%s = %+v, want %+v", name, checks[name], w)
+		}
+	}
+}
+
+func TestReadyCheckTimeout(t *testing.T) {
+	r := newReadiness()
+	release := make(chan struct{})
+	defer close(release)
+	r.Add("store", func() error {
+		<-release
+		return nil
+	})
+	start := time.Now()
+	checks, ready := r.Check()
+	if ready || checks["store"].Error != "no answer within 2s" {
+		t.Errorf("Check = %+v, %v", checks, ready)
+	}
+	if took := time.Since(start); took > readyCheckTimeout+time.Second {
+		t.Errorf("Check took %s", took)
+	}
+}
+
+func TestListenerCheck(t *testing.T) {
+	m := newListenerManager()
+	m.listeners[""] = &SlackListener{authenticated: true, connected: true}
+	if err := m.Check(); err != nil {
+		t.Fatal(err)
+	}
+	m.listeners["T2"] = &SlackListener{authenticated: true}
+	m.listeners["T1"] = &SlackListener{}
+	m.listeners[""].connected = false
+	want := "default workspace: RTM is not connected; T1: auth.test has not succeeded; T2: RTM is not connected"
+	if err := m.Check(); err == nil || err.Error() != want {
+		t.Errorf("Check = %v, want %s", err, want)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// homeOrderLimit is the number of orders listed in each section of the home tab.
+const homeOrderLimit = 20
+
+// block is a Block Kit block. The slack package predates Block Kit.
+type block map[string]interface{}
+
+func mrkdwn(text string) map[string]string {
+	return map[string]string{"type": "mrkdwn", "text": text}
+}
+
+func plainText(text string) map[string]string {
+	return map[string]string{"type": "plain_text", "text": text}
+}
+
+func headerBlock(text string) block {
+	return block{"type": "header", "text": plainText(text)}
+}
+
+func sectionBlock(text string) block {
+	return block{"type": "section", "text": mrkdwn(text)}
+}
+
+func dividerBlock() block {
+	return block{"type": "divider"}
+}
+
+func buttonElement(actionID, text, value, style string) map[string]interface{} {
+	b := map[string]interface{}{
+		"type":      "button",
+		"action_id": actionID,
+		"text":      plainText(text),
+	}
+	if value != "" {
+		b["value"] = value
+	}
+	if style != "" {
+		b["style"] = style
+	}
+	return b
+}
+
+func actionsBlock(elements ...map[string]interface{}) block {
+	return block{"type": "actions", "elements": elements}
+}
+
+// homeTab publishes the App Home dashboard of a user.
+type homeTab struct {
+	workspaces *workspaceRegistry
+	orders     *orderService
+	budgets    *budgetBook
+}
+
+// Publish renders the dashboard of user and publishes it with views.publish.
+func (h *homeTab) Publish(teamID, user string) error {
+	token, err := h.workspaces.Token(teamID)
+	if err != nil {
+		return err
+	}
+	req := map[string]interface{}{
+		"user_id": user,
+		"view": map[string]interface{}{
+			"type":   "home",
+			"blocks": h.blocks(teamID, user, time.Now()),
+		},
+	}
+	if err := callSlackJSON(token, "views.publish", req, nil); err != nil {
+		return fmt.Errorf("failed to publish home of %s: %s", user, err)
+	}
+	return nil
+}
+
+func (h *homeTab) blocks(teamID, user string, now time.Time) []block {
+	loc := h.workspaces.Locale(teamID, user)
+	blocks := []block{
+		actionsBlock(buttonElement(orderStart, tr(loc, "home.new_order"), "", "primary")),
+		headerBlock(tr(loc, "home.open_orders")),
+	}
+
+	mine := h.orders.store.Orders(func(o *order) bool {
+		return o.TeamID == teamID && o.Requester == user && o.isOpen() && o.Status != statusDraft
+	})
+	if len(mine) == 0 {
+		blocks = append(blocks, sectionBlock(tr(loc, "home.no_open_orders")))
+	}
+	for i, o := range mine {
+		if i == homeOrderLimit {
+			blocks = append(blocks, sectionBlock(tr(loc, "home.more", len(mine)-i)))
+			break
+		}
+		blocks = append(blocks, sectionBlock(homeOrderLine(o, loc)))
+	}
+
+	if h.orders.isApprover(user) {
+		blocks = append(blocks, dividerBlock(), headerBlock(tr(loc, "home.to_approve")))
+		pending := h.orders.store.Orders(func(o *order) bool {
+			return o.TeamID == teamID && o.Status == statusPending && o.Requester != user
+		})
+		if len(pending) == 0 {
+			blocks = append(blocks, sectionBlock(tr(loc, "home.nothing_to_approve")))
+		}
+		for i, o := range pending {
+			if i == homeOrderLimit {
+				blocks = append(blocks, sectionBlock(tr(loc, "home.more", len(pending)-i)))
+				break
+			}
+			value := h.orders.callbacks.Sign(o)
+			blocks = append(blocks,
+				sectionBlock(homeOrderLine(o, loc)+"\n"+tr(loc, "home.requested_by", o.Requester, o.Reason)),
+				actionsBlock(
+					buttonElement(actionApprove, tr(loc, "home.approve"), value, "primary"),
+					buttonElement(actionReject, tr(loc, "home.reject"), value, "danger"),
+				),
+			)
+		}
+	}
+
+	if bg, ok := h.budgets.For(user); ok {
+		remaining := h.budgets.Remaining(bg, now)
+		base := h.orders.currencies.Base()
+		blocks = append(blocks,
+			dividerBlock(),
+			headerBlock(tr(loc, "home.budget")),
+			sectionBlock(tr(loc, "home.budget_left", bg.Team,
+				formatMoney(loc, remaining, base), formatMoney(loc, bg.Monthly, base), formatMonth(loc, now))),
+		)
+	}
+	return blocks
+}
+
+// homeOrderLine summarizes o in one line with its status badge and date.
+func homeOrderLine(o order, loc string) string {
+	line := fmt.Sprintf("*%s* %s ×%d", o.Ref(), o.ItemName, o.Count)
+	if o.UnitPrice > 0 {
+		line += fmt.Sprintf(" (%s)", formatMoney(loc, o.Total(), o.Currency))
+	}
+	return line + "\n" + tr(loc, "status."+string(o.Status)) + " · " + formatDate(loc, o.CreatedAt)
+}
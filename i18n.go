@@ -0,0 +1,715 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	localeEN = "en"
+	localeJA = "ja"
+)
+
+// locales are the languages the bot speaks, each with its catalog.
+var locales = map[string]map[string]string{
+	localeEN: catalogEN,
+	localeJA: catalogJA,
+}
+
+// catalogEN is the reference catalog, every other catalog has the same keys.
+var catalogEN = map[string]string{
+	"order.prompt":    "Want to order something?",
+	"order.yes":       "Yes!",
+	"order.cancel":    "Cancel",
+	"order.cancelled": ":x: @%s canceled the request",
+	"order.placed":    ":ok: Your order has been placed!",
+	"order.follow":    "Follow order %s in its thread.",
+	"order.more":      ":ok: Let's add more!",
+	"order.edit_gone": ":warning: This order can no longer be edited.",
+
+	"dialog.title":             "Order something",
+	"dialog.item_name":         "Item name",
+	"dialog.item_name.example": "e.g. Keyboard",
+	"dialog.item_name.hint":    "Type the name of item you are ordering",
+	"dialog.reason":            "Reason of order",
+	"dialog.reason.example":    "e.g. Because I need a keyboard to work.",
+	"dialog.reason.hint":       "This will help your boss to know why you need this",
+	"dialog.url":               "URL",
+	"dialog.url.example":       "e.g. http://a.co/d/...",
+	"dialog.url.hint":          "Type URL of item you are ordering",
+	"dialog.count":             "How many?",
+	"dialog.count.example":     "e.g. 1",
+	"dialog.count.hint":        "How many do you want?",
+	"dialog.price":             "Price per item",
+	"dialog.price.example":     "e.g. 49.99",
+	"dialog.price.hint":        "Used to check your team budget",
+	"dialog.currency":          "Currency",
+	"dialog.error.count":       "Type a number greater than 0",
+	"dialog.error.price":       "Type a price such as 49.99",
+	"dialog.error.currency":    "%s is not accepted",
+	"dialog.error.reason":      "Tell why you need it",
+	"dialog.error.save":        "Your order could not be saved, please try again",
+	"confirm.text":             "Did I get your order right?",
+	"confirm.item_name":        "Item name",
+	"confirm.reason":           "Reason",
+	"confirm.url":              "URL",
+	"confirm.count":            "How many",
+	"confirm.total":            "Total",
+	"confirm.including":        "Including",
+	"confirm.confirm":          "Confirm",
+	"confirm.edit":             "Edit",
+	"confirm.more":             "Add more items",
+	"confirm.cancel":           "Cancel",
+	"home.new_order":           "New order",
+	"home.open_orders":         "Your open orders",
+	"home.no_open_orders":      "You have no open orders.",
+	"home.more":                "_and %d more_",
+	"home.to_approve":          "Waiting for your approval",
+	"home.nothing_to_approve":  "Nothing to approve :tada:",
+	"home.requested_by":        "Requested by <@%s>: %s",
+	"home.approve":             "Approve",
+	"home.reject":              "Reject",
+	"home.budget":              "Budget",
+	"home.budget_left":         "*%s* has *%s* of %s left in %s.",
+	"status.draft":             ":pencil2: Draft",
+	"status.pending":           ":hourglass_flowing_sand: Waiting for approval",
+	"status.approved":          ":white_check_mark: Approved",
+	"status.rejected":          ":no_entry: Rejected",
+	"status.purchased":         ":shopping_trolley: Purchased",
+	"status.delivered":         ":package: Delivered",
+	"status.cancelled":         ":x: Cancelled",
+	"status.issue":             ":rotating_light: Problem reported",
+	"lang.current":             "I talk to you in English (%s).",
+	"lang.set":                 "OK, I will talk to you in English from now on.",
+	"lang.auto":                "OK, I will follow the language of your slack settings.",
+	"lang.usage":               "Usage: `lang`, `lang en`, `lang ja` or `lang auto`",
+	"lang.source.preference":   "your preference",
+	"lang.source.slack":        "your slack settings",
+	"lang.source.default":      "the default",
+	"date.format":              "Jan 2, 2006",
+	"month.format":             "January",
+
+	"order.not_found":      "Order #%d not found",
+	"order.requester_only": ":warning: Order %s can only be edited by <@%s>.",
+	"order.joined":         ":handshake: You joined order %s",
+	"order.joined_total":   "%d in total now, follow it in its thread.",
+	"delivery.thanks":      ":white_check_mark: Thanks for confirming!",
+	"delivery.sorry":       ":rotating_light: Sorry about that!",
+	"delivery.assigned":    "I let %s know, follow order %s in its thread.",
+
+	"tracking.no_carriers":    ":warning: No carriers are configured, ask an admin to set up tracking.",
+	"tracking.title":          "Tracking for %s",
+	"tracking.carrier":        "Carrier",
+	"tracking.number":         "Tracking number",
+	"tracking.number.example": "e.g. 1Z999AA10123456784",
+	"tracking.error.number":   "Type the tracking number",
+
+	"charges.not_allowed":        ":no_entry: Only purchasers and approvers can change the charges.",
+	"charges.closed":             ":warning: Order %s is %s, charges can only change before it is purchased.",
+	"charges.title":              "Charges for %s",
+	"charges.shipping":           "Shipping",
+	"charges.shipping.example":   "e.g. 5.99",
+	"charges.tax_region":         "Tax region",
+	"charges.tax_rate":           "Tax rate (%)",
+	"charges.tax_rate.example":   "e.g. 8.25",
+	"charges.tax_rate.hint":      "Leave empty to use the rate of the tax region",
+	"charges.tax_amount":         "Tax amount",
+	"charges.tax_amount.example": "e.g. 12.34",
+	"charges.tax_amount.hint":    "The exact tax of the invoice, used instead of the rate",
+	"charges.discounts":          "Discounts and coupons",
+	"charges.discounts.example":  "Coupon SPRING24 10.00",
+	"charges.discounts.hint":     "One per line, the amount last",
+	"charges.error.amount":       "Type an amount such as 12.34",
+	"charges.error.region":       "Unknown region %s",
+	"charges.error.rate":         "Type a percentage up to 100",
+	"charges.error.discount":     "End %q with an amount such as 10.00",
+
+	"serials.title":       "Serial numbers for %s",
+	"serials.register":    "Register",
+	"serials.label":       "Serial numbers",
+	"serials.hint":        "The serial number is printed on the box or under the device",
+	"serials.hint.many":   "One serial number per line, %d in total",
+	"serials.error.owner": "Only the requester of %s can register it",
+	"serials.error.twice": "%s is listed twice",
+	"serials.error.count": "Type %d serial number(s), not %d",
+	"dialog.save":         "Save",
+
+	"apikey.admins_only":     ":no_entry: Only admins can manage API keys.",
+	"apikey.usage":           "Usage: `apikey create <name> [reader|writer|approver|admin]`, `apikey list` or `apikey revoke <id>`",
+	"apikey.created":         "Created API key `%s` (%s) with the %s role. It is shown only once:\n```%s```",
+	"apikey.none":            "There are no API keys.",
+	"apikey.line":            "`%s` %s (%s) created by <@%s> on %s",
+	"apikey.revoked_tag":     " _revoked_",
+	"apikey.revoked":         "Revoked API key `%s`.",
+	"jobs.admins_only":       ":no_entry: Only admins can see the job queue.",
+	"jobs.none":              "Interactions are processed right away, there is no job queue.",
+	"jobs.queue":             "Interaction queue: %s",
+	"jobs.wait":              "up to %s",
+	"jobs.wait.longer":       "longer",
+	"jobs.busy":              ":hourglass: I am busy right now, please try again in a moment.",
+	"assets.admins_only":     ":no_entry: Only admins can export assets.",
+	"assets.usage":           "Usage: `assets`, `assets @user` or `assets export`",
+	"assets.none":            "<@%s> has no assets.",
+	"assets.list":            "Assets of <@%s>:",
+	"assets.line":            "• `%s` %s (%s), S/N %s, order #%d, bought %s",
+	"assets.warranty":        ", warranty until %s",
+	"email.usage":            "Usage: `email <address> [event,...]` or `email off`. Events: %s",
+	"email.off":              "Email notifications are off.",
+	"email.current":          "Emailing %s about %s.",
+	"email.all_events":       "all events",
+	"email.invalid":          ":warning: %q is not an email address",
+	"email.unknown":          ":warning: unknown event %q. %s",
+	"email.set":              "Will email %s.",
+	"receipts.complete":      ":white_check_mark: Every purchased order has a receipt.",
+	"receipts.missing":       "%d purchased order(s) are missing a receipt. Drop the receipt in the order thread:",
+	"receipts.line":          "• %s %s for <@%s>, %s",
+	"webhooks.admins_only":   ":no_entry: Only admins can manage webhooks.",
+	"webhooks.usage":         "Usage: `webhooks`, `webhooks add <url> [event,...]`, `webhooks remove <id>` or `webhooks test <id>`",
+	"webhooks.unknown":       ":warning: unknown event %q",
+	"webhooks.added":         "Added webhook `%s` for %s. Verify `X-Orderbot-Signature` with this secret, shown only once:\n```%s```",
+	"webhooks.removed":       "Removed webhook `%s`.",
+	"webhooks.not_found":     ":warning: webhook %s not found",
+	"webhooks.pinged":        "Queued a ping to webhook `%s`. Check `webhooks` for the result.",
+	"webhooks.none":          "There are no webhooks. Add one with `webhooks add <url>`.",
+	"webhooks.all_events":    "all events",
+	"webhooks.no_deliveries": "no deliveries yet",
+	"webhooks.attempts":      "%d attempt(s)",
+	"webhooks.next":          ", next at %s",
+
+	"duplicate.text":             ":warning: %s ordered this %s, %s: %s %s",
+	"duplicate.you":              "You",
+	"duplicate.today":            "today",
+	"duplicate.yesterday":        "yesterday",
+	"duplicate.days_ago":         "%d days ago",
+	"duplicate.status.pending":   "still pending",
+	"duplicate.status.approved":  "approved, not purchased yet",
+	"duplicate.status.purchased": "already purchased",
+	"duplicate.status.delivered": "already delivered",
+	"duplicate.status.issue":     "with a delivery problem",
+	"duplicate.join":             "Join %s instead",
+
+	"status.by": "%s by @%s",
+
+	"state.draft":     "draft",
+	"state.pending":   "pending",
+	"state.approved":  "approved",
+	"state.rejected":  "rejected",
+	"state.purchased": "purchased",
+	"state.delivered": "delivered",
+	"state.cancelled": "cancelled",
+	"state.issue":     "issue",
+
+	"button.error.invalid": "this button is not valid, use the latest message about the order",
+	"button.error.expired": "this button has expired, use the latest message about the order",
+	"button.error.stale":   "order %s is %s now, this button is out of date",
+	"button.error.changed": "order %s was changed since, use the latest message about the order",
+	"button.error.used":    "you used this button already",
+
+	"order.error.not_found":       "order #%d not found",
+	"order.error.changed":         "order %s was changed meanwhile, try again",
+	"order.error.transition":      "order %s is %s and cannot be %s",
+	"order.error.rate":            "cannot approve %s without an exchange rate: %s",
+	"order.error.stage":           "order %s needs approval from %s first (policy %s)",
+	"order.error.reason":          "order %s needs a reason, edit it to add one",
+	"order.error.submit":          "only <@%s> can submit order %s",
+	"order.error.approve":         "you are not allowed to approve orders",
+	"order.error.purchase":        "only purchasers and approvers can mark order %s as purchased",
+	"order.error.deliver":         "only <@%s>, purchasers and approvers can mark order %s as delivered",
+	"order.error.issue":           "only <@%s> or an approver can report a problem with order %s",
+	"order.error.cancel":          "only <@%s> or an approver can cancel order %s",
+	"order.error.edit_owner":      "only <@%s> can edit order %s",
+	"order.error.edit_status":     "order %s is %s and can no longer be edited",
+	"order.error.join_draft":      "order %s cannot be joined to another order",
+	"order.error.join_status":     "order %s is %s and cannot be joined anymore",
+	"order.error.join_own":        "order %s is yours already",
+	"order.error.charges_role":    "only purchasers and approvers can change the charges of order %s",
+	"order.error.charges_state":   "order %s is %s, charges can only change before it is purchased",
+	"order.error.discounts":       "the discounts are more than the order",
+	"order.error.carrier":         "unknown carrier %q",
+	"order.error.tracking":        "the tracking number is empty",
+	"order.error.tracking_state":  "order %s is %s, tracking can be added once it is purchased",
+	"order.error.assets_twice":    "order #%d has assets already",
+	"order.error.assets_category": "order %s is not in an asset category",
+
+	"policy.rule":           "%s: %s",
+	"policy.error.blocked":  "order %s is blocked by policy %s: %s",
+	"policy.error.approved": "order %s was approved already",
+	"policy.check.quantity": "at most %d can be ordered at once",
+	"policy.check.domain":   "%s is not an allowed shop",
+	"policy.check.reason":   "explain the reason in at least %d characters",
+	"policy.check.cap":      "<@%s> would go over the monthly cap of %s (%s spent this month)",
+	"policy.check.required": "required for these items",
+
+	"order_text.error.price": "%q is not a price, write it such as @49.99",
+	"order_text.error.count": "%d is not a quantity from 1 to %d",
+}
+
+var catalogJA = map[string]string{
+	"order.prompt":    "何か注文しますか？",
+	"order.yes":       "はい！",
+	"order.cancel":    "キャンセル",
+	"order.cancelled": ":x: @%s がリクエストをキャンセルしました",
+	"order.placed":    ":ok: 注文を受け付けました！",
+	"order.follow":    "注文 %s の進捗はスレッドで確認できます。",
+	"order.more":      ":ok: 追加しましょう！",
+	"order.edit_gone": ":warning: この注文はもう編集できません。",
+
+	"dialog.title":             "注文する",
+	"dialog.item_name":         "品名",
+	"dialog.item_name.example": "例: キーボード",
+	"dialog.item_name.hint":    "注文する品物の名前を入力してください",
+	"dialog.reason":            "注文の理由",
+	"dialog.reason.example":    "例: 仕事でキーボードが必要なため",
+	"dialog.reason.hint":       "承認者が必要性を判断する助けになります",
+	"dialog.url":               "URL",
+	"dialog.url.example":       "例: http://a.co/d/...",
+	"dialog.url.hint":          "注文する品物のURLを入力してください",
+	"dialog.count":             "数量",
+	"dialog.count.example":     "例: 1",
+	"dialog.count.hint":        "いくつ必要ですか？",
+	"dialog.price":             "単価",
+	"dialog.price.example":     "例: 49.99",
+	"dialog.price.hint":        "チームの予算の確認に使います",
+	"dialog.currency":          "通貨",
+	"dialog.error.count":       "1以上の数を入力してください",
+	"dialog.error.price":       "49.99 のように価格を入力してください",
+	"dialog.error.currency":    "%s は使えません",
+	"dialog.error.reason":      "必要な理由を入力してください",
+	"dialog.error.save":        "注文を保存できませんでした。もう一度お試しください",
+	"confirm.text":             "この内容でよろしいですか？",
+	"confirm.item_name":        "品名",
+	"confirm.reason":           "理由",
+	"confirm.url":              "URL",
+	"confirm.count":            "数量",
+	"confirm.total":            "合計",
+	"confirm.including":        "内訳",
+	"confirm.confirm":          "確定",
+	"confirm.edit":             "編集",
+	"confirm.more":             "他の品物も追加",
+	"confirm.cancel":           "キャンセル",
+	"home.new_order":           "新しい注文",
+	"home.open_orders":         "進行中の注文",
+	"home.no_open_orders":      "進行中の注文はありません。",
+	"home.more":                "_他 %d 件_",
+	"home.to_approve":          "承認待ち",
+	"home.nothing_to_approve":  "承認待ちの注文はありません :tada:",
+	"home.requested_by":        "<@%s> の注文: %s",
+	"home.approve":             "承認",
+	"home.reject":              "却下",
+	"home.budget":              "予算",
+	"home.budget_left":         "*%s* の残り予算は *%s* です（%s 中、%s）。",
+	"status.draft":             ":pencil2: 下書き",
+	"status.pending":           ":hourglass_flowing_sand: 承認待ち",
+	"status.approved":          ":white_check_mark: 承認済み",
+	"status.rejected":          ":no_entry: 却下",
+	"status.purchased":         ":shopping_trolley: 購入済み",
+	"status.delivered":         ":package: 配達済み",
+	"status.cancelled":         ":x: キャンセル",
+	"status.issue":             ":rotating_light: 問題あり",
+	"lang.current":             "日本語でお話しします（%s）。",
+	"lang.set":                 "これからは日本語でお話しします。",
+	"lang.auto":                "slack の言語設定に合わせます。",
+	"lang.usage":               "使い方: `lang`、`lang en`、`lang ja`、`lang auto`",
+	"lang.source.preference":   "設定済み",
+	"lang.source.slack":        "slack の設定",
+	"lang.source.default":      "既定",
+	"date.format":              "2006年1月2日",
+	"month.format":             "1月",
+
+	"order.not_found":      "注文 #%d が見つかりません",
+	"order.requester_only": ":warning: 注文 %s を編集できるのは <@%s> だけです。",
+	"order.joined":         ":handshake: 注文 %s に参加しました",
+	"order.joined_total":   "合計 %d 個になりました。進捗はスレッドで確認できます。",
+	"delivery.thanks":      ":white_check_mark: ご確認ありがとうございます！",
+	"delivery.sorry":       ":rotating_light: 申し訳ありません！",
+	"delivery.assigned":    "%s に伝えました。注文 %s の進捗はスレッドで確認できます。",
+
+	"tracking.no_carriers":    ":warning: 配送業者が設定されていません。管理者に追跡の設定を依頼してください。",
+	"tracking.title":          "%s の追跡番号",
+	"tracking.carrier":        "配送業者",
+	"tracking.number":         "追跡番号",
+	"tracking.number.example": "例: 1Z999AA10123456784",
+	"tracking.error.number":   "追跡番号を入力してください",
+
+	"charges.not_allowed":        ":no_entry: 送料・税・割引を変更できるのは購入担当者と承認者だけです。",
+	"charges.closed":             ":warning: 注文 %s は %s です。送料・税・割引は購入前にのみ変更できます。",
+	"charges.title":              "%s の送料・税・割引",
+	"charges.shipping":           "送料",
+	"charges.shipping.example":   "例: 5.99",
+	"charges.tax_region":         "税の地域",
+	"charges.tax_rate":           "税率 (%)",
+	"charges.tax_rate.example":   "例: 8.25",
+	"charges.tax_rate.hint":      "空欄の場合は税の地域の税率を使います",
+	"charges.tax_amount":         "税額",
+	"charges.tax_amount.example": "例: 12.34",
+	"charges.tax_amount.hint":    "請求書どおりの税額で、税率の代わりに使います",
+	"charges.discounts":          "割引・クーポン",
+	"charges.discounts.example":  "クーポン SPRING24 10.00",
+	"charges.discounts.hint":     "1行に1つ、金額を最後に書いてください",
+	"charges.error.amount":       "12.34 のように金額を入力してください",
+	"charges.error.region":       "%s という地域はありません",
+	"charges.error.rate":         "100 以下の割合を入力してください",
+	"charges.error.discount":     "%q の最後に 10.00 のように金額を書いてください",
+
+	"serials.title":       "%s のシリアル番号",
+	"serials.register":    "登録",
+	"serials.label":       "シリアル番号",
+	"serials.hint":        "シリアル番号は箱か本体の裏に記載されています",
+	"serials.hint.many":   "1行に1つ、全部で %d 個入力してください",
+	"serials.error.owner": "%s を登録できるのは注文者だけです",
+	"serials.error.twice": "%s が重複しています",
+	"serials.error.count": "シリアル番号を %d 個入力してください（%d 個あります）",
+	"dialog.save":         "保存",
+
+	"apikey.admins_only":     ":no_entry: API キーを管理できるのは管理者だけです。",
+	"apikey.usage":           "使い方: `apikey create <name> [reader|writer|approver|admin]`、`apikey list`、`apikey revoke <id>`",
+	"apikey.created":         "API キー `%s`（%s）を作成しました。ロールは %s です。一度だけ表示します:\n```%s```",
+	"apikey.none":            "API キーはありません。",
+	"apikey.line":            "`%s` %s（%s）<@%s> が %s に作成",
+	"apikey.revoked_tag":     " _無効_",
+	"apikey.revoked":         "API キー `%s` を無効にしました。",
+	"jobs.admins_only":       ":no_entry: ジョブキューを見られるのは管理者だけです。",
+	"jobs.none":              "操作はすぐに処理されるため、ジョブキューはありません。",
+	"jobs.queue":             "操作のキュー: %s",
+	"jobs.wait":              "%s 以内",
+	"jobs.wait.longer":       "それ以上",
+	"jobs.busy":              ":hourglass: ただいま混み合っています。少し待ってからもう一度お試しください。",
+	"assets.admins_only":     ":no_entry: 資産をエクスポートできるのは管理者だけです。",
+	"assets.usage":           "使い方: `assets`、`assets @user`、`assets export`",
+	"assets.none":            "<@%s> の資産はありません。",
+	"assets.list":            "<@%s> の資産:",
+	"assets.line":            "• `%s` %s（%s）、S/N %s、注文 #%d、購入日 %s",
+	"assets.warranty":        "、保証期限 %s",
+	"email.usage":            "使い方: `email <address> [event,...]`、`email off`。イベント: %s",
+	"email.off":              "メール通知はオフです。",
+	"email.current":          "%s に %s をメールしています。",
+	"email.all_events":       "すべてのイベント",
+	"email.invalid":          ":warning: %q はメールアドレスではありません",
+	"email.unknown":          ":warning: %q というイベントはありません。%s",
+	"email.set":              "%s にメールします。",
+	"receipts.complete":      ":white_check_mark: 購入済みの注文にはすべて領収書があります。",
+	"receipts.missing":       "領収書のない購入済みの注文が %d 件あります。注文のスレッドに領収書を添付してください:",
+	"receipts.line":          "• %s %s（<@%s>）%s",
+	"webhooks.admins_only":   ":no_entry: Webhook を管理できるのは管理者だけです。",
+	"webhooks.usage":         "使い方: `webhooks`、`webhooks add <url> [event,...]`、`webhooks remove <id>`、`webhooks test <id>`",
+	"webhooks.unknown":       ":warning: %q というイベントはありません",
+	"webhooks.added":         "Webhook `%s` を %s に追加しました。`X-Orderbot-Signature` はこのシークレットで検証してください。一度だけ表示します:\n```%s```",
+	"webhooks.removed":       "Webhook `%s` を削除しました。",
+	"webhooks.not_found":     ":warning: Webhook %s が見つかりません",
+	"webhooks.pinged":        "Webhook `%s` に ping を送ります。結果は `webhooks` で確認できます。",
+	"webhooks.none":          "Webhook はありません。`webhooks add <url>` で追加できます。",
+	"webhooks.all_events":    "すべてのイベント",
+	"webhooks.no_deliveries": "まだ配信はありません",
+	"webhooks.attempts":      "%d 回試行",
+	"webhooks.next":          "、次回 %s",
+
+	"duplicate.text":             ":warning: %sが%s同じ品物を注文しています（%s）: %s %s",
+	"duplicate.you":              "あなた",
+	"duplicate.today":            "今日",
+	"duplicate.yesterday":        "昨日",
+	"duplicate.days_ago":         "%d 日前に",
+	"duplicate.status.pending":   "承認待ち",
+	"duplicate.status.approved":  "承認済み、未購入",
+	"duplicate.status.purchased": "購入済み",
+	"duplicate.status.delivered": "配達済み",
+	"duplicate.status.issue":     "配送に問題あり",
+	"duplicate.join":             "代わりに %s に参加",
+
+	"status.by": "%s（@%s）",
+
+	"state.draft":     "下書き",
+	"state.pending":   "承認待ち",
+	"state.approved":  "承認済み",
+	"state.rejected":  "却下",
+	"state.purchased": "購入済み",
+	"state.delivered": "配達済み",
+	"state.cancelled": "キャンセル",
+	"state.issue":     "問題あり",
+
+	"button.error.invalid": "このボタンは無効です。注文の最新のメッセージを使ってください",
+	"button.error.expired": "このボタンは期限切れです。注文の最新のメッセージを使ってください",
+	"button.error.stale":   "注文 %s は%sになっています。このボタンは古くなりました",
+	"button.error.changed": "注文 %s はその後変更されました。注文の最新のメッセージを使ってください",
+	"button.error.used":    "このボタンはもう使いました",
+
+	"order.error.not_found":       "注文 #%d が見つかりません",
+	"order.error.changed":         "注文 %s はその間に変更されました。もう一度試してください",
+	"order.error.transition":      "注文 %s は%sのため、%sにできません",
+	"order.error.rate":            "為替レートがないため %s を承認できません: %s",
+	"order.error.stage":           "注文 %s は先に %s の承認が必要です（ポリシー %s）",
+	"order.error.reason":          "注文 %s には理由が必要です。編集して追加してください",
+	"order.error.submit":          "<@%s> だけが注文 %s を申請できます",
+	"order.error.approve":         "あなたには注文を承認する権限がありません",
+	"order.error.purchase":        "注文 %s を購入済みにできるのは購入担当者と承認者だけです",
+	"order.error.deliver":         "<@%s>、購入担当者、承認者だけが注文 %s を配達済みにできます",
+	"order.error.issue":           "<@%s> か承認者だけが注文 %s の問題を報告できます",
+	"order.error.cancel":          "<@%s> か承認者だけが注文 %s をキャンセルできます",
+	"order.error.edit_owner":      "<@%s> だけが注文 %s を編集できます",
+	"order.error.edit_status":     "注文 %s は%sのため、もう編集できません",
+	"order.error.join_draft":      "注文 %s は他の注文に参加できません",
+	"order.error.join_status":     "注文 %s は%sのため、もう参加できません",
+	"order.error.join_own":        "注文 %s はすでにあなたの注文です",
+	"order.error.charges_role":    "注文 %s の費用を変更できるのは購入担当者と承認者だけです",
+	"order.error.charges_state":   "注文 %s は%sです。費用を変更できるのは購入前だけです",
+	"order.error.discounts":       "割引が注文の金額を超えています",
+	"order.error.carrier":         "%q という配送業者はありません",
+	"order.error.tracking":        "追跡番号が空です",
+	"order.error.tracking_state":  "注文 %s は%sです。追跡番号は購入後に追加できます",
+	"order.error.assets_twice":    "注文 #%d の資産はすでに登録されています",
+	"order.error.assets_category": "注文 %s は資産のカテゴリではありません",
+
+	"policy.rule":           "%s: %s",
+	"policy.error.blocked":  "注文 %s はポリシー %s により止められています: %s",
+	"policy.error.approved": "注文 %s はすでに承認されています",
+	"policy.check.quantity": "一度に注文できるのは %d 個までです",
+	"policy.check.domain":   "%s は許可されたショップではありません",
+	"policy.check.reason":   "理由を %d 文字以上で説明してください",
+	"policy.check.cap":      "<@%s> は月の上限 %s を超えます（今月の支出 %s）",
+	"policy.check.required": "この品物には必要です",
+
+	"order_text.error.price": "%q は価格ではありません。@49.99 のように書いてください",
+	"order_text.error.count": "%d は数量ではありません。1 から %d までで書いてください",
+}
+
+// tr returns the message key in loc formatted with args. Unknown locales
+// fall back to English.
+func tr(loc, key string, args ...interface{}) string {
+	msg, ok := locales[loc][key]
+	if !ok {
+		if msg, ok = catalogEN[key]; !ok {
+			log.Printf("[ERROR] Unknown message %q", key)
+			return key
+		}
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// trError is an error shown to users, made of a message key and its
+// arguments. Error returns it in English for logs and the REST API,
+// errorText in the language of the user.
+type trError struct {
+	key  string
+	args []interface{}
+}
+
+func trErrorf(key string, args ...interface{}) error {
+	return trError{key: key, args: args}
+}
+
+func (e trError) Error() string {
+	return tr(localeEN, e.key, e.args...)
+}
+
+// errorText returns err in loc. Arguments which are trErrors are
+// translated too, other errors are returned as they are.
+func errorText(loc string, err error) string {
+	e, ok := err.(trError)
+	if !ok {
+		return err.Error()
+	}
+	args := make([]interface{}, len(e.args))
+	for i, arg := range e.args {
+		if inner, ok := arg.(trError); ok {
+			arg = errorText(loc, inner)
+		}
+		args[i] = arg
+	}
+	return tr(loc, e.key, args...)
+}
+
+// statusName is the name of status in a sentence, e.g. "approved".
+func statusName(status orderStatus) trError {
+	return trError{key: "state." + string(status)}
+}
+
+// normalizeLocale maps a slack locale such as "ja-JP" to a supported
+// locale, or returns "".
+func normalizeLocale(s string) string {
+	s = strings.ToLower(s)
+	if i := strings.IndexAny(s, "-_"); i >= 0 {
+		s = s[:i]
+	}
+	if _, ok := locales[s]; ok {
+		return s
+	}
+	return ""
+}
+
+// currencySymbols are written before amounts instead of the currency code.
+var currencySymbols = map[string]string{"USD": "$", "EUR": "€", "GBP": "£", "JPY": "¥"}
+
+// wholeCurrencies have no minor unit and are rounded to the unit.
+var wholeCurrencies = map[string]bool{"JPY": true}
+
+// formatMoney formats a in currency for loc with grouped digits, e.g.
+// "$1,234.50", or "1,235円" for yen in Japanese.
+func formatMoney(loc string, a amount, currency string) string {
+	sign := ""
+	if a < 0 {
+		sign = "-"
+		a = -a
+	}
+	var number string
+	if wholeCurrencies[currency] {
+		number = groupDigits(int64((a + 50) / 100))
+	} else {
+		number = fmt.Sprintf("%s.%02d", groupDigits(int64(a/100)), a%100)
+	}
+	switch {
+	case loc == localeJA && currency == "JPY":
+		return sign + number + "円"
+	case currencySymbols[currency] != "":
+		return sign + currencySymbols[currency] + number
+	case currency == "":
+		return sign + number
+	}
+	return sign + number + " " + currency
+}
+
+// groupDigits formats n with a comma every three digits.
+func groupDigits(n int64) string {
+	s := fmt.Sprint(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// formatDate formats the date of t for loc.
+func formatDate(loc string, t time.Time) string {
+	return t.Format(tr(loc, "date.format"))
+}
+
+// formatMonth formats the month of t for loc.
+func formatMonth(loc string, t time.Time) string {
+	return t.Format(tr(loc, "month.format"))
+}
+
+// SetLanguage stores the language user chose, "" to follow slack.
+func (s *orderStore) SetLanguage(user, loc string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if loc == "" {
+		delete(s.data.Languages, user)
+	} else {
+		s.data.Languages[user] = loc
+	}
+	return s.flush()
+}
+
+// Language returns the language user chose.
+func (s *orderStore) Language(user string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	loc, ok := s.data.Languages[user]
+	return loc, ok
+}
+
+// Locale returns the locale to talk to user in: the language they chose,
+// else the locale of their slack settings, else the default locale.
+func (r *workspaceRegistry) Locale(teamID, user string) string {
+	loc, _ := r.locale(teamID, user)
+	return loc
+}
+
+// knownLocale is Locale without asking slack, for answers which cannot wait
+// for users.info. The slack settings are used once they are cached.
+func (r *workspaceRegistry) knownLocale(teamID, user string) string {
+	if loc, ok := r.store.Language(user); ok {
+		return loc
+	}
+	r.mu.Lock()
+	loc := r.locales[teamID+"/"+user]
+	r.mu.Unlock()
+	if loc != "" {
+		return loc
+	}
+	if r.defaultLocale != "" {
+		return r.defaultLocale
+	}
+	return localeEN
+}
+
+// locale is Locale which also tells where the locale comes from.
+func (r *workspaceRegistry) locale(teamID, user string) (loc, source string) {
+	if loc, ok := r.store.Language(user); ok {
+		return loc, "preference"
+	}
+	if loc := r.slackLocale(teamID, user); loc != "" {
+		return loc, "slack"
+	}
+	if r.defaultLocale != "" {
+		return r.defaultLocale, "default"
+	}
+	return localeEN, "default"
+}
+
+// slackLocale returns the supported locale of the slack settings of user.
+// Lookups are cached, locales rarely change.
+func (r *workspaceRegistry) slackLocale(teamID, user string) string {
+	key := teamID + "/" + user
+	r.mu.Lock()
+	loc, ok := r.locales[key]
+	r.mu.Unlock()
+	if ok {
+		return loc
+	}
+
+	token, err := r.Token(teamID)
+	if err != nil {
+		return ""
+	}
+	var res struct {
+		User slack.User `json:"user"`
+	}
+	values := url.Values{"user": {user}, "include_locale": {"true"}}
+	if err := callSlackForm(token, "users.info", values, &res); err != nil {
+		log.Printf("[ERROR] Failed to get the locale of %s: %s", user, err)
+		return ""
+	}
+	loc = normalizeLocale(res.User.Locale)
+	r.mu.Lock()
+	r.locales[key] = loc
+	r.mu.Unlock()
+	return loc
+}
+
+// locale returns the locale to answer the commands of user in.
+func (s *SlackListener) locale(user string) string {
+	return s.orders.threads.workspaces.Locale(s.teamID, user)
+}
+
+// handleLangCommand shows or changes the language the bot talks to the
+// sender in:
+//
+//	lang             the current language
+//	lang en|ja       talk in that language
+//	lang auto        follow the slack settings
+func (s *SlackListener) handleLangCommand(channel string, msg slack.Msg, args []string) error {
+	workspaces := s.orders.threads.workspaces
+	switch {
+	case len(args) == 0:
+		loc, source := workspaces.locale(s.teamID, msg.User)
+		return s.replyEphemeral(channel, msg, tr(loc, "lang.current", tr(loc, "lang.source."+source)))
+	case len(args) == 1 && strings.EqualFold(args[0], "auto"):
+		if err := s.orders.store.SetLanguage(msg.User, ""); err != nil {
+			return err
+		}
+		return s.replyEphemeral(channel, msg, tr(s.locale(msg.User), "lang.auto"))
+	case len(args) == 1 && normalizeLocale(args[0]) != "":
+		loc := normalizeLocale(args[0])
+		if err := s.orders.store.SetLanguage(msg.User, loc); err != nil {
+			return err
+		}
+		return s.replyEphemeral(channel, msg, tr(loc, "lang.set"))
+	}
+	return s.replyEphemeral(channel, msg, tr(s.locale(msg.User), "lang.usage"))
+}
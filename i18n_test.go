@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCatalogs(t *testing.T) {
+	if err := checkCatalogs(); err != nil {
+		t.Error(err)
+	}
+}
+
+// checkCatalogs reports keys missing from a catalog and messages whose
+// format verbs differ from English, so a bad translation fails the tests
+// rather than in front of a user.
+func checkCatalogs() error {
+	var problems []string
+	for loc, catalog := range locales {
+		for key, en := range catalogEN {
+			msg, ok := catalog[key]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing %q", loc, key))
+			} else if formatVerbs(msg) != formatVerbs(en) {
+				problems = append(problems, fmt.Sprintf("%s: %q has other format verbs than %s", loc, key, localeEN))
+			}
+		}
+		for key := range catalog {
+			if _, ok := catalogEN[key]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: unknown %q", loc, key))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid message catalogs:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// formatVerbs returns the format verbs of msg in order, e.g. "sd".
+func formatVerbs(msg string) string {
+	var verbs []byte
+	for i := 0; i < len(msg)-1; i++ {
+		if msg[i] != '%' {
+			continue
+		}
+		i++
+		if msg[i] != '%' {
+			verbs = append(verbs, msg[i])
+		}
+	}
+	return string(verbs)
+}
+
+func TestErrorText(t *testing.T) {
+	err := trErrorf("policy.error.blocked", "#7", "cap", trErrorf("policy.check.quantity", 3))
+	if want := "order #7 is blocked by policy cap: at most 3 can be ordered at once"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err, want)
+	}
+	if want := "注文 #7 はポリシー cap により止められています: 一度に注文できるのは 3 個までです"; errorText(localeJA, err) != want {
+		t.Errorf("errorText = %q, want %q", errorText(localeJA, err), want)
+	}
+	err = trErrorf("order.error.transition", "#7", statusName(statusDraft), statusName(statusApproved))
+	if want := "注文 #7 は下書きのため、承認済みにできません"; errorText(localeJA, err) != want {
+		t.Errorf("errorText = %q, want %q", errorText(localeJA, err), want)
+	}
+	if got := errorText(localeJA, errors.New("disk full")); got != "disk full" {
+		t.Errorf("errorText of another error = %q", got)
+	}
+}
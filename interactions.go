@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	// interactionTTL is how long responses are kept for retries. Slack
+	// retries within a few seconds, a slow network may take longer.
+	interactionTTL = 10 * time.Minute
+
+	// interactionWait is how long a retry waits for the first request.
+	// Slack gives up on a response after three seconds.
+	interactionWait = 2500 * time.Millisecond
+)
+
+// interactionGuard makes the interaction pipeline safe to retry and to run
+// concurrently: a retry of an interaction gets the response of the first
+// request instead of running again, and interactions about the same order
+// run one at a time. A nil guard does neither.
+type interactionGuard struct {
+	mu     sync.Mutex
+	seen   map[string]*interactionResponse
+	orders map[int64]*orderLock
+	now    func() time.Time
+}
+
+// interactionResponse is the response to an interaction, done once written.
+type interactionResponse struct {
+	done   chan struct{}
+	at     time.Time
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+// orderLock serializes the interactions about one order. It is dropped
+// once nobody holds or waits for it.
+type orderLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newInteractionGuard() *interactionGuard {
+	return &interactionGuard{
+		seen:   map[string]*interactionResponse{},
+		orders: map[int64]*orderLock{},
+		now:    time.Now,
+	}
+}
+
+// interactionKey identifies an interaction across retries: slack sends the
+// same action timestamp again. It is empty if there is none.
+func interactionKey(message slack.AttachmentActionCallback, blockAction blockActionCallback) string {
+	ts := message.ActionTs
+	if ts == "" && len(blockAction.Actions) > 0 {
+		ts = blockAction.Actions[0].ActionTs
+	}
+	if ts == "" {
+		return ""
+	}
+	return message.Team.ID + "/" + message.User.ID + "/" + ts
+}
+
+// Begin starts the interaction key. If key was seen before, it writes the
+// response of the first request to w and returns false. Otherwise the
+// interaction writes to the returned writer and calls finish once done.
+func (g *interactionGuard) Begin(key string, w http.ResponseWriter) (_ http.ResponseWriter, finish func(), first bool) {
+	if g == nil || key == "" {
+		return w, func() {}, true
+	}
+	now := g.now()
+	g.mu.Lock()
+	for k, r := range g.seen {
+		if now.Sub(r.at) > interactionTTL {
+			delete(g.seen, k)
+		}
+	}
+	prev, ok := g.seen[key]
+	if !ok {
+		resp := &interactionResponse{done: make(chan struct{}), at: now, header: http.Header{}}
+		g.seen[key] = resp
+		g.mu.Unlock()
+		return &recordingWriter{ResponseWriter: w, resp: resp}, func() { close(resp.done) }, true
+	}
+	g.mu.Unlock()
+
+	log.Printf("[INFO] Interaction %s retried", key)
+	select {
+	case <-prev.done:
+		prev.replay(w)
+	case <-time.After(interactionWait):
+		// The first request is still running, it answers slack
+		w.WriteHeader(http.StatusOK)
+	}
+	return w, func() {}, false
+}
+
+// replay writes r again to w.
+func (r *interactionResponse) replay(w http.ResponseWriter) {
+	for name, values := range r.header {
+		w.Header()[name] = values
+	}
+	status := r.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(r.body.Bytes())
+}
+
+// recordingWriter keeps a copy of the response for retries.
+type recordingWriter struct {
+	http.ResponseWriter
+	resp *interactionResponse
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.resp.status == 0 {
+		w.resp.status = status
+		for name, values := range w.ResponseWriter.Header() {
+			w.resp.header[name] = values
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.resp.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.resp.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// LockOrders waits until no other interaction holds one of ids and returns
+// the function releasing them. Zero IDs are ignored.
+func (g *interactionGuard) LockOrders(ids ...int64) (unlock func()) {
+	if g == nil {
+		return func() {}
+	}
+	// Always locked in the same order so that two interactions about the
+	// same orders cannot wait for each other
+	var sorted []int64
+	for _, id := range ids {
+		if id != 0 {
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var held []int64
+	for i, id := range sorted {
+		if i > 0 && id == sorted[i-1] {
+			continue
+		}
+		g.mu.Lock()
+		l, ok := g.orders[id]
+		if !ok {
+			l = &orderLock{}
+			g.orders[id] = l
+		}
+		l.refs++
+		g.mu.Unlock()
+		l.mu.Lock()
+		held = append(held, id)
+	}
+
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for _, id := range held {
+			l := g.orders[id]
+			l.mu.Unlock()
+			if l.refs--; l.refs == 0 {
+				delete(g.orders, id)
+			}
+		}
+	}
+}
+
+// interactionJob is the slow part of an interaction, such as calls to the
+// slack API, run on the job queue once the interaction is acknowledged.
+type interactionJob struct {
+	name        string
+	responseURL string
+	// orders are locked while the job runs, see LockOrders.
+	orders []int64
+	run    func(w http.ResponseWriter)
+	// locale is the language to say the queue is full in.
+	locale string
+	// slot is the place in the queue reserved for the job, if any.
+	slot *jobSlot
+	// use is called once the job has its place in the queue, an error
+	// refuses the job. See useButton.
+	use func() error
+	// then runs after the job, e.g. to refresh the App Home.
+	then func()
+}
+
+// enqueue acknowledges the interaction and queues j. What j writes is
+// posted to the response URL of the interaction. Without a queue j answers
+// the interaction itself.
+func (h interactionHandler) enqueue(w http.ResponseWriter, j interactionJob) {
+	slot := j.slot
+	if slot == nil {
+		var ok bool
+		if slot, ok = h.jobs.Reserve(j.name); !ok {
+			respondEphemeral(w, tr(j.locale, "jobs.busy"))
+			return
+		}
+	}
+	if j.use != nil {
+		if err := j.use(); err != nil {
+			slot.Release()
+			log.Printf("[INFO] Refused %s: %s", j.name, err)
+			respondError(w, j.locale, err)
+			return
+		}
+	}
+
+	run := func(w http.ResponseWriter) {
+		unlock := h.guard.LockOrders(j.orders...)
+		j.run(w)
+		unlock()
+		if j.then != nil {
+			j.then()
+		}
+	}
+	if h.jobs == nil {
+		run(w)
+		return
+	}
+
+	deferred := &responseURLWriter{url: j.responseURL, header: http.Header{}}
+	slot.Submit(func() {
+		run(deferred)
+		if err := deferred.send(); err != nil {
+			log.Printf("[ERROR] Failed to answer %s: %s", j.name, err)
+		}
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+// responseURLClient posts deferred responses to slack.
+var responseURLClient = &http.Client{Timeout: 10 * time.Second}
+
+// responseURLWriter keeps a response to post it to the response URL of the
+// interaction later, which slack accepts for 30 minutes.
+type responseURLWriter struct {
+	url    string
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseURLWriter) Header() http.Header { return w.header }
+
+func (w *responseURLWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseURLWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// send posts the response, if there is a message in it.
+func (w *responseURLWriter) send() error {
+	if w.body.Len() == 0 {
+		return nil
+	}
+	if w.status != http.StatusOK {
+		return fmt.Errorf("status %d: %s", w.status, w.body.String())
+	}
+	if w.url == "" {
+		return errors.New("no response URL")
+	}
+	resp, err := responseURLClient.Post(w.url, "application/json", &w.body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response URL returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJobWorkers   = 4
+	defaultJobQueueSize = 256
+
+	// jobSlowWait is the wait in the queue above which a job is logged.
+	jobSlowWait = time.Second
+)
+
+// jobWaitBuckets are the upper bounds of the queue latency histogram.
+var jobWaitBuckets = []time.Duration{
+	5 * time.Millisecond,
+	25 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// jobQueue runs slow work, such as calls to the slack API, on a pool of
+// workers so that interactions can be acknowledged right away. The queue is
+// bounded: Submit and Reserve refuse jobs once it is full.
+type jobQueue struct {
+	jobs chan job
+	wg   sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+	stats  jobStats
+	// reserved counts the slots taken by Reserve and not used yet.
+	reserved int
+	// released is signaled when a reserved slot is used or given back.
+	released *sync.Cond
+}
+
+// job is a function queued under name, e.g. the interaction action.
+type job struct {
+	name   string
+	queued time.Time
+	run    func()
+}
+
+// jobStats are counters of the queue since it started.
+type jobStats struct {
+	Queued    int // waiting now
+	Done      int64
+	Dropped   int64
+	Failed    int64 // panicked
+	WaitSum   time.Duration
+	WaitMax   time.Duration
+	WaitCount []int64 // per jobWaitBuckets, the last one counts the rest
+}
+
+func newJobQueue(size int) *jobQueue {
+	q := &jobQueue{
+		jobs:  make(chan job, size),
+		stats: jobStats{WaitCount: make([]int64, len(jobWaitBuckets)+1)},
+	}
+	q.released = sync.NewCond(&q.mu)
+	return q
+}
+
+// Start runs workers until the queue is drained.
+func (q *jobQueue) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for j := range q.jobs {
+				q.run(j)
+			}
+		}()
+	}
+}
+
+// Submit queues fn and reports whether there was room for it. A nil queue
+// runs fn right away.
+func (q *jobQueue) Submit(name string, fn func()) bool {
+	slot, ok := q.Reserve(name)
+	if ok {
+		slot.Submit(fn)
+	}
+	return ok
+}
+
+// Reserve takes a place in the queue for the job name, submitted later
+// with the slot, so that work done before is only done for jobs which will
+// run. It returns false if the queue is full or drained. A nil queue
+// returns a nil slot, which runs the job right away.
+func (q *jobQueue) Reserve(name string) (*jobSlot, bool) {
+	if q == nil {
+		return nil, true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		q.stats.Dropped++
+		return nil, false
+	}
+	if len(q.jobs)+q.reserved >= cap(q.jobs) {
+		q.stats.Dropped++
+		log.Printf("[ERROR] Job queue is full, dropped %s", name)
+		return nil, false
+	}
+	q.reserved++
+	return &jobSlot{q: q, name: name}, true
+}
+
+// jobSlot is a place in a jobQueue taken by Reserve. It is used by Submit
+// or given back by Release.
+type jobSlot struct {
+	q    *jobQueue
+	name string
+	done bool
+}
+
+// Submit queues fn in the slot. It always fits, and Drain waits for the
+// reserved slots before it stops taking jobs.
+func (s *jobSlot) Submit(fn func()) {
+	if s == nil {
+		fn()
+		return
+	}
+	q := s.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if s.done {
+		panic("job slot " + s.name + " used twice")
+	}
+	s.done = true
+	q.reserved--
+	q.jobs <- job{name: s.name, queued: time.Now(), run: fn}
+	q.released.Broadcast()
+}
+
+// Release gives the slot back unless it was used.
+func (s *jobSlot) Release() {
+	if s == nil {
+		return
+	}
+	q := s.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.done = true
+	q.reserved--
+	q.released.Broadcast()
+}
+
+func (q *jobQueue) run(j job) {
+	wait := time.Since(j.queued)
+	if wait > jobSlowWait {
+		log.Printf("[INFO] Job %s waited %s in the queue", j.name, wait)
+	}
+	failed := false
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("[ERROR] Job %s panicked: %v", j.name, r)
+				failed = true
+			}
+		}()
+		j.run()
+	}()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stats.Done++
+	if failed {
+		q.stats.Failed++
+	}
+	q.stats.WaitSum += wait
+	if wait > q.stats.WaitMax {
+		q.stats.WaitMax = wait
+	}
+	i := 0
+	for i < len(jobWaitBuckets) && wait > jobWaitBuckets[i] {
+		i++
+	}
+	q.stats.WaitCount[i]++
+}
+
+// Stats returns a copy of the counters of the queue.
+func (q *jobQueue) Stats() jobStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.stats
+	s.Queued = len(q.jobs)
+	s.WaitCount = append([]int64(nil), q.stats.WaitCount...)
+	return s
+}
+
+// String summarizes the stats for admins.
+func (s jobStats) String() string {
+	avg := time.Duration(0)
+	if s.Done > 0 {
+		avg = s.WaitSum / time.Duration(s.Done)
+	}
+	return fmt.Sprintf("%d queued, %d done, %d dropped, %d failed, waited %s on average and %s at most",
+		s.Queued, s.Done, s.Dropped, s.Failed, avg.Round(time.Millisecond), s.WaitMax.Round(time.Millisecond))
+}
+
+// Drain stops taking jobs and waits for the queued ones until ctx is done.
+func (q *jobQueue) Drain(ctx context.Context) error {
+	q.mu.Lock()
+	closing := !q.closed
+	q.closed = true
+	q.mu.Unlock()
+
+	// A condition cannot be waited on with ctx, so the waits run aside
+	done := make(chan struct{})
+	go func() {
+		if closing {
+			// Reserved slots are used or given back within a request
+			q.mu.Lock()
+			for q.reserved > 0 {
+				q.released.Wait()
+			}
+			close(q.jobs)
+			q.mu.Unlock()
+		}
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return fmt.Errorf("%d jobs left, %d reserved: %s", len(q.jobs), q.reserved, ctx.Err())
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainReserved(t *testing.T) {
+	q := newJobQueue(2)
+	q.Start(1)
+	slot, ok := q.Reserve("click")
+	if !ok {
+		t.Fatal("cannot reserve a slot")
+	}
+
+	// A slot held past the deadline does not hold up the shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := q.Drain(ctx); err == nil || !strings.Contains(err.Error(), "1 reserved") {
+		t.Fatalf("Drain with a reserved slot = %v", err)
+	}
+	if _, ok := q.Reserve("late"); ok {
+		t.Error("drained queue took a job")
+	}
+
+	// The slot can still be used, and its job is run
+	ran := make(chan struct{})
+	slot.Submit(func() { close(ran) })
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ran:
+	default:
+		t.Error("job of the reserved slot did not run")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long the components may take to stop on
+// shutdown, see stop_grace_period in docker-compose.yaml.
+const shutdownTimeout = 20 * time.Second
+
+// shutdownGrace is how long the components left once shutdownTimeout is
+// over may take, so that a stuck one is not blamed on the others.
+const shutdownGrace = 100 * time.Millisecond
+
+// lifecycle runs the long running components of the bot, such as the HTTP
+// server, the slack listeners and the schedulers, and stops them in the
+// reverse order they were started in on shutdown.
+type lifecycle struct {
+	mu         sync.Mutex
+	components []lifecycleComponent
+	failed     chan error
+}
+
+// lifecycleComponent is a started component and the function stopping it.
+type lifecycleComponent struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{failed: make(chan error, 1)}
+}
+
+// Go runs run in a goroutine until its context is cancelled on shutdown.
+func (l *lifecycle) Go(name string, run func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(ctx)
+	}()
+	l.OnStop(name, func(stopCtx context.Context) error {
+		cancel()
+		select {
+		case <-done:
+			return nil
+		case <-stopCtx.Done():
+			return stopCtx.Err()
+		}
+	})
+}
+
+// OnStop registers the stop function of a component started elsewhere.
+func (l *lifecycle) OnStop(name string, stop func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.components = append(l.components, lifecycleComponent{name: name, stop: stop})
+}
+
+// Fail shuts the bot down because the component name failed with err.
+func (l *lifecycle) Fail(name string, err error) {
+	select {
+	case l.failed <- fmt.Errorf("%s: %s", name, err):
+	default:
+	}
+}
+
+// Wait blocks until the process is asked to stop, or until a component
+// fails, in which case it returns its error.
+func (l *lifecycle) Wait() error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	select {
+	case s := <-sig:
+		log.Printf("[INFO] Received %s, shutting down", s)
+		return nil
+	case err := <-l.failed:
+		return err
+	}
+}
+
+// Shutdown stops the components, last started first, within timeout. It
+// returns the components which failed to stop cleanly.
+func (l *lifecycle) Shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	l.mu.Lock()
+	components := l.components
+	l.components = nil
+	l.mu.Unlock()
+
+	var failed []string
+	for i := len(components) - 1; i >= 0; i-- {
+		c := components[i]
+		start := time.Now()
+		stopCtx := ctx
+		if ctx.Err() != nil {
+			var cancel context.CancelFunc
+			stopCtx, cancel = context.WithTimeout(context.Background(), shutdownGrace)
+			defer cancel()
+		}
+		if err := c.stop(stopCtx); err != nil {
+			log.Printf("[ERROR] Failed to stop %s: %s", c.name, err)
+			failed = append(failed, fmt.Sprintf("%s (%s)", c.name, err))
+			continue
+		}
+		log.Printf("[INFO] Stopped %s in %s", c.name, time.Since(start).Round(time.Millisecond))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to stop %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	var mu sync.Mutex
+	var stopped []string
+	stop := func(name string) {
+		mu.Lock()
+		stopped = append(stopped, name)
+		mu.Unlock()
+	}
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+
+	l := newLifecycle()
+	l.Go("scheduler", func(ctx context.Context) {
+		<-ctx.Done()
+		stop("scheduler")
+	})
+	l.OnStop("server", func(ctx context.Context) error {
+		stop("server")
+		return nil
+	})
+	// A stuck component does not keep the others from stopping
+	l.Go("stuck", func(ctx context.Context) { <-release })
+	l.OnStop("listener", func(ctx context.Context) error {
+		stop("listener")
+		return errors.New("closed twice")
+	})
+
+	start := time.Now()
+	err := l.Shutdown(100 * time.Millisecond)
+	if err == nil || err.Error() != "failed to stop listener (closed twice), stuck (context deadline exceeded)" {
+		t.Errorf("Shutdown = %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Shutdown took %s", took)
+	}
+	// Last started first
+	if got := strings.Join(stopped, ","); got != "listener,server,scheduler" {
+		t.Errorf("stopped %s", got)
+	}
+
+	// Components are stopped once
+	if err := l.Shutdown(time.Second); err != nil || len(stopped) != 3 {
+		t.Errorf("second Shutdown = %v, stopped %q", err, stopped)
+	}
+}
+
+func TestShutdownGrace(t *testing.T) {
+	l := newLifecycle()
+	var got time.Duration
+	l.OnStop("late", func(ctx context.Context) error {
+		deadline, _ := ctx.Deadline()
+		got = time.Until(deadline)
+		return nil
+	})
+	l.OnStop("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err := l.Shutdown(10 * time.Millisecond); err == nil || !strings.Contains(err.Error(), "slow") || strings.Contains(err.Error(), "late") {
+		t.Errorf("Shutdown = %v", err)
+	}
+	// Once the timeout is over, the components left get the grace period
+	if got <= 0 || got > shutdownGrace {
+		t.Errorf("component stopped after the timeout had %s", got)
+	}
+}
+
+func TestFail(t *testing.T) {
+	l := newLifecycle()
+	l.Fail("server", errors.New("address in use"))
+	l.Fail("listener", errors.New("invalid auth"))
+	if err := l.Wait(); err == nil || err.Error() != "server: address in use" {
+		t.Errorf("Wait = %v", err)
+	}
+}
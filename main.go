@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/nlopes/slack"
@@ -14,34 +16,255 @@ func main() {
 }
 
 func _main(args []string) int {
-	err := godotenv.Load()
+	// .env is optional now that settings can come from the config file
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		log.Printf("[ERROR] Failed to load .env file: %s", err)
+		return 1
+	}
+
+	if len(args) >= 2 && args[0] == "config" && args[1] == "check" {
+		return configCheck(args[2:])
+	}
+
+	cfg, err := loadConfig("orderbot", args)
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return 2
+	}
+	if err := cfg.validate(); err != nil {
+		log.Printf("[ERROR] %s", err)
+		return 1
+	}
+
+	store, err := openStore(cfg.StorageDSN)
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return 1
+	}
+
+	// Convert orders in other currencies for budgets and reports
+	currencies, err := newCurrencyBook(cfg.Currencies)
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return 1
+	}
+
+	// Sign buttons so that clicks cannot be forged or replayed
+	callbackSecret := []byte(cfg.Slack.CallbackSecret)
+	if len(callbackSecret) == 0 {
+		if callbackSecret, err = store.CallbackSecret(); err != nil {
+			log.Printf("[ERROR] Failed to create callback secret: %s", err)
+			return 1
+		}
+	}
+
+	// Time every slack API call for the metrics
+	slack.SetHTTPClient(slackHTTP)
+
+	// The workspace configured by BOT_TOKEN keeps working without OAuth
+	workspaces := newWorkspaceRegistry(store, cfg.Slack.BotToken, cfg.Channels.Orders)
+	workspaces.defaultLocale = cfg.Locale
+	workspaces.approvalChannel = cfg.approvalChannel()
+	// Validated already, empty leaves them at zero
+	reapproveAbove, _ := parseAmount(cfg.Approval.ReapproveAbove)
+	autoApproveBelow, _ := parseAmount(cfg.Approval.AutoApproveBelow)
+	orders := &orderService{
+		store:            store,
+		threads:          &orderThreads{workspaces: workspaces, store: store},
+		approvers:        cfg.Approval.Approvers,
+		purchasers:       cfg.Approval.Purchasers,
+		currencies:       currencies,
+		taxes:            newTaxTable(cfg.Taxes),
+		reapproveAbove:   reapproveAbove,
+		autoApproveBelow: autoApproveBelow,
+		requireReason:    cfg.Approval.RequireReason,
+		callbacks:        newCallbackSigner(callbackSecret),
+	}
+	if len(cfg.Policies) > 0 {
+		orders.policies = newPolicyEngine(store, currencies, cfg.Policies)
+	}
+	// Components started below are stopped in reverse order on shutdown,
+	// and tell /readyz whether they are working
+	lc := newLifecycle()
+	ready := newReadiness()
+	ready.Add("storage", store.Ping)
+
+	orders.OnChange(observeOrderChange)
+	webhooks := newWebhookDispatcher(store, workspaces)
+	orders.OnChange(webhooks.OrderChanged)
+	webhooksBeat := ready.Heartbeat("webhook dispatcher")
+	lc.Go("webhook dispatcher", func(ctx context.Context) { webhooks.Run(ctx, webhooksBeat) })
+
+	// Email stakeholders who are not in slack
+	var mailer *emailNotifier
+	if cfg.Email.SMTP.Addr != "" {
+		mailer = newEmailNotifier(store, orders, cfg.Email)
+		orders.OnChange(mailer.OrderChanged)
+		day, at, _ := parseWeeklyTime(cfg.Schedules.Digest)
+		beat := ready.Heartbeat("email digest")
+		lc.Go("email digest", func(ctx context.Context) { mailer.RunDigest(ctx, day, at, beat) })
+	}
+
+	// Issue purchase orders for finance
+	if cfg.PurchaseOrders.Company != "" {
+		issuer, err := newPurchaseOrderIssuer(store, orders.threads, cfg.PurchaseOrders, cfg.Currencies.Base)
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			return 1
+		}
+		orders.OnChange(issuer.OrderChanged)
+	}
+
+	// Attach receipts shared in order threads
+	storage, err := openFileStorage(cfg.Receipts.Storage, cfg.Receipts.S3)
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Printf("[ERROR] %s", err)
+		return 1
+	}
+	receipts := &receiptService{orders: orders, workspaces: workspaces, storage: storage}
+
+	// Follow shipments of purchased orders
+	tracking := &trackingService{orders: orders, carriers: newCarriers(cfg.Tracking)}
+	if len(tracking.carriers) > 0 {
+		poll, _ := time.ParseDuration(cfg.Tracking.PollInterval)
+		beat := ready.Heartbeat("tracking poller")
+		lc.Go("tracking poller", func(ctx context.Context) { tracking.RunPoller(ctx, poll, beat) })
 	}
 
+	// Register delivered hardware as assets
+	assets := &assetRegistry{orders: orders, categories: cfg.Assets.Categories}
+	if len(assets.categories) > 0 {
+		orders.OnChange(assets.OrderChanged)
+	}
+
+	// Run the slow part of interactions after acknowledging them
+	jobs := newJobQueue(cfg.Interactions.QueueSize)
+	jobs.Start(cfg.Interactions.Workers)
+	lc.OnStop("interaction queue", jobs.Drain)
+	metrics.register(jobQueueMetrics{jobs: jobs})
+
 	// Listening slack event and response
 	log.Printf("[INFO] Start slack event listening")
-	client := slack.New(os.Getenv("BOT_TOKEN"))
-	slackListener := &SlackListener{
-		client:    client,
-		botID:     os.Getenv("BOT_ID"),
-		channelID: os.Getenv("CHANNEL_ID"),
+	listeners := newListenerManager()
+	lc.OnStop("slack listeners", listeners.Stop)
+	ready.Add("slack", listeners.Check)
+	if client := workspaces.fallback; client != nil {
+		listeners.Start("", &SlackListener{
+			client:    client,
+			channelID: cfg.Channels.Orders,
+			orders:    orders,
+			webhooks:  webhooks,
+			receipts:  receipts,
+			assets:    assets,
+			jobs:      jobs,
+			admins:    cfg.Admins,
+		})
+	}
+	startInstalled := func(inst installation, client *slack.Client) {
+		listeners.Start(inst.TeamID, &SlackListener{
+			client:    client,
+			teamID:    inst.TeamID,
+			botID:     inst.BotUserID,
+			channelID: workspaces.OrdersChannel(inst.TeamID),
+			orders:    orders,
+			webhooks:  webhooks,
+			receipts:  receipts,
+			assets:    assets,
+			jobs:      jobs,
+			admins:    cfg.Admins,
+		})
+	}
+	for _, inst := range store.Installations() {
+		client, err := workspaces.Client(inst.TeamID)
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			continue
+		}
+		startInstalled(inst, client)
+	}
+	// Reinstalling a team restarts its listener with the new token
+	workspaces.onInstall = startInstalled
+
+	home := &homeTab{
+		workspaces: workspaces,
+		orders:     orders,
+		budgets:    newBudgetBook(store, currencies, cfg.Budgets),
 	}
-	go slackListener.ListenAndResponse()
 
 	// Register handler to receive interactive message
 	// responses from slack (kicked by user action)
 	http.Handle("/interaction", interactionHandler{
-		verificationToken: os.Getenv("VERIFICATION_TOKEN"),
-		slackClient:       client,
+		verificationToken: cfg.Slack.VerificationToken,
+		workspaces:        workspaces,
+		orders:            orders,
+		home:              home,
+		tracking:          tracking,
+		assets:            assets,
+		guard:             newInteractionGuard(),
+		jobs:              jobs,
 	})
 
-	const port = "3000"
-	log.Printf("[INFO] Server listening on :%s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Printf("[ERROR] %s", err)
-		return 1
+	// Register handler to receive Events API callbacks such as app_home_opened
+	http.Handle("/slack/events", eventsHandler{
+		verificationToken: cfg.Slack.VerificationToken,
+		home:              home,
+	})
+
+	// Remind approvers of orders waiting for too long
+	reminder, _ := time.ParseDuration(cfg.Schedules.Reminder)
+	remindersBeat := ready.Heartbeat("reminders")
+	lc.Go("reminders", func(ctx context.Context) { orders.RunReminders(ctx, reminder, remindersBeat) })
+
+	// Register the REST API for other internal tools
+	http.Handle(apiPrefix, apiHandler{
+		store:      store,
+		orders:     orders,
+		workspaces: workspaces,
+	})
+
+	// Register metrics for Prometheus to scrape
+	http.Handle(metricsPath, metrics)
+
+	// Register health checks for docker and the load balancer
+	http.HandleFunc(healthzPath, serveHealth)
+	http.HandleFunc(readyzPath, ready.serveReady)
+
+	// Register one-time approval links sent by email
+	if mailer != nil && cfg.Email.PublicURL != "" {
+		http.Handle(emailApprovePath, emailApprovalHandler{notifier: mailer})
 	}
 
-	return 0
+	// Register OAuth v2 endpoints to install the bot to other workspaces
+	if cfg.Slack.ClientID != "" {
+		oauth := oauthHandler{
+			clientID:     cfg.Slack.ClientID,
+			clientSecret: cfg.Slack.ClientSecret,
+			redirectURL:  cfg.Slack.RedirectURL,
+			workspaces:   workspaces,
+		}
+		http.HandleFunc("/slack/install", oauth.install)
+		http.HandleFunc("/slack/oauth_redirect", oauth.redirect)
+	}
+
+	// Stop taking requests first on shutdown, letting running ones finish
+	server := &http.Server{Addr: cfg.ListenAddr}
+	lc.OnStop("HTTP server", server.Shutdown)
+	go func() {
+		log.Printf("[INFO] Server listening on %s", cfg.ListenAddr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			lc.Fail("HTTP server", err)
+		}
+	}()
+
+	// Run until SIGINT or SIGTERM, or until a component fails
+	code := 0
+	if err := lc.Wait(); err != nil {
+		log.Printf("[ERROR] %s", err)
+		code = 1
+	}
+	if err := lc.Shutdown(shutdownTimeout); err != nil {
+		log.Printf("[ERROR] %s", err)
+		code = 1
+	}
+	return code
 }
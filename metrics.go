@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsPath serves the metrics in the Prometheus text format.
+const metricsPath = "/metrics"
+
+var (
+	// metrics are the metrics served at metricsPath.
+	metrics = &metricRegistry{}
+
+	metricEvents = metrics.counter("orderbot_events_total",
+		"Slack events received, by source (rtm or events_api) and type.", "source", "type")
+	metricInteractions = metrics.counter("orderbot_interactions_total",
+		"Clicks and dialog submissions, by action name.", "action")
+	metricSlackCalls = metrics.histogram("orderbot_slack_api_duration_seconds",
+		"Latency of slack Web API calls, by method.", []float64{.05, .1, .25, .5, 1, 2.5, 5, 10}, "method")
+	metricSlackErrors = metrics.counter("orderbot_slack_api_errors_total",
+		"Failed slack Web API calls, by method and error: the slack error, the HTTP status or \"transport\".", "method", "error")
+	metricTransitions = metrics.counter("orderbot_order_transitions_total",
+		"Order status changes, by status before and after.", "from", "to")
+	metricApprovals = metrics.histogram("orderbot_approval_duration_seconds",
+		"Time from submitting an order to its approval.", []float64{60, 600, 3600, 4 * 3600, 24 * 3600, 3 * 24 * 3600, 7 * 24 * 3600})
+	metricRTMReconnects = metrics.counter("orderbot_rtm_reconnects_total",
+		"RTM connections made again after being lost, by team.", "team")
+)
+
+// metricRegistry holds metrics in registration order.
+type metricRegistry struct {
+	mu         sync.Mutex
+	collectors []metricCollector
+}
+
+// metricCollector writes the samples of a metric.
+type metricCollector interface {
+	collect(w io.Writer)
+}
+
+func (r *metricRegistry) register(c metricCollector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *metricRegistry) counter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, series: map[string]*counterSeries{}}
+	r.register(c)
+	return c
+}
+
+func (r *metricRegistry) histogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	r.register(h)
+	return h
+}
+
+func (r *metricRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	collectors := append([]metricCollector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, c := range collectors {
+		c.collect(&buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// counterVec is a counter with one value per combination of labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labels []string
+	value  float64
+}
+
+// Inc adds one to the counter of the label values.
+func (c *counterVec) Inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := strings.Join(values, "\xff")
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labels: values}
+		c.series[key] = s
+	}
+	s.value++
+}
+
+func (c *counterVec) collect(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeMetricHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, metricLabels(c.labels, s.labels), formatMetric(s.value))
+	}
+}
+
+// histogramVec is a histogram with one series per combination of labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Observe records v for the label values.
+func (h *histogramVec) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(values, "\xff")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) collect(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		writeHistogram(w, h.name, h.labels, s.labels, h.buckets, s.counts, s.count, s.sum)
+	}
+}
+
+// writeHistogram writes the samples of a histogram series, counts being
+// the observations per bucket.
+func writeHistogram(w io.Writer, name string, labels, values []string, buckets []float64, counts []uint64, count uint64, sum float64) {
+	le := append(append([]string(nil), labels...), "le")
+	bucket := func(bound string) string {
+		return metricLabels(le, append(append([]string(nil), values...), bound))
+	}
+	var cumulative uint64
+	for i, b := range buckets {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, bucket(formatMetric(b)), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, bucket("+Inf"), count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, metricLabels(labels, values), formatMetric(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, metricLabels(labels, values), count)
+}
+
+func writeMetricHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabels formats labels as {name="value",...}, empty without labels.
+func metricLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, metricLabelEscaper.Replace(v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*counterSeries:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramSeries:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jobQueueMetrics exports the stats of the interaction queue.
+type jobQueueMetrics struct {
+	jobs *jobQueue
+}
+
+func (m jobQueueMetrics) collect(w io.Writer) {
+	s := m.jobs.Stats()
+	writeMetricHeader(w, "orderbot_job_queue_depth", "Interactions waiting in the queue.", "gauge")
+	fmt.Fprintf(w, "orderbot_job_queue_depth %d\n", s.Queued)
+	writeMetricHeader(w, "orderbot_jobs_dropped_total", "Interactions refused as the queue was full.", "counter")
+	fmt.Fprintf(w, "orderbot_jobs_dropped_total %d\n", s.Dropped)
+	writeMetricHeader(w, "orderbot_jobs_failed_total", "Interactions which panicked.", "counter")
+	fmt.Fprintf(w, "orderbot_jobs_failed_total %d\n", s.Failed)
+
+	buckets := make([]float64, len(jobWaitBuckets))
+	for i, b := range jobWaitBuckets {
+		buckets[i] = b.Seconds()
+	}
+	counts := make([]uint64, len(buckets))
+	for i := range counts {
+		counts[i] = uint64(s.WaitCount[i])
+	}
+	writeMetricHeader(w, "orderbot_job_wait_seconds", "Time interactions waited in the queue.", "histogram")
+	writeHistogram(w, "orderbot_job_wait_seconds", nil, nil, buckets, counts, uint64(s.Done), s.WaitSum.Seconds())
+}
+
+// observeOrderChange counts status changes and how long approvals took.
+func observeOrderChange(c orderChange) {
+	metricTransitions.Inc(string(c.From), string(c.To))
+	if c.To != statusApproved {
+		return
+	}
+	for i := len(c.Order.History) - 1; i >= 0; i-- {
+		if ev := c.Order.History[i]; ev.Kind == eventStatus && ev.Status == statusPending {
+			metricApprovals.Observe(c.At.Sub(ev.At).Seconds())
+			return
+		}
+	}
+}
+
+// slackHTTP makes the HTTP requests of slack API calls, timing them by
+// method for the metrics.
+var slackHTTP = meteredSlackClient{client: http.DefaultClient}
+
+type meteredSlackClient struct {
+	client *http.Client
+}
+
+func (c meteredSlackClient) Do(r *http.Request) (*http.Response, error) {
+	method := path.Base(r.URL.Path)
+	start := time.Now()
+	resp, err := c.client.Do(r)
+	metricSlackCalls.Observe(time.Since(start).Seconds(), method)
+	if err != nil {
+		metricSlackErrors.Inc(method, "transport")
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		metricSlackErrors.Inc(method, strconv.Itoa(resp.StatusCode))
+		return resp, nil
+	}
+
+	// Slack reports errors in the body with a 200 status
+	buf, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		metricSlackErrors.Inc(method, "transport")
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	var sr struct {
+		Ok    *bool  `json:"ok"`
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(buf, &sr) == nil && sr.Ok != nil && !*sr.Ok {
+		metricSlackErrors.Inc(method, sr.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricRegistry(t *testing.T) {
+	r := &metricRegistry{}
+	// Metrics are written in registration order, series sorted by labels
+	calls := r.counter("test_calls_total", "Calls.", "method", "error")
+	latency := r.histogram("test_latency_seconds", "Latency.", []float64{.1, 1})
+	calls.Inc("chat.update", "")
+	calls.Inc("chat.postMessage", `not "found"`+"\n")
+	calls.Inc("chat.update", "")
+	latency.Observe(.1)
+	latency.Observe(.5)
+	latency.Observe(3)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", metricsPath, nil))
+	want := `# HELP test_calls_total Calls.
+# TYPE test_calls_total counter
+test_calls_total{method="chat.postMessage",error="not \"found\"\n"} 1
+test_calls_total{method="chat.update",error=""} 2
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 3.6
+test_latency_seconds_count 3
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("metrics:\n%s\nwant:\n%s", got, want)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	tests := []struct {
+		names, values []string
+		want          string
+	}{
+		{nil, nil, ""},
+		{[]string{"from", "to"}, []string{"pending", "approved"}, `{from="pending",to="approved"}`},
+		{[]string{"error"}, []string{`C:\tmp "x"`}, `{error="C:\\tmp \"x\""}`},
+		// Missing values are empty
+		{[]string{"method", "error"}, []string{"chat.update"}, `{method="chat.update",error=""}`},
+	}
+	for _, tt := range tests {
+		if got := metricLabels(tt.names, tt.values); got != tt.want {
+			t.Errorf("metricLabels(%q, %q) = %s, want %s", tt.names, tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestMeteredSlackClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/chat.update":
+			fmt.Fprint(w, `{"ok":false,"error":"message_not_found"}`)
+		case "/api/chat.postMessage":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			fmt.Fprint(w, `{"ok":true}`)
+		}
+	}))
+	defer srv.Close()
+	failures := func(method, reason string) float64 {
+		metricSlackErrors.mu.Lock()
+		defer metricSlackErrors.mu.Unlock()
+		if s, ok := metricSlackErrors.series[method+"\xff"+reason]; ok {
+			return s.value
+		}
+		return 0
+	}
+	before := map[string]float64{
+		"chat.update message_not_found": failures("chat.update", "message_not_found"),
+		"chat.postMessage 429":          failures("chat.postMessage", "429"),
+		"views.publish transport":       failures("views.publish", "transport"),
+	}
+
+	for _, method := range []string{"chat.update", "chat.postMessage", "auth.test"} {
+		req, _ := http.NewRequest("POST", srv.URL+"/api/"+method, nil)
+		resp, err := slackHTTP.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// The body is still readable after looking for the slack error
+	req, _ := http.NewRequest("POST", srv.URL+"/api/chat.update", nil)
+	resp, err := slackHTTP.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !strings.Contains(string(b), "message_not_found") {
+		t.Errorf("body = %q, %v", b, err)
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	req, _ = http.NewRequest("POST", closed.URL+"/api/views.publish", nil)
+	if _, err := slackHTTP.Do(req); err == nil {
+		t.Error("call to a closed server succeeded")
+	}
+
+	for key, want := range map[string]float64{
+		"chat.update message_not_found": 2,
+		"chat.postMessage 429":          1,
+		"views.publish transport":       1,
+	} {
+		parts := strings.Split(key, " ")
+		if got := failures(parts[0], parts[1]) - before[key]; got != want {
+			t.Errorf("%s errors = %v, want %v", key, got, want)
+		}
+	}
+	if got := failures("auth.test", ""); got != 0 {
+		t.Errorf("successful call counted as %v errors", got)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	oauthAuthorizeURL = "https://slack.com/oauth/v2/authorize"
+	oauthStateTTL     = 10 * time.Minute
+	// oauthStateCookie binds the state to the browser which started the
+	// install, so a redirect with someone else's code and state is refused.
+	oauthStateCookie = "orderbot_oauth_state"
+
+	// botScopes are the scopes requested when installing the bot.
+	botScopes = "chat:write,commands,channels:history,groups:history,im:history,users:read,files:read,files:write,incoming-webhook"
+)
+
+// oauthV2Response is the response of oauth.v2.access.
+type oauthV2Response struct {
+	slack.SlackResponse
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Scope       string `json:"scope"`
+	BotUserID   string `json:"bot_user_id"`
+	AppID       string `json:"app_id"`
+	Team        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"team"`
+	AuthedUser struct {
+		ID string `json:"id"`
+	} `json:"authed_user"`
+	IncomingWebhook struct {
+		Channel   string `json:"channel"`
+		ChannelID string `json:"channel_id"`
+	} `json:"incoming_webhook"`
+}
+
+// oauthHandler implements the OAuth v2 install flow.
+// It serves /slack/install and /slack/oauth_redirect.
+type oauthHandler struct {
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	workspaces   *workspaceRegistry
+}
+
+// install redirects the user to slack to authorize the bot.
+func (h oauthHandler) install(w http.ResponseWriter, r *http.Request) {
+	state, err := h.newState(time.Now())
+	if err != nil {
+		log.Printf("[ERROR] Failed to generate oauth state: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/slack/",
+		MaxAge:   int(oauthStateTTL / time.Second),
+		Secure:   r.TLS != nil || strings.HasPrefix(h.redirectURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	v := url.Values{
+		"client_id": {h.clientID},
+		"scope":     {botScopes},
+		"state":     {state},
+	}
+	if h.redirectURL != "" {
+		v.Set("redirect_uri", h.redirectURL)
+	}
+	http.Redirect(w, r, oauthAuthorizeURL+"?"+v.Encode(), http.StatusFound)
+}
+
+// redirect receives the authorization code and stores the team token.
+func (h oauthHandler) redirect(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("[ERROR] Installation was denied: %s", e)
+		http.Error(w, "Installation was canceled.", http.StatusForbidden)
+		return
+	}
+
+	var cookie string
+	if c, err := r.Cookie(oauthStateCookie); err == nil {
+		cookie = c.Value
+	}
+	if err := h.verifyState(q.Get("state"), cookie, time.Now()); err != nil {
+		log.Printf("[ERROR] Invalid oauth state: %s", err)
+		http.Error(w, "Invalid or expired installation link.", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/slack/", MaxAge: -1})
+
+	res, err := h.exchange(q.Get("code"))
+	if err != nil {
+		log.Printf("[ERROR] Failed to exchange oauth code: %s", err)
+		http.Error(w, "Failed to install the bot.", http.StatusBadGateway)
+		return
+	}
+
+	inst := installation{
+		TeamID:      res.Team.ID,
+		TeamName:    res.Team.Name,
+		BotUserID:   res.BotUserID,
+		BotToken:    res.AccessToken,
+		Scope:       res.Scope,
+		ChannelID:   res.IncomingWebhook.ChannelID,
+		InstalledBy: res.AuthedUser.ID,
+		InstalledAt: time.Now(),
+	}
+	if err := h.workspaces.Install(inst); err != nil {
+		log.Printf("[ERROR] Failed to save installation: %s", err)
+		http.Error(w, "Failed to install the bot.", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "orderbot has been installed to %s.", inst.TeamName)
+}
+
+// exchange trades an authorization code for a bot token.
+func (h oauthHandler) exchange(code string) (*oauthV2Response, error) {
+	if code == "" {
+		return nil, fmt.Errorf("missing code")
+	}
+
+	v := url.Values{
+		"client_id":     {h.clientID},
+		"client_secret": {h.clientSecret},
+		"code":          {code},
+	}
+	if h.redirectURL != "" {
+		v.Set("redirect_uri", h.redirectURL)
+	}
+
+	resp, err := http.PostForm(slack.SLACK_API+"oauth.v2.access", v)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oauth.v2.access returned %s", resp.Status)
+	}
+
+	var res oauthV2Response
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+	if res.Team.ID == "" || res.AccessToken == "" {
+		return nil, fmt.Errorf("oauth.v2.access returned no team or token")
+	}
+	return &res, nil
+}
+
+// newState returns "<expiry>.<nonce>.<signature>" so the redirect can be
+// verified without keeping server side state. install also sets it as
+// cookie, which the redirect must come with.
+func (h oauthHandler) newState(now time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload := strconv.FormatInt(now.Add(oauthStateTTL).Unix(), 10) + "." + hex.EncodeToString(nonce)
+	return payload + "." + h.sign(payload), nil
+}
+
+// verifyState checks that state was issued by newState, has not expired
+// and is the one of cookie.
+func (h oauthHandler) verifyState(state, cookie string, now time.Time) error {
+	if cookie == "" {
+		return fmt.Errorf("no state cookie")
+	}
+	if !hmac.Equal([]byte(state), []byte(cookie)) {
+		return fmt.Errorf("state does not match the cookie")
+	}
+	i := strings.LastIndex(state, ".")
+	if i < 0 {
+		return fmt.Errorf("malformed state")
+	}
+	payload, sig := state[:i], state[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(h.sign(payload))) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	expiry, err := strconv.ParseInt(strings.SplitN(payload, ".", 2)[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed state")
+	}
+	if now.Unix() > expiry {
+		return fmt.Errorf("state expired")
+	}
+	return nil
+}
+
+func (h oauthHandler) sign(payload string) string {
+	mac := hmac.New(sha256.New, []byte(h.clientSecret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestOAuthState(t *testing.T) {
+	h := oauthHandler{clientID: "cid", clientSecret: "secret"}
+
+	// install sets the state as cookie of the browser
+	rec := httptest.NewRecorder()
+	h.install(rec, httptest.NewRequest(http.MethodGet, "/slack/install", nil))
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := loc.Query().Get("state")
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oauthStateCookie || cookies[0].Value != state || !cookies[0].HttpOnly {
+		t.Fatalf("install set cookies %+v for state %q", cookies, state)
+	}
+
+	other := httptest.NewRecorder()
+	h.install(other, httptest.NewRequest(http.MethodGet, "/slack/install", nil))
+	otherState := other.Result().Cookies()[0].Value
+
+	redirect := func(state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/slack/oauth_redirect?"+url.Values{"state": {state}}.Encode(), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.redirect(rec, req)
+		return rec
+	}
+	for name, rec := range map[string]*httptest.ResponseRecorder{
+		"no cookie":      redirect(state, nil),
+		"other browser":  redirect(state, &http.Cookie{Name: oauthStateCookie, Value: otherState}),
+		"forged state":   redirect(state+"x", &http.Cookie{Name: oauthStateCookie, Value: state + "x"}),
+		"missing state":  redirect("", &http.Cookie{Name: oauthStateCookie, Value: ""}),
+		"unsigned state": redirect("1.2", &http.Cookie{Name: oauthStateCookie, Value: "1.2"}),
+	} {
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Invalid or expired") {
+			t.Errorf("%s: redirect = %d %q", name, rec.Code, rec.Body)
+		}
+	}
+
+	// The browser which started the install gets past the state, to the
+	// code exchange which fails without a code
+	if rec := redirect(state, cookies[0]); rec.Code != http.StatusBadGateway {
+		t.Errorf("redirect with the cookie = %d %q", rec.Code, rec.Body)
+	}
+}
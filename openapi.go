@@ -0,0 +1,331 @@
+package main
+
+// openAPIDocument describes the REST API. It is served at /api/v1/openapi.json.
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "orderbot API",
+    "version": "1.0.0",
+    "description": "Read and create orders without slack. Authenticate with an API key issued by an admin with \"@orderbot apikey create <name> <role>\". A key only sees the orders and assets of the workspace it was issued in. Order changes are also sent to webhooks: order.created when an order is first submitted, order.resubmitted when an edit sends it back to pending, then order.approved, order.rejected, order.purchased, order.delivered, order.cancelled and order.issue."
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"apiKey": []}],
+  "paths": {
+    "/orders": {
+      "get": {
+        "summary": "List orders",
+        "description": "Requires the reader role.",
+        "parameters": [
+          {"name": "status", "in": "query", "description": "Comma separated statuses", "schema": {"type": "string"}},
+          {"name": "requester", "in": "query", "schema": {"type": "string"}},
+          {"name": "team_id", "in": "query", "description": "Must be the workspace of the API key if set", "schema": {"type": "string"}},
+          {"name": "created_since", "in": "query", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "created_until", "in": "query", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "missing_receipt", "in": "query", "description": "Only purchased or delivered orders without a receipt", "schema": {"type": "boolean"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 200, "default": 50}},
+          {"name": "after", "in": "query", "description": "Return orders with an ID greater than this, use next_after of the previous page", "schema": {"type": "integer"}}
+        ],
+        "responses": {
+          "200": {"description": "A page of orders", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/OrderList"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Create a draft order",
+        "description": "Requires the writer role. Submit the draft for approval with a transition to pending.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NewOrder"}}}},
+        "responses": {
+          "201": {"description": "The created draft", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Order"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/orders/{id}": {
+      "get": {
+        "summary": "Get an order with its history",
+        "description": "Requires the reader role.",
+        "parameters": [{"$ref": "#/components/parameters/OrderID"}],
+        "responses": {
+          "200": {"description": "The order", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Order"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/orders/{id}/transitions": {
+      "post": {
+        "summary": "Change the status of an order",
+        "description": "approved and rejected require the approver role, other statuses the writer role.",
+        "parameters": [{"$ref": "#/components/parameters/OrderID"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Transition"}}}},
+        "responses": {
+          "200": {"description": "The updated order", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Order"}}}},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/orders/{id}/purchase-order": {
+      "get": {
+        "summary": "Download the purchase order of an approved order",
+        "description": "Requires the reader role. The PDF is issued when the order is approved and purchase_orders.company is configured.",
+        "parameters": [{"$ref": "#/components/parameters/OrderID"}],
+        "responses": {
+          "200": {"description": "The purchase order", "content": {"application/pdf": {"schema": {"type": "string", "format": "binary"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/catalog": {
+      "get": {
+        "summary": "List catalog items",
+        "description": "Requires the reader role.",
+        "responses": {
+          "200": {"description": "Catalog items", "content": {"application/json": {"schema": {"type": "object", "properties": {"items": {"type": "array", "items": {"$ref": "#/components/schemas/CatalogItem"}}}}}}}
+        }
+      },
+      "post": {
+        "summary": "Add a catalog item",
+        "description": "Requires the admin role.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CatalogItem"}}}},
+        "responses": {
+          "201": {"description": "The created item", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CatalogItem"}}}},
+          "409": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/catalog/{sku}": {
+      "parameters": [{"name": "sku", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {
+        "summary": "Get a catalog item",
+        "description": "Requires the reader role.",
+        "responses": {
+          "200": {"description": "The item", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CatalogItem"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Create or replace a catalog item",
+        "description": "Requires the admin role.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CatalogItem"}}}},
+        "responses": {
+          "200": {"description": "The saved item", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CatalogItem"}}}},
+          "422": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a catalog item",
+        "description": "Requires the admin role.",
+        "responses": {
+          "204": {"description": "Deleted"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/assets": {
+      "get": {
+        "summary": "List assets registered from delivered orders",
+        "description": "Requires the reader role.",
+        "parameters": [
+          {"name": "owner", "in": "query", "description": "Slack user ID of the owner", "schema": {"type": "string"}},
+          {"name": "category", "in": "query", "schema": {"type": "string"}},
+          {"name": "format", "in": "query", "schema": {"type": "string", "enum": ["json", "csv"], "default": "json"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Assets ordered by tag",
+            "content": {
+              "application/json": {"schema": {"type": "object", "properties": {"assets": {"type": "array", "items": {"$ref": "#/components/schemas/Asset"}}}}},
+              "text/csv": {"schema": {"type": "string"}}
+            }
+          },
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "apiKey": {"type": "http", "scheme": "bearer"}
+    },
+    "parameters": {
+      "OrderID": {"name": "id", "in": "path", "required": true, "schema": {"type": "integer"}}
+    },
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"type": "object", "properties": {"error": {"type": "string"}}}}}}
+    },
+    "schemas": {
+      "Amount": {"type": "string", "pattern": "^-?[0-9]+\\.[0-9]{2}$", "example": "49.99"},
+      "Status": {"type": "string", "enum": ["draft", "pending", "approved", "rejected", "purchased", "delivered", "cancelled", "issue"]},
+      "Event": {
+        "type": "object",
+        "properties": {
+          "at": {"type": "string", "format": "date-time"},
+          "user": {"type": "string"},
+          "kind": {"type": "string", "enum": ["created", "status", "comment", "reminder", "tracking", "receipt", "joined", "policy", "charges", "edited"]},
+          "status": {"$ref": "#/components/schemas/Status"},
+          "text": {"type": "string"}
+        }
+      },
+      "Order": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "team_id": {"type": "string"},
+          "channel_id": {"type": "string"},
+          "thread_ts": {"type": "string"},
+          "requester": {"type": "string"},
+          "sku": {"type": "string"},
+          "item_name": {"type": "string"},
+          "item_url": {"type": "string"},
+          "reason": {"type": "string"},
+          "count": {"type": "integer"},
+          "unit_price": {"$ref": "#/components/schemas/Amount"},
+          "currency": {"type": "string", "description": "Currency of unit_price, the base currency if empty"},
+          "rate": {"$ref": "#/components/schemas/ExchangeRate"},
+          "shipping": {"$ref": "#/components/schemas/Amount"},
+          "tax_region": {"type": "string"},
+          "tax_rate": {"$ref": "#/components/schemas/Amount", "description": "Percentage of the items after discounts"},
+          "tax_amount": {"$ref": "#/components/schemas/Amount", "description": "Exact tax, overrides tax_rate"},
+          "discounts": {
+            "type": "array",
+            "items": {"type": "object", "properties": {"label": {"type": "string"}, "amount": {"$ref": "#/components/schemas/Amount"}}}
+          },
+          "status": {"$ref": "#/components/schemas/Status"},
+          "approved_by": {"type": "string"},
+          "purchased_by": {"type": "string"},
+          "assigned_to": {"type": "string", "description": "Who has to sort out an issue"},
+          "shipment": {"$ref": "#/components/schemas/Shipment"},
+          "joined": {
+            "type": "array",
+            "description": "People who joined the order instead of ordering the same item, count includes their items",
+            "items": {"type": "object", "properties": {"user": {"type": "string"}, "count": {"type": "integer"}, "at": {"type": "string", "format": "date-time"}}}
+          },
+          "policies": {
+            "type": "array",
+            "description": "Policy rules the order triggered",
+            "items": {
+              "type": "object",
+              "properties": {
+                "rule": {"type": "string"},
+                "action": {"type": "string", "enum": ["block", "warn", "approval"]},
+                "message": {"type": "string"},
+                "approvers": {"type": "array", "items": {"type": "string"}},
+                "approved_by": {"type": "string"},
+                "at": {"type": "string", "format": "date-time"}
+              }
+            }
+          },
+          "po_number": {"type": "string"},
+          "receipts": {"type": "array", "items": {"$ref": "#/components/schemas/Receipt"}},
+          "history": {"type": "array", "items": {"$ref": "#/components/schemas/Event"}},
+          "version": {"type": "integer", "description": "Incremented by every change of the order"},
+          "created_at": {"type": "string", "format": "date-time"},
+          "updated_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "ExchangeRate": {
+        "type": "object",
+        "description": "Rate into the base currency kept when the order was approved",
+        "properties": {
+          "from": {"type": "string", "example": "EUR"},
+          "to": {"type": "string", "example": "USD"},
+          "rate": {"type": "string", "example": "1.08", "description": "Value in to of one unit of from"},
+          "source": {"type": "string"},
+          "at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Shipment": {
+        "type": "object",
+        "properties": {
+          "carrier": {"type": "string"},
+          "number": {"type": "string"},
+          "status": {"type": "string", "enum": ["unknown", "in_transit", "out_for_delivery", "delivered", "exception"]},
+          "entered_by": {"type": "string"},
+          "entered_at": {"type": "string", "format": "date-time"},
+          "checked_at": {"type": "string", "format": "date-time"},
+          "delivered_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Receipt": {
+        "type": "object",
+        "properties": {
+          "file_id": {"type": "string"},
+          "name": {"type": "string"},
+          "mimetype": {"type": "string"},
+          "size": {"type": "integer"},
+          "permalink": {"type": "string"},
+          "uploaded_by": {"type": "string"},
+          "uploaded_at": {"type": "string", "format": "date-time"},
+          "copy": {"type": "string", "description": "Where the copy of the file is stored, if any"}
+        }
+      },
+      "OrderList": {
+        "type": "object",
+        "properties": {
+          "orders": {"type": "array", "items": {"$ref": "#/components/schemas/Order"}},
+          "next_after": {"type": "integer"}
+        }
+      },
+      "NewOrder": {
+        "type": "object",
+        "required": ["requester", "count"],
+        "properties": {
+          "team_id": {"type": "string"},
+          "channel_id": {"type": "string", "description": "Defaults to the orders channel of the team"},
+          "requester": {"type": "string", "description": "Slack user ID"},
+          "sku": {"type": "string", "description": "Catalog item to fill name, URL and price from"},
+          "item_name": {"type": "string"},
+          "item_url": {"type": "string"},
+          "reason": {"type": "string"},
+          "count": {"type": "integer", "minimum": 1},
+          "unit_price": {"$ref": "#/components/schemas/Amount"},
+          "currency": {"type": "string", "description": "One of the allowed currencies, defaults to the base currency"}
+        }
+      },
+      "Transition": {
+        "type": "object",
+        "required": ["status"],
+        "properties": {
+          "status": {"$ref": "#/components/schemas/Status"},
+          "note": {"type": "string"}
+        }
+      },
+      "CatalogItem": {
+        "type": "object",
+        "required": ["sku", "name"],
+        "properties": {
+          "sku": {"type": "string"},
+          "name": {"type": "string"},
+          "url": {"type": "string"},
+          "category": {"type": "string"},
+          "unit_price": {"$ref": "#/components/schemas/Amount"},
+          "active": {"type": "boolean", "default": true},
+          "updated_at": {"type": "string", "format": "date-time", "readOnly": true}
+        }
+      },
+      "Asset": {
+        "type": "object",
+        "properties": {
+          "tag": {"type": "string", "example": "A-00001"},
+          "serial": {"type": "string"},
+          "category": {"type": "string"},
+          "item_name": {"type": "string"},
+          "owner": {"type": "string"},
+          "team_id": {"type": "string"},
+          "order_id": {"type": "integer"},
+          "purchased_at": {"type": "string", "format": "date-time"},
+          "price": {"$ref": "#/components/schemas/Amount"},
+          "warranty_end": {"type": "string", "format": "date-time", "description": "Zero time when the category has no warranty"},
+          "created_at": {"type": "string", "format": "date-time"}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// orderStatus is the lifecycle state of an order.
+type orderStatus string
+
+const (
+	statusDraft     orderStatus = "draft"
+	statusPending   orderStatus = "pending"
+	statusApproved  orderStatus = "approved"
+	statusRejected  orderStatus = "rejected"
+	statusPurchased orderStatus = "purchased"
+	statusDelivered orderStatus = "delivered"
+	statusCancelled orderStatus = "cancelled"
+	// statusIssue is an order the requester did not receive or received
+	// damaged. It is assigned to whoever purchased it.
+	statusIssue orderStatus = "issue"
+)
+
+// transitions lists the statuses an order can move to from each status.
+var transitions = map[orderStatus][]orderStatus{
+	statusDraft:     {statusPending, statusCancelled},
+	statusPending:   {statusApproved, statusRejected, statusCancelled},
+	statusApproved:  {statusPurchased, statusCancelled},
+	statusPurchased: {statusDelivered, statusIssue},
+	statusDelivered: {statusIssue},
+	statusIssue:     {statusPurchased, statusDelivered, statusCancelled},
+}
+
+// canTransition reports whether an order in from can move to to.
+func canTransition(from, to orderStatus) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Kinds of orderEvent.
+const (
+	eventCreated  = "created"
+	eventStatus   = "status"
+	eventComment  = "comment"
+	eventReminder = "reminder"
+	eventTracking = "tracking"
+	eventReceipt  = "receipt"
+	eventJoined   = "joined"
+	eventPolicy   = "policy"
+	eventCharges  = "charges"
+	eventEdited   = "edited"
+)
+
+// orderEvent is an entry of the order history.
+type orderEvent struct {
+	At     time.Time   `json:"at"`
+	User   string      `json:"user,omitempty"`
+	Kind   string      `json:"kind"`
+	Status orderStatus `json:"status,omitempty"`
+	Text   string      `json:"text,omitempty"`
+}
+
+// order is a purchase request made through the dialog.
+type order struct {
+	ID        int64  `json:"id"`
+	TeamID    string `json:"team_id"`
+	ChannelID string `json:"channel_id"`
+	// ThreadTS is the timestamp of the public summary message.
+	// Every later message about the order is posted in its thread.
+	ThreadTS  string `json:"thread_ts,omitempty"`
+	Requester string `json:"requester"`
+
+	SKU       string `json:"sku,omitempty"`
+	ItemName  string `json:"item_name"`
+	ItemURL   string `json:"item_url"`
+	Reason    string `json:"reason"`
+	Count     int    `json:"count"`
+	UnitPrice amount `json:"unit_price,omitempty"`
+	// Currency is the currency of UnitPrice, empty for orders made before
+	// currencies were kept, which are in the base currency.
+	Currency string `json:"currency,omitempty"`
+	// Rate converts the order into the base currency. It is kept when the
+	// order is approved so that reports do not follow later rates.
+	Rate *exchangeRate `json:"rate,omitempty"`
+	// Shipping, tax and discounts come on top of the items, the purchaser
+	// can change them until the order is purchased. TaxRate is a percentage
+	// and TaxAmount, when the exact tax is known, overrides it.
+	Shipping  amount     `json:"shipping,omitempty"`
+	TaxRegion string     `json:"tax_region,omitempty"`
+	TaxRate   amount     `json:"tax_rate,omitempty"`
+	TaxAmount *amount    `json:"tax_amount,omitempty"`
+	Discounts []discount `json:"discounts,omitempty"`
+
+	Status     orderStatus `json:"status"`
+	ApprovedBy string      `json:"approved_by,omitempty"`
+	// PurchasedBy is who bought the order, issues are assigned to them.
+	PurchasedBy string    `json:"purchased_by,omitempty"`
+	AssignedTo  string    `json:"assigned_to,omitempty"`
+	Shipment    *shipment `json:"shipment,omitempty"`
+	PONumber    string    `json:"po_number,omitempty"`
+	Receipts    []receipt `json:"receipts,omitempty"`
+	// Joined are people who added to this order instead of ordering the
+	// same item themselves. Count includes their items.
+	Joined []orderJoin `json:"joined,omitempty"`
+	// Policies are the policy rules the order triggered.
+	Policies []policyResult `json:"policies,omitempty"`
+	History  []orderEvent   `json:"history"`
+
+	// Version counts the changes of the order, see UpdateOrderVersion.
+	Version        int64     `json:"version"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	LastRemindedAt time.Time `json:"last_reminded_at,omitempty"`
+}
+
+// Ref returns the human readable reference of the order.
+func (o *order) Ref() string {
+	return fmt.Sprintf("#%d", o.ID)
+}
+
+// Total returns the price of the whole order with shipping, tax and discounts.
+func (o *order) Total() amount {
+	return o.Subtotal() + o.Shipping + o.Tax() - o.DiscountTotal()
+}
+
+// money formats a in the currency of the order, e.g. "49.99 EUR".
+func (o *order) money(a amount) string {
+	if o.Currency == "" {
+		return a.String()
+	}
+	return a.String() + " " + o.Currency
+}
+
+// isOpen reports whether the order still needs something to happen.
+func (o *order) isOpen() bool {
+	switch o.Status {
+	case statusDelivered, statusRejected, statusCancelled:
+		return false
+	}
+	return true
+}
+
+// transition moves the order to status and records it in the history.
+func (o *order) transition(to orderStatus, user, note string, now time.Time) error {
+	if !canTransition(o.Status, to) {
+		return trErrorf("order.error.transition", o.Ref(), statusName(o.Status), statusName(to))
+	}
+	from := o.Status
+	o.Status = to
+	switch to {
+	case statusApproved:
+		o.ApprovedBy = user
+	case statusPurchased:
+		if from == statusIssue {
+			// Reshipped, the new shipment is tracked from scratch
+			o.Shipment = nil
+		} else {
+			o.PurchasedBy = user
+		}
+		o.AssignedTo = ""
+	case statusIssue:
+		o.AssignedTo = o.PurchasedBy
+	case statusDelivered, statusCancelled:
+		o.AssignedTo = ""
+	}
+	o.record(orderEvent{At: now, User: user, Kind: eventStatus, Status: to, Text: note})
+	return nil
+}
+
+func (o *order) record(ev orderEvent) {
+	o.History = append(o.History, ev)
+	o.UpdatedAt = ev.At
+}
+
+// statusSince returns when the order entered its current status.
+func (o *order) statusSince() time.Time {
+	for i := len(o.History) - 1; i >= 0; i-- {
+		if o.History[i].Kind == eventStatus {
+			return o.History[i].At
+		}
+	}
+	return o.CreatedAt
+}
+
+func (o order) clone() order {
+	o.History = append([]orderEvent(nil), o.History...)
+	o.Receipts = append([]receipt(nil), o.Receipts...)
+	o.Joined = append([]orderJoin(nil), o.Joined...)
+	o.Policies = append([]policyResult(nil), o.Policies...)
+	if o.Shipment != nil {
+		sh := *o.Shipment
+		o.Shipment = &sh
+	}
+	if o.Rate != nil {
+		r := *o.Rate
+		o.Rate = &r
+	}
+	if o.TaxAmount != nil {
+		tax := *o.TaxAmount
+		o.TaxAmount = &tax
+	}
+	o.Discounts = append([]discount(nil), o.Discounts...)
+	return o
+}
+
+// CreateOrder assigns an ID to o and stores it.
+func (s *orderStore) CreateOrder(o order) (order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.LastOrderID++
+	o.ID = s.data.LastOrderID
+	if o.CreatedAt.IsZero() {
+		o.CreatedAt = time.Now()
+	}
+	o.UpdatedAt = o.CreatedAt
+	o.Version = 1
+	o.record(orderEvent{At: o.CreatedAt, User: o.Requester, Kind: eventCreated, Status: o.Status})
+	s.data.Orders[o.ID] = &o
+	if err := s.flush(); err != nil {
+		delete(s.data.Orders, o.ID)
+		s.data.LastOrderID--
+		return order{}, err
+	}
+	return o.clone(), nil
+}
+
+// Order returns the order with id.
+func (s *orderStore) Order(id int64) (order, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.data.Orders[id]
+	if !ok {
+		return order{}, false
+	}
+	return o.clone(), true
+}
+
+// UpdateOrder applies fn to the order with id and persists the result.
+// Nothing is changed when fn returns an error.
+func (s *orderStore) UpdateOrder(id int64, fn func(o *order) error) (order, error) {
+	return s.UpdateOrderVersion(id, 0, fn)
+}
+
+// AnnotateOrder is UpdateOrder for what happens around the order without
+// changing it, such as its thread, comments and receipts. The version is
+// kept, so that buttons and decisions about the order stay valid.
+func (s *orderStore) AnnotateOrder(id int64, fn func(o *order) error) (order, error) {
+	return s.updateOrder(id, 0, false, fn)
+}
+
+// UpdateOrderVersion is UpdateOrder for changes decided from the order at
+// version outside the store lock: it fails if the order changed since, so
+// that a decision is never applied to another state. Version 0 is any.
+func (s *orderStore) UpdateOrderVersion(id, version int64, fn func(o *order) error) (order, error) {
+	return s.updateOrder(id, version, true, fn)
+}
+
+func (s *orderStore) updateOrder(id, version int64, change bool, fn func(o *order) error) (order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.data.Orders[id]
+	if !ok {
+		return order{}, trErrorf("order.error.not_found", id)
+	}
+	if version != 0 && stored.Version != version {
+		return order{}, trErrorf("order.error.changed", stored.Ref())
+	}
+	o := stored.clone()
+	if err := fn(&o); err != nil {
+		return order{}, err
+	}
+	if change {
+		o.Version = stored.Version + 1
+	}
+	s.data.Orders[id] = &o
+	if err := s.flush(); err != nil {
+		s.data.Orders[id] = stored
+		return order{}, err
+	}
+	return o.clone(), nil
+}
+
+// OrderByThread returns the order whose summary message is ts in channel.
+func (s *orderStore) OrderByThread(channel, ts string) (order, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, o := range s.data.Orders {
+		if o.ThreadTS == ts && o.ChannelID == channel {
+			return o.clone(), true
+		}
+	}
+	return order{}, false
+}
+
+// Orders returns the orders matching match, oldest first.
+// A nil match returns every order.
+func (s *orderStore) Orders(match func(o *order) bool) []order {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var orders []order
+	for _, o := range s.data.Orders {
+		if match == nil || match(o) {
+			orders = append(orders, o.clone())
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return orders
+}
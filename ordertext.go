@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	actionEditDraft = "order_edit_draft"
+
+	// orderDialogCallback is the callback ID of the order dialog. A dialog
+	// editing a draft appends ":" and the callback token of the draft.
+	orderDialogCallback = "dialog_callback_id"
+
+	// orderTextMaxCount is the largest quantity taken from a message.
+	orderTextMaxCount = 10000
+)
+
+// orderText is an order written in a message, e.g.
+// "2x Logitech MX Keys https://a.co/d/xyz for the new hire".
+type orderText struct {
+	Count     int
+	ItemName  string
+	ItemURL   string
+	Reason    string
+	UnitPrice amount
+	// Currency is the currency of the price, "" if the text has none.
+	Currency string
+}
+
+// errNoItem is returned for text without an item name, which is not an order.
+var errNoItem = errors.New("no item name")
+
+var (
+	// orderTextURL is a link as slack sends it, "<url>" or "<url|label>".
+	orderTextURL = regexp.MustCompile(`^<?(https?://[^|>\s]+)(?:\|[^>]*)?>?$`)
+	// orderTextCount is a quantity such as "2", "2x", "x2" or "×2".
+	orderTextCount = regexp.MustCompile(`^(?i)(?:(\d+)[x×]?|[x×](\d+))$`)
+	// orderTextCurrency is a currency code after a price, e.g. "EUR".
+	orderTextCurrency = regexp.MustCompile(`^[A-Z]{3}$`)
+
+	slackUnescaper = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+)
+
+// parseOrderText reads an order from text with these rules, in order:
+//
+//   - The first link is the item URL. Words after it are the reason, with a
+//     leading "for" or "because" dropped.
+//   - Without words after the link, the reason starts at the first
+//     "because", else at the last "for" which is not the first word.
+//   - "@49.99" or "@ 49.99" is the price per item. A currency symbol
+//     ("@€49.99") or code ("@49.99 EUR") gives its currency, "each" after
+//     it is dropped.
+//   - A quantity ("2", "2x", "x2", "2 x") as the first or last word of the
+//     item is the count, which defaults to 1.
+//   - What is left is the item name. Without one, text is not an order and
+//     errNoItem is returned.
+//
+// A malformed price or a quantity out of range is an error in loc.
+func parseOrderText(text, loc string) (orderText, error) {
+	o := orderText{Count: 1}
+	words := strings.Fields(text)
+
+	var item, rest []string
+	for i, w := range words {
+		if m := orderTextURL.FindStringSubmatch(w); m != nil {
+			o.ItemURL = m[1]
+			item, rest = words[:i], words[i+1:]
+			break
+		}
+	}
+	if o.ItemURL == "" {
+		item = words
+	}
+
+	if len(rest) > 0 {
+		if isReasonMarker(rest[0]) {
+			rest = rest[1:]
+		}
+		o.Reason = strings.Join(rest, " ")
+	} else {
+		item, o.Reason = splitReason(item)
+	}
+
+	item, err := takePrice(item, &o, loc)
+	if err != nil {
+		return orderText{}, err
+	}
+	item, count, err := takeCount(item, loc)
+	if err != nil {
+		return orderText{}, err
+	}
+	if count > 0 {
+		o.Count = count
+	}
+
+	o.ItemName = slackUnescaper.Replace(strings.Join(item, " "))
+	o.Reason = slackUnescaper.Replace(o.Reason)
+	if o.ItemName == "" {
+		return orderText{}, errNoItem
+	}
+	return o, nil
+}
+
+func isReasonMarker(w string) bool {
+	w = strings.ToLower(w)
+	return w == "for" || w == "because"
+}
+
+// splitReason splits words at the reason marker, see parseOrderText.
+func splitReason(words []string) (item []string, reason string) {
+	at := -1
+	for i, w := range words {
+		if strings.EqualFold(w, "because") {
+			at = i
+			break
+		}
+	}
+	if at < 0 {
+		for i := len(words) - 1; i > 0; i-- {
+			if strings.EqualFold(words[i], "for") {
+				at = i
+				break
+			}
+		}
+	}
+	if at < 0 {
+		return words, ""
+	}
+	return words[:at], strings.Join(words[at+1:], " ")
+}
+
+// takePrice removes the price from words into o. It fails on a malformed
+// price.
+func takePrice(words []string, o *orderText, loc string) ([]string, error) {
+	for i, w := range words {
+		if !strings.HasPrefix(w, "@") {
+			continue
+		}
+		value, end := w[1:], i+1
+		if value == "" && i+1 < len(words) {
+			value, end = words[i+1], i+2
+		}
+		for currency, symbol := range currencySymbols {
+			if strings.HasPrefix(value, symbol) {
+				value, o.Currency = value[len(symbol):], currency
+				break
+			}
+		}
+		price, err := parseAmount(value)
+		if err != nil || price < 0 {
+			return nil, errors.New(tr(loc, "order_text.error.price", strings.Join(words[i:end], " ")))
+		}
+		o.UnitPrice = price
+		if o.Currency == "" && end < len(words) && orderTextCurrency.MatchString(words[end]) {
+			o.Currency = words[end]
+			end++
+		}
+		if end < len(words) && strings.EqualFold(words[end], "each") {
+			end++
+		}
+		return append(append([]string{}, words[:i]...), words[end:]...), nil
+	}
+	return words, nil
+}
+
+// takeCount removes the quantity from the start or the end of words. It
+// returns 0 if there is none and fails on a quantity out of range.
+func takeCount(words []string, loc string) ([]string, int, error) {
+	if len(words) < 2 {
+		return words, 0, nil
+	}
+	parse := func(w string) (int, bool) {
+		m := orderTextCount.FindStringSubmatch(w)
+		if m == nil {
+			return 0, false
+		}
+		n, _ := strconv.Atoi(m[1] + m[2])
+		return n, true
+	}
+	check := func(rest []string, n int) ([]string, int, error) {
+		if n < 1 || n > orderTextMaxCount {
+			return nil, 0, errors.New(tr(loc, "order_text.error.count", n, orderTextMaxCount))
+		}
+		return rest, n, nil
+	}
+
+	// "2 x Keyboard"
+	if n, ok := parse(words[0]); ok && len(words) > 2 && strings.EqualFold(words[1], "x") {
+		return check(words[2:], n)
+	}
+	if n, ok := parse(words[0]); ok {
+		return check(words[1:], n)
+	}
+	// At the end only "x2" or "2x" is a count, as names such as
+	// "Dell monitor 27" end with a bare number
+	last := words[len(words)-1]
+	if n, ok := parse(last); ok && strings.ContainsAny(last, "xX×") {
+		return check(words[:len(words)-1], n)
+	}
+	return words, 0, nil
+}
+
+// DiscardDraft cancels the draft with id of user once it was replaced by
+// another one. The draft was never posted, so it has no thread to update.
+func (s *orderService) DiscardDraft(id int64, user string) error {
+	_, err := s.store.UpdateOrder(id, func(o *order) error {
+		if o.Requester != user || o.Status != statusDraft {
+			return fmt.Errorf("order %s is not a draft of <@%s>", o.Ref(), user)
+		}
+		return o.transition(statusCancelled, user, "edited", time.Now())
+	})
+	return err
+}
+
+// orderFromText starts an order from the words after "order": the parsed
+// order is saved as a draft and confirmed right away. It returns false if
+// the words are not an order.
+func (s *SlackListener) orderFromText(channel string, msg slack.Msg, args []string) (bool, error) {
+	loc := s.locale(msg.User)
+	parsed, err := parseOrderText(strings.Join(args, " "), loc)
+	if err == errNoItem {
+		return false, nil
+	}
+	if err != nil {
+		return true, s.replyEphemeral(channel, msg, ":warning: "+err.Error())
+	}
+	if parsed.Currency == "" {
+		parsed.Currency = s.orders.currencies.Base()
+	} else if !s.orders.currencies.Allowed(parsed.Currency) {
+		return true, s.replyEphemeral(channel, msg, ":warning: "+tr(loc, "dialog.error.currency", parsed.Currency))
+	}
+	draft := order{
+		TeamID:    s.team(),
+		ChannelID: channel,
+		Requester: msg.User,
+		ItemName:  parsed.ItemName,
+		ItemURL:   parsed.ItemURL,
+		Reason:    parsed.Reason,
+		Count:     parsed.Count,
+		UnitPrice: parsed.UnitPrice,
+		Currency:  parsed.Currency,
+	}
+	now := time.Now()
+	if s.orders.policies != nil {
+		draft.Policies = s.orders.policies.Evaluate(draft, now)
+	}
+	o, err := s.orders.CreateDraft(draft)
+	if err != nil {
+		return true, fmt.Errorf("failed to save order: %s", err)
+	}
+	log.Printf("[INFO] Order %s parsed from a message of %s", o.Ref(), msg.User)
+
+	params := slack.PostMessageParameters{
+		Attachments: confirmationAttachments(o, loc, s.orders.Duplicates(o, now), s.orders.callbacks, now),
+	}
+	if _, err := s.postEphemeral(channel, msg.User, msg.ThreadTimestamp, "", params); err != nil {
+		return true, fmt.Errorf("failed to post message: %s", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestParseOrderText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want orderText
+		err  string
+	}{
+		// Quantities
+		{"count first", "2x Logitech MX Keys", orderText{Count: 2, ItemName: "Logitech MX Keys"}, ""},
+		{"bare count first", "3 USB-C cables", orderText{Count: 3, ItemName: "USB-C cables"}, ""},
+		{"spaced count", "3 x USB-C cables", orderText{Count: 3, ItemName: "USB-C cables"}, ""},
+		{"count last", "Logitech MX Keys x3", orderText{Count: 3, ItemName: "Logitech MX Keys"}, ""},
+		{"multiplication sign", "Tom &amp; Jerry DVD ×2", orderText{Count: 2, ItemName: "Tom & Jerry DVD"}, ""},
+		{"number in name", "Dell monitor 27", orderText{Count: 1, ItemName: "Dell monitor 27"}, ""},
+		{"number alone", "5", orderText{Count: 1, ItemName: "5"}, ""},
+		{"largest count", "10000x screws", orderText{Count: 10000, ItemName: "screws"}, ""},
+
+		// Prices and currencies
+		{"price", "2 chairs @ 49.99 each for the office", orderText{Count: 2, ItemName: "chairs", UnitPrice: 4999, Reason: "the office"}, ""},
+		{"grouped price", "chairs @1,200.5", orderText{Count: 1, ItemName: "chairs", UnitPrice: 120050}, ""},
+		{"currency code", "chairs @49.99 EUR each", orderText{Count: 1, ItemName: "chairs", UnitPrice: 4999, Currency: "EUR"}, ""},
+		{"spaced currency code", "chairs @ 49.99 GBP", orderText{Count: 1, ItemName: "chairs", UnitPrice: 4999, Currency: "GBP"}, ""},
+		{"currency symbol", "chairs @€49.99", orderText{Count: 1, ItemName: "chairs", UnitPrice: 4999, Currency: "EUR"}, ""},
+		{"spaced currency symbol", "2 chairs @ ¥5000", orderText{Count: 2, ItemName: "chairs", UnitPrice: 500000, Currency: "JPY"}, ""},
+		{"lowercase word after price", "chairs @49.99 red", orderText{Count: 1, ItemName: "chairs red", UnitPrice: 4999}, ""},
+
+		// URLs
+		{"slack link", "2x Logitech MX Keys <https://a.co/d/xyz> for the new hire", orderText{Count: 2, ItemName: "Logitech MX Keys", ItemURL: "https://a.co/d/xyz", Reason: "the new hire"}, ""},
+		{"plain link", "2x Logitech MX Keys https://a.co/d/xyz for the new hire", orderText{Count: 2, ItemName: "Logitech MX Keys", ItemURL: "https://a.co/d/xyz", Reason: "the new hire"}, ""},
+		{"labelled link", "Logitech MX Keys x3 <https://a.co/d/xyz|a.co/d/xyz>", orderText{Count: 3, ItemName: "Logitech MX Keys", ItemURL: "https://a.co/d/xyz"}, ""},
+		{"first link only", "Keys <http://a.co/1> <http://a.co/2>", orderText{Count: 1, ItemName: "Keys", ItemURL: "http://a.co/1", Reason: "<http://a.co/2>"}, ""},
+
+		// Reasons
+		{"because", "3 x USB-C cable for MacBook because mine broke", orderText{Count: 3, ItemName: "USB-C cable for MacBook", Reason: "mine broke"}, ""},
+		{"last for", "Case for iPhone for Bob", orderText{Count: 1, ItemName: "Case for iPhone", Reason: "Bob"}, ""},
+		{"leading for", "for the team", orderText{Count: 1, ItemName: "for the team"}, ""},
+		{"reason after link", "Keys <https://a.co/d/xyz> because mine broke", orderText{Count: 1, ItemName: "Keys", ItemURL: "https://a.co/d/xyz", Reason: "mine broke"}, ""},
+		{"escaped reason", "Keys for R&amp;D", orderText{Count: 1, ItemName: "Keys", Reason: "R&D"}, ""},
+
+		// Malformed input
+		{"empty", "", orderText{}, errNoItem.Error()},
+		{"link only", "<https://a.co/d/xyz>", orderText{}, errNoItem.Error()},
+		{"price only", "@ 3.00 each for Bob", orderText{}, errNoItem.Error()},
+		{"zero count", "0x cables", orderText{}, "0 is not a quantity from 1 to 10000"},
+		{"count too large", "cables x10001", orderText{}, "10001 is not a quantity from 1 to 10000"},
+		{"price not a number", "chairs @ abc", orderText{}, `"@ abc" is not a price, write it such as @49.99`},
+		{"price with three decimals", "chairs @4.999", orderText{}, `"@4.999" is not a price, write it such as @49.99`},
+		{"negative price", "chairs @-5", orderText{}, `"@-5" is not a price, write it such as @49.99`},
+		{"price missing", "chairs @", orderText{}, `"@" is not a price, write it such as @49.99`},
+	}
+	for _, tt := range tests {
+		got, err := parseOrderText(tt.in, localeEN)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: parseOrderText(%q) = %+v, %v; want error %q", tt.name, tt.in, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: parseOrderText(%q) = %+v, %v; want %+v", tt.name, tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseOrderTextLocale(t *testing.T) {
+	_, err := parseOrderText("0x cables", localeJA)
+	if want := "0 は数量ではありません。1 から 10000 までで書いてください"; err == nil || err.Error() != want {
+		t.Errorf("error = %v, want %q", err, want)
+	}
+}
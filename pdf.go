@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// PDF fonts. Only standard fonts are used so nothing has to be embedded,
+// which limits text to the WinAnsi (Latin-1) character set.
+const (
+	pdfFontRegular = "F1"
+	pdfFontBold    = "F2"
+	pdfFontMono    = "F3"
+)
+
+var pdfFonts = []struct{ name, base string }{
+	{pdfFontRegular, "Helvetica"},
+	{pdfFontBold, "Helvetica-Bold"},
+	{pdfFontMono, "Courier"},
+}
+
+// A4 in points.
+const (
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+	pdfMargin     = 50
+)
+
+// pdfDocument builds a text only PDF page by page.
+type pdfDocument struct {
+	pages []*bytes.Buffer
+}
+
+// newPage starts a page and returns its content stream.
+func (d *pdfDocument) newPage() *bytes.Buffer {
+	p := new(bytes.Buffer)
+	d.pages = append(d.pages, p)
+	return p
+}
+
+// pdfText draws s with its baseline at x, y.
+func pdfText(p *bytes.Buffer, x, y float64, font string, size float64, s string) {
+	fmt.Fprintf(p, "BT /%s %.1f Tf %.1f %.1f Td (%s) Tj ET\n", font, size, x, y, pdfEscape(s))
+}
+
+// pdfRule draws a horizontal line from x1 to x2.
+func pdfRule(p *bytes.Buffer, x1, x2, y float64) {
+	fmt.Fprintf(p, "0.5 w %.1f %.1f m %.1f %.1f l S\n", x1, y, x2, y)
+}
+
+// pdfEscape encodes s as WinAnsi and escapes it for a PDF string.
+// Characters outside of Latin-1 are replaced with "?".
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString("    ")
+		case r < 0x20:
+		case r < 0x80:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// Bytes returns the encoded document.
+func (d *pdfDocument) Bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// 1: catalog, 2: page tree, then fonts, then a page and its content per page
+	firstFont := 3
+	firstPage := firstFont + len(pdfFonts)
+	var kids, fonts []string
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", firstPage+2*i))
+	}
+	for i, f := range pdfFonts {
+		fonts = append(fonts, fmt.Sprintf("/%s %d 0 R", f.name, firstFont+i))
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	for _, f := range pdfFonts {
+		object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", f.base))
+	}
+	for i, p := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << %s >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, strings.Join(fonts, " "), firstPage+2*i+1))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.Len(), p.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// renderTextPDF lays out text as pages. Lines starting with "# " and
+// "## " are headings, "---" is a rule and other lines are set in a
+// monospaced font so templates can align columns with printf.
+func renderTextPDF(text string) []byte {
+	const (
+		monoSize  = 9.5
+		monoWidth = monoSize * 0.6
+	)
+	width := float64(pdfPageWidth - 2*pdfMargin)
+	maxChars := int(width / monoWidth)
+
+	d := &pdfDocument{}
+	p := d.newPage()
+	y := float64(pdfPageHeight - pdfMargin)
+	advance := func(h float64) {
+		if y-h < pdfMargin {
+			p = d.newPage()
+			y = pdfPageHeight - pdfMargin
+		}
+		y -= h
+	}
+
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		line = strings.TrimRight(line, " \r")
+		switch {
+		case strings.HasPrefix(line, "# "):
+			advance(24)
+			pdfText(p, pdfMargin, y, pdfFontBold, 18, strings.TrimPrefix(line, "# "))
+			y -= 4
+		case strings.HasPrefix(line, "## "):
+			advance(18)
+			pdfText(p, pdfMargin, y, pdfFontBold, 12, strings.TrimPrefix(line, "## "))
+			y -= 2
+		case line == "---":
+			advance(7)
+			pdfRule(p, pdfMargin, pdfPageWidth-pdfMargin, y+3)
+		case line == "":
+			advance(monoSize * 0.8)
+		default:
+			for len([]rune(line)) > maxChars {
+				r := []rune(line)
+				advance(monoSize * 1.35)
+				pdfText(p, pdfMargin, y, pdfFontMono, monoSize, string(r[:maxChars]))
+				line = string(r[maxChars:])
+			}
+			advance(monoSize * 1.35)
+			pdfText(p, pdfMargin, y, pdfFontMono, monoSize, line)
+		}
+	}
+	return d.Bytes()
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// policyAction is what happens when a policy rule is triggered.
+type policyAction string
+
+const (
+	// policyBlock refuses the order, or its approval.
+	policyBlock policyAction = "block"
+	// policyWarn lets the order through with a warning.
+	policyWarn policyAction = "warn"
+	// policyApproval adds an approval stage for the approvers of the rule
+	// before the order can be approved.
+	policyApproval policyAction = "approval"
+)
+
+var policyActions = map[policyAction]bool{policyBlock: true, policyWarn: true, policyApproval: true}
+
+var policyIcons = map[policyAction]string{
+	policyBlock:    ":no_entry:",
+	policyWarn:     ":warning:",
+	policyApproval: ":lock:",
+}
+
+// policyResult is a rule triggered by an order. It is kept on the order.
+type policyResult struct {
+	Rule    string       `json:"rule"`
+	Action  policyAction `json:"action"`
+	Message string       `json:"message"`
+	// Approvers must approve the order for an approval rule, one of them
+	// is recorded in ApprovedBy.
+	Approvers  []string  `json:"approvers,omitempty"`
+	ApprovedBy string    `json:"approved_by,omitempty"`
+	At         time.Time `json:"at"`
+
+	// field is the dialog field the rule checked, for blocking rules.
+	field string
+	// check is Message to translate, unless the rule has a message of its own.
+	check error
+}
+
+// reason is the message of r, to translate with errorText.
+func (r policyResult) reason() error {
+	if r.check != nil {
+		return r.check
+	}
+	return errors.New(r.Message)
+}
+
+// text formats r for slack.
+func (r policyResult) text() string {
+	text := fmt.Sprintf("%s *%s*: %s", policyIcons[r.Action], r.Rule, r.Message)
+	if r.Action == policyApproval {
+		if r.ApprovedBy != "" {
+			text += fmt.Sprintf(" (approved by <@%s>)", r.ApprovedBy)
+		} else {
+			text += " (needs approval from " + mentions(r.Approvers) + ")"
+		}
+	}
+	return text
+}
+
+// openStages returns the approval rules of o nobody approved yet.
+func (o *order) openStages() []policyResult {
+	var open []policyResult
+	for _, r := range o.Policies {
+		if r.Action == policyApproval && r.ApprovedBy == "" {
+			open = append(open, r)
+		}
+	}
+	return open
+}
+
+// recordPolicies adds the results for rules o did not trigger before and
+// reports whether any was added.
+func (o *order) recordPolicies(results []policyResult) bool {
+	added := false
+next:
+	for _, r := range results {
+		for _, existing := range o.Policies {
+			if existing.Rule == r.Rule {
+				continue next
+			}
+		}
+		o.Policies = append(o.Policies, r)
+		added = true
+	}
+	return added
+}
+
+// policyRule is a validated policyConfig.
+type policyRule struct {
+	policyConfig
+	monthlyCap amount
+}
+
+// policyEngine evaluates the policy rules of the config against orders.
+type policyEngine struct {
+	store      *orderStore
+	currencies *currencyBook
+	rules      []policyRule
+}
+
+// newPolicyEngine builds the rules of a validated config. Monthly caps are
+// in the base currency of currencies.
+func newPolicyEngine(store *orderStore, currencies *currencyBook, configs []policyConfig) *policyEngine {
+	e := &policyEngine{store: store, currencies: currencies}
+	for _, c := range configs {
+		r := policyRule{policyConfig: c}
+		if c.MonthlyCap != "" {
+			r.monthlyCap, _ = parseAmount(c.MonthlyCap)
+		}
+		e.rules = append(e.rules, r)
+	}
+	return e
+}
+
+// Evaluate returns the rules o triggers. A rule is triggered when o is in
+// its scope and fails one of its checks, or always for rules without checks.
+func (e *policyEngine) Evaluate(o order, now time.Time) []policyResult {
+	var results []policyResult
+	for _, r := range e.rules {
+		if !e.inScope(r, o) {
+			continue
+		}
+		field, check := e.check(r, o, now)
+		if check == nil {
+			continue
+		}
+		result := policyResult{
+			Rule:      r.Name,
+			Action:    policyAction(r.Action),
+			Message:   check.Error(),
+			Approvers: r.Approvers,
+			At:        now,
+			field:     field,
+			check:     check,
+		}
+		if r.Message != "" {
+			result.Message, result.check = r.Message, nil
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// inScope reports whether o is one of the orders r applies to.
+func (e *policyEngine) inScope(r policyRule, o order) bool {
+	if len(r.Categories) == 0 && len(r.Keywords) == 0 {
+		return true
+	}
+	if o.SKU != "" {
+		if it, ok := e.store.CatalogItem(o.SKU); ok {
+			for _, c := range r.Categories {
+				if strings.EqualFold(c, it.Category) {
+					return true
+				}
+			}
+		}
+	}
+	name := strings.ToLower(o.ItemName)
+	for _, k := range r.Keywords {
+		if strings.Contains(name, strings.ToLower(k)) {
+			return true
+		}
+	}
+	return false
+}
+
+// check runs the checks of r and describes the first which failed. The
+// message is nil if they all passed.
+func (e *policyEngine) check(r policyRule, o order, now time.Time) (field string, message error) {
+	hasCheck := false
+	if r.MaxQuantity > 0 {
+		hasCheck = true
+		if o.Count > r.MaxQuantity {
+			return "item_count", trErrorf("policy.check.quantity", r.MaxQuantity)
+		}
+	}
+	if len(r.BannedDomains) > 0 {
+		hasCheck = true
+		if u, err := url.Parse(o.ItemURL); err == nil && u.Host != "" {
+			host := strings.ToLower(u.Hostname())
+			for _, d := range r.BannedDomains {
+				d = strings.ToLower(d)
+				if host == d || strings.HasSuffix(host, "."+d) {
+					return "item_url", trErrorf("policy.check.domain", d)
+				}
+			}
+		}
+	}
+	if r.MinReasonLength > 0 {
+		hasCheck = true
+		if n := len([]rune(strings.TrimSpace(o.Reason))); n < r.MinReasonLength {
+			return "item_reason", trErrorf("policy.check.reason", r.MinReasonLength)
+		}
+	}
+	if r.monthlyCap > 0 {
+		hasCheck = true
+		spent := e.spentThisMonth(o, now)
+		if spent+e.currencies.BaseTotal(o) > r.monthlyCap {
+			return "item_price", trErrorf("policy.check.cap", o.Requester, r.monthlyCap, spent)
+		}
+	}
+	if !hasCheck {
+		return "", trErrorf("policy.check.required")
+	}
+	return "", nil
+}
+
+// spentThisMonth returns the total of the other orders the requester of o
+// made this month which are pending or bought.
+func (e *policyEngine) spentThisMonth(o order, now time.Time) amount {
+	year, month, _ := now.Date()
+	var spent amount
+	for _, other := range e.store.Orders(func(other *order) bool {
+		y, m, _ := other.CreatedAt.In(now.Location()).Date()
+		return other.ID != o.ID && other.Requester == o.Requester &&
+			(other.Status == statusPending || spendingStatuses[other.Status]) &&
+			y == year && m == month
+	}) {
+		spent += e.currencies.BaseTotal(other)
+	}
+	return spent
+}
+
+// blocking returns the first blocking result, if any.
+func blocking(results []policyResult) (policyResult, bool) {
+	for _, r := range results {
+		if r.Action == policyBlock {
+			return r, true
+		}
+	}
+	return policyResult{}, false
+}
+
+// checkPolicies evaluates the rules again before the order with id is
+// approved, as caps may have been used up since it was submitted. Newly
+// triggered rules are recorded on the order.
+func (s *orderService) checkPolicies(id int64, now time.Time) error {
+	o, ok := s.store.Order(id)
+	if !ok {
+		return trErrorf("order.error.not_found", id)
+	}
+	results := s.policies.Evaluate(o, now)
+	if r, ok := blocking(results); ok {
+		return trErrorf("policy.error.blocked", o.Ref(), r.Rule, r.reason())
+	}
+
+	added := false
+	o, err := s.store.UpdateOrder(id, func(o *order) error {
+		added = o.recordPolicies(results)
+		return nil
+	})
+	if err != nil || !added {
+		return err
+	}
+	if _, err := s.threads.Publish(o); err != nil {
+		log.Printf("[ERROR] %s", err)
+	}
+	return nil
+}
+
+// approveStage records the approval of user for the approval rules of the
+// order with id which user can approve. It returns false if there were none.
+func (s *orderService) approveStage(id int64, user string, now time.Time) (order, bool, error) {
+	canApprove := func(o *order) []string {
+		var rules []string
+		for _, r := range o.openStages() {
+			for _, a := range r.Approvers {
+				if a == user {
+					rules = append(rules, r.Rule)
+					break
+				}
+			}
+		}
+		return rules
+	}
+	if o, ok := s.store.Order(id); !ok || o.Status != statusPending || len(canApprove(&o)) == 0 {
+		return order{}, false, nil
+	}
+
+	var rules []string
+	o, err := s.store.UpdateOrder(id, func(o *order) error {
+		if rules = canApprove(o); len(rules) == 0 {
+			return trErrorf("policy.error.approved", o.Ref())
+		}
+		for i, r := range o.Policies {
+			for _, name := range rules {
+				if r.Rule == name {
+					o.Policies[i].ApprovedBy = user
+				}
+			}
+		}
+		o.record(orderEvent{At: now, User: user, Kind: eventPolicy, Text: "approved " + strings.Join(rules, ", ")})
+		return nil
+	})
+	if err != nil {
+		return o, true, err
+	}
+
+	if published, err := s.threads.Publish(o); err != nil {
+		log.Printf("[ERROR] %s", err)
+	} else {
+		o = published
+	}
+	text := fmt.Sprintf("<@%s> approved the order for policy %s", user, strings.Join(rules, ", "))
+	if err := s.threads.Reply(o, text); err != nil {
+		log.Printf("[ERROR] %s", err)
+	}
+	s.postNextStep(o)
+	return o, true, nil
+}
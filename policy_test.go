@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluatePolicies(t *testing.T) {
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveCatalogItem(catalogItem{SKU: "LAP-1", Name: "ThinkPad", Category: "Laptops", UnitPrice: 150000, Active: true}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	// U1 spent 60.00 this month, the order of last month does not count
+	for _, o := range []order{
+		{Requester: "U1", ItemName: "Chair", Count: 1, UnitPrice: 6000, Status: statusPurchased, CreatedAt: now.Add(-24 * time.Hour)},
+		{Requester: "U1", ItemName: "Desk", Count: 1, UnitPrice: 50000, Status: statusPurchased, CreatedAt: now.AddDate(0, -1, 0)},
+		{Requester: "U1", ItemName: "Lamp", Count: 1, UnitPrice: 50000, Status: statusRejected, CreatedAt: now},
+	} {
+		if _, err := store.CreateOrder(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := newPolicyEngine(store, nil, []policyConfig{
+		{Name: "max-quantity", MaxQuantity: 3, Action: "block"},
+		{Name: "shops", BannedDomains: []string{"aliexpress.com"}, Action: "block", Message: "buy from an approved shop"},
+		{Name: "laptop-reason", Keywords: []string{"laptop"}, MinReasonLength: 10, Action: "block"},
+		{Name: "cap", MonthlyCap: "100", Action: "warn"},
+		{Name: "it", Categories: []string{"laptops"}, Action: "approval", Approvers: []string{"UIT"}},
+	})
+
+	tests := []struct {
+		name string
+		o    order
+		want []string
+	}{
+		{"nothing", order{ItemName: "Pen", Count: 3}, nil},
+		{"quantity", order{ItemName: "Pen", Count: 4}, []string{"max-quantity item_count at most 3 can be ordered at once"}},
+		{"banned subdomain", order{ItemName: "Pen", Count: 1, ItemURL: "https://ja.aliexpress.com/item/1"}, []string{"shops item_url buy from an approved shop"}},
+		{"other domain", order{ItemName: "Pen", Count: 1, ItemURL: "https://notaliexpress.com/item/1"}, nil},
+		{"keyword", order{ItemName: "Gaming LAPTOP", Count: 1, Reason: "  broken  "}, []string{"laptop-reason item_reason explain the reason in at least 10 characters"}},
+		{"keyword with reason", order{ItemName: "Laptop", Count: 1, Reason: "screen is broken"}, nil},
+		{"category", order{ItemName: "ThinkPad", SKU: "LAP-1", Count: 1, Reason: "screen is broken"}, []string{"it  required for these items"}},
+		{"cap", order{Requester: "U1", ItemName: "Pen", Count: 1, UnitPrice: 4001}, []string{"cap item_price <@U1> would go over the monthly cap of 100.00 (60.00 spent this month)"}},
+		{"below cap", order{Requester: "U1", ItemName: "Pen", Count: 1, UnitPrice: 4000}, nil},
+		{"several", order{ItemName: "Laptop", Count: 5}, []string{"max-quantity item_count at most 3 can be ordered at once", "laptop-reason item_reason explain the reason in at least 10 characters"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, r := range e.Evaluate(tt.o, now) {
+			got = append(got, r.Rule+" "+r.field+" "+r.Message)
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: triggered %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPolicies(t *testing.T) {
+	newFakeSlack(t)
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &orderService{
+		store:     store,
+		threads:   &orderThreads{workspaces: newWorkspaceRegistry(store, "xoxb-test", "C1"), store: store},
+		approvers: []string{"UBOSS"},
+		callbacks: newCallbackSigner([]byte("0123456789abcdef")),
+		policies: newPolicyEngine(store, nil, []policyConfig{
+			{Name: "cap", MonthlyCap: "100", Action: "block"},
+			{Name: "it", Keywords: []string{"laptop"}, Action: "approval", Approvers: []string{"UIT"}},
+		}),
+	}
+	create := func(name string, price amount) order {
+		o, err := store.CreateOrder(order{Requester: "U1", ItemName: name, Count: 1, UnitPrice: price, ChannelID: "C1", Status: statusPending})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+
+	// The approval stage is added when the order is approved, and its
+	// approvers approve it before the approvers of orders
+	laptop := create("Laptop", 8000)
+	if _, err := s.Transition(laptop.ID, statusApproved, "UBOSS", ""); err == nil || !strings.Contains(err.Error(), "needs approval from <@UIT> first") {
+		t.Fatalf("approval before the stage = %v", err)
+	}
+	o, err := s.Transition(laptop.ID, statusApproved, "UIT", "")
+	if err != nil || o.Status != statusPending || len(o.Policies) != 1 || o.Policies[0].ApprovedBy != "UIT" {
+		t.Fatalf("stage approval = %s %+v, %v", o.Status, o.Policies, err)
+	}
+	if o, err = s.Transition(laptop.ID, statusApproved, "UBOSS", ""); err != nil || o.Status != statusApproved || len(o.Policies) != 1 {
+		t.Fatalf("approval = %s %+v, %v", o.Status, o.Policies, err)
+	}
+
+	// The cap is checked again on approval, the laptop used up most of it
+	mouse := create("Mouse", 3000)
+	if _, err := s.Transition(mouse.ID, statusApproved, "UBOSS", ""); err == nil || !strings.Contains(err.Error(), "blocked by policy cap") {
+		t.Fatalf("approval over the cap = %v", err)
+	}
+	if o, _ := store.Order(mouse.ID); o.Status != statusPending || len(o.Policies) != 0 {
+		t.Errorf("blocked order is %s with %+v", o.Status, o.Policies)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultPurchaseOrderTemplate lays out a purchase order for renderTextPDF.
+// It is replaced by purchase_orders.template in the config.
+const defaultPurchaseOrderTemplate = `# {{.Company}}
+{{range .Address}}{{.}}
+{{end}}
+## PURCHASE ORDER {{.Number}}
+---
+PO number:    {{.Number}}
+PO date:      {{.Date}}
+Order:        {{.Order.Ref}}
+Vendor:       {{.Vendor}}
+Requested by: {{.Requester}} on {{.Requested}}
+Approved by:  {{join .Approvers ", "}} on {{.Approved}}
+---
+{{printf "%-44s %5s %12s %14s" "Item" "Qty" "Unit price" "Amount"}}
+---
+{{range .Lines}}{{printf "%-44.44s %5d %12s %14s" .Description .Quantity .UnitPrice .Amount}}
+{{end -}}
+---
+{{printf "%63s %14s" "Subtotal" .Subtotal}}
+{{printf "%63s %14s" .TaxLabel .Tax}}
+{{printf "%63s %14s" (printf "Total (%s)" .Currency) .Total}}
+{{if .Order.ItemURL}}
+URL:    {{.Order.ItemURL}}{{end}}
+{{- if .Order.Reason}}
+Reason: {{.Order.Reason}}{{end}}
+`
+
+var purchaseOrderFuncs = template.FuncMap{"join": strings.Join}
+
+// parsePurchaseOrderTemplate returns the template at path, or the default
+// one if path is empty.
+func parsePurchaseOrderTemplate(path string) (*template.Template, error) {
+	text := defaultPurchaseOrderTemplate
+	if path != "" {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		text = string(buf)
+	}
+	return template.New("purchase_order").Funcs(purchaseOrderFuncs).Parse(text)
+}
+
+// purchaseOrder is an issued PO. The PDF is kept as issued so later
+// changes of the order or the template do not alter it.
+type purchaseOrder struct {
+	Number   string    `json:"number"`
+	OrderID  int64     `json:"order_id"`
+	IssuedAt time.Time `json:"issued_at"`
+	PDF      []byte    `json:"pdf"`
+}
+
+// Filename is the name the PDF is uploaded and downloaded as.
+func (po purchaseOrder) Filename() string {
+	return po.Number + ".pdf"
+}
+
+// IssuePurchaseOrder assigns the next PO number to the order with id and
+// stores the document render builds for it. It returns false if the order
+// has a PO already.
+func (s *orderStore) IssuePurchaseOrder(id int64, render func(seq int64) (purchaseOrder, error)) (purchaseOrder, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if po, ok := s.data.PurchaseOrders[id]; ok {
+		return po, false, nil
+	}
+	o, ok := s.data.Orders[id]
+	if !ok {
+		return purchaseOrder{}, false, fmt.Errorf("order #%d not found", id)
+	}
+
+	seq := s.data.LastPONumber + 1
+	po, err := render(seq)
+	if err != nil {
+		return purchaseOrder{}, false, err
+	}
+	s.data.LastPONumber = seq
+	s.data.PurchaseOrders[id] = po
+	prev := o.PONumber
+	o.PONumber = po.Number
+	if err := s.flush(); err != nil {
+		s.data.LastPONumber = seq - 1
+		delete(s.data.PurchaseOrders, id)
+		o.PONumber = prev
+		return purchaseOrder{}, false, err
+	}
+	return po, true, nil
+}
+
+// PurchaseOrder returns the PO of the order with id.
+func (s *orderStore) PurchaseOrder(id int64) (purchaseOrder, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	po, ok := s.data.PurchaseOrders[id]
+	return po, ok
+}
+
+// purchaseOrderLine is a line item of a PO.
+type purchaseOrderLine struct {
+	Description string
+	Quantity    int
+	UnitPrice   amount
+	Amount      amount
+}
+
+// purchaseOrderData is passed to the PO template.
+type purchaseOrderData struct {
+	Number    string
+	Date      string
+	Company   string
+	Address   []string
+	Vendor    string
+	Order     *order
+	Requester string
+	Requested string
+	Approvers []string
+	Approved  string
+	Lines     []purchaseOrderLine
+	Subtotal  amount
+	TaxRate   string
+	// TaxLabel is "Tax (<rate>%)", or "Tax" for a fixed tax amount.
+	TaxLabel string
+	Tax      amount
+	Total    amount
+	Currency string
+}
+
+// purchaseOrderIssuer issues a PO when an order is approved and attaches
+// it to the order thread.
+type purchaseOrderIssuer struct {
+	store      *orderStore
+	threads    *orderThreads
+	cfg        purchaseOrderConfig
+	currency   string
+	taxRate    amount
+	template   *template.Template
+	workspaces *workspaceRegistry
+}
+
+func newPurchaseOrderIssuer(store *orderStore, threads *orderThreads, cfg purchaseOrderConfig, currency string) (*purchaseOrderIssuer, error) {
+	tmpl, err := parsePurchaseOrderTemplate(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	var rate amount
+	if cfg.TaxRate != "" {
+		if rate, err = parseAmount(cfg.TaxRate); err != nil {
+			return nil, err
+		}
+	}
+	return &purchaseOrderIssuer{
+		store:      store,
+		threads:    threads,
+		cfg:        cfg,
+		currency:   currency,
+		taxRate:    rate,
+		template:   tmpl,
+		workspaces: threads.workspaces,
+	}, nil
+}
+
+// OrderChanged issues the PO of approved orders in the background.
+func (p *purchaseOrderIssuer) OrderChanged(c orderChange) {
+	if c.To != statusApproved {
+		return
+	}
+	go func() {
+		if err := p.Issue(c.Order, c.At); err != nil {
+			log.Printf("[ERROR] Failed to issue purchase order of %s: %s", c.Order.Ref(), err)
+		}
+	}()
+}
+
+// Issue creates the PO of o and posts it in the order thread.
+func (p *purchaseOrderIssuer) Issue(o order, now time.Time) error {
+	data := p.data(o, now)
+	po, issued, err := p.store.IssuePurchaseOrder(o.ID, func(seq int64) (purchaseOrder, error) {
+		data.Number = fmt.Sprintf(p.cfg.NumberFormat, seq)
+		var text bytes.Buffer
+		if err := p.template.Execute(&text, data); err != nil {
+			return purchaseOrder{}, err
+		}
+		return purchaseOrder{
+			Number:   data.Number,
+			OrderID:  o.ID,
+			IssuedAt: now,
+			PDF:      renderTextPDF(text.String()),
+		}, nil
+	})
+	if err != nil || !issued {
+		return err
+	}
+	log.Printf("[INFO] Issued purchase order %s for %s", po.Number, o.Ref())
+
+	o, _ = p.store.Order(o.ID)
+	if o.ThreadTS == "" {
+		return nil
+	}
+	token, err := p.workspaces.Token(o.TeamID)
+	if err != nil {
+		return err
+	}
+	err = uploadSlackFile(token, slackFile{
+		Channel:        o.ChannelID,
+		ThreadTS:       o.ThreadTS,
+		Filename:       po.Filename(),
+		Title:          "Purchase order " + po.Number,
+		InitialComment: fmt.Sprintf("Purchase order %s for order %s", po.Number, o.Ref()),
+		Content:        po.PDF,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %s", po.Filename(), err)
+	}
+	// Show the PO number in the summary
+	_, err = p.threads.Publish(o)
+	return err
+}
+
+func (p *purchaseOrderIssuer) data(o order, now time.Time) purchaseOrderData {
+	lines := []purchaseOrderLine{{
+		Description: o.ItemName,
+		Quantity:    o.Count,
+		UnitPrice:   o.UnitPrice,
+		Amount:      o.Subtotal(),
+	}}
+	if o.Shipping != 0 {
+		lines = append(lines, purchaseOrderLine{Description: "Shipping", Quantity: 1, UnitPrice: o.Shipping, Amount: o.Shipping})
+	}
+	for _, d := range o.Discounts {
+		lines = append(lines, purchaseOrderLine{Description: d.Label, Quantity: 1, UnitPrice: -d.Amount, Amount: -d.Amount})
+	}
+	var subtotal amount
+	for _, l := range lines {
+		subtotal += l.Amount
+	}
+
+	var approvers []string
+	approved := ""
+	for _, ev := range o.History {
+		if ev.Kind == eventStatus && ev.Status == statusApproved {
+			approvers = append(approvers, p.workspaces.ActorName(o.TeamID, ev.User))
+			approved = ev.At.Format("2006-01-02")
+		}
+	}
+
+	// Orders are bought in the currency they were made in
+	currency := o.Currency
+	if currency == "" {
+		currency = p.currency
+	}
+
+	// Orders without a tax of their own are taxed at the PO tax rate
+	var tax amount
+	rate, label := "0", ""
+	switch {
+	case o.TaxAmount != nil:
+		tax, label = o.Tax(), "Tax"
+	case o.hasTax():
+		tax, rate = o.Tax(), o.taxRateText()
+	default:
+		// Round half up to the cent, the rate is in hundredths of a percent
+		tax = (subtotal*p.taxRate + 5000) / 10000
+		if p.taxRate != 0 {
+			rate = strings.TrimRight(strings.TrimRight(p.taxRate.String(), "0"), ".")
+		}
+	}
+	if label == "" {
+		label = fmt.Sprintf("Tax (%s%%)", rate)
+	}
+	return purchaseOrderData{
+		Date:      now.Format("2006-01-02"),
+		Company:   p.cfg.Company,
+		Address:   p.cfg.Address,
+		Vendor:    p.vendor(o),
+		Order:     &o,
+		Requester: p.workspaces.UserName(o.TeamID, o.Requester),
+		Requested: o.CreatedAt.Format("2006-01-02"),
+		Approvers: approvers,
+		Approved:  approved,
+		Lines:     lines,
+		Subtotal:  subtotal,
+		TaxRate:   rate,
+		TaxLabel:  label,
+		Tax:       tax,
+		Total:     subtotal + tax,
+		Currency:  currency,
+	}
+}
+
+// vendor is the shop of the item URL, or the configured vendor.
+func (p *purchaseOrderIssuer) vendor(o order) string {
+	if u, err := url.Parse(o.ItemURL); err == nil && u.Host != "" {
+		return strings.TrimPrefix(u.Hostname(), "www.")
+	}
+	if p.cfg.Vendor != "" {
+		return p.cfg.Vendor
+	}
+	return "-"
+}
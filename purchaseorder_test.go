@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestIssuer returns a PO issuer taxing at rate, its store and slack.
+func newTestIssuer(t *testing.T, rate string) (*purchaseOrderIssuer, *orderStore, *fakeSlack) {
+	fake := newFakeSlack(t)
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	threads := &orderThreads{workspaces: newWorkspaceRegistry(store, "xoxb-test", "C1"), store: store}
+	cfg := purchaseOrderConfig{Company: "Acme", Vendor: "Office Supplies", TaxRate: rate, NumberFormat: "PO-%05d"}
+	p, err := newPurchaseOrderIssuer(store, threads, cfg, "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, store, fake
+}
+
+func TestIssuePurchaseOrder(t *testing.T) {
+	p, store, fake := newTestIssuer(t, "8.25")
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	var orders []order
+	for _, name := range []string{"Keyboard", "Mouse"} {
+		o, err := store.CreateOrder(order{Requester: "U1", ItemName: name, Count: 3, UnitPrice: 1999, ChannelID: "C1", ThreadTS: "1400000000.000001",
+			Status: statusApproved, History: []orderEvent{{At: now, User: "UBOSS", Kind: eventStatus, Status: statusApproved}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		orders = append(orders, o)
+	}
+
+	// Issuing again keeps the first PO and its number
+	for i := 0; i < 2; i++ {
+		if err := p.Issue(orders[0], now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Issue(orders[1], now); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"PO-00001", "PO-00002"} {
+		po, ok := store.PurchaseOrder(orders[i].ID)
+		if !ok || po.Number != want || po.Filename() != want+".pdf" {
+			t.Errorf("order %d has PO %q, %v; want %s", i, po.Number, ok, want)
+		}
+		if o, _ := store.Order(orders[i].ID); o.PONumber != want {
+			t.Errorf("order %d shows PO %q", i, o.PONumber)
+		}
+		if !bytes.HasPrefix(po.PDF, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(po.PDF, []byte("%%EOF\n")) {
+			t.Errorf("PO %s is not a PDF: %.40q", po.Number, po.PDF)
+		}
+	}
+	if store.data.LastPONumber != 2 {
+		t.Errorf("last PO number is %d", store.data.LastPONumber)
+	}
+	uploads := 0
+	for _, c := range fake.recorded() {
+		if c.Method == "files.upload" {
+			uploads++
+		}
+	}
+	if uploads != 2 {
+		t.Errorf("%d POs were uploaded, want 2", uploads)
+	}
+}
+
+func TestPurchaseOrderData(t *testing.T) {
+	p, _, _ := newTestIssuer(t, "8.25")
+	fixed := amount(123)
+	tests := []struct {
+		name     string
+		o        order
+		subtotal amount
+		label    string
+		tax      amount
+		vendor   string
+	}{
+		// 8.25% of 59.97 is 4.9475
+		{"configured rate", order{ItemName: "Mouse", Count: 3, UnitPrice: 1999}, 5997, "Tax (8.25%)", 495, "Office Supplies"},
+		{"order rate", order{ItemName: "Mouse", Count: 1, UnitPrice: 10000, TaxRate: 1000}, 10000, "Tax (10%)", 1000, "Office Supplies"},
+		{"fixed tax", order{ItemName: "Mouse", Count: 1, UnitPrice: 10000, TaxAmount: &fixed}, 10000, "Tax", 123, "Office Supplies"},
+		{"shipping and discounts", order{ItemName: "Mouse", Count: 2, UnitPrice: 1000, Shipping: 500, Discounts: []discount{{Label: "Coupon", Amount: 300}}}, 2200, "Tax (8.25%)", 182, "Office Supplies"},
+		{"vendor from URL", order{ItemName: "Mouse", Count: 1, ItemURL: "https://www.example.com/mouse"}, 0, "Tax (8.25%)", 0, "example.com"},
+	}
+	for _, tt := range tests {
+		d := p.data(tt.o, time.Now())
+		if d.Subtotal != tt.subtotal || d.TaxLabel != tt.label || d.Tax != tt.tax || d.Total != tt.subtotal+tt.tax || d.Vendor != tt.vendor {
+			t.Errorf("%s: subtotal %s, %s %s, total %s, vendor %q; want %s, %s %s, %q",
+				tt.name, d.Subtotal, d.TaxLabel, d.Tax, d.Total, d.Vendor, tt.subtotal, tt.label, tt.tax, tt.vendor)
+		}
+	}
+}
+
+func TestPDFEscape(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Keys (2)", `Keys \(2\)`},
+		{`a\b`, `a\\b`},
+		{"Café", `Caf\351`},
+		{"✓ done", "? done"},
+		{"a\tb\x01", "a    b"},
+	}
+	for _, tt := range tests {
+		if got := pdfEscape(tt.in); got != tt.want {
+			t.Errorf("pdfEscape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRenderTextPDFPages(t *testing.T) {
+	pages := func(text string) int {
+		return strings.Count(string(renderTextPDF(text)), "/Type /Page /Parent")
+	}
+	if n := pages("# Title\n---\nline"); n != 1 {
+		t.Errorf("short text has %d pages", n)
+	}
+	if n := pages(strings.Repeat("line\n", 200)); n < 2 {
+		t.Errorf("200 lines have %d pages", n)
+	}
+}
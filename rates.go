@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rateDecimals is the precision of exchange rates. Eight decimals keep
+	// currencies worth a fraction of a cent of the base exact enough.
+	rateDecimals = 8
+	rateScale    = 100000000
+
+	// httpRatesTTL is how long rates fetched over HTTP are used.
+	httpRatesTTL = time.Hour
+)
+
+// rateValue is an exchange rate in hundred millionths, fixed point like amount.
+type rateValue int64
+
+// parseRate parses a positive decimal such as "1.08" or "0.0067".
+func parseRate(s string) (rateValue, error) {
+	s = strings.TrimSpace(s)
+	intPart, fracPart := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	if intPart == "" || len(fracPart) > rateDecimals || strings.Trim(intPart+fracPart, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	units, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil || units > 1<<32 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	frac := int64(0)
+	if fracPart != "" {
+		frac, _ = strconv.ParseInt((fracPart + strings.Repeat("0", rateDecimals))[:rateDecimals], 10, 64)
+	}
+	r := rateValue(units*rateScale + frac)
+	if r <= 0 {
+		return 0, fmt.Errorf("rate %q must be greater than 0", s)
+	}
+	return r, nil
+}
+
+// String formats r without trailing zeros, e.g. "1.08".
+func (r rateValue) String() string {
+	s := fmt.Sprintf("%d.%08d", r/rateScale, r%rateScale)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+// MarshalJSON encodes r as a decimal string like amounts.
+func (r rateValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// UnmarshalJSON accepts a decimal string or number.
+func (r *rateValue) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n json.Number
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("invalid rate %s", b)
+		}
+		s = n.String()
+	}
+	v, err := parseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+// convert returns a multiplied by r, rounded half away from zero.
+// big.Int is used as a large amount times the scale overflows int64.
+func (r rateValue) convert(a amount) amount {
+	n := new(big.Int).Mul(big.NewInt(int64(a)), big.NewInt(int64(r)))
+	half := big.NewInt(rateScale / 2)
+	if n.Sign() < 0 {
+		half.Neg(half)
+	}
+	n.Add(n, half)
+	n.Quo(n, big.NewInt(rateScale))
+	return amount(n.Int64())
+}
+
+// exchangeRate is the value in To of one unit of From. The rate used when
+// an order is approved is kept on it, so past reports never change.
+type exchangeRate struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Rate   rateValue `json:"rate"`
+	Source string    `json:"source"`
+	At     time.Time `json:"at"`
+}
+
+// rateProvider returns the rates of currencies into its base currency.
+type rateProvider interface {
+	Base() string
+	Rate(currency string) (exchangeRate, error)
+}
+
+// rateTable is the format of the rates file and of HTTP rate providers:
+//
+//	{"base": "USD", "rates": {"EUR": "1.08", "JPY": "0.0067"}}
+//
+// A rate is the value in base of one unit of the currency.
+type rateTable struct {
+	Base  string               `json:"base"`
+	Rates map[string]rateValue `json:"rates"`
+}
+
+// lookup returns the rate of currency in t.
+func (t rateTable) lookup(currency, source string, at time.Time) (exchangeRate, error) {
+	r, ok := t.Rates[currency]
+	if !ok {
+		return exchangeRate{}, fmt.Errorf("no rate for %s in %s", currency, source)
+	}
+	return exchangeRate{From: currency, To: t.Base, Rate: r, Source: source, At: at}, nil
+}
+
+// staticRates are rates read once from a file.
+type staticRates struct {
+	path  string
+	table rateTable
+	at    time.Time
+}
+
+// loadStaticRates reads the rates file at path.
+func loadStaticRates(path string) (*staticRates, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rates: %s", err)
+	}
+	var t rateTable
+	if err := json.Unmarshal(buf, &t); err != nil {
+		return nil, fmt.Errorf("failed to decode rates %s: %s", path, err)
+	}
+	at := time.Now()
+	if fi, err := os.Stat(path); err == nil {
+		at = fi.ModTime()
+	}
+	return &staticRates{path: path, table: t, at: at}, nil
+}
+
+func (s *staticRates) Base() string { return s.table.Base }
+
+func (s *staticRates) Rate(currency string) (exchangeRate, error) {
+	return s.table.lookup(currency, s.path, s.at)
+}
+
+// httpRates fetches a rate table from url and caches it for httpRatesTTL.
+// The last table is kept when a refresh fails.
+type httpRates struct {
+	url    string
+	base   string
+	client *http.Client
+
+	mu        sync.Mutex
+	table     rateTable
+	fetchedAt time.Time
+}
+
+func newHTTPRates(url, base string) *httpRates {
+	return &httpRates{url: url, base: base, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (h *httpRates) Base() string { return h.base }
+
+func (h *httpRates) Rate(currency string) (exchangeRate, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.fetchedAt) > httpRatesTTL {
+		if err := h.fetch(); err != nil {
+			if h.fetchedAt.IsZero() {
+				return exchangeRate{}, err
+			}
+			log.Printf("[ERROR] %s, using rates from %s", err, h.fetchedAt.Format(time.RFC3339))
+		}
+	}
+	return h.table.lookup(currency, h.url, h.fetchedAt)
+}
+
+// fetch replaces the table with the one served at url.
+func (h *httpRates) fetch() error {
+	resp, err := h.client.Get(h.url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch rates: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch rates: %s", resp.Status)
+	}
+	var t rateTable
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return fmt.Errorf("failed to decode rates: %s", err)
+	}
+	if t.Base != h.base {
+		return fmt.Errorf("rates from %s are in %s, not %s", h.url, t.Base, h.base)
+	}
+	h.table = t
+	h.fetchedAt = time.Now()
+	return nil
+}
+
+// fakeRates are fixed rates for trying the bot out without a rates file.
+// They are quoted in USD and crossed when the base is another currency.
+type fakeRates struct {
+	base  string
+	rates map[string]rateValue
+}
+
+func newFakeRates(base string) *fakeRates {
+	return &fakeRates{base: base, rates: map[string]rateValue{
+		"EUR": 110000000,
+		"GBP": 125000000,
+		"JPY": 700000,
+		"USD": 100000000,
+	}}
+}
+
+func (f *fakeRates) Base() string { return f.base }
+
+func (f *fakeRates) Rate(currency string) (exchangeRate, error) {
+	r, ok := f.rates[currency]
+	base, okBase := f.rates[f.base]
+	if !ok || !okBase {
+		return exchangeRate{}, fmt.Errorf("no fake rate for %s in %s", currency, f.base)
+	}
+	r = rateValue(int64(r) * rateScale / int64(base))
+	return exchangeRate{From: currency, To: f.base, Rate: r, Source: "fake", At: time.Now()}, nil
+}
+
+// currencyBook converts order totals into the base currency, which budgets,
+// policy caps and reports use. A nil book leaves totals as they are.
+type currencyBook struct {
+	base     string
+	allowed  []string
+	provider rateProvider
+}
+
+// newCurrencyBook builds the rate provider of a validated config and checks
+// it knows every allowed currency.
+func newCurrencyBook(cfg currenciesConfig) (*currencyBook, error) {
+	c := &currencyBook{base: cfg.Base, allowed: cfg.Allowed}
+	switch cfg.Provider {
+	case "fake":
+		c.provider = newFakeRates(cfg.Base)
+	case "http":
+		c.provider = newHTTPRates(cfg.RatesURL, cfg.Base)
+	default:
+		// Without a rates file only the base currency can be used
+		if cfg.RatesFile != "" {
+			rates, err := loadStaticRates(cfg.RatesFile)
+			if err != nil {
+				return nil, err
+			}
+			if rates.Base() != cfg.Base {
+				return nil, fmt.Errorf("rates %s are in %s, not %s", cfg.RatesFile, rates.Base(), cfg.Base)
+			}
+			c.provider = rates
+		}
+	}
+	// Rates over HTTP may not be reachable yet and are checked when used
+	if cfg.Provider != "http" {
+		for _, cur := range c.Currencies()[1:] {
+			if _, err := c.rate(cur); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// Base returns the base currency.
+func (c *currencyBook) Base() string {
+	if c == nil {
+		return ""
+	}
+	return c.base
+}
+
+// Currencies returns the currencies orders can be made in, base first.
+func (c *currencyBook) Currencies() []string {
+	if c == nil {
+		return nil
+	}
+	list := []string{c.base}
+	for _, cur := range c.allowed {
+		if cur != c.base {
+			list = append(list, cur)
+		}
+	}
+	return list
+}
+
+// Allowed reports whether orders can be made in currency.
+func (c *currencyBook) Allowed(currency string) bool {
+	for _, cur := range c.Currencies() {
+		if cur == currency {
+			return true
+		}
+	}
+	return false
+}
+
+// rate returns the current rate of currency into the base.
+func (c *currencyBook) rate(currency string) (exchangeRate, error) {
+	if c.provider == nil {
+		return exchangeRate{}, fmt.Errorf("no exchange rates configured for %s", currency)
+	}
+	return c.provider.Rate(currency)
+}
+
+// Snapshot returns the current rate of the currency of o, nil for orders
+// in the base currency.
+func (c *currencyBook) Snapshot(o order) (*exchangeRate, error) {
+	if c == nil || o.Currency == "" || o.Currency == c.base {
+		return nil, nil
+	}
+	r, err := c.rate(o.Currency)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// BaseTotal returns the total of o in the base currency. Approved orders
+// use the rate kept at approval, others the current rate. If no rate is
+// known, the total is counted as is so that spending is never hidden.
+func (c *currencyBook) BaseTotal(o order) amount {
+	if c == nil || o.Currency == "" || o.Currency == c.base {
+		return o.Total()
+	}
+	if o.Rate != nil && o.Rate.To == c.base {
+		return o.Rate.Rate.convert(o.Total())
+	}
+	r, err := c.rate(o.Currency)
+	if err != nil {
+		log.Printf("[ERROR] Failed to convert %s: %s", o.Ref(), err)
+		return o.Total()
+	}
+	return r.Rate.convert(o.Total())
+}
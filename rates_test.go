@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want rateValue
+		err  bool
+	}{
+		{"1.08", 108000000, false},
+		{"0.0067", 670000, false},
+		{" 1 ", 100000000, false},
+		{"0.00000001", 1, false},
+		{"0", 0, true},
+		{"0.000000001", 0, true},
+		{"-1", 0, true},
+		{".5", 0, true},
+		{"abc", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRate(tt.in)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("parseRate(%q) = %d, %v, want %d, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestRateConvert(t *testing.T) {
+	tests := []struct {
+		rate string
+		in   amount
+		want amount
+	}{
+		{"0.0067", 1500000, 10050},  // 15000 JPY is 100.50
+		{"1.0833", 9999, 10832},     // 108.319167 rounds down
+		{"1.0835", 9999, 10834},     // 108.339165 rounds up
+		{"0.5", 1, 1},               // half a cent rounds away from zero
+		{"0.5", -1, -1},             // for refunds too
+		{"0.49999999", 1, 0},        // under half a cent
+		{"2", 1 << 50, 1 << 51},     // the product overflows int64
+		{"1", 123456789, 123456789}, // same value
+		{"0.00000001", 49999999, 0}, // 0.0049999999 rounds to nothing
+		{"0.00000001", 50000000, 1}, // 0.005 rounds to a cent
+		{"1.1", -1500, -1650},       // negative totals
+	}
+	for _, tt := range tests {
+		r, err := parseRate(tt.rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.convert(tt.in); got != tt.want {
+			t.Errorf("%s.convert(%d) = %d, want %d", tt.rate, tt.in, got, tt.want)
+		}
+	}
+}
+
+// newCurrencyService returns an order service converting with book, whose
+// orders UBOSS approves.
+func newCurrencyService(t *testing.T, book *currencyBook) *orderService {
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &orderService{
+		store:      store,
+		threads:    &orderThreads{workspaces: newWorkspaceRegistry(store, "", ""), store: store},
+		approvers:  []string{"UBOSS"},
+		callbacks:  newCallbackSigner([]byte("0123456789abcdef")),
+		currencies: book,
+	}
+}
+
+// pendingOrder stores a pending order of 2 x 50.00 in currency.
+func pendingOrder(t *testing.T, orders *orderService, currency string) order {
+	o, err := orders.CreateDraft(order{Requester: "U1", ItemName: "Desk", Count: 2, UnitPrice: 5000, Currency: currency})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, err = orders.Transition(o.ID, statusPending, "U1", ""); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestApprovalKeepsRate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	if err := ioutil.WriteFile(path, []byte(`{"base": "USD", "rates": {"EUR": "1.10", "JPY": 0.0067}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	book, err := newCurrencyBook(currenciesConfig{Base: "USD", Allowed: []string{"EUR", "JPY"}, RatesFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := newCurrencyService(t, book)
+
+	eur := pendingOrder(t, orders, "EUR")
+	if eur.Rate != nil {
+		t.Errorf("pending order has rate %+v", *eur.Rate)
+	}
+	if got := book.BaseTotal(eur); got != 11000 {
+		t.Errorf("BaseTotal of pending = %s, want 110.00 at the current rate", got)
+	}
+	eur, err = orders.Transition(eur.ID, statusApproved, "UBOSS", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := eur.Rate; r == nil || r.From != "EUR" || r.To != "USD" || r.Rate.String() != "1.1" || r.Source != path {
+		t.Fatalf("rate kept at approval = %+v", r)
+	}
+
+	usd := pendingOrder(t, orders, "USD")
+	if usd, err = orders.Transition(usd.ID, statusApproved, "UBOSS", ""); err != nil {
+		t.Fatal(err)
+	}
+	if usd.Rate != nil {
+		t.Errorf("order in the base currency has rate %+v", *usd.Rate)
+	}
+
+	// Later rates change the totals of open orders only
+	book.provider.(*staticRates).table.Rates["EUR"] = 200000000
+	pending := pendingOrder(t, orders, "EUR")
+	stored, _ := orders.store.Order(eur.ID)
+	if got := book.BaseTotal(stored); got != 11000 {
+		t.Errorf("BaseTotal of approved = %s, want 110.00 at the kept rate", got)
+	}
+	if got := book.BaseTotal(pending); got != 20000 {
+		t.Errorf("BaseTotal of pending = %s, want 200.00 at the new rate", got)
+	}
+	if got := book.BaseTotal(usd); got != 10000 {
+		t.Errorf("BaseTotal in the base currency = %s, want 100.00", got)
+	}
+}
+
+func TestApprovalWithoutRate(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	tests := []struct {
+		name string
+		book *currencyBook
+		want string
+	}{
+		{"provider down", &currencyBook{base: "USD", allowed: []string{"EUR"}, provider: newHTTPRates(down.URL, "USD")}, "503 Service Unavailable"},
+		{"currency missing", &currencyBook{base: "USD", allowed: []string{"GBP"}, provider: &staticRates{path: "rates.json", table: rateTable{Base: "USD", Rates: map[string]rateValue{}}}}, "no rate for GBP in rates.json"},
+		{"no provider", &currencyBook{base: "USD", allowed: []string{"EUR"}}, "no exchange rates configured for EUR"},
+	}
+	for _, tt := range tests {
+		orders := newCurrencyService(t, tt.book)
+		o := pendingOrder(t, orders, tt.book.allowed[0])
+		_, err := orders.Transition(o.ID, statusApproved, "UBOSS", "")
+		if err == nil || !strings.Contains(err.Error(), "cannot approve "+o.Ref()+" without an exchange rate") || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: approving = %v, want %q", tt.name, err, tt.want)
+		}
+		if stored, _ := orders.store.Order(o.ID); stored.Status != statusPending || stored.Rate != nil {
+			t.Errorf("%s: order is %s with rate %+v", tt.name, stored.Status, stored.Rate)
+		}
+		// Totals are counted unconverted rather than hidden
+		if got := tt.book.BaseTotal(o); got != o.Total() {
+			t.Errorf("%s: BaseTotal = %s, want %s", tt.name, got, o.Total())
+		}
+	}
+
+	_, err := newCurrencyBook(currenciesConfig{Base: "USD", Allowed: []string{"EUR"}})
+	if err == nil || err.Error() != "no exchange rates configured for EUR" {
+		t.Errorf("newCurrencyBook without rates = %v", err)
+	}
+}
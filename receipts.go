@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// receiptMaxSize is the largest file copied to the receipt storage.
+const receiptMaxSize = 25 << 20
+
+// receiptStatuses are the statuses in which files shared in the order
+// thread are taken as receipts.
+var receiptStatuses = map[orderStatus]bool{
+	statusApproved:  true,
+	statusPurchased: true,
+	statusDelivered: true,
+	statusIssue:     true,
+}
+
+// receipt is a receipt or invoice shared in the thread of an order.
+type receipt struct {
+	FileID     string    `json:"file_id"`
+	Name       string    `json:"name"`
+	Mimetype   string    `json:"mimetype"`
+	Size       int       `json:"size"`
+	Permalink  string    `json:"permalink"`
+	UploadedBy string    `json:"uploaded_by"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	// Copy is where the file was copied to, if a receipt storage is configured.
+	Copy string `json:"copy,omitempty"`
+}
+
+// missingReceipt reports whether o was bought but has no receipt yet.
+func (o *order) missingReceipt() bool {
+	return (o.Status == statusPurchased || o.Status == statusDelivered) && len(o.Receipts) == 0
+}
+
+// slackFileInfo is the file of files.info with where it was shared.
+type slackFileInfo struct {
+	ID                 string `json:"id"`
+	Name               string `json:"name"`
+	Mimetype           string `json:"mimetype"`
+	Size               int    `json:"size"`
+	User               string `json:"user"`
+	Permalink          string `json:"permalink"`
+	URLPrivateDownload string `json:"url_private_download"`
+	Shares             struct {
+		Public  map[string][]slackFileShare `json:"public"`
+		Private map[string][]slackFileShare `json:"private"`
+	} `json:"shares"`
+}
+
+type slackFileShare struct {
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+}
+
+// receiptService attaches files shared in order threads to the orders.
+type receiptService struct {
+	orders     *orderService
+	workspaces *workspaceRegistry
+	// storage keeps copies of the files. Nil keeps them in slack only.
+	storage fileStorage
+}
+
+// FileShared handles a file_shared event of teamID. Files shared outside
+// of order threads are ignored.
+func (r *receiptService) FileShared(teamID, fileID string) error {
+	token, err := r.workspaces.Token(teamID)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		File slackFileInfo `json:"file"`
+	}
+	if err := callSlackForm(token, "files.info", url.Values{"file": {fileID}}, &res); err != nil {
+		return err
+	}
+	f := res.File
+
+	o, ok := r.orderOf(f)
+	if !ok {
+		return nil
+	}
+	if !receiptStatuses[o.Status] {
+		return r.orders.threads.Reply(o, fmt.Sprintf(
+			"<@%s> receipts can be attached once the order is approved, `%s` was not recorded.", f.User, f.Name))
+	}
+	// file_shared is sent again when the file is shared elsewhere
+	for _, existing := range o.Receipts {
+		if existing.FileID == f.ID {
+			return nil
+		}
+	}
+
+	rc := receipt{
+		FileID:     f.ID,
+		Name:       f.Name,
+		Mimetype:   f.Mimetype,
+		Size:       f.Size,
+		Permalink:  f.Permalink,
+		UploadedBy: f.User,
+		UploadedAt: time.Now(),
+	}
+	if r.storage != nil {
+		if rc.Copy, err = r.copy(token, o, f); err != nil {
+			// The receipt is still recorded, it can be fetched from slack
+			log.Printf("[ERROR] Failed to copy receipt %s of %s: %s", f.ID, o.Ref(), err)
+		}
+	}
+
+	added := false
+	o, err = r.orders.store.AnnotateOrder(o.ID, func(o *order) error {
+		for _, existing := range o.Receipts {
+			if existing.FileID == rc.FileID {
+				return nil
+			}
+		}
+		o.Receipts = append(o.Receipts, rc)
+		o.record(orderEvent{At: rc.UploadedAt, User: rc.UploadedBy, Kind: eventReceipt, Text: rc.Name})
+		added = true
+		return nil
+	})
+	if err != nil || !added {
+		return err
+	}
+
+	if _, err := r.orders.threads.Publish(o); err != nil {
+		log.Printf("[ERROR] %s", err)
+	}
+	return r.orders.threads.Reply(o, fmt.Sprintf(":receipt: <@%s> attached `%s` as a receipt", rc.UploadedBy, rc.Name))
+}
+
+// orderOf returns the order in whose thread f was shared.
+func (r *receiptService) orderOf(f slackFileInfo) (order, bool) {
+	for _, shares := range []map[string][]slackFileShare{f.Shares.Public, f.Shares.Private} {
+		for channel, list := range shares {
+			for _, sh := range list {
+				if sh.ThreadTS == "" {
+					continue
+				}
+				if o, ok := r.orders.store.OrderByThread(channel, sh.ThreadTS); ok {
+					return o, true
+				}
+			}
+		}
+	}
+	return order{}, false
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// copy downloads f and puts it in the receipt storage.
+func (r *receiptService) copy(token string, o order, f slackFileInfo) (string, error) {
+	if f.Size > receiptMaxSize {
+		return "", fmt.Errorf("file is larger than %d bytes", receiptMaxSize)
+	}
+	req, err := http.NewRequest(http.MethodGet, f.URLPrivateDownload, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download returned %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, receiptMaxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(body) > receiptMaxSize {
+		return "", fmt.Errorf("file is larger than %d bytes", receiptMaxSize)
+	}
+
+	name := unsafeFileChars.ReplaceAllString(f.Name, "_")
+	key := fmt.Sprintf("receipts/order-%d/%s-%s", o.ID, f.ID, name)
+	return r.storage.Put(key, f.Mimetype, body)
+}
+
+// handleReceiptsCommand lists bought orders which have no receipt yet:
+//
+//	receipts
+func (s *SlackListener) handleReceiptsCommand(channel string, msg slack.Msg, args []string) error {
+	missing := s.orders.store.Orders(func(o *order) bool { return o.missingReceipt() })
+	loc := s.locale(msg.User)
+	if len(missing) == 0 {
+		return s.replyEphemeral(channel, msg, tr(loc, "receipts.complete"))
+	}
+
+	lines := []string{tr(loc, "receipts.missing", len(missing))}
+	for _, o := range missing {
+		lines = append(lines, tr(loc, "receipts.line", o.Ref(), o.ItemName, o.Requester, tr(loc, "status."+string(o.Status))))
+	}
+	return s.replyEphemeral(channel, msg, strings.Join(lines, "\n"))
+}
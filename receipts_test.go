@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nlopes/slack"
+)
+
+// newReceiptSlack points the Slack client at an API whose files.info
+// describes file F1 shared in thread of C1, and returns the messages
+// posted.
+func newReceiptSlack(t *testing.T, thread string) func() []string {
+	var mu sync.Mutex
+	var posted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/files.info":
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "file": map[string]interface{}{
+				"id": "F1", "name": "receipt (1).pdf", "mimetype": "application/pdf", "size": 5, "user": "U1",
+				"url_private_download": "http://" + r.Host + "/download/F1",
+				"shares": map[string]interface{}{"public": map[string]interface{}{
+					"C1": []map[string]string{{"ts": "1500000000.000009", "thread_ts": thread}},
+				}},
+			}})
+		case "/download/F1":
+			if r.Header.Get("Authorization") != "Bearer xoxb-test" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte("%PDF!"))
+		default:
+			if r.URL.Path == "/chat.postMessage" {
+				mu.Lock()
+				posted = append(posted, r.Form.Get("text"))
+				mu.Unlock()
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "ts": "1500000000.000001", "channel": "C1"})
+		}
+	}))
+	api := slack.SLACK_API
+	slack.SLACK_API = srv.URL + "/"
+	t.Cleanup(func() {
+		slack.SLACK_API = api
+		srv.Close()
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), posted...)
+	}
+}
+
+func TestFileShared(t *testing.T) {
+	const thread = "1400000000.000001"
+	posted := newReceiptSlack(t, thread)
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaces := newWorkspaceRegistry(store, "xoxb-test", "C1")
+	orders := &orderService{store: store, threads: &orderThreads{workspaces: workspaces, store: store}}
+	dir := t.TempDir()
+	r := &receiptService{orders: orders, workspaces: workspaces, storage: localStorage{dir: dir}}
+	o, err := store.CreateOrder(order{Requester: "U1", ItemName: "Pen", Count: 1, ChannelID: "C1", ThreadTS: thread, Status: statusPending})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Receipts of orders which are not approved are refused
+	if err := r.FileShared("", "F1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Order(o.ID); len(got.Receipts) != 0 {
+		t.Fatalf("pending order has receipts %+v", got.Receipts)
+	}
+	if p := posted(); len(p) != 1 || !strings.Contains(p[0], "once the order is approved") {
+		t.Fatalf("posted %q", p)
+	}
+
+	if _, err := store.UpdateOrder(o.ID, func(o *order) error {
+		o.Status = statusPurchased
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Order(o.ID); !got.missingReceipt() {
+		t.Error("purchased order without receipts is not missing one")
+	}
+	// file_shared is sent again for every share of the file
+	for i := 0; i < 2; i++ {
+		if err := r.FileShared("", "F1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, _ := store.Order(o.ID)
+	if len(got.Receipts) != 1 || got.missingReceipt() {
+		t.Fatalf("receipts %+v", got.Receipts)
+	}
+	rc := got.Receipts[0]
+	path := filepath.Join(dir, "receipts", "order-1", "F1-receipt_1_.pdf")
+	if rc.FileID != "F1" || rc.UploadedBy != "U1" || rc.Copy != "file:"+path {
+		t.Errorf("receipt %+v", rc)
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "%PDF!" {
+		t.Errorf("copy = %q, %v", b, err)
+	}
+	if p := posted(); len(p) != 2 || !strings.Contains(p[1], "attached `receipt (1).pdf` as a receipt") {
+		t.Errorf("posted %q", p)
+	}
+
+	// Files shared outside of order threads are ignored
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.UpdateOrder(o.ID, func(o *order) error {
+		o.ThreadTS = "1400000000.000002"
+		o.Receipts = nil
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.FileShared("", "F1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Order(o.ID); len(got.Receipts) != 0 {
+		t.Errorf("file outside of the thread was recorded: %+v", got.Receipts)
+	}
+}
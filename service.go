@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// autoApprover is the actor of the approvals of orders below
+// autoApproveBelow.
+const autoApprover = "orderbot"
+
+// statusVerbs describe a transition in thread replies.
+var statusVerbs = map[orderStatus]string{
+	statusPending:   "submitted",
+	statusApproved:  "approved",
+	statusRejected:  "rejected",
+	statusPurchased: "purchased",
+	statusDelivered: "marked as delivered",
+	statusCancelled: "cancelled",
+	statusIssue:     "reported a problem with",
+}
+
+// orderChange describes a status change of an order.
+type orderChange struct {
+	Order order
+	From  orderStatus
+	To    orderStatus
+	Actor string
+	Note  string
+	At    time.Time
+}
+
+// orderService changes orders and reflects every change in the order thread.
+type orderService struct {
+	store     *orderStore
+	threads   *orderThreads
+	approvers []string
+	// purchasers buy approved orders, along with the approvers.
+	purchasers []string
+	// policies are checked again before orders are approved, nil if no
+	// rules are configured.
+	policies *policyEngine
+	// currencies keep the exchange rate of orders when they are approved.
+	currencies *currencyBook
+	// taxes are the tax regions new orders default to.
+	taxes *taxTable
+	// reapproveAbove is the total, in the base currency, above which
+	// edits raising the total need approval again. Zero disables it.
+	reapproveAbove amount
+	// autoApproveBelow is the total, in the base currency, under which
+	// submitted orders are approved by the bot. Zero disables it.
+	autoApproveBelow amount
+	// requireReason refuses to submit orders without a reason.
+	requireReason bool
+	// callbacks sign the buttons and dialogs about orders.
+	callbacks *callbackSigner
+
+	// observers are called after every status change.
+	observers []func(c orderChange)
+}
+
+// OnChange registers fn to be called after every status change.
+// It must be called before the service is used.
+func (s *orderService) OnChange(fn func(c orderChange)) {
+	s.observers = append(s.observers, fn)
+}
+
+// CreateDraft stores a new order which the requester has not confirmed yet.
+func (s *orderService) CreateDraft(o order) (order, error) {
+	o.Status = statusDraft
+	s.taxes.applyDefault(&o)
+	return s.store.CreateOrder(o)
+}
+
+// Transition moves an order to status on behalf of a slack user.
+func (s *orderService) Transition(id int64, to orderStatus, user, note string) (order, error) {
+	return s.transition(id, to, user, note, s.authorize)
+}
+
+// TransitionByAPI moves an order to status on behalf of an API key
+// whose role was checked by the caller.
+func (s *orderService) TransitionByAPI(id int64, to orderStatus, key apiKey, note string) (order, error) {
+	return s.transition(id, to, apiActor(key), note, nil)
+}
+
+func (s *orderService) transition(id int64, to orderStatus, user, note string, authorize func(o *order, to orderStatus, user string) error) (order, error) {
+	var from orderStatus
+	now := time.Now()
+	if to == statusApproved && s.policies != nil {
+		if err := s.checkPolicies(id, now); err != nil {
+			return order{}, err
+		}
+		// Approvers of policy rules approve their stage first
+		if authorize != nil {
+			if o, ok, err := s.approveStage(id, user, now); ok || err != nil {
+				return o, err
+			}
+		}
+	}
+	// Fetched outside the store lock, the provider may call out over HTTP.
+	// The rate is only kept if the order did not change meanwhile.
+	var (
+		rate    *exchangeRate
+		version int64
+	)
+	if to == statusApproved {
+		if o, ok := s.store.Order(id); ok {
+			var err error
+			if rate, err = s.currencies.Snapshot(o); err != nil {
+				return order{}, trErrorf("order.error.rate", o.Ref(), err)
+			}
+			version = o.Version
+		}
+	}
+	o, err := s.store.UpdateOrderVersion(id, version, func(o *order) error {
+		if authorize != nil {
+			if err := authorize(o, to, user); err != nil {
+				return err
+			}
+		}
+		if to == statusApproved {
+			if open := o.openStages(); len(open) > 0 {
+				return trErrorf("order.error.stage", o.Ref(), mentions(open[0].Approvers), open[0].Rule)
+			}
+		}
+		if to == statusPending && s.requireReason && strings.TrimSpace(o.Reason) == "" {
+			return trErrorf("order.error.reason", o.Ref())
+		}
+		from = o.Status
+		if err := o.transition(to, user, note, now); err != nil {
+			return err
+		}
+		if to == statusApproved {
+			o.Rate = rate
+		}
+		return nil
+	})
+	if err != nil {
+		return o, err
+	}
+
+	// Orders approved right away are not put up for approval
+	auto := to == statusPending && s.autoApproves(o)
+
+	// The order is changed already, failing to tell slack is only logged
+	if published, err := s.threads.Publish(o); err != nil {
+		log.Printf("[ERROR] %s", err)
+	} else {
+		o = published
+		text := fmt.Sprintf("%s %s the order", actorMention(user), statusVerbs[to])
+		if note != "" {
+			text += ": " + note
+		}
+		if to == statusApproved || to == statusRejected || to == statusCancelled {
+			text += fmt.Sprintf(" (cc <@%s>)", o.Requester)
+		}
+		if to == statusIssue && o.AssignedTo != "" {
+			text += fmt.Sprintf(", assigned to %s", actorMention(o.AssignedTo))
+		}
+		if err := s.threads.Reply(o, text); err != nil {
+			log.Printf("[ERROR] %s", err)
+		}
+		if !auto {
+			s.postNextStep(o)
+		}
+	}
+
+	change := orderChange{Order: o, From: from, To: to, Actor: user, Note: note, At: now}
+	for _, fn := range s.observers {
+		fn(change)
+	}
+
+	if auto {
+		note := strings.TrimSpace(fmt.Sprintf("total below %s %s", s.autoApproveBelow, s.currencies.Base()))
+		approved, err := s.transition(o.ID, statusApproved, autoApprover, note, nil)
+		if err != nil {
+			// Policies may still refuse it, then it waits for approvers
+			log.Printf("[ERROR] Failed to approve %s automatically: %s", o.Ref(), err)
+			s.postNextStep(o)
+			return o, nil
+		}
+		o = approved
+	}
+	return o, nil
+}
+
+// autoApproves reports whether the submitted order o is approved without
+// asking: its total in the base currency is below autoApproveBelow and no
+// policy stage needs an approver.
+func (s *orderService) autoApproves(o order) bool {
+	if s.autoApproveBelow <= 0 || o.UnitPrice <= 0 || len(o.openStages()) > 0 {
+		return false
+	}
+	return s.currencies.BaseTotal(o) < s.autoApproveBelow
+}
+
+// apiActor is recorded in the history for changes made through the REST API.
+func apiActor(key apiKey) string {
+	return "api:" + key.Name
+}
+
+// actorMention formats who made a change for slack.
+func actorMention(user string) string {
+	if user == autoApprover {
+		return autoApprover
+	}
+	if strings.HasPrefix(user, "api:") {
+		return fmt.Sprintf("`%s` (via API)", strings.TrimPrefix(user, "api:"))
+	}
+	return fmt.Sprintf("<@%s>", user)
+}
+
+// authorize checks that user may move o to status.
+func (s *orderService) authorize(o *order, to orderStatus, user string) error {
+	switch to {
+	case statusPending:
+		if user != o.Requester {
+			return trErrorf("order.error.submit", o.Requester, o.Ref())
+		}
+	case statusApproved, statusRejected:
+		if !s.isApprover(user) {
+			return trErrorf("order.error.approve")
+		}
+	case statusPurchased:
+		if !s.isPurchaser(user) {
+			return trErrorf("order.error.purchase", o.Ref())
+		}
+	case statusDelivered:
+		if user != o.Requester && !s.isPurchaser(user) {
+			return trErrorf("order.error.deliver", o.Requester, o.Ref())
+		}
+	case statusIssue:
+		if user != o.Requester && !s.isApprover(user) {
+			return trErrorf("order.error.issue", o.Requester, o.Ref())
+		}
+	case statusCancelled:
+		if user != o.Requester && !s.isApprover(user) {
+			return trErrorf("order.error.cancel", o.Requester, o.Ref())
+		}
+	}
+	return nil
+}
+
+// isApprover reports whether user may approve orders.
+// Anyone may approve when no approvers are configured.
+func (s *orderService) isApprover(user string) bool {
+	if len(s.approvers) == 0 {
+		return true
+	}
+	for _, a := range s.approvers {
+		if a == user {
+			return true
+		}
+	}
+	return false
+}
+
+// isPurchaser reports whether user may buy orders and change their charges.
+func (s *orderService) isPurchaser(user string) bool {
+	for _, p := range s.purchasers {
+		if p == user {
+			return true
+		}
+	}
+	return s.isApprover(user)
+}
+
+// postNextStep replies with the buttons to move o forward, if any.
+// Approval requests go to the approvals channel instead if there is one.
+func (s *orderService) postNextStep(o order) {
+	a, ok := nextStepAttachment(o, s.approvers, s.callbacks.Sign(o))
+	if !ok {
+		return
+	}
+	if channel := s.threads.workspaces.ApprovalChannel(o.TeamID); o.Status == statusPending && channel != "" && channel != o.ChannelID {
+		text := fmt.Sprintf("Order %s: %s by <@%s>", o.Ref(), o.ItemName, o.Requester)
+		if err := s.threads.Post(o, channel, text, a); err != nil {
+			log.Printf("[ERROR] %s", err)
+		}
+		return
+	}
+	if err := s.threads.Reply(o, "", a); err != nil {
+		log.Printf("[ERROR] %s", err)
+	}
+}
+
+// Comment records a reply posted by user in the order thread.
+func (s *orderService) Comment(id int64, user, text string) error {
+	_, err := s.store.AnnotateOrder(id, func(o *order) error {
+		o.record(orderEvent{At: time.Now(), User: user, Kind: eventComment, Text: text})
+		return nil
+	})
+	return err
+}
+
+// Remind posts a reminder in the thread of every order pending for longer
+// than interval since it was submitted or last reminded.
+func (s *orderService) Remind(interval time.Duration, now time.Time) {
+	due := s.store.Orders(func(o *order) bool {
+		if o.Status != statusPending || o.ThreadTS == "" {
+			return false
+		}
+		last := o.statusSince()
+		if o.LastRemindedAt.After(last) {
+			last = o.LastRemindedAt
+		}
+		return now.Sub(last) >= interval
+	})
+
+	for _, o := range due {
+		text := fmt.Sprintf(":bell: Order %s is still waiting for approval", o.Ref())
+		if len(s.approvers) > 0 {
+			text += " from " + mentions(s.approvers)
+		}
+		if err := s.threads.Reply(o, text); err != nil {
+			log.Printf("[ERROR] %s", err)
+			continue
+		}
+		_, err := s.store.AnnotateOrder(o.ID, func(o *order) error {
+			o.LastRemindedAt = now
+			o.record(orderEvent{At: now, Kind: eventReminder})
+			return nil
+		})
+		if err != nil {
+			log.Printf("[ERROR] Failed to record reminder of %s: %s", o.Ref(), err)
+		}
+	}
+}
+
+// RunReminders calls Remind periodically until ctx is done.
+func (s *orderService) RunReminders(ctx context.Context, interval time.Duration, beat *heartbeat) {
+	tick := time.Minute
+	if interval < tick {
+		tick = interval
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		beat.Beat(time.Now().Add(tick))
+		select {
+		case now := <-t.C:
+			s.Remind(interval, now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	s := &orderService{approvers: []string{"UBOSS"}, purchasers: []string{"UBUYER"}}
+	o := &order{ID: 1, Requester: "U1"}
+	tests := []struct {
+		to   orderStatus
+		user string
+		ok   bool
+	}{
+		{statusPending, "U1", true},
+		{statusPending, "UBOSS", false},
+		{statusApproved, "UBOSS", true},
+		{statusApproved, "UBUYER", false},
+		{statusPurchased, "UBUYER", true},
+		{statusPurchased, "UBOSS", true},
+		{statusPurchased, "U1", false},
+		{statusDelivered, "U1", true},
+		{statusDelivered, "UBUYER", true},
+		{statusDelivered, "UBOSS", true},
+		{statusDelivered, "U2", false},
+		{statusIssue, "U1", true},
+		{statusIssue, "UBUYER", false},
+	}
+	for _, tt := range tests {
+		err := s.authorize(o, tt.to, tt.user)
+		if (err == nil) != tt.ok {
+			t.Errorf("authorize(%s, %s) = %v, want allowed %v", tt.to, tt.user, err, tt.ok)
+		}
+	}
+}
+
+func TestApprovalSettings(t *testing.T) {
+	f := newFakeSlack(t)
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaces := newWorkspaceRegistry(store, "xoxb-test", "C1")
+	workspaces.approvalChannel = "CAPPROVE"
+	s := &orderService{
+		store:            store,
+		threads:          &orderThreads{workspaces: workspaces, store: store},
+		approvers:        []string{"UBOSS"},
+		autoApproveBelow: 3000,
+		requireReason:    true,
+		callbacks:        newCallbackSigner([]byte("0123456789abcdef")),
+	}
+	submit := func(price amount, reason string) (order, error) {
+		o, err := s.CreateDraft(order{Requester: "U1", ChannelID: "C1", ItemName: "Cable", Count: 2, UnitPrice: price, Reason: reason})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Transition(o.ID, statusPending, "U1", "")
+	}
+
+	// Below the limit the bot approves, nobody is asked
+	o, err := submit(1250, "new hire")
+	if err != nil || o.Status != statusApproved || o.ApprovedBy != autoApprover {
+		t.Fatalf("cheap order = %s by %q, %v", o.Status, o.ApprovedBy, err)
+	}
+	if got := f.messages("CAPPROVE"); len(got) != 0 {
+		t.Errorf("approval requested for a cheap order: %v", got)
+	}
+
+	// Above it the approvers are asked in their channel
+	if o, err = submit(2000, "new hire"); err != nil || o.Status != statusPending {
+		t.Fatalf("order = %s, %v", o.Status, err)
+	}
+	got := f.messages("CAPPROVE")
+	if len(got) != 1 || !strings.Contains(got[0].Get("attachments"), actionApprove) || got[0].Get("thread_ts") != "" {
+		t.Errorf("approval requests = %v", got)
+	}
+
+	// Orders without a price are not approved automatically
+	if o, err = submit(0, "new hire"); err != nil || o.Status != statusPending {
+		t.Errorf("order without a price = %s, %v", o.Status, err)
+	}
+
+	if _, err = submit(1250, " "); err == nil {
+		t.Error("order without a reason was submitted")
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/nlopes/slack"
 )
@@ -16,67 +21,255 @@ const (
 	actionCancel = "cancel"
 )
 
-// SlackListener is
+// handledMessagesLimit is the number of message timestamps remembered
+// so that editing an already handled message does not trigger it again.
+const handledMessagesLimit = 1000
+
+// mentionPattern matches user mentions such as <@U012AB3CD> and <@U012AB3CD|bob>.
+var mentionPattern = regexp.MustCompile(`<@([A-Z0-9]+)(?:\|[^>]*)?>`)
+
+// mentionedUser returns the user ID if arg is a mention and nothing else.
+func mentionedUser(arg string) (string, bool) {
+	m := mentionPattern.FindStringSubmatch(arg)
+	if m == nil || m[0] != arg {
+		return "", false
+	}
+	return m[1], true
+}
+
+// SlackListener listens events of one workspace and responds to mentions.
 type SlackListener struct {
 	client    *slack.Client
-	botID     string
 	channelID string
+	orders    *orderService
+	webhooks  *webhookDispatcher
+	receipts  *receiptService
+	assets    *assetRegistry
+	jobs      *jobQueue
+	admins    []string
+
+	// teamID is the workspace of the listener, empty for the BOT_TOKEN one.
+	teamID string
+
+	// botID is the user ID of the bot. It is resolved with auth.test
+	// when ListenAndResponse starts, which also checks the token.
+	botID string
+	// authTeamID is the workspace of the token according to auth.test.
+	authTeamID string
+
+	mu      sync.Mutex
+	handled map[string]bool
+	order   []string
+	// authenticated and connected tell /readyz whether auth.test
+	// succeeded and the RTM connection is up.
+	authenticated bool
+	connected     bool
+}
+
+// identify resolves the bot user ID via auth.test, retrying until it
+// succeeds or ctx is done.
+func (s *SlackListener) identify(ctx context.Context) bool {
+	wait := time.Second
+	for {
+		res, err := s.client.AuthTest()
+		if err == nil {
+			s.botID, s.authTeamID = res.UserID, res.TeamID
+			s.setState(func() { s.authenticated = true })
+			log.Printf("[INFO] Authenticated as %s (%s) in %s", res.User, res.UserID, res.Team)
+			return true
+		}
+		log.Printf("[ERROR] auth.test failed, retrying in %s: %s", wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return false
+		}
+		if wait < time.Minute {
+			wait *= 2
+		}
+	}
 }
 
 // ListenAndResponse listens slack events and response
 // particular messages. It replies by slack message button.
-func (s *SlackListener) ListenAndResponse() {
+func (s *SlackListener) ListenAndResponse(ctx context.Context) {
+	if !s.identify(ctx) {
+		return
+	}
+
 	rtm := s.client.NewRTM()
 
 	// Start listening slack events
 	go rtm.ManageConnection()
 
-	// Handle slack events
-	for msg := range rtm.IncomingEvents {
+	// Handle slack events until stopped
+	for {
+		var msg slack.RTMEvent
+		select {
+		case msg = <-rtm.IncomingEvents:
+		case <-ctx.Done():
+			if err := rtm.Disconnect(); err != nil {
+				log.Printf("[ERROR] Failed to disconnect from slack: %s", err)
+			}
+			return
+		}
+		metricEvents.Inc("rtm", msg.Type)
 		switch ev := msg.Data.(type) {
+		case *slack.ConnectedEvent:
+			s.setState(func() { s.connected = true })
+			if ev.ConnectionCount > 1 {
+				metricRTMReconnects.Inc(s.teamID)
+			}
+		case *slack.DisconnectedEvent, *slack.ConnectionErrorEvent, *slack.InvalidAuthEvent:
+			s.setState(func() { s.connected = false })
 		case *slack.MessageEvent:
 			if err := s.handleMessageEvent(ev); err != nil {
 				log.Printf("[ERROR] Failed to handle message: %s", err)
 			}
+		case *slack.FileSharedEvent:
+			fileID := ev.FileID
+			if fileID == "" {
+				fileID = ev.File.ID
+			}
+			if err := s.receipts.FileShared(s.teamID, fileID); err != nil {
+				log.Printf("[ERROR] Failed to handle shared file %s: %s", fileID, err)
+			}
 		}
 	}
 }
 
+// team returns the ID of the workspace of the listener, which orders and
+// API keys are recorded with. Slack sends it with interactions too.
+func (s *SlackListener) team() string {
+	if s.teamID != "" {
+		return s.teamID
+	}
+	return s.authTeamID
+}
+
+// setState changes the connection state of the listener with fn.
+func (s *SlackListener) setState(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
+
+// check reports whether the listener is authenticated and connected.
+func (s *SlackListener) check() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case !s.authenticated:
+		return errors.New("auth.test has not succeeded")
+	case !s.connected:
+		return errors.New("RTM is not connected")
+	}
+	return nil
+}
+
 // handleMesageEvent handles message events.
 func (s *SlackListener) handleMessageEvent(ev *slack.MessageEvent) error {
 	// Only response in specific channel. Ignore else.
 	if ev.Channel != s.channelID {
-		log.Printf("%s %s", ev.Channel, ev.Msg.Text)
 		return nil
 	}
 
-	// Only response mention to bot. Ignore else.
-	if !strings.HasPrefix(ev.Msg.Text, fmt.Sprintf("<@%s> ", s.botID)) {
+	// An edited message carries the new content in the sub message
+	msg := ev.Msg
+	if ev.SubType == "message_changed" {
+		if ev.SubMessage == nil {
+			return nil
+		}
+		msg = *ev.SubMessage
+	}
+
+	// Ignore ourselves and other bots
+	if msg.BotID != "" || msg.SubType == "bot_message" || msg.User == "" || msg.User == s.botID {
+		return nil
+	}
+	if msg.SubType != "" && msg.SubType != "thread_broadcast" {
 		return nil
 	}
 
-	// Parse message
-	m := strings.Split(strings.TrimSpace(ev.Msg.Text), " ")[1:]
-	if len(m) == 0 || m[0] != "order" {
+	// Mentions of the bot naming a command run it, even in order threads
+	command, mentioned := parseMention(msg.Text, s.botID)
+	m := strings.Fields(command)
+	var run func(channel string, msg slack.Msg, args []string) error
+	if mentioned && len(m) > 0 {
+		run = s.command(m[0])
+	}
+
+	// Other replies in the thread of an order are recorded as comments
+	if run == nil && msg.ThreadTimestamp != "" && msg.ThreadTimestamp != msg.Timestamp && ev.SubType != "message_changed" {
+		if o, ok := s.orders.store.OrderByThread(ev.Channel, msg.ThreadTimestamp); ok {
+			if err := s.orders.Comment(o.ID, msg.User, msg.Text); err != nil {
+				return fmt.Errorf("failed to record comment: %s", err)
+			}
+			return nil
+		}
+	}
+
+	// Only response mention to bot. Ignore else.
+	if !mentioned {
+		return nil
+	}
+	if run == nil {
 		return fmt.Errorf("invalid message")
 	}
-	fmt.Printf("User: %s", ev.User)
-	fmt.Printf("event:\n %+v", ev)
 
+	// Respond once per message even if it is edited afterwards
+	if !s.markHandled(msg.Timestamp) {
+		return nil
+	}
+	return run(ev.Channel, msg, m[1:])
+}
+
+// command returns the handler of the command name, nil if there is none.
+func (s *SlackListener) command(name string) func(channel string, msg slack.Msg, args []string) error {
+	switch strings.ToLower(name) {
+	case "order":
+		return s.startOrder
+	case "apikey":
+		return s.handleAPIKeyCommand
+	case "webhook", "webhooks":
+		return s.handleWebhooksCommand
+	case "email":
+		return s.handleEmailCommand
+	case "receipts":
+		return s.handleReceiptsCommand
+	case "assets":
+		return s.handleAssetsCommand
+	case "lang":
+		return s.handleLangCommand
+	case "jobs":
+		return s.handleJobsCommand
+	}
+	return nil
+}
+
+// startOrder confirms the order written after "order" right away, or asks
+// the user whether to open the order dialog.
+func (s *SlackListener) startOrder(channel string, msg slack.Msg, args []string) error {
+	if len(args) > 0 {
+		if ok, err := s.orderFromText(channel, msg, args); ok || err != nil {
+			return err
+		}
+	}
+	loc := s.orders.threads.workspaces.Locale(s.teamID, msg.User)
 	// value is passed to message handler when request is approved.
 	attachment := slack.Attachment{
-		Text:       "Want to order something?",
+		Text:       tr(loc, "order.prompt"),
 		Color:      "#f9a41b",
 		CallbackID: "order",
 		Actions: []slack.AttachmentAction{
 			{
 				Name: orderStart,
-				Text: "Yes!",
+				Text: tr(loc, "order.yes"),
 				Type: "button",
 			},
 			{
 				Name:  actionCancel,
-				Text:  "Cancel",
+				Text:  tr(loc, "order.cancel"),
 				Type:  "button",
 				Style: "danger",
 			},
@@ -89,19 +282,79 @@ func (s *SlackListener) handleMessageEvent(ev *slack.MessageEvent) error {
 		},
 	}
 
-	if _, err := s.postEphemeral(ev.Channel, ev.User, "", params); err != nil {
+	if _, err := s.postEphemeral(channel, msg.User, msg.ThreadTimestamp, "", params); err != nil {
 		return fmt.Errorf("failed to post message: %s", err)
 	}
 	return nil
-
 }
 
-func (s *SlackListener) postEphemeral(channel, user, text string, params slack.PostMessageParameters) (string, error) {
-	return s.client.PostEphemeral(
-		channel,
-		user,
+// postEphemeral posts params to user. Messages in a thread are answered in that thread.
+func (s *SlackListener) postEphemeral(channel, user, threadTS, text string, params slack.PostMessageParameters) (string, error) {
+	options := []slack.MsgOption{
 		slack.MsgOptionText(text, params.EscapeText),
 		slack.MsgOptionAttachments(params.Attachments...),
 		slack.MsgOptionPostMessageParameters(params),
-	)
+	}
+	if threadTS != "" {
+		options = append(options, slack.MsgOptionTS(threadTS))
+	}
+	return s.client.PostEphemeral(channel, user, options...)
+}
+
+// markHandled records ts and reports whether it was seen for the first time.
+func (s *SlackListener) markHandled(ts string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.handled == nil {
+		s.handled = map[string]bool{}
+	}
+	if s.handled[ts] {
+		return false
+	}
+	s.handled[ts] = true
+	s.order = append(s.order, ts)
+	if len(s.order) > handledMessagesLimit {
+		delete(s.handled, s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
+
+// parseMention finds a mention of botID anywhere in text and returns the
+// command addressed to the bot. Words after the mention are preferred,
+// so both "<@bot> order" and "hey <@bot>, order please" work, as well as
+// "order something <@bot>". Mentions of other users are kept as arguments,
+// e.g. "<@bot> assets <@alice>".
+func parseMention(text, botID string) (string, bool) {
+	if botID == "" {
+		return "", false
+	}
+	for _, loc := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		if text[loc[2]:loc[3]] != botID {
+			continue
+		}
+		after := cleanCommand(text[loc[1]:], botID)
+		if after != "" {
+			return after, true
+		}
+		return cleanCommand(text[:loc[0]], botID), true
+	}
+	return "", false
+}
+
+// cleanCommand strips further mentions of the bot and punctuation around a
+// command. Other mentions lose their label so that each is one word.
+func cleanCommand(s, botID string) string {
+	s = mentionPattern.ReplaceAllStringFunc(s, func(m string) string {
+		id := mentionPattern.FindStringSubmatch(m)[1]
+		if id == botID {
+			return " "
+		}
+		return "<@" + id + ">"
+	})
+	s = strings.TrimFunc(s, func(r rune) bool {
+		return r == ' ' || r == ',' || r == ':' || r == '\n' || r == '\t'
+	})
+	return strings.Join(strings.Fields(s), " ")
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nlopes/slack"
+)
+
+// fakeSlack is a Slack API which records the calls and answers them all
+// with ok, as the bot UBOT of team T1.
+type fakeSlack struct {
+	mu    sync.Mutex
+	calls []slackCall
+}
+
+// slackCall is a call of the Slack API, e.g. chat.postMessage.
+type slackCall struct {
+	Method string
+	Args   url.Values
+}
+
+// newFakeSlack points the Slack client at a fakeSlack until the test ends.
+func newFakeSlack(t *testing.T) *fakeSlack {
+	f := &fakeSlack{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		args, _ := url.ParseQuery(string(body))
+		f.mu.Lock()
+		f.calls = append(f.calls, slackCall{Method: strings.TrimPrefix(r.URL.Path, "/"), Args: args})
+		ts := fmt.Sprintf("1500000000.%06d", len(f.calls))
+		f.mu.Unlock()
+		res := map[string]interface{}{"ok": true, "ts": ts, "channel": args.Get("channel"), "user_id": "UBOT", "team_id": "T1"}
+		if r.URL.Path == "/im.open" {
+			// DMs of U1 go to D1
+			res["channel"] = map[string]string{"id": "D" + strings.TrimPrefix(args.Get("user"), "U")}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	api := slack.SLACK_API
+	slack.SLACK_API = srv.URL + "/"
+	t.Cleanup(func() {
+		slack.SLACK_API = api
+		srv.Close()
+	})
+	return f
+}
+
+// messages returns the messages posted to channel, thread replies
+// included.
+func (f *fakeSlack) messages(channel string) []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var messages []url.Values
+	for _, c := range f.calls {
+		if c.Method == "chat.postMessage" && c.Args.Get("channel") == channel {
+			messages = append(messages, c.Args)
+		}
+	}
+	return messages
+}
+
+// recorded returns the calls so far.
+func (f *fakeSlack) recorded() []slackCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]slackCall(nil), f.calls...)
+}
+
+// reset forgets the calls so far.
+func (f *fakeSlack) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+func TestParseMention(t *testing.T) {
+	tests := []struct {
+		text    string
+		command string
+		ok      bool
+	}{
+		{"<@UBOT> order", "order", true},
+		{"<@UBOT|orderbot>: order please", "order please", true},
+		{"hey <@UBOT>, order", "order", true},
+		{"order something <@UBOT>", "order something", true},
+		{"<@UBOT> assets <@UALICE>", "assets <@UALICE>", true},
+		{"<@UBOT> assets <@UALICE|alice smith>", "assets <@UALICE>", true},
+		{"<@UALICE> <@UBOT> assets", "assets", true},
+		{"<@UBOT> order <@UBOT> keys", "order keys", true},
+		{"<@UALICE> order", "", false},
+		{"order", "", false},
+	}
+	for _, tt := range tests {
+		command, ok := parseMention(tt.text, "UBOT")
+		if command != tt.command || ok != tt.ok {
+			t.Errorf("parseMention(%q) = %q, %v, want %q, %v", tt.text, command, ok, tt.command, tt.ok)
+		}
+	}
+}
+
+func TestThreadMessages(t *testing.T) {
+	fake := newFakeSlack(t)
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := store.CreateOrder(order{Requester: "U1", ItemName: "Keyboard", Count: 1, ChannelID: "C1", ThreadTS: "1400000000.000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SlackListener{
+		client:    slack.New("xoxb-test"),
+		channelID: "C1",
+		botID:     "UBOT",
+		orders:    &orderService{store: store, threads: &orderThreads{workspaces: newWorkspaceRegistry(store, "xoxb-test", "C1"), store: store}},
+	}
+
+	tests := []struct {
+		text    string
+		comment bool
+	}{
+		{"looks good", true},
+		{"thanks <@UBOT>!", true},
+		{"<@UBOT> assets", false},
+		{"<@UBOT> lang ja", false},
+	}
+	for i, tt := range tests {
+		fake.reset()
+		ts := fmt.Sprintf("1500000000.%06d", i)
+		ev := &slack.MessageEvent{Msg: slack.Msg{Channel: "C1", User: "U2", Text: tt.text, Timestamp: ts, ThreadTimestamp: o.ThreadTS}}
+		if err := s.handleMessageEvent(ev); err != nil {
+			t.Errorf("%q: %s", tt.text, err)
+		}
+		got, _ := store.Order(o.ID)
+		last := got.History[len(got.History)-1]
+		if commented := last.Kind == eventComment && last.Text == tt.text; commented != tt.comment {
+			t.Errorf("%q: recorded as comment %v, want %v", tt.text, commented, tt.comment)
+		}
+		if answered := len(fake.messages("C1")) > 0 || len(fake.recorded()) > 0; answered == tt.comment {
+			t.Errorf("%q: bot answered %v: %v", tt.text, answered, fake.recorded())
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+// callSlackJSON calls a Web API method which is not supported by the
+// slack package, posting req as JSON and decoding the result into res.
+func callSlackJSON(token, method string, req, res interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequest(http.MethodPost, slack.SLACK_API+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := slackHTTP.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeSlackResponse(method, resp, res)
+}
+
+// callSlackForm calls a Web API method which only takes form arguments,
+// decoding the result into res.
+func callSlackForm(token, method string, values url.Values, res interface{}) error {
+	r, err := http.NewRequest(http.MethodPost, slack.SLACK_API+method, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := slackHTTP.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeSlackResponse(method, resp, res)
+}
+
+// slackFile is a file shared with files.upload.
+type slackFile struct {
+	Channel        string
+	ThreadTS       string
+	Filename       string
+	Title          string
+	InitialComment string
+	Content        []byte
+}
+
+// uploadSlackFile uploads f. Unlike the slack package it can share the
+// file in a thread.
+func uploadSlackFile(token string, f slackFile) error {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	fields := []struct{ name, value string }{
+		{"channels", f.Channel},
+		{"thread_ts", f.ThreadTS},
+		{"filename", f.Filename},
+		{"title", f.Title},
+		{"initial_comment", f.InitialComment},
+	}
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		if err := mw.WriteField(field.name, field.value); err != nil {
+			return err
+		}
+	}
+	fw, err := mw.CreateFormFile("file", f.Filename)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(f.Content); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	r, err := http.NewRequest(http.MethodPost, slack.SLACK_API+"files.upload", body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := slackHTTP.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeSlackResponse("files.upload", resp, nil)
+}
+
+// decodeSlackResponse checks the response of method and decodes it into res.
+func decodeSlackResponse(method string, resp *http.Response, res interface{}) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", method, resp.Status)
+	}
+
+	var sr struct {
+		slack.SlackResponse
+		Metadata struct {
+			Messages []string `json:"messages"`
+		} `json:"response_metadata"`
+	}
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buf.Bytes(), &sr); err != nil {
+		return err
+	}
+	if !sr.Ok {
+		if len(sr.Metadata.Messages) > 0 {
+			return fmt.Errorf("%s: %s %v", method, sr.Error, sr.Metadata.Messages)
+		}
+		return fmt.Errorf("%s: %s", method, sr.Error)
+	}
+	if res != nil {
+		return json.Unmarshal(buf.Bytes(), res)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// installation is a workspace which installed the bot via OAuth.
+type installation struct {
+	TeamID      string    `json:"team_id"`
+	TeamName    string    `json:"team_name"`
+	BotUserID   string    `json:"bot_user_id"`
+	BotToken    string    `json:"bot_token"`
+	Scope       string    `json:"scope"`
+	ChannelID   string    `json:"channel_id"`
+	InstalledBy string    `json:"installed_by"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// storeData is the on-disk representation of orderStore.
+type storeData struct {
+	Installations map[string]installation        `json:"installations"`
+	Orders        map[int64]*order               `json:"orders"`
+	LastOrderID   int64                          `json:"last_order_id"`
+	Catalog       map[string]catalogItem         `json:"catalog"`
+	APIKeys       map[string]apiKey              `json:"api_keys"`
+	Webhooks      map[string]webhookSubscription `json:"webhooks"`
+	Deliveries    map[string]webhookDelivery     `json:"webhook_deliveries"`
+	EmailPrefs    map[string]emailRecipient      `json:"email_prefs"`
+	UsedLinks     map[string]time.Time           `json:"used_links"`
+	// PurchaseOrders are keyed by order ID.
+	PurchaseOrders map[int64]purchaseOrder `json:"purchase_orders"`
+	LastPONumber   int64                   `json:"last_po_number"`
+	// Assets are keyed by tag.
+	Assets          map[string]asset `json:"assets"`
+	LastAssetNumber int64            `json:"last_asset_number"`
+	// Languages are the locales users chose with "lang", keyed by user.
+	Languages map[string]string `json:"languages"`
+	// CallbackSecret signs the values of buttons unless the config sets one.
+	CallbackSecret string `json:"callback_secret,omitempty"`
+}
+
+// orderStore keeps bot state in memory and persists it to a JSON file.
+// When path is empty nothing is written to disk.
+type orderStore struct {
+	mu   sync.RWMutex
+	path string
+	data storeData
+}
+
+// openStore opens the store described by a storage DSN.
+func openStore(dsn string) (*orderStore, error) {
+	_, path, err := parseStorageDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return openOrderStore(path)
+}
+
+// openOrderStore loads the store from path. A missing file is not an error.
+func openOrderStore(path string) (*orderStore, error) {
+	s := &orderStore{path: path}
+	if path != "" {
+		buf, err := ioutil.ReadFile(path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read store: %s", err)
+		default:
+			if err := json.Unmarshal(buf, &s.data); err != nil {
+				return nil, fmt.Errorf("failed to decode store %s: %s", path, err)
+			}
+		}
+	}
+	if s.data.Installations == nil {
+		s.data.Installations = map[string]installation{}
+	}
+	if s.data.Orders == nil {
+		s.data.Orders = map[int64]*order{}
+	}
+	if s.data.Catalog == nil {
+		s.data.Catalog = map[string]catalogItem{}
+	}
+	if s.data.APIKeys == nil {
+		s.data.APIKeys = map[string]apiKey{}
+	}
+	if s.data.Webhooks == nil {
+		s.data.Webhooks = map[string]webhookSubscription{}
+	}
+	if s.data.Deliveries == nil {
+		s.data.Deliveries = map[string]webhookDelivery{}
+	}
+	if s.data.EmailPrefs == nil {
+		s.data.EmailPrefs = map[string]emailRecipient{}
+	}
+	if s.data.UsedLinks == nil {
+		s.data.UsedLinks = map[string]time.Time{}
+	}
+	if s.data.PurchaseOrders == nil {
+		s.data.PurchaseOrders = map[int64]purchaseOrder{}
+	}
+	if s.data.Assets == nil {
+		s.data.Assets = map[string]asset{}
+	}
+	if s.data.Languages == nil {
+		s.data.Languages = map[string]string{}
+	}
+	return s, nil
+}
+
+// SaveInstallation adds or replaces the installation of a team.
+func (s *orderStore) SaveInstallation(inst installation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Installations[inst.TeamID] = inst
+	return s.flush()
+}
+
+// Installation returns the installation of teamID.
+func (s *orderStore) Installation(teamID string) (installation, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	inst, ok := s.data.Installations[teamID]
+	return inst, ok
+}
+
+// Installations returns every installation ordered by team ID.
+func (s *orderStore) Installations() []installation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	insts := make([]installation, 0, len(s.data.Installations))
+	for _, inst := range s.data.Installations {
+		insts = append(insts, inst)
+	}
+	sort.Slice(insts, func(i, j int) bool { return insts[i].TeamID < insts[j].TeamID })
+	return insts
+}
+
+// Ping checks that the store can be locked and, when kept on disk, that
+// its directory can be written.
+func (s *orderStore) Ping() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".orderbot-ping-")
+	if err != nil {
+		return fmt.Errorf("store is not writable: %s", err)
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// flush writes the store to disk. Caller must hold the write lock.
+func (s *orderStore) flush() error {
+	if s.path == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(&s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode store: %s", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated store
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".orderbot-store-")
+	if err != nil {
+		return fmt.Errorf("failed to write store: %s", err)
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write store: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write store: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write store: %s", err)
+	}
+	return nil
+}
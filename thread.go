@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	actionApprove  = orderApprovalApproved
+	actionReject   = orderApprovalRejected
+	actionPurchase = "order_purchased"
+	actionDeliver  = "order_delivered"
+	actionReship   = "order_reshipped"
+)
+
+// statusBadges are shown in order summaries.
+var statusBadges = map[orderStatus]string{
+	statusDraft:     ":pencil2: Draft",
+	statusPending:   ":hourglass_flowing_sand: Waiting for approval",
+	statusApproved:  ":white_check_mark: Approved",
+	statusRejected:  ":no_entry: Rejected",
+	statusPurchased: ":shopping_trolley: Purchased",
+	statusDelivered: ":package: Delivered",
+	statusCancelled: ":x: Cancelled",
+	statusIssue:     ":rotating_light: Problem reported",
+}
+
+var statusColors = map[orderStatus]string{
+	statusPending:   "#f9a41b",
+	statusApproved:  "#36a64f",
+	statusRejected:  "#d50200",
+	statusPurchased: "#2f7ee0",
+	statusDelivered: "#2f7ee0",
+	statusCancelled: "#9e9e9e",
+	statusIssue:     "#d50200",
+}
+
+// orderThreads keeps one slack thread per order. The parent message is a
+// summary of the order which is updated whenever the order changes, and
+// every event of the order is posted as a reply.
+type orderThreads struct {
+	workspaces *workspaceRegistry
+	store      *orderStore
+}
+
+// Publish posts the summary of o to its channel, or updates the summary
+// if it was already posted. The returned order has ThreadTS set.
+func (t *orderThreads) Publish(o order) (order, error) {
+	client, err := t.workspaces.Client(o.TeamID)
+	if err != nil {
+		return o, err
+	}
+
+	options := []slack.MsgOption{
+		slack.MsgOptionText(fmt.Sprintf("Order %s: %s", o.Ref(), o.ItemName), false),
+		slack.MsgOptionAttachments(summaryAttachment(o)),
+	}
+	if o.ThreadTS != "" {
+		options = append(options, slack.MsgOptionUpdate(o.ThreadTS))
+		if _, _, _, err := client.SendMessage(o.ChannelID, options...); err != nil {
+			return o, fmt.Errorf("failed to update summary of %s: %s", o.Ref(), err)
+		}
+		return o, nil
+	}
+
+	_, ts, _, err := client.SendMessage(o.ChannelID, options...)
+	if err != nil {
+		return o, fmt.Errorf("failed to post summary of %s: %s", o.Ref(), err)
+	}
+	return t.store.AnnotateOrder(o.ID, func(o *order) error {
+		o.ThreadTS = ts
+		return nil
+	})
+}
+
+// Reply posts a message in the thread of o.
+func (t *orderThreads) Reply(o order, text string, attachments ...slack.Attachment) error {
+	if o.ThreadTS == "" {
+		return fmt.Errorf("order %s has no thread", o.Ref())
+	}
+	client, err := t.workspaces.Client(o.TeamID)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = client.SendMessage(
+		o.ChannelID,
+		slack.MsgOptionText(text, false),
+		slack.MsgOptionAttachments(attachments...),
+		slack.MsgOptionTS(o.ThreadTS),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to reply to %s: %s", o.Ref(), err)
+	}
+	return nil
+}
+
+// Post posts a message about o to channel, outside of its thread.
+func (t *orderThreads) Post(o order, channel, text string, attachments ...slack.Attachment) error {
+	client, err := t.workspaces.Client(o.TeamID)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = client.SendMessage(
+		channel,
+		slack.MsgOptionText(text, false),
+		slack.MsgOptionAttachments(attachments...),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to post %s to %s: %s", o.Ref(), channel, err)
+	}
+	return nil
+}
+
+// summaryAttachment renders the current state of o.
+func summaryAttachment(o order) slack.Attachment {
+	fields := []slack.AttachmentField{
+		{Title: "Status", Value: statusBadges[o.Status], Short: true},
+		{Title: "Requested by", Value: fmt.Sprintf("<@%s>", o.Requester), Short: true},
+		{Title: "Item name", Value: o.ItemName, Short: true},
+		{Title: "How many", Value: strconv.Itoa(o.Count), Short: true},
+	}
+	if o.UnitPrice > 0 {
+		total := o.money(o.Total())
+		if r := o.Rate; r != nil {
+			total += fmt.Sprintf(" (%s %s at %s)", r.Rate.convert(o.Total()), r.To, r.Rate)
+		}
+		fields = append(fields,
+			slack.AttachmentField{Title: "Price per item", Value: o.money(o.UnitPrice), Short: true},
+			slack.AttachmentField{Title: "Total", Value: total, Short: true},
+		)
+		if charges := o.chargesText(); charges != "" {
+			fields = append(fields, slack.AttachmentField{Title: "Including", Value: charges, Short: false})
+		}
+	}
+	if len(o.Joined) > 0 {
+		joined := make([]string, len(o.Joined))
+		for i, j := range o.Joined {
+			joined[i] = fmt.Sprintf("<@%s> (%d)", j.User, j.Count)
+		}
+		fields = append(fields, slack.AttachmentField{Title: "Also for", Value: strings.Join(joined, ", "), Short: true})
+	}
+	fields = append(fields,
+		slack.AttachmentField{Title: "URL", Value: o.ItemURL, Short: false},
+		slack.AttachmentField{Title: "Reason", Value: o.Reason, Short: false},
+	)
+	if o.ApprovedBy != "" {
+		fields = append(fields, slack.AttachmentField{
+			Title: "Approved by",
+			Value: actorMention(o.ApprovedBy),
+			Short: true,
+		})
+	}
+	if sh := o.Shipment; sh != nil {
+		fields = append(fields, slack.AttachmentField{
+			Title: "Tracking",
+			Value: fmt.Sprintf("%s %s, %s", sh.Carrier, sh.Number, shipmentLabels[sh.Status]),
+			Short: true,
+		})
+	}
+	if o.AssignedTo != "" {
+		fields = append(fields, slack.AttachmentField{Title: "Assigned to", Value: actorMention(o.AssignedTo), Short: true})
+	}
+	if len(o.Policies) > 0 {
+		lines := make([]string, len(o.Policies))
+		for i, r := range o.Policies {
+			lines[i] = r.text()
+		}
+		fields = append(fields, slack.AttachmentField{Title: "Policies", Value: strings.Join(lines, "\n"), Short: false})
+	}
+	if o.PONumber != "" {
+		fields = append(fields, slack.AttachmentField{Title: "Purchase order", Value: o.PONumber, Short: true})
+	}
+	switch {
+	case len(o.Receipts) > 0:
+		fields = append(fields, slack.AttachmentField{
+			Title: "Receipt",
+			Value: fmt.Sprintf(":paperclip: attached (%d)", len(o.Receipts)),
+			Short: true,
+		})
+	case o.missingReceipt():
+		fields = append(fields, slack.AttachmentField{
+			Title: "Receipt",
+			Value: ":warning: missing, drop it in this thread",
+			Short: true,
+		})
+	}
+
+	return slack.Attachment{
+		Title:    fmt.Sprintf("Order %s", o.Ref()),
+		Fallback: fmt.Sprintf("Order %s: %s (%s)", o.Ref(), o.ItemName, o.Status),
+		Color:    statusColors[o.Status],
+		Fields:   fields,
+		Footer:   "Updates are posted in the thread",
+		Ts:       json.Number(strconv.FormatInt(o.CreatedAt.Unix(), 10)),
+	}
+}
+
+// nextStepAttachment returns the buttons to move o forward from its
+// current status, and false if nothing can be done from slack. value is
+// the callback token of o.
+func nextStepAttachment(o order, approvers []string, value string) (slack.Attachment, bool) {
+	a := slack.Attachment{
+		CallbackID: "order_step",
+		Color:      statusColors[o.Status],
+	}
+
+	switch o.Status {
+	case statusPending:
+		a.Text = "Waiting for approval"
+		if open := o.openStages(); len(open) > 0 {
+			a.Text += fmt.Sprintf(" from %s for policy %s", mentions(open[0].Approvers), open[0].Rule)
+		} else if len(approvers) > 0 {
+			a.Text += " from " + mentions(approvers)
+		}
+		a.Actions = []slack.AttachmentAction{
+			{Name: actionApprove, Text: "Approve", Type: "button", Style: "primary", Value: value},
+			{Name: actionReject, Text: "Reject", Type: "button", Style: "danger", Value: value},
+			{Name: actionEditOrder, Text: "Edit", Type: "button", Value: value},
+		}
+	case statusApproved:
+		a.Text = "Let me know once it is purchased"
+		a.Actions = []slack.AttachmentAction{
+			{Name: actionEditCharges, Text: "Shipping, tax and discounts", Type: "button", Value: value},
+			{Name: actionPurchase, Text: "Mark as purchased", Type: "button", Value: value},
+			{Name: actionEditOrder, Text: "Edit", Type: "button", Value: value},
+		}
+	case statusPurchased:
+		a.Text = "Let me know once it is delivered"
+		a.Actions = []slack.AttachmentAction{
+			{Name: actionTrack, Text: "Add tracking number", Type: "button", Value: value},
+			{Name: actionDeliver, Text: "Mark as delivered", Type: "button", Value: value},
+		}
+	case statusIssue:
+		a.Text = "Sort out the problem"
+		if o.AssignedTo != "" {
+			a.Text = actorMention(o.AssignedTo) + " please sort out the problem"
+		}
+		a.Actions = []slack.AttachmentAction{
+			{Name: actionReship, Text: "Reshipped", Type: "button", Value: value},
+			{Name: actionDeliver, Text: "Resolved", Type: "button", Style: "primary", Value: value},
+		}
+	default:
+		return a, false
+	}
+	return a, true
+}
+
+func mentions(users []string) string {
+	m := make([]string, len(users))
+	for i, u := range users {
+		m[i] = fmt.Sprintf("<@%s>", u)
+	}
+	return strings.Join(m, " ")
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// shipmentStatus is the state of a shipment as reported by its carrier.
+type shipmentStatus string
+
+const (
+	shipmentUnknown        shipmentStatus = "unknown"
+	shipmentInTransit      shipmentStatus = "in_transit"
+	shipmentOutForDelivery shipmentStatus = "out_for_delivery"
+	shipmentDelivered      shipmentStatus = "delivered"
+	shipmentException      shipmentStatus = "exception"
+)
+
+var shipmentLabels = map[shipmentStatus]string{
+	shipmentUnknown:        "no updates yet",
+	shipmentInTransit:      "in transit",
+	shipmentOutForDelivery: "out for delivery",
+	shipmentDelivered:      "delivered",
+	shipmentException:      "delivery problem",
+}
+
+// Buttons to add a tracking number and to confirm the delivery.
+const (
+	actionTrack       = "order_track"
+	actionReceived    = "order_received"
+	actionNotReceived = "order_not_received"
+	actionDamaged     = "order_damaged"
+
+	// trackingDialogPrefix starts the callback ID of the tracking dialog,
+	// followed by the callback token of the order.
+	trackingDialogPrefix = "tracking_dialog:"
+)
+
+// shipment is the parcel of a purchased order.
+type shipment struct {
+	Carrier     string         `json:"carrier"`
+	Number      string         `json:"number"`
+	Status      shipmentStatus `json:"status"`
+	EnteredBy   string         `json:"entered_by"`
+	EnteredAt   time.Time      `json:"entered_at"`
+	CheckedAt   time.Time      `json:"checked_at"`
+	DeliveredAt time.Time      `json:"delivered_at"`
+}
+
+// carrier looks up shipments of one carrier. Carriers are plugged in by
+// name in the tracking config.
+type carrier interface {
+	Name() string
+	// Track returns the current status of the shipment with number.
+	Track(number string) (shipmentStatus, error)
+}
+
+// fakeCarrier is for trying the bot out and for tests. The status is told
+// by the prefix of the tracking number, e.g. "DELIVERED-1" is delivered.
+type fakeCarrier struct{}
+
+var fakeCarrierPrefixes = []struct {
+	prefix string
+	status shipmentStatus
+}{
+	{"DELIVERED", shipmentDelivered},
+	{"EXCEPTION", shipmentException},
+	{"OUT", shipmentOutForDelivery},
+	{"TRANSIT", shipmentInTransit},
+}
+
+func (fakeCarrier) Name() string { return "fake" }
+
+func (fakeCarrier) Track(number string) (shipmentStatus, error) {
+	n := strings.ToUpper(number)
+	for _, p := range fakeCarrierPrefixes {
+		if strings.HasPrefix(n, p.prefix) {
+			return p.status, nil
+		}
+	}
+	return shipmentUnknown, nil
+}
+
+// httpCarrier asks a tracking service over HTTP. It sends
+// GET <url>?number=<number> and expects {"status": "<shipmentStatus>"},
+// which is easy to put in front of any carrier API.
+type httpCarrier struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+func (c httpCarrier) Name() string { return c.name }
+
+func (c httpCarrier) Track(number string) (shipmentStatus, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("number", number)
+	u.RawQuery = q.Encode()
+
+	resp, err := c.client.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", c.name, resp.Status)
+	}
+	var res struct {
+		Status shipmentStatus `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("%s: %s", c.name, err)
+	}
+	if _, ok := shipmentLabels[res.Status]; !ok {
+		return "", fmt.Errorf("%s: unknown status %q", c.name, res.Status)
+	}
+	return res.Status, nil
+}
+
+// newCarriers returns the carriers of cfg by name.
+func newCarriers(cfg trackingConfig) map[string]carrier {
+	carriers := map[string]carrier{}
+	if cfg.Fake {
+		carriers["fake"] = fakeCarrier{}
+	}
+	for _, c := range cfg.Carriers {
+		carriers[c.Name] = httpCarrier{name: c.Name, url: c.URL, client: &http.Client{Timeout: 30 * time.Second}}
+	}
+	return carriers
+}
+
+// trackingService records tracking numbers, polls the carriers and asks
+// the requester to confirm delivered orders.
+type trackingService struct {
+	orders   *orderService
+	carriers map[string]carrier
+}
+
+// Carriers returns the names of the carriers in order.
+func (t *trackingService) Carriers() []string {
+	var names []string
+	for name := range t.carriers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetTracking records the tracking number of the order with id and
+// checks it right away.
+func (t *trackingService) SetTracking(id int64, carrierName, number, user string) (order, error) {
+	c, ok := t.carriers[carrierName]
+	if !ok {
+		return order{}, trErrorf("order.error.carrier", carrierName)
+	}
+	number = strings.TrimSpace(number)
+	if number == "" {
+		return order{}, trErrorf("order.error.tracking")
+	}
+
+	now := time.Now()
+	o, err := t.orders.store.AnnotateOrder(id, func(o *order) error {
+		if o.Status != statusPurchased {
+			return trErrorf("order.error.tracking_state", o.Ref(), statusName(o.Status))
+		}
+		o.Shipment = &shipment{
+			Carrier:   c.Name(),
+			Number:    number,
+			Status:    shipmentUnknown,
+			EnteredBy: user,
+			EnteredAt: now,
+		}
+		o.record(orderEvent{At: now, User: user, Kind: eventTracking, Text: c.Name() + " " + number})
+		return nil
+	})
+	if err != nil {
+		return o, err
+	}
+
+	if published, err := t.orders.threads.Publish(o); err != nil {
+		log.Printf("[ERROR] %s", err)
+	} else {
+		o = published
+	}
+	text := fmt.Sprintf(":package: <@%s> added tracking number %s (%s)", user, number, c.Name())
+	if err := t.orders.threads.Reply(o, text); err != nil {
+		log.Printf("[ERROR] %s", err)
+	}
+	go t.check(o, now)
+	return o, nil
+}
+
+// Poll checks every shipment which is not delivered yet.
+func (t *trackingService) Poll(now time.Time) {
+	due := t.orders.store.Orders(func(o *order) bool {
+		return o.Status == statusPurchased && o.Shipment != nil && o.Shipment.Status != shipmentDelivered
+	})
+	for _, o := range due {
+		t.check(o, now)
+	}
+}
+
+// RunPoller calls Poll every interval until ctx is done.
+func (t *trackingService) RunPoller(ctx context.Context, interval time.Duration, beat *heartbeat) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		beat.Beat(time.Now().Add(interval))
+		select {
+		case now := <-tick.C:
+			t.Poll(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check asks the carrier about the shipment of o and tells the thread
+// when its status changed.
+func (t *trackingService) check(o order, now time.Time) {
+	sh := o.Shipment
+	c, ok := t.carriers[sh.Carrier]
+	if !ok {
+		log.Printf("[ERROR] Carrier %q of %s is not configured", sh.Carrier, o.Ref())
+		return
+	}
+	status, err := c.Track(sh.Number)
+	if err != nil {
+		log.Printf("[ERROR] Failed to track %s of %s: %s", sh.Number, o.Ref(), err)
+		return
+	}
+
+	changed := false
+	o, err = t.orders.store.AnnotateOrder(o.ID, func(o *order) error {
+		// Skip if the tracking number was replaced meanwhile
+		if o.Shipment == nil || o.Shipment.Number != sh.Number {
+			return nil
+		}
+		o.Shipment.CheckedAt = now
+		if o.Shipment.Status != status {
+			o.Shipment.Status = status
+			if status == shipmentDelivered {
+				o.Shipment.DeliveredAt = now
+			}
+			changed = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to record tracking of %s: %s", o.Ref(), err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	if _, err := t.orders.threads.Publish(o); err != nil {
+		log.Printf("[ERROR] %s", err)
+	}
+	text := fmt.Sprintf(":truck: Shipment %s is %s", sh.Number, shipmentLabels[status])
+	if err := t.orders.threads.Reply(o, text); err != nil {
+		log.Printf("[ERROR] %s", err)
+	}
+	if status == shipmentDelivered && o.Status == statusPurchased {
+		if err := t.askRequester(o); err != nil {
+			log.Printf("[ERROR] Failed to ask about delivery of %s: %s", o.Ref(), err)
+		}
+	}
+}
+
+// askRequester DMs the requester of o whether the delivery arrived.
+func (t *trackingService) askRequester(o order) error {
+	client, err := t.orders.threads.workspaces.Client(o.TeamID)
+	if err != nil {
+		return err
+	}
+	_, _, channel, err := client.OpenIMChannel(o.Requester)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = client.SendMessage(
+		channel,
+		slack.MsgOptionText(fmt.Sprintf("%s says your order %s (%s) was delivered.", o.Shipment.Carrier, o.Ref(), o.ItemName), false),
+		slack.MsgOptionAttachments(deliveryConfirmationAttachment(o, t.orders.callbacks.Sign(o))),
+	)
+	return err
+}
+
+func deliveryConfirmationAttachment(o order, value string) slack.Attachment {
+	return slack.Attachment{
+		Text:       "Did you receive it?",
+		CallbackID: "order_delivery",
+		Color:      statusColors[statusDelivered],
+		Actions: []slack.AttachmentAction{
+			{Name: actionReceived, Text: "Yes, received", Type: "button", Style: "primary", Value: value},
+			{Name: actionNotReceived, Text: "Not received", Type: "button", Value: value},
+			{Name: actionDamaged, Text: "Damaged", Type: "button", Style: "danger", Value: value},
+		},
+	}
+}
+
+// trackingDialog asks the purchaser for the carrier and tracking number.
+func trackingDialog(o order, carriers []string, token, loc string) slack.Dialog {
+	options := make([]slack.DialogElementOption, len(carriers))
+	for i, name := range carriers {
+		options[i] = slack.DialogElementOption{Label: name, Value: name}
+	}
+	carrierElement := slack.DialogSelectElement{
+		Label:   tr(loc, "tracking.carrier"),
+		Name:    "carrier",
+		Type:    "select",
+		Options: options,
+	}
+	if len(carriers) == 1 {
+		carrierElement.Value = carriers[0]
+	}
+	return slack.Dialog{
+		CallbackId:  trackingDialogPrefix + token,
+		Title:       tr(loc, "tracking.title", o.Ref()),
+		SubmitLabel: tr(loc, "dialog.save"),
+		Elements: []slack.DialogElement{
+			carrierElement,
+			slack.DialogTextElement{
+				Label:       tr(loc, "tracking.number"),
+				Name:        "number",
+				Type:        "text",
+				Placeholder: tr(loc, "tracking.number.example"),
+			},
+		},
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrackingPoll(t *testing.T) {
+	fake := newFakeSlack(t)
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := &orderService{
+		store:     store,
+		threads:   &orderThreads{workspaces: newWorkspaceRegistry(store, "xoxb-test", "C1"), store: store},
+		approvers: []string{"UBOSS"},
+		callbacks: newCallbackSigner([]byte("0123456789abcdef")),
+	}
+	tracking := &trackingService{orders: orders, carriers: newCarriers(trackingConfig{Fake: true})}
+
+	o, err := orders.CreateDraft(order{Requester: "U1", ItemName: "Keyboard", Count: 1, ChannelID: "C1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		to   orderStatus
+		user string
+	}{{statusPending, "U1"}, {statusApproved, "UBOSS"}, {statusPurchased, "UBOSS"}} {
+		if o, err = orders.Transition(o.ID, step.to, step.user, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if o.ThreadTS == "" {
+		t.Fatal("the order has no thread")
+	}
+	// The carrier is asked by the poller only, not right away as SetTracking does
+	setNumber := func(number string) {
+		_, err := store.UpdateOrder(o.ID, func(o *order) error {
+			o.Shipment = &shipment{Carrier: "fake", Number: number, Status: shipmentUnknown, EnteredBy: "UBOSS"}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	replies := func() []string {
+		var texts []string
+		for _, m := range fake.messages("C1") {
+			if m.Get("thread_ts") != o.ThreadTS {
+				t.Errorf("message %q is not in the thread of the order", m.Get("text"))
+			}
+			texts = append(texts, m.Get("text"))
+		}
+		fake.reset()
+		return texts
+	}
+
+	setNumber("TRANSIT-1")
+	fake.reset()
+	tracking.Poll(time.Now())
+	if got := replies(); len(got) != 1 || got[0] != ":truck: Shipment TRANSIT-1 is in transit" {
+		t.Errorf("replies = %q", got)
+	}
+	tracking.Poll(time.Now())
+	if got := replies(); len(got) != 0 {
+		t.Errorf("replies = %q without any change", got)
+	}
+
+	setNumber("DELIVERED-1")
+	delivered := time.Date(2024, 4, 2, 15, 0, 0, 0, time.UTC)
+	tracking.Poll(delivered)
+	// The requester is asked to confirm the delivery in a DM
+	dms := fake.messages("D1")
+	if len(dms) != 1 || !strings.Contains(dms[0].Get("text"), "says your order "+o.Ref()+" (Keyboard) was delivered") ||
+		!strings.Contains(dms[0].Get("attachments"), actionReceived) {
+		t.Errorf("DMs to the requester = %v", dms)
+	}
+	if got := replies(); len(got) != 1 || got[0] != ":truck: Shipment DELIVERED-1 is delivered" {
+		t.Errorf("replies = %q", got)
+	}
+	o, _ = store.Order(o.ID)
+	if o.Shipment.Status != shipmentDelivered || !o.Shipment.DeliveredAt.Equal(delivered) {
+		t.Errorf("shipment = %+v", *o.Shipment)
+	}
+	// The order is purchased until the requester confirms
+	if o.Status != statusPurchased {
+		t.Errorf("order is %s before the requester confirmed", o.Status)
+	}
+
+	// Delivered shipments are not polled again
+	tracking.Poll(delivered.Add(time.Hour))
+	if got := replies(); len(got) != 0 {
+		t.Errorf("replies = %q after delivery", got)
+	}
+
+	if o, err = orders.Transition(o.ID, statusDelivered, "U1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if o.Status != statusDelivered || o.History[len(o.History)-1].Kind != eventStatus {
+		t.Errorf("order is %s, last event %+v", o.Status, o.History[len(o.History)-1])
+	}
+	if got := replies(); len(got) != 1 || got[0] != "<@U1> marked as delivered the order" {
+		t.Errorf("replies = %q", got)
+	}
+}
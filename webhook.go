@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Webhook events, sent in the X-Orderbot-Event header and payload.
+const (
+	webhookOrderCreated     = "order.created"
+	webhookOrderResubmitted = "order.resubmitted"
+	webhookOrderApproved    = "order.approved"
+	webhookOrderRejected    = "order.rejected"
+	webhookOrderPurchased   = "order.purchased"
+	webhookOrderDelivered   = "order.delivered"
+	webhookOrderCancelled   = "order.cancelled"
+	webhookOrderIssue       = "order.issue"
+	webhookPing             = "ping"
+)
+
+// webhookEvents maps the status an order moved to to its event.
+// An order is "created" once it is submitted for approval, and
+// "resubmitted" when it goes back to approval later, see webhookEvent.
+var webhookEvents = map[orderStatus]string{
+	statusPending:   webhookOrderCreated,
+	statusApproved:  webhookOrderApproved,
+	statusRejected:  webhookOrderRejected,
+	statusPurchased: webhookOrderPurchased,
+	statusDelivered: webhookOrderDelivered,
+	statusCancelled: webhookOrderCancelled,
+	statusIssue:     webhookOrderIssue,
+}
+
+const (
+	webhookMaxAttempts  = 8
+	webhookBaseBackoff  = 30 * time.Second
+	webhookMaxBackoff   = time.Hour
+	webhookTimeout      = 10 * time.Second
+	webhookPollInterval = 5 * time.Second
+	// webhookKeepFinished is the number of finished deliveries kept for inspection.
+	webhookKeepFinished = 200
+)
+
+// Delivery states.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// webhookSubscription is a URL registered by an admin to receive the
+// events of the orders of their workspace.
+type webhookSubscription struct {
+	ID string `json:"id"`
+	// TeamID is empty for subscriptions made before they were kept per
+	// workspace, which belong to the workspace of the bot token.
+	TeamID    string    `json:"team_id,omitempty"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret"`
+	Events    []string  `json:"events"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// wants reports whether the subscription receives event.
+func (sub webhookSubscription) wants(event string) bool {
+	if event == webhookPing || len(sub.Events) == 0 {
+		return true
+	}
+	for _, e := range sub.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookAttempt is one HTTP request of a delivery.
+type webhookAttempt struct {
+	At         time.Time     `json:"at"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// webhookDelivery is a queued event for one subscription.
+type webhookDelivery struct {
+	ID             string           `json:"id"`
+	SubscriptionID string           `json:"subscription_id"`
+	Event          string           `json:"event"`
+	Payload        json.RawMessage  `json:"payload"`
+	State          string           `json:"state"`
+	Attempts       []webhookAttempt `json:"attempts"`
+	NextAttemptAt  time.Time        `json:"next_attempt_at"`
+	CreatedAt      time.Time        `json:"created_at"`
+}
+
+// webhookPayload is the JSON body posted to subscribers.
+type webhookPayload struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Actor     string    `json:"actor,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	Order     *order    `json:"order,omitempty"`
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// signWebhook returns the signature sent in X-Orderbot-Signature:
+// "sha256=" followed by the hex HMAC of "<timestamp>.<body>".
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff returns the wait before retrying after attempts failures.
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookBaseBackoff
+	for i := 1; i < attempts && d < webhookMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > webhookMaxBackoff {
+		d = webhookMaxBackoff
+	}
+	return d
+}
+
+// SaveWebhook adds a subscription.
+func (s *orderStore) SaveWebhook(sub webhookSubscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Webhooks[sub.ID] = sub
+	return s.flush()
+}
+
+// DeleteWebhook removes a subscription and its queued deliveries.
+func (s *orderStore) DeleteWebhook(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Webhooks[id]; !ok {
+		return fmt.Errorf("webhook %s not found", id)
+	}
+	delete(s.data.Webhooks, id)
+	for did, d := range s.data.Deliveries {
+		if d.SubscriptionID == id && d.State == deliveryPending {
+			delete(s.data.Deliveries, did)
+		}
+	}
+	return s.flush()
+}
+
+// Webhooks returns every subscription, oldest first.
+func (s *orderStore) Webhooks() []webhookSubscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subs := make([]webhookSubscription, 0, len(s.data.Webhooks))
+	for _, sub := range s.data.Webhooks {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.Before(subs[j].CreatedAt) })
+	return subs
+}
+
+// Webhook returns the subscription with id.
+func (s *orderStore) Webhook(id string) (webhookSubscription, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sub, ok := s.data.Webhooks[id]
+	return sub, ok
+}
+
+// EnqueueDeliveries stores deliveries so they survive restarts.
+func (s *orderStore) EnqueueDeliveries(ds []webhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range ds {
+		s.data.Deliveries[d.ID] = d
+	}
+	return s.flush()
+}
+
+// Deliveries returns deliveries matching match, oldest first.
+func (s *orderStore) Deliveries(match func(d *webhookDelivery) bool) []webhookDelivery {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ds []webhookDelivery
+	for _, d := range s.data.Deliveries {
+		if match == nil || match(&d) {
+			ds = append(ds, d)
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].CreatedAt.Before(ds[j].CreatedAt) })
+	return ds
+}
+
+// SaveDelivery replaces a delivery and prunes old finished deliveries.
+func (s *orderStore) SaveDelivery(d webhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Deliveries[d.ID] = d
+
+	var finished []webhookDelivery
+	for _, d := range s.data.Deliveries {
+		if d.State != deliveryPending {
+			finished = append(finished, d)
+		}
+	}
+	if len(finished) > webhookKeepFinished {
+		sort.Slice(finished, func(i, j int) bool { return finished[i].CreatedAt.After(finished[j].CreatedAt) })
+		for _, d := range finished[webhookKeepFinished:] {
+			delete(s.data.Deliveries, d.ID)
+		}
+	}
+	return s.flush()
+}
+
+// webhookDispatcher queues order events for subscribers and delivers them.
+type webhookDispatcher struct {
+	store *orderStore
+	// workspaces tell the workspace of subscriptions without a team, nil
+	// if there is no bot token.
+	workspaces *workspaceRegistry
+	client     *http.Client
+	now        func() time.Time
+	wake       chan struct{}
+}
+
+func newWebhookDispatcher(store *orderStore, workspaces *workspaceRegistry) *webhookDispatcher {
+	return &webhookDispatcher{
+		store:      store,
+		workspaces: workspaces,
+		client:     &http.Client{Timeout: webhookTimeout},
+		now:        time.Now,
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Subscriptions returns the subscriptions of the workspace teamID, oldest
+// first.
+func (d *webhookDispatcher) Subscriptions(teamID string) []webhookSubscription {
+	var subs []webhookSubscription
+	for _, sub := range d.store.Webhooks() {
+		if sub.TeamID == teamID || (sub.TeamID == "" && d.workspaces.IsFallbackTeam(teamID)) {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// Subscription returns the subscription id of the workspace teamID.
+func (d *webhookDispatcher) Subscription(teamID, id string) (webhookSubscription, bool) {
+	for _, sub := range d.Subscriptions(teamID) {
+		if sub.ID == id {
+			return sub, true
+		}
+	}
+	return webhookSubscription{}, false
+}
+
+// webhookEvent returns the event of c, false if c has none.
+func webhookEvent(c orderChange) (string, bool) {
+	if c.To == statusPending && c.From != statusDraft {
+		return webhookOrderResubmitted, true
+	}
+	event, ok := webhookEvents[c.To]
+	return event, ok
+}
+
+// OrderChanged queues the event of c for every subscription which wants it.
+func (d *webhookDispatcher) OrderChanged(c orderChange) {
+	event, ok := webhookEvent(c)
+	if !ok {
+		return
+	}
+	o := c.Order
+	if err := d.Enqueue(o.TeamID, event, webhookPayload{Actor: c.Actor, Note: c.Note, Order: &o}, ""); err != nil {
+		log.Printf("[ERROR] Failed to queue webhook %s of %s: %s", event, o.Ref(), err)
+	}
+}
+
+// Enqueue queues payload as event for the subscription subID, or for every
+// subscription of teamID which wants event when subID is empty.
+func (d *webhookDispatcher) Enqueue(teamID, event string, payload webhookPayload, subID string) error {
+	now := d.now()
+	var ds []webhookDelivery
+	for _, sub := range d.Subscriptions(teamID) {
+		if (subID != "" && sub.ID != subID) || !sub.wants(event) {
+			continue
+		}
+		id, err := randomHex(8)
+		if err != nil {
+			return err
+		}
+		p := payload
+		p.ID, p.Event, p.CreatedAt = id, event, now
+		body, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		ds = append(ds, webhookDelivery{
+			ID:             id,
+			SubscriptionID: sub.ID,
+			Event:          event,
+			Payload:        body,
+			State:          deliveryPending,
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+		})
+	}
+	if len(ds) == 0 {
+		return nil
+	}
+	if err := d.store.EnqueueDeliveries(ds); err != nil {
+		return err
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run delivers queued events until ctx is done. Deliveries left pending
+// are attempted again on the next start.
+func (d *webhookDispatcher) Run(ctx context.Context, beat *heartbeat) {
+	t := time.NewTicker(webhookPollInterval)
+	defer t.Stop()
+	for {
+		d.DeliverDue()
+		beat.Beat(d.now().Add(webhookPollInterval))
+		select {
+		case <-t.C:
+		case <-d.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// DeliverDue attempts every pending delivery whose next attempt is due.
+func (d *webhookDispatcher) DeliverDue() {
+	now := d.now()
+	due := d.store.Deliveries(func(del *webhookDelivery) bool {
+		return del.State == deliveryPending && !del.NextAttemptAt.After(now)
+	})
+	for _, del := range due {
+		sub, ok := d.store.Webhook(del.SubscriptionID)
+		if !ok {
+			continue
+		}
+		d.attempt(sub, del)
+	}
+}
+
+// attempt posts del once and records the outcome.
+func (d *webhookDispatcher) attempt(sub webhookSubscription, del webhookDelivery) {
+	start := d.now()
+	status, err := d.post(sub, del)
+	a := webhookAttempt{At: start, StatusCode: status, Duration: d.now().Sub(start)}
+	if err == nil && (status < 200 || status > 299) {
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	del.Attempts = append(del.Attempts, a)
+
+	switch {
+	case err == nil:
+		del.State = deliveryDelivered
+	case len(del.Attempts) >= webhookMaxAttempts:
+		del.State = deliveryFailed
+		log.Printf("[ERROR] Webhook %s to %s failed %d times, giving up: %s", del.Event, sub.URL, len(del.Attempts), err)
+	default:
+		del.NextAttemptAt = start.Add(webhookBackoff(len(del.Attempts)))
+	}
+
+	if err := d.store.SaveDelivery(del); err != nil {
+		log.Printf("[ERROR] Failed to save webhook delivery %s: %s", del.ID, err)
+	}
+}
+
+func (d *webhookDispatcher) post(sub webhookSubscription, del webhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(del.Payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(d.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "orderbot-webhook")
+	req.Header.Set("X-Orderbot-Event", del.Event)
+	req.Header.Set("X-Orderbot-Delivery", del.ID)
+	req.Header.Set("X-Orderbot-Timestamp", ts)
+	req.Header.Set("X-Orderbot-Signature", signWebhook(sub.Secret, ts, del.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	return resp.StatusCode, nil
+}
+
+// validateWebhookURL accepts absolute http and https URLs.
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http(s) URL", raw)
+	}
+	return nil
+}
+
+// handleWebhooksCommand manages webhook subscriptions:
+//
+//	webhooks                              subscriptions and recent deliveries
+//	webhooks add <url> [event,event,...]  subscribe, all events by default
+//	webhooks remove <id>
+//	webhooks test <id>                    send a ping event
+func (s *SlackListener) handleWebhooksCommand(channel string, msg slack.Msg, args []string) error {
+	loc := s.locale(msg.User)
+	if !s.isAdmin(msg.User) {
+		return s.replyEphemeral(channel, msg, tr(loc, "webhooks.admins_only"))
+	}
+
+	usage := tr(loc, "webhooks.usage")
+	store := s.orders.store
+	team := s.team()
+	if len(args) == 0 {
+		return s.replyEphemeral(channel, msg, webhookReport(store, s.webhooks.Subscriptions(team), loc))
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "add":
+		if len(args) < 2 || len(args) > 3 {
+			return s.replyEphemeral(channel, msg, usage)
+		}
+		// Slack wraps URLs in <...>
+		rawURL := strings.Trim(args[1], "<>")
+		if i := strings.Index(rawURL, "|"); i >= 0 {
+			rawURL = rawURL[:i]
+		}
+		if err := validateWebhookURL(rawURL); err != nil {
+			return s.replyEphemeral(channel, msg, fmt.Sprintf(":warning: %s", err))
+		}
+		var events []string
+		if len(args) == 3 {
+			for _, e := range splitList(args[2]) {
+				if _, ok := webhookEventNames[e]; !ok {
+					return s.replyEphemeral(channel, msg, tr(loc, "webhooks.unknown", e))
+				}
+				events = append(events, e)
+			}
+		}
+		id, err := randomHex(4)
+		if err != nil {
+			return err
+		}
+		secret, err := randomHex(24)
+		if err != nil {
+			return err
+		}
+		sub := webhookSubscription{
+			ID:        id,
+			TeamID:    team,
+			URL:       rawURL,
+			Secret:    secret,
+			Events:    events,
+			CreatedBy: msg.User,
+			CreatedAt: time.Now(),
+		}
+		if err := store.SaveWebhook(sub); err != nil {
+			return s.replyEphemeral(channel, msg, fmt.Sprintf(":warning: %s", err))
+		}
+		return s.replyEphemeral(channel, msg, tr(loc, "webhooks.added", sub.ID, sub.URL, secret))
+
+	case "remove":
+		if len(args) != 2 {
+			return s.replyEphemeral(channel, msg, usage)
+		}
+		if _, ok := s.webhooks.Subscription(team, args[1]); !ok {
+			return s.replyEphemeral(channel, msg, tr(loc, "webhooks.not_found", args[1]))
+		}
+		if err := store.DeleteWebhook(args[1]); err != nil {
+			return s.replyEphemeral(channel, msg, fmt.Sprintf(":warning: %s", err))
+		}
+		return s.replyEphemeral(channel, msg, tr(loc, "webhooks.removed", args[1]))
+
+	case "test":
+		if len(args) != 2 {
+			return s.replyEphemeral(channel, msg, usage)
+		}
+		if _, ok := s.webhooks.Subscription(team, args[1]); !ok {
+			return s.replyEphemeral(channel, msg, tr(loc, "webhooks.not_found", args[1]))
+		}
+		if err := s.webhooks.Enqueue(team, webhookPing, webhookPayload{Actor: msg.User}, args[1]); err != nil {
+			return s.replyEphemeral(channel, msg, fmt.Sprintf(":warning: %s", err))
+		}
+		return s.replyEphemeral(channel, msg, tr(loc, "webhooks.pinged", args[1]))
+	}
+	return s.replyEphemeral(channel, msg, usage)
+}
+
+var webhookEventNames = map[string]bool{
+	webhookOrderCreated:     true,
+	webhookOrderResubmitted: true,
+	webhookOrderApproved:    true,
+	webhookOrderRejected:    true,
+	webhookOrderPurchased:   true,
+	webhookOrderDelivered:   true,
+	webhookOrderCancelled:   true,
+	webhookOrderIssue:       true,
+}
+
+// webhookReportLimit is the number of deliveries shown by "webhooks".
+const webhookReportLimit = 10
+
+// webhookReport lists subs and their most recent deliveries in loc.
+func webhookReport(store *orderStore, subs []webhookSubscription, loc string) string {
+	if len(subs) == 0 {
+		return tr(loc, "webhooks.none")
+	}
+
+	var b strings.Builder
+	for _, sub := range subs {
+		events := tr(loc, "webhooks.all_events")
+		if len(sub.Events) > 0 {
+			events = strings.Join(sub.Events, ", ")
+		}
+		fmt.Fprintf(&b, "*`%s`* %s (%s)\n", sub.ID, sub.URL, events)
+
+		ds := store.Deliveries(func(d *webhookDelivery) bool { return d.SubscriptionID == sub.ID })
+		if len(ds) == 0 {
+			fmt.Fprintf(&b, "    %s\n", tr(loc, "webhooks.no_deliveries"))
+		}
+		if len(ds) > webhookReportLimit {
+			ds = ds[len(ds)-webhookReportLimit:]
+		}
+		for i := len(ds) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "    %s\n", deliveryLine(ds[i], loc))
+		}
+	}
+	return b.String()
+}
+
+func deliveryLine(d webhookDelivery, loc string) string {
+	icon := map[string]string{
+		deliveryPending:   ":hourglass_flowing_sand:",
+		deliveryDelivered: ":white_check_mark:",
+		deliveryFailed:    ":x:",
+	}[d.State]
+	line := fmt.Sprintf("%s %s `%s` %s, %s", icon, d.CreatedAt.Format("01-02 15:04"), d.ID, d.Event, tr(loc, "webhooks.attempts", len(d.Attempts)))
+	if n := len(d.Attempts); n > 0 && d.Attempts[n-1].Error != "" {
+		line += ": " + d.Attempts[n-1].Error
+	}
+	if d.State == deliveryPending && len(d.Attempts) > 0 {
+		line += tr(loc, "webhooks.next", d.NextAttemptAt.Format("15:04:05"))
+	}
+	return line
+}
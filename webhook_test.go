@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// webhookReceiver records the requests of a dispatcher and answers them
+// with the statuses in order, then with 200.
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []webhookRequest
+}
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func newWebhookReceiver(statuses ...int) *webhookReceiver {
+	rcv := &webhookReceiver{statuses: statuses}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.requests = append(rcv.requests, webhookRequest{header: r.Header, body: body})
+		if len(rcv.statuses) > 0 {
+			w.WriteHeader(rcv.statuses[0])
+			rcv.statuses = rcv.statuses[1:]
+		}
+	}))
+	return rcv
+}
+
+func (rcv *webhookReceiver) count() int {
+	return len(rcv.received())
+}
+
+func (rcv *webhookReceiver) received() []webhookRequest {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]webhookRequest(nil), rcv.requests...)
+}
+
+// newTestDispatcher returns a dispatcher subscribing url to events, whose
+// clock is *now.
+func newTestDispatcher(t *testing.T, url string, now *time.Time, events ...string) *webhookDispatcher {
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := webhookSubscription{ID: "w1", URL: url, Secret: "s3cret", Events: events, CreatedAt: *now}
+	if err := store.SaveWebhook(sub); err != nil {
+		t.Fatal(err)
+	}
+	d := newWebhookDispatcher(store, nil)
+	d.now = func() time.Time { return *now }
+	return d
+}
+
+func onlyDelivery(t *testing.T, d *webhookDispatcher) webhookDelivery {
+	ds := d.store.Deliveries(nil)
+	if len(ds) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(ds))
+	}
+	return ds[0]
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	rcv := newWebhookReceiver()
+	defer rcv.Close()
+	now := time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC)
+	d := newTestDispatcher(t, rcv.URL, &now, webhookOrderApproved)
+
+	o := order{ID: 7, Requester: "U1", ItemName: "Keyboard", Count: 1, Status: statusApproved}
+	d.OrderChanged(orderChange{Order: o, From: statusPending, To: statusRejected, Actor: "U2"})
+	d.OrderChanged(orderChange{Order: o, From: statusPending, To: statusApproved, Actor: "U2", Note: "ok"})
+	d.DeliverDue()
+
+	if rcv.count() != 1 {
+		t.Fatalf("got %d requests, want only order.approved", rcv.count())
+	}
+	req := rcv.received()[0]
+	if got := req.header.Get("X-Orderbot-Event"); got != webhookOrderApproved {
+		t.Errorf("X-Orderbot-Event = %q", got)
+	}
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	ts := req.header.Get("X-Orderbot-Timestamp")
+	if ts != "1711962000" {
+		t.Errorf("X-Orderbot-Timestamp = %q", ts)
+	}
+	if got, want := req.header.Get("X-Orderbot-Signature"), signWebhook("s3cret", ts, req.body); got != want {
+		t.Errorf("X-Orderbot-Signature = %q, want %q", got, want)
+	}
+	if got := signWebhook("other", ts, req.body); got == req.header.Get("X-Orderbot-Signature") {
+		t.Error("signature does not depend on the secret")
+	}
+
+	var p webhookPayload
+	if err := json.Unmarshal(req.body, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != req.header.Get("X-Orderbot-Delivery") || p.Event != webhookOrderApproved || !p.CreatedAt.Equal(now) {
+		t.Errorf("payload = %+v", p)
+	}
+	if p.Actor != "U2" || p.Note != "ok" || p.Order == nil || p.Order.ID != 7 || p.Order.ItemName != "Keyboard" {
+		t.Errorf("payload = %+v", p)
+	}
+	if del := onlyDelivery(t, d); del.State != deliveryDelivered || len(del.Attempts) != 1 || del.Attempts[0].StatusCode != 200 {
+		t.Errorf("delivery = %+v", del)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	rcv := newWebhookReceiver(http.StatusInternalServerError, http.StatusBadGateway)
+	defer rcv.Close()
+	start := time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC)
+	now := start
+	d := newTestDispatcher(t, rcv.URL, &now)
+
+	if err := d.Enqueue("", webhookPing, webhookPayload{Actor: "U1"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	d.DeliverDue()
+	del := onlyDelivery(t, d)
+	if del.State != deliveryPending || del.Attempts[0].StatusCode != 500 || del.Attempts[0].Error == "" {
+		t.Fatalf("after a 500, delivery = %+v", del)
+	}
+	if want := start.Add(30 * time.Second); !del.NextAttemptAt.Equal(want) {
+		t.Errorf("next attempt at %s, want %s", del.NextAttemptAt, want)
+	}
+
+	// Not due yet
+	now = start.Add(29 * time.Second)
+	d.DeliverDue()
+	if rcv.count() != 1 {
+		t.Fatalf("retried before the backoff, %d requests", rcv.count())
+	}
+
+	now = start.Add(30 * time.Second)
+	d.DeliverDue()
+	del = onlyDelivery(t, d)
+	if want := now.Add(time.Minute); del.State != deliveryPending || !del.NextAttemptAt.Equal(want) {
+		t.Fatalf("after a 502, delivery = %+v, want the next attempt at %s", del, want)
+	}
+
+	now = now.Add(time.Minute)
+	d.DeliverDue()
+	del = onlyDelivery(t, d)
+	if del.State != deliveryDelivered || len(del.Attempts) != 3 || rcv.count() != 3 {
+		t.Errorf("delivery = %+v after %d requests", del, rcv.count())
+	}
+	// Every attempt is the same delivery
+	for _, r := range rcv.received() {
+		if r.header.Get("X-Orderbot-Delivery") != del.ID {
+			t.Errorf("X-Orderbot-Delivery = %q, want %q", r.header.Get("X-Orderbot-Delivery"), del.ID)
+		}
+	}
+}
+
+func TestWebhookGiveUp(t *testing.T) {
+	statuses := make([]int, webhookMaxAttempts+1)
+	for i := range statuses {
+		statuses[i] = http.StatusServiceUnavailable
+	}
+	rcv := newWebhookReceiver(statuses...)
+	defer rcv.Close()
+	now := time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC)
+	d := newTestDispatcher(t, rcv.URL, &now)
+
+	if err := d.Enqueue("", webhookPing, webhookPayload{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < webhookMaxAttempts; i++ {
+		d.DeliverDue()
+		now = onlyDelivery(t, d).NextAttemptAt
+	}
+	del := onlyDelivery(t, d)
+	if del.State != deliveryFailed || len(del.Attempts) != webhookMaxAttempts {
+		t.Fatalf("delivery = %s after %d attempts", del.State, len(del.Attempts))
+	}
+
+	now = now.Add(24 * time.Hour)
+	d.DeliverDue()
+	if rcv.count() != webhookMaxAttempts {
+		t.Errorf("got %d requests, want %d", rcv.count(), webhookMaxAttempts)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookEvent(t *testing.T) {
+	tests := []struct {
+		from, to orderStatus
+		want     string
+	}{
+		{statusDraft, statusPending, webhookOrderCreated},
+		{statusApproved, statusPending, webhookOrderResubmitted},
+		{statusPending, statusPending, webhookOrderResubmitted},
+		{statusPending, statusApproved, webhookOrderApproved},
+		{statusApproved, statusPurchased, webhookOrderPurchased},
+		{statusPending, statusDraft, ""},
+	}
+	for _, tt := range tests {
+		got, ok := webhookEvent(orderChange{From: tt.from, To: tt.to})
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("webhookEvent(%s -> %s) = %q, %v; want %q", tt.from, tt.to, got, ok, tt.want)
+		}
+	}
+}
+
+func TestWebhookWorkspaces(t *testing.T) {
+	fake := newFakeSlack(t)
+	rcv := newWebhookReceiver()
+	defer rcv.Close()
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The bot token is of T1 in the fake, w0 predates workspaces
+	now := time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC)
+	for i, team := range []string{"", "T1", "T2"} {
+		sub := webhookSubscription{ID: fmt.Sprintf("w%d", i), TeamID: team, URL: rcv.URL, CreatedAt: now.Add(time.Duration(i) * time.Second)}
+		if err := store.SaveWebhook(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	workspaces := newWorkspaceRegistry(store, "xoxb-test", "C1")
+	d := newWebhookDispatcher(store, workspaces)
+
+	subscribers := func() string {
+		var ids []string
+		for _, del := range d.store.Deliveries(nil) {
+			ids = append(ids, del.SubscriptionID)
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+	for _, tt := range []struct{ team, want string }{
+		{"T1", "w0,w1"},
+		{"T2", "w2"},
+		{"T3", ""},
+	} {
+		store.data.Deliveries = map[string]webhookDelivery{}
+		d.OrderChanged(orderChange{Order: order{ID: 1, TeamID: tt.team}, From: statusPending, To: statusApproved})
+		if got := subscribers(); got != tt.want {
+			t.Errorf("order of %s delivered to %q, want %q", tt.team, got, tt.want)
+		}
+	}
+
+	// Admins only see and change the subscriptions of their workspace
+	s := &SlackListener{
+		client:   slack.New("xoxb-test"),
+		teamID:   "T2",
+		admins:   []string{"UADMIN"},
+		orders:   &orderService{store: store, threads: &orderThreads{workspaces: workspaces, store: store}},
+		webhooks: d,
+	}
+	reply := func(args ...string) string {
+		fake.reset()
+		if err := s.handleWebhooksCommand("C1", slack.Msg{User: "UADMIN"}, args); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range fake.recorded() {
+			if c.Method == "chat.postEphemeral" {
+				return c.Args.Get("text")
+			}
+		}
+		return ""
+	}
+	if got := reply(); !strings.Contains(got, "`w2`") || strings.Contains(got, "`w1`") || strings.Contains(got, "`w0`") {
+		t.Errorf("webhooks = %q", got)
+	}
+	for _, cmd := range []string{"remove", "test"} {
+		if got := reply(cmd, "w1"); !strings.Contains(got, "w1") || strings.Contains(got, "removed") {
+			t.Errorf("webhooks %s w1 = %q", cmd, got)
+		}
+	}
+	if _, ok := store.Webhook("w1"); !ok {
+		t.Error("w1 was removed from another workspace")
+	}
+	reply("add", "https://example.com/hook")
+	subs := d.Subscriptions("T2")
+	if len(subs) != 2 || subs[1].TeamID != "T2" || subs[1].URL != "https://example.com/hook" {
+		t.Errorf("subscriptions of T2 = %+v", subs)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/nlopes/slack"
+)
+
+// workspaceRegistry resolves the slack client of each installed team.
+// The bot token and orders channel of the config, if any, are used for
+// the team of that token, which need not be installed through OAuth.
+type workspaceRegistry struct {
+	store          *orderStore
+	fallback       *slack.Client
+	fallbackToken  string
+	defaultChannel string
+	// fallbackTeam is the team of the bot token, resolved with auth.test
+	// on first use.
+	fallbackTeam string
+
+	// onInstall is called after a team was (re)installed.
+	onInstall func(inst installation, client *slack.Client)
+	// approvalChannel is where approval requests of the team of the bot
+	// token are posted, empty to post them in the order threads.
+	approvalChannel string
+	// defaultLocale is used for users whose slack locale is not supported.
+	defaultLocale string
+
+	mu      sync.Mutex
+	clients map[string]*slack.Client
+	// locales caches the slack locale of users, keyed by team and user.
+	locales map[string]string
+}
+
+func newWorkspaceRegistry(store *orderStore, token, channel string) *workspaceRegistry {
+	r := &workspaceRegistry{
+		store:          store,
+		fallbackToken:  token,
+		defaultChannel: channel,
+		clients:        map[string]*slack.Client{},
+		locales:        map[string]string{},
+	}
+	if token != "" {
+		r.fallback = slack.New(token)
+	}
+	return r
+}
+
+// Client returns the slack client for teamID.
+func (r *workspaceRegistry) Client(teamID string) (*slack.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if client, ok := r.clients[teamID]; ok {
+		return client, nil
+	}
+	if inst, ok := r.store.Installation(teamID); ok {
+		client := slack.New(inst.BotToken)
+		r.clients[teamID] = client
+		return client, nil
+	}
+	if r.isFallbackTeam(teamID) {
+		return r.fallback, nil
+	}
+	return nil, fmt.Errorf("team %s has not installed the bot", teamID)
+}
+
+// Token returns the bot token for teamID, for API methods the slack
+// package does not support.
+func (r *workspaceRegistry) Token(teamID string) (string, error) {
+	if inst, ok := r.store.Installation(teamID); ok {
+		return inst.BotToken, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.isFallbackTeam(teamID) {
+		return r.fallbackToken, nil
+	}
+	return "", fmt.Errorf("team %s has not installed the bot", teamID)
+}
+
+// IsFallbackTeam tells whether teamID is the team of the bot token of the
+// config, false for a nil registry.
+func (r *workspaceRegistry) IsFallbackTeam(teamID string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.isFallbackTeam(teamID)
+}
+
+// isFallbackTeam tells whether teamID is the team of the bot token of the
+// config. An empty teamID is, as single workspace setups record no team.
+// r.mu must be held.
+func (r *workspaceRegistry) isFallbackTeam(teamID string) bool {
+	if r.fallback == nil {
+		return false
+	}
+	if teamID == "" {
+		return true
+	}
+	if r.fallbackTeam == "" {
+		res, err := r.fallback.AuthTest()
+		if err != nil {
+			log.Printf("[ERROR] Failed to resolve the team of the bot token: %s", err)
+			return false
+		}
+		r.fallbackTeam = res.TeamID
+	}
+	return teamID == r.fallbackTeam
+}
+
+// UserName returns the real name of a slack user of teamID, for places
+// outside of slack where mentions are not rendered. It falls back to the ID.
+func (r *workspaceRegistry) UserName(teamID, user string) string {
+	client, err := r.Client(teamID)
+	if err != nil {
+		return user
+	}
+	u, err := client.GetUserInfo(user)
+	if err != nil {
+		return user
+	}
+	if u.RealName != "" {
+		return u.RealName
+	}
+	return u.Name
+}
+
+// ActorName is UserName for the actor of an order change, which may be an API key.
+func (r *workspaceRegistry) ActorName(teamID, actor string) string {
+	if actor == autoApprover {
+		return autoApprover
+	}
+	if strings.HasPrefix(actor, "api:") {
+		return strings.TrimPrefix(actor, "api:") + " (via API)"
+	}
+	return r.UserName(teamID, actor)
+}
+
+// OrdersChannel returns the channel where orders of teamID are posted.
+func (r *workspaceRegistry) OrdersChannel(teamID string) string {
+	if inst, ok := r.store.Installation(teamID); ok && inst.ChannelID != "" {
+		return inst.ChannelID
+	}
+	return r.defaultChannel
+}
+
+// ApprovalChannel returns the channel where approval requests of teamID
+// are posted, or "" for the order threads. Installed teams use the threads.
+func (r *workspaceRegistry) ApprovalChannel(teamID string) string {
+	if _, ok := r.store.Installation(teamID); ok {
+		return ""
+	}
+	return r.approvalChannel
+}
+
+// Install stores the installation and replaces any cached client of the team.
+func (r *workspaceRegistry) Install(inst installation) error {
+	if err := r.store.SaveInstallation(inst); err != nil {
+		return err
+	}
+
+	client := slack.New(inst.BotToken)
+	r.mu.Lock()
+	r.clients[inst.TeamID] = client
+	r.mu.Unlock()
+
+	log.Printf("[INFO] Installed to team %s (%s)", inst.TeamName, inst.TeamID)
+	if r.onInstall != nil {
+		r.onInstall(inst, client)
+	}
+	return nil
+}
+
+// listenerManager runs one SlackListener per workspace until stopped.
+type listenerManager struct {
+	mu        sync.Mutex
+	listeners map[string]*SlackListener
+	// running stops the listener of a key and is done once it returned.
+	running map[string]runningListener
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+type runningListener struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newListenerManager() *listenerManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &listenerManager{
+		listeners: map[string]*SlackListener{},
+		running:   map[string]runningListener{},
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Start starts listening to events of key. A listener already running for
+// key, e.g. of a reinstalled team, is stopped first so that the new one
+// connects with the new token. Nothing is started once stopped.
+func (m *listenerManager) Start(key string, l *SlackListener) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ctx.Err() != nil {
+		return
+	}
+	prev, restart := m.running[key]
+	if restart {
+		log.Printf("[INFO] Restarting the listener of %q", key)
+		prev.cancel()
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	done := make(chan struct{})
+	m.listeners[key] = l
+	m.running[key] = runningListener{cancel: cancel, done: done}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer close(done)
+		// Both would answer the same events otherwise
+		if restart {
+			<-prev.done
+		}
+		l.ListenAndResponse(ctx)
+	}()
+}
+
+// Stop disconnects the listeners and waits until they handled the event
+// they were handling, or until ctx is done.
+func (m *listenerManager) Stop(ctx context.Context) error {
+	m.mu.Lock()
+	m.cancel()
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestWorkspaceClient(t *testing.T) {
+	f := newFakeSlack(t)
+	store, err := openOrderStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveInstallation(installation{TeamID: "T2", BotToken: "xoxb-t2"}); err != nil {
+		t.Fatal(err)
+	}
+	r := newWorkspaceRegistry(store, "xoxb-test", "C1")
+
+	// The bot token serves its own team, T1 in the fake, and setups
+	// without team IDs
+	for _, team := range []string{"", "T1", "T2"} {
+		if _, err := r.Client(team); err != nil {
+			t.Errorf("Client(%q) = %v", team, err)
+		}
+	}
+	if token, err := r.Token("T1"); err != nil || token != "xoxb-test" {
+		t.Errorf("Token(T1) = %q, %v", token, err)
+	}
+	for _, team := range []string{"T3", "TX"} {
+		if _, err := r.Client(team); err == nil {
+			t.Errorf("Client(%q) of an unknown team succeeded", team)
+		}
+		if _, err := r.Token(team); err == nil {
+			t.Errorf("Token(%q) of an unknown team succeeded", team)
+		}
+	}
+	// auth.test is asked once
+	n := 0
+	for _, c := range f.recorded() {
+		if c.Method == "auth.test" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("auth.test was called %d times", n)
+	}
+
+	// Without a bot token only installed teams are served
+	r = newWorkspaceRegistry(store, "", "")
+	if _, err := r.Client(""); err == nil {
+		t.Error("Client of no team succeeded without a bot token")
+	}
+	if _, err := r.Client("T2"); err != nil {
+		t.Errorf("Client(T2) = %v", err)
+	}
+}